@@ -0,0 +1,219 @@
+// package keytransition implements a record which transfers an identity from one key to another.
+//
+// A Transition is signed by both the old and the new key.
+// The old signature shows that the owner of the old identity authorized the change,
+// and the new signature shows that the owner of the new key accepted it.
+package keytransition
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+const (
+	// Version is the only version of the format understood by this package.
+	Version = 1
+
+	purposeOld = "p2p/keytransition/old"
+	purposeNew = "p2p/keytransition/new"
+)
+
+// Transition is a record, signed by two keys, stating that Old has been replaced by New.
+// Between NotBefore and NotAfter (the grace period) the new key may be used in place of the old one.
+type Transition struct {
+	Old, New  x509.PublicKey
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	OldSig []byte
+	NewSig []byte
+}
+
+// InGracePeriod returns true if the new key can be used in place of the old key at time now.
+func (t *Transition) InGracePeriod(now time.Time) bool {
+	return !now.Before(t.NotBefore) && now.Before(t.NotAfter)
+}
+
+// Sign creates a Transition from the key oldPriv to the key newPriv.
+// The times are truncated to a second.
+func Sign(reg x509.Registry, oldPriv, newPriv *x509.PrivateKey, notBefore, notAfter time.Time) (*Transition, error) {
+	oldPub, err := reg.PublicFromPrivate(oldPriv)
+	if err != nil {
+		return nil, err
+	}
+	newPub, err := reg.PublicFromPrivate(newPriv)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transition{
+		Old:       oldPub,
+		New:       newPub,
+		NotBefore: notBefore.UTC().Truncate(time.Second),
+		NotAfter:  notAfter.UTC().Truncate(time.Second),
+	}
+	if !t.NotBefore.Before(t.NotAfter) {
+		return nil, errors.New("keytransition: NotBefore must be before NotAfter")
+	}
+	tbs, err := t.marshalTBS()
+	if err != nil {
+		return nil, err
+	}
+	if t.OldSig, err = sign(reg, oldPriv, purposeOld, tbs); err != nil {
+		return nil, err
+	}
+	if t.NewSig, err = sign(reg, newPriv, purposeNew, tbs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Verify checks both signatures on t.
+func Verify(reg x509.Registry, t *Transition) error {
+	if !t.NotBefore.Before(t.NotAfter) {
+		return errors.New("keytransition: NotBefore must be before NotAfter")
+	}
+	if x509.EqualPublicKeys(&t.Old, &t.New) {
+		return errors.New("keytransition: old and new keys are the same")
+	}
+	tbs, err := t.marshalTBS()
+	if err != nil {
+		return err
+	}
+	if err := verify(reg, &t.Old, purposeOld, tbs, t.OldSig); err != nil {
+		return errors.Wrap(err, "keytransition: old key")
+	}
+	if err := verify(reg, &t.New, purposeNew, tbs, t.NewSig); err != nil {
+		return errors.Wrap(err, "keytransition: new key")
+	}
+	return nil
+}
+
+// Marshal appends the DER encoding of t to out and returns the result.
+func Marshal(out []byte, t *Transition) []byte {
+	tbs, err := t.marshalTBS()
+	if err != nil {
+		panic(err)
+	}
+	data, err := asn1.Marshal(signedRecord{
+		TBS:    asn1.RawValue{FullBytes: tbs},
+		OldSig: asn1.BitString{Bytes: t.OldSig, BitLength: len(t.OldSig) * 8},
+		NewSig: asn1.BitString{Bytes: t.NewSig, BitLength: len(t.NewSig) * 8},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append(out, data...)
+}
+
+// Parse parses a Transition from data.
+// The signatures are not checked, call Verify for that.
+func Parse(data []byte) (*Transition, error) {
+	var sr signedRecord
+	if rest, err := asn1.Unmarshal(data, &sr); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("keytransition: data after record")
+	}
+	var tbs tbsRecord
+	if rest, err := asn1.Unmarshal(sr.TBS.FullBytes, &tbs); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("keytransition: data after record body")
+	}
+	if tbs.Version != Version {
+		return nil, fmt.Errorf("keytransition: unsupported version %d", tbs.Version)
+	}
+	oldPub, err := x509.ParsePublicKey(tbs.Old.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	newPub, err := x509.ParsePublicKey(tbs.New.FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &Transition{
+		Old:       oldPub,
+		New:       newPub,
+		NotBefore: tbs.NotBefore.UTC(),
+		NotAfter:  tbs.NotAfter.UTC(),
+		OldSig:    sr.OldSig.RightAlign(),
+		NewSig:    sr.NewSig.RightAlign(),
+	}, nil
+}
+
+// tbsRecord is the part of the record covered by the signatures.
+type tbsRecord struct {
+	Version   int
+	Old       asn1.RawValue
+	New       asn1.RawValue
+	NotBefore time.Time `asn1:"generalized"`
+	NotAfter  time.Time `asn1:"generalized"`
+}
+
+type signedRecord struct {
+	TBS    asn1.RawValue
+	OldSig asn1.BitString
+	NewSig asn1.BitString
+}
+
+func (t *Transition) marshalTBS() ([]byte, error) {
+	return asn1.Marshal(tbsRecord{
+		Version:   Version,
+		Old:       asn1.RawValue{FullBytes: x509.MarshalPublicKey(nil, &t.Old)},
+		New:       asn1.RawValue{FullBytes: x509.MarshalPublicKey(nil, &t.New)},
+		NotBefore: t.NotBefore.UTC(),
+		NotAfter:  t.NotAfter.UTC(),
+	})
+}
+
+func sign(reg x509.Registry, priv *x509.PrivateKey, purpose string, msg []byte) ([]byte, error) {
+	signer, err := reg.LoadSigner(priv)
+	if err != nil {
+		return nil, err
+	}
+	presig, err := createPreSig(purpose, msg)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(nil, presig[:])
+}
+
+func verify(reg x509.Registry, pub *x509.PublicKey, purpose string, msg, sig []byte) error {
+	v, err := reg.LoadVerifier(pub)
+	if err != nil {
+		return err
+	}
+	presig, err := createPreSig(purpose, msg)
+	if err != nil {
+		return err
+	}
+	if !v.Verify(presig[:], sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func createPreSig(purpose string, msg []byte) (ret [64]byte, _ error) {
+	if len(purpose) > math.MaxUint8 {
+		return ret, fmt.Errorf("purpose is too long len=%d, max=%d", len(purpose), math.MaxUint8)
+	}
+	h, err := blake2b.NewXOF(64, nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write([]byte{uint8(len(purpose))})
+	h.Write([]byte(purpose))
+	h.Write(msg)
+	if _, err := io.ReadFull(h, ret[:]); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,95 @@
+package keytransition
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+func TestSignVerify(t *testing.T) {
+	reg := x509.DefaultRegistry()
+	oldPriv, newPriv := newPrivateKey(t), newPrivateKey(t)
+	now := time.Now()
+	tr, err := Sign(reg, &oldPriv, &newPriv, now, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, Verify(reg, tr))
+
+	data := Marshal(nil, tr)
+	tr2, err := Parse(data)
+	require.NoError(t, err)
+	require.NoError(t, Verify(reg, tr2))
+	require.Equal(t, tr, tr2)
+
+	// tampering with the record invalidates it
+	tr2.NotAfter = tr2.NotAfter.Add(time.Hour)
+	require.Error(t, Verify(reg, tr2))
+	tr3, err := Parse(data)
+	require.NoError(t, err)
+	tr3.OldSig, tr3.NewSig = tr3.NewSig, tr3.OldSig
+	require.Error(t, Verify(reg, tr3))
+}
+
+func TestSet(t *testing.T) {
+	reg := x509.DefaultRegistry()
+	k1, k2, k3 := newPrivateKey(t), newPrivateKey(t), newPrivateKey(t)
+	id1, id2, id3 := idFromPrivate(t, k1), idFromPrivate(t, k2), idFromPrivate(t, k3)
+	now := time.Now()
+
+	s := NewSet(reg, fingerprint)
+	var notified []p2p.PeerID
+	s.OnTransition(func(oldID, newID p2p.PeerID, _ *Transition) {
+		notified = append(notified, oldID, newID)
+	})
+	tr12, err := Sign(reg, &k1, &k2, now.Add(-time.Minute), now.Add(time.Hour))
+	require.NoError(t, err)
+	tr23, err := Sign(reg, &k2, &k3, now.Add(-time.Minute), now.Add(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, s.Add(tr12))
+	require.NoError(t, s.Add(tr23))
+	require.NoError(t, s.Add(tr12))
+	require.Equal(t, []p2p.PeerID{id1, id2, id2, id3}, notified)
+
+	pub3, err := reg.PublicFromPrivate(&k3)
+	require.NoError(t, err)
+	require.Equal(t, id3, s.Resolve(id1, now))
+	require.True(t, s.Accepts(id1, &pub3, now))
+	require.True(t, s.Accepts(id3, &pub3, now))
+	// after the second grace period the chain is broken
+	require.False(t, s.Accepts(id1, &pub3, now.Add(2*time.Minute)))
+
+	// the old key cannot transition to a different key.
+	tr13, err := Sign(reg, &k1, &k3, now, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.ErrorIs(t, s.Add(tr13), ErrConflict)
+
+	s.Purge(now.Add(2 * time.Minute))
+	require.Equal(t, id2, s.Resolve(id1, now.Add(2*time.Minute)))
+	_, exists := s.Get(id2)
+	require.False(t, exists)
+}
+
+func newPrivateKey(t testing.TB) x509.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	return x509.PrivateKey{
+		Algorithm: x509.Algo_Ed25519,
+		Data:      priv.Seed(),
+	}
+}
+
+func idFromPrivate(t testing.TB, priv x509.PrivateKey) p2p.PeerID {
+	pub, err := x509.DefaultRegistry().PublicFromPrivate(&priv)
+	require.NoError(t, err)
+	return fingerprint(&pub)
+}
+
+func fingerprint(pub *x509.PublicKey) (ret p2p.PeerID) {
+	sha3.ShakeSum256(ret[:], x509.MarshalPublicKey(nil, pub))
+	return ret
+}
@@ -0,0 +1,131 @@
+package keytransition
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+// maxChain is the longest sequence of transitions that will be followed.
+const maxChain = 16
+
+var ErrConflict = errors.New("keytransition: a different transition already exists for the old key")
+
+// Fingerprinter derives a PeerID from a public key.
+type Fingerprinter = func(*x509.PublicKey) p2p.PeerID
+
+// Set holds verified Transitions, indexed by the PeerID of the old key.
+// It is safe for concurrent use, and can be shared between swarms which use the same Fingerprinter.
+type Set struct {
+	registry x509.Registry
+	fp       Fingerprinter
+
+	mu    sync.RWMutex
+	byOld map[p2p.PeerID]*Transition
+	subs  []func(oldID, newID p2p.PeerID, t *Transition)
+}
+
+// NewSet creates an empty Set. PeerIDs are derived from keys using fp.
+func NewSet(reg x509.Registry, fp Fingerprinter) *Set {
+	return &Set{
+		registry: reg,
+		fp:       fp,
+		byOld:    make(map[p2p.PeerID]*Transition),
+	}
+}
+
+// Add verifies t and adds it to the set.
+// Adding a transition which is already in the set is not an error.
+// If the old key has already transitioned to a different key, ErrConflict is returned.
+func (s *Set) Add(t *Transition) error {
+	if err := Verify(s.registry, t); err != nil {
+		return err
+	}
+	oldID, newID := s.fp(&t.Old), s.fp(&t.New)
+	s.mu.Lock()
+	if existing, exists := s.byOld[oldID]; exists {
+		s.mu.Unlock()
+		if !x509.EqualPublicKeys(&existing.New, &t.New) {
+			return ErrConflict
+		}
+		return nil
+	}
+	s.byOld[oldID] = t
+	subs := append([]func(p2p.PeerID, p2p.PeerID, *Transition){}, s.subs...)
+	s.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(oldID, newID, t)
+	}
+	return nil
+}
+
+// Get returns the transition away from the key with PeerID oldID, if it exists.
+func (s *Set) Get(oldID p2p.PeerID) (*Transition, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, exists := s.byOld[oldID]
+	return t, exists
+}
+
+// Resolve follows transitions which have started by time now, and returns the latest PeerID for id.
+// If there are no transitions for id, then id is returned.
+func (s *Set) Resolve(id p2p.PeerID, now time.Time) p2p.PeerID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 0; i < maxChain; i++ {
+		t, exists := s.byOld[id]
+		if !exists || now.Before(t.NotBefore) {
+			break
+		}
+		id = s.fp(&t.New)
+	}
+	return id
+}
+
+// Accepts returns true if pub can be used by the peer identified by id at time now.
+// That is the case if pub has the PeerID id, or there is a sequence of transitions from id to pub,
+// all of which are in their grace period.
+func (s *Set) Accepts(id p2p.PeerID, pub *x509.PublicKey, now time.Time) bool {
+	target := s.fp(pub)
+	if target == id {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 0; i < maxChain; i++ {
+		t, exists := s.byOld[id]
+		if !exists || !t.InGracePeriod(now) {
+			return false
+		}
+		id = s.fp(&t.New)
+		if id == target {
+			return true
+		}
+	}
+	return false
+}
+
+// OnTransition registers fn to be called whenever a new transition is added to the set.
+// It can be used to keep an address book up to date.
+func (s *Set) OnTransition(fn func(oldID, newID p2p.PeerID, t *Transition)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, fn)
+}
+
+// Purge removes transitions whose grace period ended before now.
+// After a transition is purged, Resolve will no longer map its old PeerID.
+func (s *Set) Purge(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.byOld {
+		if !now.Before(t.NotAfter) {
+			delete(s.byOld, id)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package multiaddr
+
+import (
+	"errors"
+	"strings"
+)
+
+// base58Alphabet is the bitcoin alphabet, used by base58btc.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func encodeBase58(x []byte) string {
+	var zeros int
+	for zeros < len(x) && x[zeros] == 0 {
+		zeros++
+	}
+	// digits holds the base58 digits, least significant first.
+	var digits []byte
+	for _, b := range x[zeros:] {
+		carry := int(b)
+		for i := range digits {
+			carry += int(digits[i]) << 8
+			digits[i] = byte(carry % 58)
+			carry /= 58
+		}
+		for carry > 0 {
+			digits = append(digits, byte(carry%58))
+			carry /= 58
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat("1", zeros))
+	for i := len(digits) - 1; i >= 0; i-- {
+		sb.WriteByte(base58Alphabet[digits[i]])
+	}
+	return sb.String()
+}
+
+func decodeBase58(x string) ([]byte, error) {
+	var zeros int
+	for zeros < len(x) && x[zeros] == '1' {
+		zeros++
+	}
+	// out holds the bytes, least significant first.
+	var out []byte
+	for i := zeros; i < len(x); i++ {
+		carry := strings.IndexByte(base58Alphabet, x[i])
+		if carry < 0 {
+			return nil, errors.New("multiaddr: invalid base58")
+		}
+		for j := range out {
+			carry += int(out[j]) * 58
+			out[j] = byte(carry)
+			carry >>= 8
+		}
+		for carry > 0 {
+			out = append(out, byte(carry))
+			carry >>= 8
+		}
+	}
+	ret := make([]byte, zeros, zeros+len(out))
+	for i := len(out) - 1; i >= 0; i-- {
+		ret = append(ret, out[i])
+	}
+	return ret, nil
+}
@@ -0,0 +1,215 @@
+// package multiaddr implements the multiaddr format, for the protocols used by this module's swarms.
+// https://github.com/multiformats/multiaddr
+package multiaddr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Component is a single protocol and its value.
+type Component struct {
+	Code  Code
+	Value []byte
+}
+
+// Multiaddr is a sequence of Components, each encapsulated in the one before it.
+type Multiaddr []Component
+
+// Parse parses the text format, for example /ip4/127.0.0.1/udp/1234.
+func Parse(x string) (Multiaddr, error) {
+	if !strings.HasPrefix(x, "/") {
+		return nil, errors.New("multiaddr: must start with /")
+	}
+	parts := strings.Split(strings.TrimSuffix(x[1:], "/"), "/")
+	var ret Multiaddr
+	for len(parts) > 0 {
+		p, ok := ProtocolWithName(parts[0])
+		if !ok {
+			return nil, fmt.Errorf("multiaddr: unknown protocol %q", parts[0])
+		}
+		parts = parts[1:]
+		c := Component{Code: p.Code}
+		if p.Size != sizeNone {
+			if len(parts) == 0 {
+				return nil, fmt.Errorf("multiaddr: %s is missing a value", p.Name)
+			}
+			value, err := p.fromText(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("multiaddr: parsing %s: %w", p.Name, err)
+			}
+			c.Value = value
+			parts = parts[1:]
+		}
+		ret = append(ret, c)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("multiaddr: empty")
+	}
+	return ret, nil
+}
+
+// ParseBinary parses the binary format.
+func ParseBinary(data []byte) (Multiaddr, error) {
+	var ret Multiaddr
+	for len(data) > 0 {
+		code, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("multiaddr: invalid protocol code")
+		}
+		data = data[n:]
+		p, ok := ProtocolWithCode(Code(code))
+		if !ok {
+			return nil, fmt.Errorf("multiaddr: unknown protocol code %#x", code)
+		}
+		size := p.Size
+		if size == sizeVar {
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return nil, fmt.Errorf("multiaddr: invalid length for %s", p.Name)
+			}
+			data = data[n:]
+			size = int(l)
+		}
+		if len(data) < size {
+			return nil, fmt.Errorf("multiaddr: value for %s is too short", p.Name)
+		}
+		c := Component{Code: p.Code}
+		if size > 0 {
+			c.Value = append([]byte{}, data[:size]...)
+		}
+		if err := p.validate(c.Value); err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+		data = data[size:]
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("multiaddr: empty")
+	}
+	return ret, nil
+}
+
+// MarshalBinary returns the binary format.
+// It returns an error if a component has an unknown protocol code, or an invalid value.
+func (m Multiaddr) MarshalBinary() ([]byte, error) {
+	var out []byte
+	for _, c := range m {
+		p, ok := ProtocolWithCode(c.Code)
+		if !ok {
+			return nil, fmt.Errorf("multiaddr: unknown protocol code %#x", c.Code)
+		}
+		if err := p.validate(c.Value); err != nil {
+			return nil, err
+		}
+		out = binary.AppendUvarint(out, uint64(c.Code))
+		if p.Size == sizeVar {
+			out = binary.AppendUvarint(out, uint64(len(c.Value)))
+		}
+		out = append(out, c.Value...)
+	}
+	return out, nil
+}
+
+func (m *Multiaddr) UnmarshalBinary(data []byte) error {
+	x, err := ParseBinary(data)
+	if err != nil {
+		return err
+	}
+	*m = x
+	return nil
+}
+
+func (m Multiaddr) MarshalText() ([]byte, error) {
+	var sb strings.Builder
+	for _, c := range m {
+		p, ok := ProtocolWithCode(c.Code)
+		if !ok {
+			return nil, fmt.Errorf("multiaddr: unknown protocol code %#x", c.Code)
+		}
+		sb.WriteString("/")
+		sb.WriteString(p.Name)
+		if p.Size == sizeNone {
+			if err := p.validate(c.Value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		value, err := p.toText(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString("/")
+		sb.WriteString(value)
+	}
+	return []byte(sb.String()), nil
+}
+
+func (m *Multiaddr) UnmarshalText(data []byte) error {
+	x, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*m = x
+	return nil
+}
+
+func (m Multiaddr) String() string {
+	data, err := m.MarshalText()
+	if err != nil {
+		return fmt.Sprintf("<invalid multiaddr: %v>", err)
+	}
+	return string(data)
+}
+
+// Codes returns the protocol code of each component.
+func (m Multiaddr) Codes() []Code {
+	ret := make([]Code, len(m))
+	for i := range m {
+		ret[i] = m[i].Code
+	}
+	return ret
+}
+
+// HasPrefix returns true if the protocols of the first components of m are codes.
+func (m Multiaddr) HasPrefix(codes ...Code) bool {
+	if len(m) < len(codes) {
+		return false
+	}
+	for i := range codes {
+		if m[i].Code != codes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Multihash codes used for peer ids.
+const (
+	MultihashIdentity = 0x00
+	MultihashSHA2_256 = 0x12
+	MultihashSHA3_256 = 0x16
+)
+
+// SplitMultihash returns the hash function code and the digest of a multihash.
+func SplitMultihash(x []byte) (uint64, []byte, error) {
+	code, n := binary.Uvarint(x)
+	if n <= 0 {
+		return 0, nil, errors.New("multiaddr: invalid multihash code")
+	}
+	x = x[n:]
+	l, n := binary.Uvarint(x)
+	if n <= 0 || l != uint64(len(x)-n) {
+		return 0, nil, errors.New("multiaddr: invalid multihash length")
+	}
+	return code, x[n:], nil
+}
+
+// NewMultihash returns a multihash for the digest, computed with the hash function code.
+func NewMultihash(code uint64, digest []byte) []byte {
+	out := binary.AppendUvarint(nil, code)
+	out = binary.AppendUvarint(out, uint64(len(digest)))
+	return append(out, digest...)
+}
@@ -0,0 +1,120 @@
+package multiaddr
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVectors(t *testing.T) {
+	tcs := []struct {
+		Text   string
+		Binary string
+	}{
+		{"/ip4/127.0.0.1/udp/1234", "047f000001910204d2"},
+		{"/ip4/1.2.3.4/tcp/80", "040102030406" + "0050"},
+		{"/ip6/::1/tcp/8080", "29" + "00000000000000000000000000000001" + "061f90"},
+		{"/dns4/example.com/udp/53/quic-v1", "360b" + hex.EncodeToString([]byte("example.com")) + "91020035" + "cd03"},
+		{
+			"/ip4/127.0.0.1/tcp/4001/p2p/QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N",
+			"047f000001060fa1a5032212209dff3b17d74cf4d38a50d8b6383e92d181a10395a5e73a726dcccbd21bf6f0b9",
+		},
+	}
+	for _, tc := range tcs {
+		ma, err := Parse(tc.Text)
+		require.NoError(t, err, tc.Text)
+		data, err := ma.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, tc.Binary, hex.EncodeToString(data), tc.Text)
+		require.Equal(t, tc.Text, ma.String())
+
+		ma2, err := ParseBinary(data)
+		require.NoError(t, err)
+		require.Equal(t, ma, ma2)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, x := range []string{
+		"",
+		"ip4/127.0.0.1",
+		"/",
+		"/ip4",
+		"/ip4/::1",
+		"/ip6/127.0.0.1",
+		"/udp/65536",
+		"/notaprotocol/1",
+		"/p2p/0OIl",
+		"/ssh/abcd",
+	} {
+		_, err := Parse(x)
+		require.Error(t, err, x)
+	}
+	for _, x := range []string{
+		"04",
+		"047f0000",
+		"a503ff",
+		"ffffffffffffffffffffff",
+	} {
+		data, err := hex.DecodeString(x)
+		require.NoError(t, err)
+		_, err = ParseBinary(data)
+		require.Error(t, err, x)
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	for _, ma := range []Multiaddr{
+		{{Code: 0xfffe}},
+		{{Code: CodeTCP, Value: []byte{1}}},
+		{{Code: CodeUDP}},
+		{{Code: CodeIP4, Value: make([]byte, 16)}},
+		{{Code: CodeIP6, Value: make([]byte, 4)}},
+		{{Code: CodeQUICv1, Value: []byte{1}}},
+		{{Code: CodeSSH, Value: make([]byte, 31)}},
+	} {
+		_, err := ma.MarshalBinary()
+		require.Error(t, err, "%v", ma)
+		_, err = ma.MarshalText()
+		require.Error(t, err, "%v", ma)
+		require.Contains(t, ma.String(), "invalid multiaddr")
+	}
+}
+
+func TestSSH(t *testing.T) {
+	fp := make([]byte, 32)
+	for i := range fp {
+		fp[i] = 0xff
+	}
+	ma := Multiaddr{
+		{Code: CodeIP4, Value: []byte{10, 0, 0, 1}},
+		{Code: CodeTCP, Value: []byte{0, 22}},
+		{Code: CodeSSH, Value: fp},
+	}
+	text := ma.String()
+	require.Equal(t, "/ip4/10.0.0.1/tcp/22/ssh/__________________________________________8", text)
+	ma2, err := Parse(text)
+	require.NoError(t, err)
+	require.Equal(t, ma, ma2)
+	data, err := ma.MarshalBinary()
+	require.NoError(t, err)
+	ma3, err := ParseBinary(data)
+	require.NoError(t, err)
+	require.Equal(t, ma, ma3)
+}
+
+func TestBase58(t *testing.T) {
+	for _, x := range [][]byte{
+		{},
+		{0},
+		{0, 0, 1},
+		{0xff, 0xfe},
+		[]byte("hello world"),
+	} {
+		y, err := decodeBase58(encodeBase58(x))
+		require.NoError(t, err)
+		require.Equal(t, x, y)
+	}
+	require.Equal(t, "StV1DL6CwTryKyV", encodeBase58([]byte("hello world")))
+}
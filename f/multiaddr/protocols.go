@@ -0,0 +1,192 @@
+package multiaddr
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Code identifies a protocol in a multiaddr.
+// The codes are from the multicodec table.
+type Code uint64
+
+const (
+	CodeIP4    = Code(0x04)
+	CodeTCP    = Code(0x06)
+	CodeIP6    = Code(0x29)
+	CodeDNS    = Code(0x35)
+	CodeDNS4   = Code(0x36)
+	CodeDNS6   = Code(0x37)
+	CodeUDP    = Code(0x0111)
+	CodeP2P    = Code(0x01a5)
+	CodeQUICv1 = Code(0x01cd)
+
+	// CodeP2PKE is the p2pke protocol.
+	// It is not in the multicodec table, so it uses a code from the private use range.
+	CodeP2PKE = Code(0x300000)
+	// CodeSSH is an SSH server, with the SHA256 fingerprint of its host key as the value.
+	// It is not in the multicodec table, so it uses a code from the private use range.
+	CodeSSH = Code(0x300001)
+)
+
+const (
+	// sizeNone is the size of protocols without a value.
+	sizeNone = 0
+	// sizeVar is the size of protocols with a length prefixed value.
+	sizeVar = -1
+)
+
+// Protocol describes how a protocol's value is encoded.
+type Protocol struct {
+	Name string
+	Code Code
+	// Size is the size of the value in bytes, 0 if there is no value, or -1 if the value is length prefixed.
+	Size int
+
+	fromText func(string) ([]byte, error)
+	toText   func([]byte) (string, error)
+}
+
+var protocols = []Protocol{
+	{Name: "ip4", Code: CodeIP4, Size: 4, fromText: ipFromText(true), toText: ipToText(true)},
+	{Name: "tcp", Code: CodeTCP, Size: 2, fromText: portFromText, toText: portToText},
+	{Name: "ip6", Code: CodeIP6, Size: 16, fromText: ipFromText(false), toText: ipToText(false)},
+	{Name: "dns", Code: CodeDNS, Size: sizeVar, fromText: dnsFromText, toText: dnsToText},
+	{Name: "dns4", Code: CodeDNS4, Size: sizeVar, fromText: dnsFromText, toText: dnsToText},
+	{Name: "dns6", Code: CodeDNS6, Size: sizeVar, fromText: dnsFromText, toText: dnsToText},
+	{Name: "udp", Code: CodeUDP, Size: 2, fromText: portFromText, toText: portToText},
+	{Name: "p2p", Code: CodeP2P, Size: sizeVar, fromText: multihashFromText, toText: multihashToText},
+	{Name: "quic-v1", Code: CodeQUICv1, Size: sizeNone},
+	{Name: "p2pke", Code: CodeP2PKE, Size: sizeNone},
+	{Name: "ssh", Code: CodeSSH, Size: 32, fromText: sshFromText, toText: sshToText},
+}
+
+// ProtocolWithCode returns the Protocol for code.
+func ProtocolWithCode(code Code) (Protocol, bool) {
+	for _, p := range protocols {
+		if p.Code == code {
+			return p, true
+		}
+	}
+	return Protocol{}, false
+}
+
+// ProtocolWithName returns the Protocol with the name used in the text format.
+func ProtocolWithName(name string) (Protocol, bool) {
+	for _, p := range protocols {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	// "ipfs" is the old name for "p2p", and is still accepted.
+	if name == "ipfs" {
+		return ProtocolWithCode(CodeP2P)
+	}
+	return Protocol{}, false
+}
+
+// validate returns an error if x is not a valid value for the protocol.
+func (p Protocol) validate(x []byte) error {
+	if p.Size == sizeNone {
+		if len(x) > 0 {
+			return fmt.Errorf("multiaddr: %s has no value, have %d bytes", p.Name, len(x))
+		}
+		return nil
+	}
+	_, err := p.toText(x)
+	return err
+}
+
+func ipFromText(is4 bool) func(string) ([]byte, error) {
+	return func(x string) ([]byte, error) {
+		ip, err := netip.ParseAddr(x)
+		if err != nil {
+			return nil, err
+		}
+		if ip.Is4() != is4 || ip.Zone() != "" {
+			return nil, fmt.Errorf("multiaddr: wrong ip version %v", ip)
+		}
+		return ip.AsSlice(), nil
+	}
+}
+
+func ipToText(is4 bool) func([]byte) (string, error) {
+	return func(x []byte) (string, error) {
+		ip, ok := netip.AddrFromSlice(x)
+		if !ok || ip.Is4() != is4 {
+			return "", fmt.Errorf("multiaddr: invalid ip %x", x)
+		}
+		return ip.String(), nil
+	}
+}
+
+func portFromText(x string) ([]byte, error) {
+	port, err := strconv.ParseUint(x, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint16(nil, uint16(port)), nil
+}
+
+func portToText(x []byte) (string, error) {
+	if len(x) != 2 {
+		return "", fmt.Errorf("multiaddr: port must be 2 bytes, have %d", len(x))
+	}
+	return strconv.Itoa(int(binary.BigEndian.Uint16(x))), nil
+}
+
+func dnsFromText(x string) ([]byte, error) {
+	if x == "" {
+		return nil, fmt.Errorf("multiaddr: empty dns name")
+	}
+	return []byte(x), nil
+}
+
+func dnsToText(x []byte) (string, error) {
+	if len(x) == 0 || strings.Contains(string(x), "/") {
+		return "", fmt.Errorf("multiaddr: invalid dns name %q", x)
+	}
+	return string(x), nil
+}
+
+// multihashFromText decodes a base58btc multihash.
+// The CID form of peer ids is not supported.
+func multihashFromText(x string) ([]byte, error) {
+	data, err := decodeBase58(x)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := SplitMultihash(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func multihashToText(x []byte) (string, error) {
+	if _, _, err := SplitMultihash(x); err != nil {
+		return "", err
+	}
+	return encodeBase58(x), nil
+}
+
+// The text form of an ssh value is URL safe base64, since standard base64 can contain '/'.
+func sshFromText(x string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 32 {
+		return nil, fmt.Errorf("multiaddr: ssh fingerprint must be 32 bytes, have %d", len(data))
+	}
+	return data, nil
+}
+
+func sshToText(x []byte) (string, error) {
+	if len(x) != 32 {
+		return "", fmt.Errorf("multiaddr: ssh fingerprint must be 32 bytes, have %d", len(x))
+	}
+	return base64.RawURLEncoding.EncodeToString(x), nil
+}
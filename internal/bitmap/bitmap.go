@@ -0,0 +1,113 @@
+// Package bitmap provides a fixed size set of bits, used to track which parts of a message have been received.
+package bitmap
+
+// BitMap is a fixed number of bits.
+// The zero value has no bits.
+type BitMap struct {
+	buf []byte
+	n   int
+}
+
+// New returns a BitMap of n bits, which are all unset.
+func New(n int) BitMap {
+	return BitMap{
+		buf: make([]byte, Size(n)),
+		n:   n,
+	}
+}
+
+// Full returns a BitMap of n bits, which are all set.
+func Full(n int) BitMap {
+	bm := New(n)
+	for i := 0; i < n; i++ {
+		bm.Set(i, true)
+	}
+	return bm
+}
+
+// FromBytes returns a BitMap of n bits, read from buf.
+// It returns false if buf is not Size(n) bytes.
+func FromBytes(buf []byte, n int) (BitMap, bool) {
+	if len(buf) != Size(n) {
+		return BitMap{}, false
+	}
+	return BitMap{buf: append([]byte{}, buf...), n: n}, true
+}
+
+// Size returns the number of bytes needed for n bits.
+func Size(n int) int {
+	l := n / 8
+	if n%8 > 0 {
+		l++
+	}
+	return l
+}
+
+func (bm BitMap) Set(i int, v bool) {
+	if i >= bm.Len() {
+		panic("bitMap: index out of bounds")
+	}
+	if v {
+		bm.buf[i/8] |= mask(i)
+	} else {
+		bm.buf[i/8] &= maskInverse(i)
+	}
+}
+
+func (bm BitMap) Get(i int) bool {
+	if i >= bm.Len() {
+		panic("bitMap: index out of bounds")
+	}
+	return bm.buf[i/8]&mask(i) > 0
+}
+
+// Len returns the number of bits.
+func (bm BitMap) Len() int {
+	return bm.n
+}
+
+func (bm BitMap) AllSet() bool {
+	l := bm.Len()
+	for i := 0; i < l; i++ {
+		if !bm.Get(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Or sets every bit which is set in other.
+func (bm BitMap) Or(other BitMap) {
+	for i := range bm.buf {
+		if i < len(other.buf) {
+			bm.buf[i] |= other.buf[i]
+		}
+	}
+}
+
+// Unset returns the indexes of the bits which are not set.
+func (bm BitMap) Unset() (ret []int) {
+	for i := 0; i < bm.Len(); i++ {
+		if !bm.Get(i) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// Bytes returns a copy of the bits, in the format read by FromBytes.
+func (bm BitMap) Bytes() []byte {
+	return append([]byte{}, bm.buf...)
+}
+
+func (bm BitMap) Clone() BitMap {
+	return BitMap{buf: bm.Bytes(), n: bm.n}
+}
+
+func mask(i int) uint8 {
+	return 1 << (i % 8)
+}
+
+func maskInverse(i int) uint8 {
+	return ^mask(i)
+}
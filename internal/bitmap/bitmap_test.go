@@ -0,0 +1,21 @@
+package bitmap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitMap(t *testing.T) {
+	have := New(10)
+	have.Set(3, true)
+	have2, ok := FromBytes(have.Bytes(), 10)
+	require.True(t, ok)
+	require.Equal(t, []int{0, 1, 2, 4, 5, 6, 7, 8, 9}, have2.Unset())
+	_, ok = FromBytes(have.Bytes(), 20)
+	require.False(t, ok)
+
+	have2.Or(Full(10))
+	require.True(t, have2.AllSet())
+	require.False(t, have.AllSet())
+}
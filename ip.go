@@ -10,8 +10,10 @@ type HasIP interface {
 	MapIP(func(netip.Addr) netip.Addr) Addr
 }
 
+// ExtractIP returns the IP address of x, or of an address wrapped by x.
+// Addresses only need a GetIP method, and not all of HasIP.
 func ExtractIP(x Addr) (netip.Addr, bool) {
-	if hasIP, ok := x.(HasIP); ok {
+	if hasIP, ok := x.(interface{ GetIP() netip.Addr }); ok {
 		return hasIP.GetIP(), true
 	}
 	if unwrap, ok := x.(UnwrapAddr); ok {
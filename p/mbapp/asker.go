@@ -1,8 +1,10 @@
 package mbapp
 
 import (
-	"context"
 	"sync"
+	"time"
+
+	"go.brendoncarroll.net/p2p/internal/bitmap"
 )
 
 type askID struct {
@@ -11,31 +13,71 @@ type askID struct {
 }
 
 type ask struct {
-	once    sync.Once
-	done    chan struct{}
-	respBuf []byte
-	n       int
-	errCode uint8
-}
+	once      sync.Once
+	done      chan struct{}
+	respBuf   []byte
+	n         int
+	errCode   uint8
+	serveTime time.Duration
 
-func (a *ask) await(ctx context.Context) error {
-	select {
-	case <-ctx.Done():
-		a.abort()
-		return ctx.Err()
-	case <-a.done:
-		return nil
-	}
+	// nacked is signaled when the server reports which parts of the request it has received.
+	nacked  chan struct{}
+	mu      sync.Mutex
+	reqHave bitmap.BitMap
+	// version is the highest protocol version the server has sent.
+	version uint8
 }
 
-func (a *ask) complete(resp []byte, errCode uint8) {
+func (a *ask) complete(resp []byte, errCode uint8, serveTime time.Duration) {
 	a.once.Do(func() {
 		a.errCode = errCode
+		a.serveTime = serveTime
 		a.n = copy(a.respBuf, resp)
 		close(a.done)
 	})
 }
 
+// nack records the parts of the request which the server has received.
+// If have is the wrong length, the server does not have the request, and it must be sent again.
+func (a *ask) nack(have bitmap.BitMap) {
+	a.mu.Lock()
+	if have.Len() == a.reqHave.Len() {
+		for i := 0; i < have.Len(); i++ {
+			if have.Get(i) {
+				a.reqHave.Set(i, true)
+			}
+		}
+	} else {
+		a.reqHave = bitmap.New(a.reqHave.Len())
+	}
+	a.mu.Unlock()
+	select {
+	case a.nacked <- struct{}{}:
+	default:
+	}
+}
+
+// setVersion records that the server sent a message with protocol version v.
+func (a *ask) setVersion(v uint8) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.version = max(a.version, v)
+}
+
+// getVersion returns the highest protocol version the server has sent.
+func (a *ask) getVersion() uint8 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.version
+}
+
+// missing returns the parts of the request which the server has not reported receiving.
+func (a *ask) missing() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reqHave.Unset()
+}
+
 func (a *ask) abort() {
 	a.once.Do(func() {
 		close(a.done)
@@ -53,10 +95,12 @@ func newAsker() *asker {
 	}
 }
 
-func (a *asker) createAsk(id askID, respBuf []byte) *ask {
+func (a *asker) createAsk(id askID, respBuf []byte, reqParts int) *ask {
 	ask := &ask{
 		done:    make(chan struct{}),
 		respBuf: respBuf,
+		nacked:  make(chan struct{}, 1),
+		reqHave: bitmap.New(reqParts),
 	}
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -70,6 +114,12 @@ func (a *asker) removeAsk(id askID) {
 	delete(a.inFlight, id)
 }
 
+func (a *asker) getAsk(id askID) *ask {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.inFlight[id]
+}
+
 func (a *asker) getAndRemoveAsk(id askID) *ask {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -77,8 +127,3 @@ func (a *asker) getAndRemoveAsk(id askID) *ask {
 	delete(a.inFlight, id)
 	return ask
 }
-
-func retry(ctx context.Context, fn func() error) error {
-	// TODO: retry until context is cancelled.
-	return fn()
-}
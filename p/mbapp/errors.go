@@ -6,6 +6,57 @@ import (
 	"go.brendoncarroll.net/p2p"
 )
 
+// Error codes are sent in the header of replies, and surface to the caller as AppError.Code.
+// Codes not defined here are available to applications.
+const (
+	// CodeOK means the handler returned a response.
+	CodeOK = uint8(0)
+	// CodeNotFound means the requested resource does not exist.
+	CodeNotFound = uint8(1)
+	// CodeOverloaded means the server is too busy to serve the request, and it can be tried again later.
+	CodeOverloaded = uint8(2)
+	// CodeUnauthorized means the requester is not allowed to make the request.
+	CodeUnauthorized = uint8(3)
+
+	// CodeUnknown is used when a handler returns a negative value which did not come from ErrorReply.
+	CodeUnknown = uint8(0xff)
+)
+
+// MaxErrorBodySize is the largest error body which can be returned by ErrorReply.
+const MaxErrorBodySize = 1<<22 - 1
+
+// errorReplyFlag is set in the values returned by ErrorReply, to distinguish them from other negative values.
+const errorReplyFlag = 1 << 30
+
+// ErrorReply copies body into resp, and returns the value a ServeAsk handler should return,
+// to reply with an error code and body.
+// body is truncated to fit in resp, and MaxErrorBodySize.
+// code must not be CodeOK.
+func ErrorReply(resp []byte, code uint8, body []byte) int {
+	if code == CodeOK {
+		panic("mbapp: ErrorReply with CodeOK")
+	}
+	if len(resp) > MaxErrorBodySize {
+		resp = resp[:MaxErrorBodySize]
+	}
+	n := copy(resp, body)
+	return ^(errorReplyFlag | n<<8 | int(code))
+}
+
+// extractErrorCode returns the error code, and the length of the response body, for the value returned by a handler.
+func extractErrorCode(n int) (uint8, int) {
+	if n >= 0 {
+		return CodeOK, n
+	}
+	x := ^n
+	if x&errorReplyFlag == 0 || uint8(x) == CodeOK {
+		return CodeUnknown, 0
+	}
+	return uint8(x), (x &^ errorReplyFlag) >> 8
+}
+
+// AppError is returned by Ask, when the handler replies with an error code.
+// Response is the error body.
 type AppError struct {
 	Addr     p2p.Addr
 	Code     uint8
@@ -14,5 +65,20 @@ type AppError struct {
 }
 
 func (e AppError) Error() string {
-	return fmt.Sprintf("ADDR: %v REQ: %q RES: %q", e.Addr, e.Request, e.Response)
+	return fmt.Sprintf("ADDR: %v CODE: %s REQ: %q RES: %q", e.Addr, codeString(e.Code), e.Request, e.Response)
+}
+
+func codeString(code uint8) string {
+	switch code {
+	case CodeNotFound:
+		return "not found"
+	case CodeOverloaded:
+		return "overloaded"
+	case CodeUnauthorized:
+		return "unauthorized"
+	case CodeUnknown:
+		return "unknown"
+	default:
+		return fmt.Sprintf("%d", code)
+	}
 }
@@ -7,34 +7,43 @@ import (
 
 	"github.com/pkg/errors"
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
 )
 
+// nackDelay is how long a collector waits after receiving a part, before reporting the missing parts.
+const nackDelay = 20 * time.Millisecond
+
 type collector struct {
 	partCount int
 	createdAt time.Time
 
-	mu     sync.Mutex
-	bitMap bitMap
-	buf    []byte
+	mu        sync.Mutex
+	bitMap    bitmap.BitMap
+	buf       []byte
+	done      bool
+	nackTimer *time.Timer
 }
 
 func newCollector(partCount, totalSize int, now time.Time) *collector {
 	return &collector{
 		partCount: partCount,
+		createdAt: now,
 
 		buf:    make([]byte, totalSize),
-		bitMap: newBitMap(partCount),
+		bitMap: bitmap.New(partCount),
 	}
 }
 
-func (c *collector) addPart(partIndex int, data []byte) error {
+// addPart adds the part, and returns true if the message is complete.
+// It only returns true once, even if parts are received again.
+func (c *collector) addPart(partIndex int, data []byte) (bool, error) {
 	if partIndex >= c.partCount {
-		return errors.Errorf("partIndex %d >= partCount %d", partIndex, c.partCount)
+		return false, errors.Errorf("partIndex %d >= partCount %d", partIndex, c.partCount)
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.bitMap.get(partIndex) {
-		return nil
+	if c.done || c.bitMap.Get(partIndex) {
+		return false, nil
 	}
 	var offset int
 	if partIndex == (c.partCount - 1) {
@@ -42,18 +51,54 @@ func (c *collector) addPart(partIndex int, data []byte) error {
 	} else {
 		offset = len(data) * partIndex
 	}
-	if offset >= len(c.buf) {
-		return errors.Errorf("invalid offset len=%d for buf of len=%d", offset, len(c.buf))
+	if offset < 0 || offset+len(data) > len(c.buf) {
+		return false, errors.Errorf("invalid offset len=%d for buf of len=%d", offset, len(c.buf))
 	}
 	copy(c.buf[offset:], data)
-	c.bitMap.set(partIndex, true)
-	return nil
+	c.bitMap.Set(partIndex, true)
+	if !c.bitMap.AllSet() {
+		return false, nil
+	}
+	c.done = true
+	if c.nackTimer != nil {
+		c.nackTimer.Stop()
+	}
+	return true, nil
+}
+
+// scheduleNack calls fn with the parts which have been received, after delay, unless another part is received first.
+func (c *collector) scheduleNack(delay time.Duration, fn func(have bitmap.BitMap)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nackTimer != nil {
+		c.nackTimer.Stop()
+	}
+	c.nackTimer = time.AfterFunc(delay, func() {
+		c.mu.Lock()
+		if c.done {
+			c.mu.Unlock()
+			return
+		}
+		have := c.bitMap.Clone()
+		c.mu.Unlock()
+		fn(have)
+	})
 }
 
-func (c *collector) isComplete() bool {
+// have returns the parts which have been received.
+func (c *collector) have() bitmap.BitMap {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.bitMap.allSet()
+	return c.bitMap.Clone()
+}
+
+func (c *collector) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	if c.nackTimer != nil {
+		c.nackTimer.Stop()
+	}
 }
 
 func (c *collector) withBuffer(fn func([]byte) error) error {
@@ -78,6 +123,7 @@ type fragLayer struct {
 func newFragLayer() *fragLayer {
 	ctx, cf := context.WithCancel(context.Background())
 	fl := &fragLayer{
+		ttl:        maxAskWait,
 		cf:         cf,
 		collectors: make(map[collectorID]*collector),
 	}
@@ -85,7 +131,9 @@ func newFragLayer() *fragLayer {
 	return fl
 }
 
-func (fl *fragLayer) handlePart(remote p2p.Addr, gid GroupID, partIndex, partCount uint16, totalSize uint32, body []byte, fn func([]byte) error) error {
+// handlePart adds a part to the message, and calls fn with the message once all the parts have been received.
+// If nack is not nil, it is called with the parts which have been received, when parts stop arriving before the message is complete.
+func (fl *fragLayer) handlePart(remote p2p.Addr, gid GroupID, partIndex, partCount uint16, totalSize uint32, body []byte, nack func(have bitmap.BitMap), fn func([]byte) error) error {
 	cid := collectorID{Remote: remote.String(), GroupID: gid}
 	if partCount < 2 && !disableFastPath {
 		return fn(body)
@@ -94,14 +142,31 @@ func (fl *fragLayer) handlePart(remote p2p.Addr, gid GroupID, partIndex, partCou
 	if err != nil {
 		return err
 	}
-	col.addPart(int(partIndex), body)
-	if !col.isComplete() {
+	complete, err := col.addPart(int(partIndex), body)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		if nack != nil {
+			col.scheduleNack(nackDelay, nack)
+		}
 		return nil
 	}
 	defer fl.dropCollector(cid)
 	return col.withBuffer(fn)
 }
 
+// have returns the parts of a message which have been received, or false if no parts have been received.
+func (fl *fragLayer) have(cid collectorID) (bitmap.BitMap, bool) {
+	fl.mu.RLock()
+	col, exists := fl.collectors[cid]
+	fl.mu.RUnlock()
+	if !exists {
+		return bitmap.BitMap{}, false
+	}
+	return col.have(), true
+}
+
 func (fl *fragLayer) getCollector(cid collectorID, partCount uint16, totalSize uint32) (*collector, error) {
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
@@ -118,7 +183,10 @@ func (fl *fragLayer) getCollector(cid collectorID, partCount uint16, totalSize u
 func (fl *fragLayer) dropCollector(cid collectorID) {
 	fl.mu.Lock()
 	defer fl.mu.Unlock()
-	delete(fl.collectors, cid)
+	if col, exists := fl.collectors[cid]; exists {
+		col.stop()
+		delete(fl.collectors, cid)
+	}
 }
 
 func (fl *fragLayer) cleanupLoop(ctx context.Context) {
@@ -131,6 +199,7 @@ func (fl *fragLayer) cleanupLoop(ctx context.Context) {
 			now := time.Now().UTC()
 			for id, c := range fl.collectors {
 				if now.Sub(c.createdAt) > fl.ttl {
+					c.stop()
 					delete(fl.collectors, id)
 				}
 			}
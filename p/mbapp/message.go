@@ -12,16 +12,30 @@ const (
 
 	isAskBit   = 31
 	isReplyBit = 30
+	isNackBit  = 29
+
+	versionShift = 24
+	versionMask  = 0xF
 )
 
+// Version is the version of the protocol sent in the header.
+// Peers which set no version send neither NACKs, nor the serve time in replies,
+// and do not understand NACKs, so they are only sent to peers which send a version of at least 1.
+const Version = 1
+
 // Header
 // 	 |<-        32 bits             ->|
-// 0 | mode bits       24| resp code 8|
+// 0 | mode 4| ver 4| reserved 16| code 8|
 // 1 | origin time                  32|
 // 2 | counter                      32|
 // 3 | part size 					32|
 // 4 | part index   16| part count  16|
 // 5 | timeout or dest time
+//
+// From version 1, replies put the time the handler took to serve the request in word 5, instead of the timeout.
+//
+// From version 1, NACKs have the ask and nack bits set, and the reply bit set if they refer to a reply.
+// The part count is the number of parts in the message they refer to, and the body is a bitmap of the parts which have been received.
 type Header []byte
 
 func ParseMessage(data []byte) (Header, []byte, error) {
@@ -48,6 +62,26 @@ func (h Header) SetIsReply(yes bool) {
 	h.setUint32Bit(0, isReplyBit, yes)
 }
 
+func (h Header) IsNack() bool {
+	return h.getUint32Bit(0, isNackBit)
+}
+
+func (h Header) SetIsNack(yes bool) {
+	h.setUint32Bit(0, isNackBit, yes)
+}
+
+func (h Header) GetVersion() uint8 {
+	return uint8(h.getUint32(0)>>versionShift) & versionMask
+}
+
+func (h Header) SetVersion(v uint8) {
+	h.updateUint32(0, func(x uint32) uint32 {
+		x &= ^uint32(versionMask << versionShift)
+		x |= uint32(v&versionMask) << versionShift
+		return x
+	})
+}
+
 func (h Header) SetErrorCode(v uint8) {
 	h.updateUint32(0, func(x uint32) uint32 {
 		x &= ^uint32(0xFF)
@@ -117,6 +151,15 @@ func (h Header) GetTimeout() time.Duration {
 	return time.Duration(h.getUint32(5)) * time.Millisecond
 }
 
+// SetServeTime is used by replies, instead of SetTimeout, from version 1.
+func (h Header) SetServeTime(d time.Duration) {
+	h.setUint32(5, uint32(d.Milliseconds()))
+}
+
+func (h Header) GetServeTime() time.Duration {
+	return time.Duration(h.getUint32(5)) * time.Millisecond
+}
+
 func (h Header) GroupID() GroupID {
 	return GroupID{
 		Counter:    h.GetCounter(),
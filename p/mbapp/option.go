@@ -7,6 +7,9 @@ import (
 type swarmConfig struct {
 	bgCtx      context.Context
 	numWorkers int
+
+	maxReplies    int
+	maxReplyBytes int
 }
 
 type Option = func(c *swarmConfig)
@@ -25,3 +28,15 @@ func WithNumWorkers(n int) Option {
 		c.numWorkers = n
 	}
 }
+
+// WithReplyCacheLimits limits the number of replies which are kept to answer requests that are sent again,
+// and the total size of their bodies.
+// When a limit is reached, the replies which expire first are removed,
+// and requests are dropped while the cache is full of requests which are still being served.
+// n <= 0 or maxBytes <= 0 mean no limit.  The default is 4096 replies, and 64MiB.
+func WithReplyCacheLimits(n, maxBytes int) Option {
+	return func(c *swarmConfig) {
+		c.maxReplies = n
+		c.maxReplyBytes = maxBytes
+	}
+}
@@ -0,0 +1,172 @@
+package mbapp
+
+import (
+	"sync"
+	"time"
+)
+
+// minReplyTTL is the least amount of time a reply is cached, even if the request's deadline has passed.
+const minReplyTTL = time.Second
+
+// reply is an entry in the replyCache.
+// Until the handler returns, the entry only records that the request is being served.
+type reply struct {
+	// reqParts is the number of parts in the request.
+	reqParts int
+
+	mu        sync.Mutex
+	ready     bool
+	errCode   uint8
+	body      []byte
+	serveTime time.Duration
+	lastSent  time.Time
+	expiresAt time.Time
+}
+
+// replyCache holds the replies to recent requests, so that requests which are sent again
+// are answered without calling the handler again.
+// The cache holds at most maxEntries entries, and maxBytes bytes of replies.
+// When a limit is reached, the ready replies which expire first are evicted.
+type replyCache struct {
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	entries map[askID]*reply
+	size    int
+}
+
+func newReplyCache(maxEntries, maxBytes int) *replyCache {
+	return &replyCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[askID]*reply),
+	}
+}
+
+func (rc *replyCache) get(id askID) *reply {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.entries[id]
+}
+
+// getOrCreate returns the entry for id, creating it if it does not exist.
+// created is true if the entry was created.
+// If the cache is full of requests which are still being served, it returns nil.
+func (rc *replyCache) getOrCreate(id askID, reqParts int) (r *reply, created bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if r, exists := rc.entries[id]; exists {
+		return r, false
+	}
+	if rc.maxEntries > 0 && len(rc.entries) >= rc.maxEntries && !rc.evictOne(nil) {
+		return nil, false
+	}
+	r = &reply{reqParts: reqParts}
+	rc.entries[id] = r
+	return r, true
+}
+
+// setReply makes r ready, and evicts other replies if the cache is over its byte limit.
+// See reply.setReply
+func (rc *replyCache) setReply(r *reply, errCode uint8, body []byte, serveTime time.Duration, deadline, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	r.setReply(errCode, body, serveTime, deadline, now)
+	rc.size += len(body)
+	for rc.maxBytes > 0 && rc.size > rc.maxBytes && rc.evictOne(r) {
+	}
+}
+
+func (rc *replyCache) remove(id askID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if r, exists := rc.entries[id]; exists {
+		rc.delete(id, r)
+	}
+}
+
+// purge removes the replies which expired before now.
+// Requests which are still being served are not removed.
+func (rc *replyCache) purge(now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for id, r := range rc.entries {
+		r.mu.Lock()
+		expired := r.ready && now.After(r.expiresAt)
+		r.mu.Unlock()
+		if expired {
+			rc.delete(id, r)
+		}
+	}
+}
+
+// evictOne removes the ready reply which expires first, other than keep.
+// It returns false if there are no replies which can be removed.
+// rc.mu must be held.
+func (rc *replyCache) evictOne(keep *reply) bool {
+	var oldestID askID
+	var oldest *reply
+	var oldestExpiry time.Time
+	for id, r := range rc.entries {
+		if r == keep {
+			continue
+		}
+		r.mu.Lock()
+		ready, expiresAt := r.ready, r.expiresAt
+		r.mu.Unlock()
+		if ready && (oldest == nil || expiresAt.Before(oldestExpiry)) {
+			oldestID, oldest, oldestExpiry = id, r, expiresAt
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	rc.delete(oldestID, oldest)
+	return true
+}
+
+// delete removes r from the cache.
+// rc.mu must be held.
+func (rc *replyCache) delete(id askID, r *reply) {
+	r.mu.Lock()
+	rc.size -= len(r.body)
+	r.mu.Unlock()
+	delete(rc.entries, id)
+}
+
+// setReply makes the reply ready, and keeps it until deadline, or at least minReplyTTL after now.
+func (r *reply) setReply(errCode uint8, body []byte, serveTime time.Duration, deadline, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = true
+	r.errCode = errCode
+	r.body = body
+	r.serveTime = serveTime
+	r.lastSent = now
+	r.expiresAt = deadline
+	if min := now.Add(minReplyTTL); r.expiresAt.Before(min) {
+		r.expiresAt = min
+	}
+	if max := now.Add(maxAskWait); r.expiresAt.After(max) {
+		r.expiresAt = max
+	}
+}
+
+// shouldResend returns true if the reply is ready, and was not sent within interval before now.
+// If it returns true, the reply is considered sent at now.
+func (r *reply) shouldResend(interval time.Duration, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ready || now.Sub(r.lastSent) < interval {
+		return false
+	}
+	r.lastSent = now
+	return true
+}
+
+func (r *reply) isReady() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
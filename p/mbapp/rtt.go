@@ -0,0 +1,102 @@
+package mbapp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// initialRTO is the retransmission timeout used for peers without any round trip samples.
+	initialRTO = 500 * time.Millisecond
+	minRTO     = 50 * time.Millisecond
+	maxRTO     = 10 * time.Second
+	// rttIdleTTL is how long an rttEstimator is kept after it was last used.
+	rttIdleTTL = 10 * time.Minute
+)
+
+// rttEstimator estimates the round trip time to a peer, and the retransmission timeout, as described in RFC 6298.
+type rttEstimator struct {
+	sampled  bool
+	srtt     time.Duration
+	rttvar   time.Duration
+	lastUsed time.Time
+}
+
+func (e *rttEstimator) observe(sample time.Duration) {
+	if sample < 0 {
+		sample = 0
+	}
+	if !e.sampled {
+		e.sampled = true
+		e.srtt = sample
+		e.rttvar = sample / 2
+		return
+	}
+	delta := e.srtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + sample) / 8
+}
+
+func (e *rttEstimator) rto() time.Duration {
+	if !e.sampled {
+		return initialRTO
+	}
+	rto := e.srtt + 4*e.rttvar
+	if rto < minRTO {
+		rto = minRTO
+	}
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// rttTable holds an rttEstimator for each peer.
+type rttTable struct {
+	mu         sync.Mutex
+	estimators map[string]*rttEstimator
+}
+
+func newRTTTable() *rttTable {
+	return &rttTable{estimators: make(map[string]*rttEstimator)}
+}
+
+// observe adds a round trip time sample for the peer.
+// Samples should not be taken from Asks which were retransmitted, since the reply could be to either transmission.
+func (t *rttTable) observe(peer string, sample time.Duration, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, exists := t.estimators[peer]
+	if !exists {
+		e = &rttEstimator{}
+		t.estimators[peer] = e
+	}
+	e.observe(sample)
+	e.lastUsed = now
+}
+
+// rto returns the retransmission timeout for the peer.
+func (t *rttTable) rto(peer string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, exists := t.estimators[peer]
+	if !exists {
+		return initialRTO
+	}
+	e.lastUsed = now
+	return e.rto()
+}
+
+// purge removes the estimators which have not been used since rttIdleTTL before now.
+func (t *rttTable) purge(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, e := range t.estimators {
+		if now.Sub(e.lastUsed) > rttIdleTTL {
+			delete(t.estimators, k)
+		}
+	}
+}
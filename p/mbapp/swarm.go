@@ -12,6 +12,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
 	"go.brendoncarroll.net/p2p/s/swarmutil"
 )
 
@@ -20,6 +21,8 @@ var disableFastPath bool
 const (
 	maxTimeout = (1 << 28) * time.Millisecond
 	maxAskWait = 30 * time.Second
+	// purgePeriod is how often expired replies, round trip estimates, and peer versions are removed.
+	purgePeriod = time.Second
 )
 
 type Swarm[A p2p.Addr, Pub any] struct {
@@ -27,9 +30,13 @@ type Swarm[A p2p.Addr, Pub any] struct {
 	mtu        int
 	numWorkers int
 
+	ctx       context.Context
 	cf        context.CancelFunc
 	fragLayer *fragLayer
 	asker     *asker
+	replies   *replyCache
+	rtts      *rttTable
+	versions  *versionTable
 	counter   uint32
 	tells     swarmutil.TellHub[A]
 	asks      swarmutil.AskHub[A]
@@ -39,6 +46,9 @@ func New[A p2p.Addr, Pub any](x p2p.SecureSwarm[A, Pub], mtu int, opts ...Option
 	config := swarmConfig{
 		bgCtx:      context.Background(),
 		numWorkers: runtime.GOMAXPROCS(0),
+
+		maxReplies:    4096,
+		maxReplyBytes: 64 << 20,
 	}
 	for _, opt := range opts {
 		opt(&config)
@@ -50,16 +60,24 @@ func New[A p2p.Addr, Pub any](x p2p.SecureSwarm[A, Pub], mtu int, opts ...Option
 		mtu:        mtu,
 		numWorkers: config.numWorkers,
 
+		ctx:       ctx,
 		cf:        cf,
 		fragLayer: newFragLayer(),
 		asker:     newAsker(),
+		replies:   newReplyCache(config.maxReplies, config.maxReplyBytes),
+		rtts:      newRTTTable(),
+		versions:  newVersionTable(),
 		tells:     swarmutil.NewTellHub[A](),
 		asks:      swarmutil.NewAskHub[A](),
 	}
 	go s.recvLoops(ctx, s.numWorkers)
+	go s.purgeLoop(ctx)
 	return s
 }
 
+// Ask sends a request to dst and waits for the reply.
+// Lost parts of the request and reply are sent again, after a timeout based on the round trip time to dst,
+// or as soon as the other side reports that they are missing.
 func (s *Swarm[A, Pub]) Ask(ctx context.Context, resp []byte, dst A, req p2p.IOVec) (int, error) {
 	ctx, cf := context.WithTimeout(ctx, maxAskWait)
 	defer cf()
@@ -69,11 +87,12 @@ func (s *Swarm[A, Pub]) Ask(ctx context.Context, resp []byte, dst A, req p2p.IOV
 	// create ask in map
 	counter := s.getCounter()
 	originTime := s.getTime()
-	id := askID{GroupID: GroupID{Counter: counter, OriginTime: originTime}, Addr: dst.String()}
-	ask := s.asker.createAsk(id, resp)
+	gid := GroupID{Counter: counter, OriginTime: originTime}
+	id := askID{GroupID: gid, Addr: dst.String()}
+	ask := s.asker.createAsk(id, resp, s.partCount(p2p.VecSize(req)))
 	defer s.asker.removeAsk(id)
 	// call send
-	if err := s.send(ctx, dst, sendParams{
+	params := sendParams{
 		isAsk:      true,
 		isReply:    false,
 		counter:    counter,
@@ -81,12 +100,50 @@ func (s *Swarm[A, Pub]) Ask(ctx context.Context, resp []byte, dst A, req p2p.IOV
 		timeout:    getTimeoutMillis(ctx),
 
 		m: req,
-	}); err != nil {
+	}
+	sentAt := time.Now()
+	if err := s.send(ctx, dst, params); err != nil {
 		return 0, err
 	}
-	// wait or timeout
-	if err := ask.await(ctx); err != nil {
-		return 0, errors.Wrapf(err, "waiting for ask response from %v", dst)
+	// wait for the reply, sending parts again if they are lost.
+	rto := s.rtts.rto(id.Addr, sentAt)
+	timer := time.NewTimer(rto)
+	defer timer.Stop()
+	var retransmitted bool
+	for waiting := true; waiting; {
+		select {
+		case <-ctx.Done():
+			ask.abort()
+			return 0, errors.Wrapf(ctx.Err(), "waiting for ask response from %v", dst)
+		case <-ask.done:
+			waiting = false
+		case <-ask.nacked:
+			if missing := ask.missing(); len(missing) > 0 {
+				retransmitted = true
+				params.parts = missing
+				if err := s.send(ctx, dst, params); err != nil {
+					logctx.Debugln(ctx, "mbapp: sending missing request parts", err)
+				}
+			}
+		case <-timer.C:
+			// Servers before version 1 have no reply cache, they would call the handler again for a request sent again.
+			if max(ask.getVersion(), s.versions.get(id.Addr)) >= 1 {
+				retransmitted = true
+				if err := s.retransmit(ctx, dst, ask, params); err != nil {
+					logctx.Debugln(ctx, "mbapp: retransmitting ask", err)
+				}
+			}
+			if rto *= 2; rto > maxRTO {
+				rto = maxRTO
+			}
+			timer.Reset(rto)
+		}
+	}
+	// the reply could be to any transmission of a retransmitted request, so only the first transmission is sampled.
+	// Servers without a version send their timeout instead of the serve time, so they are not sampled.
+	if !retransmitted && ask.getVersion() >= 1 {
+		now := time.Now()
+		s.rtts.observe(id.Addr, now.Sub(sentAt)-ask.serveTime, now)
 	}
 	if ask.errCode > 0 {
 		err := AppError{
@@ -118,11 +175,31 @@ func (s *Swarm[A, Pub]) Receive(ctx context.Context, th func(p2p.Message[A])) er
 	return s.tells.Receive(ctx, th)
 }
 
+// ServeAsk calls fn to serve each Ask.
+// fn can return the value from ErrorReply, to reply with an error code, which the caller receives as an AppError.
+// Other negative values reply with CodeUnknown, and no body.
 func (s *Swarm[A, Pub]) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[A]) int) error {
 	return s.asks.ServeAsk(ctx, fn)
 }
 
+// retransmit is called when no reply has been received before the retransmission timeout.
+// If part of the reply has been received, and the server understands NACKs, the server is told which parts are missing.
+// Otherwise the parts of the request which the server has not reported receiving are sent again.
+// If the server has the whole request, it is asked for the reply.
+func (s *Swarm[A, Pub]) retransmit(ctx context.Context, dst A, ask *ask, params sendParams) error {
+	gid := GroupID{Counter: params.counter, OriginTime: params.originTime}
+	if have, ok := s.fragLayer.have(collectorID{Remote: dst.String(), GroupID: gid}); ok && ask.getVersion() >= 1 {
+		return s.sendNack(ctx, dst, gid, true, have)
+	}
+	if missing := ask.missing(); len(missing) > 0 {
+		params.parts = missing
+		return s.send(ctx, dst, params)
+	}
+	return s.sendNack(ctx, dst, gid, true, bitmap.BitMap{})
+}
+
 func (s *Swarm[A, Pub]) Close() error {
+	s.cf()
 	s.fragLayer.Close()
 	s.asks.CloseWithError(p2p.ErrClosed)
 	s.tells.CloseWithError(p2p.ErrClosed)
@@ -176,6 +253,10 @@ func (s *Swarm[A, Pub]) handleMessage(ctx context.Context, src, dst A, data []by
 	if err != nil {
 		return err
 	}
+	s.versions.observe(src.String(), hdr.GetVersion(), time.Now())
+	if hdr.IsAsk() && hdr.IsNack() {
+		return s.handleNack(ctx, src, hdr, body)
+	}
 	originTime := hdr.GetOriginTime().UTC(time.Now(), time.Millisecond)
 	partCount := hdr.GetPartCount()
 	totalSize := hdr.GetTotalSize()
@@ -184,15 +265,46 @@ func (s *Swarm[A, Pub]) handleMessage(ctx context.Context, src, dst A, data []by
 		return fmt.Errorf("total message size exceeds mtu %d", s.mtu)
 	}
 	gid := hdr.GroupID()
-	timeout := hdr.GetTimeout()
-	return s.fragLayer.handlePart(src, gid, partIndex, partCount, totalSize, body, func(buf []byte) error {
+	id := askID{GroupID: gid, Addr: src.String()}
+	version := hdr.GetVersion()
+	var nack func(have bitmap.BitMap)
+	switch {
+	case hdr.IsAsk() && hdr.IsReply():
+		ask := s.asker.getAsk(id)
+		if ask == nil {
+			// a part of a reply which was already received, or which is no longer wanted.
+			return nil
+		}
+		ask.setVersion(version)
+		if version < 1 {
+			break
+		}
+		nack = func(have bitmap.BitMap) {
+			if err := s.sendNack(s.ctx, src, gid, true, have); err != nil {
+				logctx.Debugln(s.ctx, "mbapp: sending nack", err)
+			}
+		}
+	case hdr.IsAsk():
+		if r := s.replies.get(id); r != nil {
+			return s.handleDuplicateRequest(ctx, src, gid, version, r)
+		}
+		if version < 1 {
+			break
+		}
+		nack = func(have bitmap.BitMap) {
+			if err := s.sendNack(s.ctx, src, gid, false, have); err != nil {
+				logctx.Debugln(s.ctx, "mbapp: sending nack", err)
+			}
+		}
+	}
+	return s.fragLayer.handlePart(src, gid, partIndex, partCount, totalSize, body, nack, func(buf []byte) error {
 		if hdr.IsAsk() {
-			ctx, cf := context.WithDeadline(ctx, originTime.Add(timeout))
-			defer cf()
 			if hdr.IsReply() {
-				return s.handleAskReply(ctx, src, dst, gid, hdr.GetErrorCode(), buf)
+				return s.handleAskReply(ctx, src, dst, gid, hdr.GetErrorCode(), hdr.GetServeTime(), buf)
 			} else {
-				return s.handleAskRequest(ctx, src, dst, gid, buf)
+				ctx, cf := context.WithDeadline(ctx, originTime.Add(hdr.GetTimeout()))
+				defer cf()
+				return s.handleAskRequest(ctx, src, dst, gid, version, int(partCount), buf)
 			}
 		} else {
 			return s.handleTell(ctx, src, dst, buf)
@@ -208,7 +320,18 @@ func (s *Swarm[A, Pub]) handleTell(ctx context.Context, src, dst A, body []byte)
 	})
 }
 
-func (s *Swarm[A, Pub]) handleAskRequest(ctx context.Context, src, dst A, id GroupID, body []byte) error {
+func (s *Swarm[A, Pub]) handleAskRequest(ctx context.Context, src, dst A, id GroupID, version uint8, reqParts int, body []byte) error {
+	rid := askID{GroupID: id, Addr: src.String()}
+	r, created := s.replies.getOrCreate(rid, reqParts)
+	if r == nil {
+		// the client will send the request again.
+		logctx.Debugln(ctx, "mbapp: reply cache is full, dropping request from", src)
+		return nil
+	}
+	if !created {
+		return s.handleDuplicateRequest(ctx, src, id, version, r)
+	}
+	startedAt := time.Now()
 	respBuf := make([]byte, s.mtu)
 	n, err := s.asks.Deliver(ctx, respBuf, p2p.Message[A]{
 		Src:     src,
@@ -216,20 +339,108 @@ func (s *Swarm[A, Pub]) handleAskRequest(ctx context.Context, src, dst A, id Gro
 		Payload: body,
 	})
 	if err != nil {
+		// the request can be served if it is sent again.
+		s.replies.remove(rid)
 		return err
 	}
 	errCode, bufLen := extractErrorCode(n)
-	return s.send(ctx, src, sendParams{
+	if bufLen > len(respBuf) {
+		bufLen = len(respBuf)
+	}
+	now := time.Now()
+	deadline, _ := ctx.Deadline()
+	// copy the body, so the cache does not keep the whole response buffer.
+	replyBody := append([]byte{}, respBuf[:bufLen]...)
+	s.replies.setReply(r, errCode, replyBody, now.Sub(startedAt), deadline, now)
+	return s.sendReply(ctx, src, id, r, nil)
+}
+
+// handleDuplicateRequest is called when part of a request is received, after the whole request was received.
+// If the reply is ready, the client did not receive it, and it is sent again.
+// Otherwise the client is told that the whole request was received, so it stops sending it,
+// if its protocol version understands NACKs.
+func (s *Swarm[A, Pub]) handleDuplicateRequest(ctx context.Context, src A, id GroupID, version uint8, r *reply) error {
+	if !r.isReady() {
+		if version < 1 {
+			return nil
+		}
+		return s.sendNack(ctx, src, id, false, bitmap.Full(r.reqParts))
+	}
+	// every part of a request which is sent again would otherwise cause the whole reply to be sent again.
+	if !r.shouldResend(minRTO, time.Now()) {
+		return nil
+	}
+	return s.sendReply(ctx, src, id, r, nil)
+}
+
+// sendReply sends the parts of a ready reply, or all the parts if parts is nil.
+func (s *Swarm[A, Pub]) sendReply(ctx context.Context, dst A, id GroupID, r *reply, parts []int) error {
+	return s.send(ctx, dst, sendParams{
 		isAsk:      true,
 		isReply:    true,
 		originTime: id.OriginTime,
 		counter:    id.Counter,
-		errCode:    errCode,
-		m:          p2p.IOVec{respBuf[:bufLen]},
+		errCode:    r.errCode,
+		serveTime:  r.serveTime,
+		m:          p2p.IOVec{r.body},
+		parts:      parts,
 	})
 }
 
-func (s *Swarm[A, Pub]) handleAskReply(ctx context.Context, src, dst A, id GroupID, errCode uint8, body []byte) error {
+// handleNack handles a report of the parts of a message which have been received.
+// NACKs for requests are handled by the client, and NACKs for replies are handled by the server.
+func (s *Swarm[A, Pub]) handleNack(ctx context.Context, src A, hdr Header, body []byte) error {
+	have, ok := bitmap.FromBytes(body, int(hdr.GetPartCount()))
+	if !ok {
+		return errors.Errorf("nack bitmap is wrong length")
+	}
+	id := askID{GroupID: hdr.GroupID(), Addr: src.String()}
+	if !hdr.IsReply() {
+		if ask := s.asker.getAsk(id); ask != nil {
+			ask.setVersion(hdr.GetVersion())
+			ask.nack(have)
+		}
+		return nil
+	}
+	r := s.replies.get(id)
+	switch {
+	case r == nil:
+		// the request has not been received, report the parts which have been.
+		have, _ := s.fragLayer.have(collectorID{Remote: id.Addr, GroupID: id.GroupID})
+		return s.sendNack(ctx, src, id.GroupID, false, have)
+	case !r.isReady():
+		return s.sendNack(ctx, src, id.GroupID, false, bitmap.Full(r.reqParts))
+	default:
+		var missing []int
+		if have.Len() == s.partCount(len(r.body)) {
+			if missing = have.Unset(); len(missing) == 0 {
+				return nil
+			}
+		}
+		return s.sendReply(ctx, src, id.GroupID, r, missing)
+	}
+}
+
+// sendNack tells dst which parts of a message have been received.
+// If the bitmap does not fit in the underlying swarm's MTU, nothing is sent, and dst will send the message again after a timeout.
+func (s *Swarm[A, Pub]) sendNack(ctx context.Context, dst A, id GroupID, isReply bool, have bitmap.BitMap) error {
+	if HeaderSize+bitmap.Size(have.Len()) > s.inner.MTU() {
+		return nil
+	}
+	hdrBuf := [HeaderSize]byte{}
+	hdr := Header(hdrBuf[:])
+	hdr.SetVersion(Version)
+	hdr.SetIsAsk(true)
+	hdr.SetIsReply(isReply)
+	hdr.SetIsNack(true)
+	hdr.SetCounter(id.Counter)
+	hdr.SetOriginTime(id.OriginTime)
+	hdr.SetPartCount(uint16(have.Len()))
+	hdr.SetTotalSize(uint32(bitmap.Size(have.Len())))
+	return s.inner.Tell(ctx, dst, p2p.IOVec{hdr, have.Bytes()})
+}
+
+func (s *Swarm[A, Pub]) handleAskReply(ctx context.Context, src, dst A, id GroupID, errCode uint8, serveTime time.Duration, body []byte) error {
 	ask := s.asker.getAndRemoveAsk(askID{
 		GroupID: id,
 		Addr:    src.String(),
@@ -237,7 +448,7 @@ func (s *Swarm[A, Pub]) handleAskReply(ctx context.Context, src, dst A, id Group
 	if ask == nil {
 		return errors.Errorf("got reply for non existent ask %v", id)
 	}
-	ask.complete(body, errCode)
+	ask.complete(body, errCode, serveTime)
 	return nil
 }
 
@@ -248,27 +459,32 @@ type sendParams struct {
 	counter    uint32
 	originTime PhaseTime32
 	timeout    uint32
+	// serveTime is sent instead of the timeout in replies.
+	serveTime time.Duration
 
 	m p2p.IOVec
+	// parts are the indexes of the parts to send, or nil to send all the parts.
+	parts []int
 }
 
 func (s *Swarm[A, Pub]) send(ctx context.Context, dst A, params sendParams) error {
 	hdrBuf := [HeaderSize]byte{}
 	hdr := Header(hdrBuf[:])
+	hdr.SetVersion(Version)
 	hdr.SetIsAsk(params.isAsk)
 	hdr.SetIsReply(params.isReply)
 	hdr.SetErrorCode(params.errCode)
 	hdr.SetCounter(params.counter)
 	hdr.SetOriginTime(params.originTime)
-	hdr.SetTimeout(params.timeout)
+	if params.isReply {
+		hdr.SetServeTime(params.serveTime)
+	} else {
+		hdr.SetTimeout(params.timeout)
+	}
 
-	mtu := s.inner.MTU()
-	partSize := (mtu - HeaderSize)
+	partSize := s.inner.MTU() - HeaderSize
 	totalSize := p2p.VecSize(params.m)
-	partCount := totalSize / partSize
-	if partSize*partCount < totalSize {
-		partCount++
-	}
+	partCount := s.partCount(totalSize)
 	hdr.SetPartIndex(uint16(0))
 	hdr.SetPartCount(uint16(partCount))
 	hdr.SetTotalSize(uint32(totalSize))
@@ -280,9 +496,16 @@ func (s *Swarm[A, Pub]) send(ctx context.Context, dst A, params sendParams) erro
 		return s.inner.Tell(ctx, dst, msg)
 	}
 
+	which := params.parts
+	if which == nil {
+		which = make([]int, partCount)
+		for i := range which {
+			which[i] = i
+		}
+	}
 	whole := p2p.VecBytes(nil, params.m)
 	eg := errgroup.Group{}
-	for i := 0; i < partCount; i++ {
+	for _, i := range which {
 		hdrBuf2 := hdrBuf
 		hdr := Header(hdrBuf2[:])
 		hdr.SetPartIndex(uint16(i))
@@ -300,6 +523,32 @@ func (s *Swarm[A, Pub]) send(ctx context.Context, dst A, params sendParams) erro
 	return eg.Wait()
 }
 
+// partCount returns the number of parts a message of size bytes is sent in.
+// Empty messages are sent in 1 part.
+func (s *Swarm[A, Pub]) partCount(size int) int {
+	partSize := s.inner.MTU() - HeaderSize
+	count := size / partSize
+	if partSize*count < size || count == 0 {
+		count++
+	}
+	return count
+}
+
+func (s *Swarm[A, Pub]) purgeLoop(ctx context.Context) {
+	ticker := time.NewTicker(purgePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.replies.purge(now)
+			s.rtts.purge(now)
+			s.versions.purge(now)
+		}
+	}
+}
+
 func (s *Swarm[A, Pub]) getCounter() uint32 {
 	return atomic.AddUint32(&s.counter, 1)
 }
@@ -317,12 +566,3 @@ func getTimeoutMillis(ctx context.Context) uint32 {
 	timeout := deadline.Sub(now)
 	return uint32(timeout.Milliseconds())
 }
-
-func extractErrorCode(n int) (uint8, int) {
-	if n >= 0 {
-		return 0, n
-	}
-	// TODO: allow setting of error codes
-	// for now error code is constant, and n is always 0
-	return 0xff, 0
-}
@@ -1,9 +1,20 @@
 package mbapp
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
+	"go.brendoncarroll.net/p2p/p2ptest"
 	"go.brendoncarroll.net/p2p/s/memswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
 )
@@ -31,3 +42,274 @@ func TestSwarm(t *testing.T) {
 		}
 	})
 }
+
+func TestErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewSecureRealm[struct{}](memswarm.WithMTU(1<<10), memswarm.WithQueueLen(100))
+	a := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	b := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		for {
+			if err := b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[memswarm.Addr]) int {
+				switch string(req.Payload) {
+				case "missing":
+					return ErrorReply(resp, CodeNotFound, []byte("no such thing"))
+				case "large":
+					return ErrorReply(resp, 200, make([]byte, 5000))
+				case "other":
+					return -1
+				default:
+					return copy(resp, "ok")
+				}
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	resp := make([]byte, a.MTU())
+	n, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{[]byte("present")})
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(resp[:n]))
+
+	for _, tc := range []struct {
+		req  string
+		code uint8
+		body []byte
+	}{
+		{"missing", CodeNotFound, []byte("no such thing")},
+		{"large", 200, make([]byte, 5000)},
+		{"other", CodeUnknown, []byte{}},
+	} {
+		_, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{[]byte(tc.req)})
+		var appErr AppError
+		require.True(t, errors.As(err, &appErr), "req=%s %v", tc.req, err)
+		require.Equal(t, tc.code, appErr.Code)
+		require.Equal(t, tc.body, appErr.Response)
+	}
+}
+
+func TestExtractErrorCode(t *testing.T) {
+	resp := make([]byte, 100)
+	for _, tc := range []struct {
+		n       int
+		code    uint8
+		bodyLen int
+	}{
+		{5, CodeOK, 5},
+		{-1, CodeUnknown, 0},
+		{-1000, CodeUnknown, 0},
+		{ErrorReply(resp, CodeOverloaded, nil), CodeOverloaded, 0},
+		{ErrorReply(resp, CodeUnauthorized, []byte("go away")), CodeUnauthorized, 7},
+		{ErrorReply(resp, 0xfe, make([]byte, 200)), 0xfe, 100},
+	} {
+		code, bodyLen := extractErrorCode(tc.n)
+		require.Equal(t, tc.code, code, "n=%d", tc.n)
+		require.Equal(t, tc.bodyLen, bodyLen, "n=%d", tc.n)
+	}
+}
+
+func TestLossyAsk(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cf()
+	r := memswarm.NewSecureRealm[struct{}](
+		memswarm.WithMTU(1<<10),
+		memswarm.WithQueueLen(1000),
+		memswarm.WithTellTransform(p2ptest.NewDropRandom(0.2, 0)),
+	)
+	a := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	b := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	defer a.Close()
+	defer b.Close()
+
+	var mu sync.Mutex
+	served := map[uint64]int{}
+	go func() {
+		for {
+			if err := b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[memswarm.Addr]) int {
+				mu.Lock()
+				served[binary.BigEndian.Uint64(req.Payload)]++
+				mu.Unlock()
+				return copy(resp, req.Payload)
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	const numAsks = 40
+	resp := make([]byte, a.MTU())
+	for i := 0; i < numAsks; i++ {
+		req := make([]byte, 8+[]int{0, 100, 5000, 20000}[i%4])
+		rand.Read(req)
+		binary.BigEndian.PutUint64(req, uint64(i))
+		start := time.Now()
+		n, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{req})
+		require.NoError(t, err)
+		require.Equal(t, req, resp[:n])
+		// without retransmission, a lost part would take until the ask timed out.
+		require.Less(t, time.Since(start), 5*time.Second)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, served, numAsks)
+	for i, count := range served {
+		require.Equal(t, 1, count, "request %d served more than once", i)
+	}
+}
+
+func TestNoResendToOldServer(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	var server memswarm.Addr
+	var requests atomic.Int32
+	r := memswarm.NewSecureRealm[struct{}](memswarm.WithTellTransform(func(m *memswarm.Message) bool {
+		hdr, _, err := ParseMessage(m.Payload)
+		switch {
+		case err != nil:
+		case m.Src == server:
+			// the server appears to be from before version 1, which had no reply cache.
+			hdr.SetVersion(0)
+		case hdr.IsAsk() && !hdr.IsReply():
+			requests.Add(1)
+		}
+		return true
+	}))
+	a := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	b := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	defer a.Close()
+	defer b.Close()
+	server = b.LocalAddrs()[0]
+	go b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[memswarm.Addr]) int {
+		time.Sleep(3 * initialRTO)
+		return copy(resp, req.Payload)
+	})
+
+	resp := make([]byte, a.MTU())
+	n, err := a.Ask(ctx, resp, server, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	require.Equal(t, initialRTO, e.rto())
+	e.observe(100 * time.Millisecond)
+	require.Equal(t, 300*time.Millisecond, e.rto())
+	// the variance decays when the samples are steady.
+	for i := 0; i < 100; i++ {
+		e.observe(100 * time.Millisecond)
+	}
+	require.GreaterOrEqual(t, e.rto(), 100*time.Millisecond)
+	require.Less(t, e.rto(), 110*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		e.observe(time.Millisecond)
+	}
+	require.Equal(t, minRTO, e.rto())
+	e.observe(time.Hour)
+	require.Equal(t, maxRTO, e.rto())
+}
+
+func TestNack(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	var server memswarm.Addr
+	var mu sync.Mutex
+	sent := map[uint16]int{}
+	// reported holds the parts of the reply which a NACK has reported missing.
+	reported := map[uint16]bool{}
+	r := memswarm.NewSecureRealm[struct{}](
+		memswarm.WithMTU(1<<10),
+		memswarm.WithTellTransform(func(m *memswarm.Message) bool {
+			hdr, body, err := ParseMessage(m.Payload)
+			if err != nil {
+				return true
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case hdr.IsNack() && hdr.IsReply():
+				have, _ := bitmap.FromBytes(body, int(hdr.GetPartCount()))
+				for _, i := range have.Unset() {
+					reported[uint16(i)] = true
+				}
+			case m.Src == server && hdr.IsReply():
+				i := hdr.GetPartIndex()
+				sent[i]++
+				// the first copy of parts 1 and 3 of the reply is lost.
+				return sent[i] > 1 || (i != 1 && i != 3)
+			}
+			return true
+		}),
+	)
+	a := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	b := New[memswarm.Addr, struct{}](r.NewSwarm(struct{}{}), 1<<16)
+	defer a.Close()
+	defer b.Close()
+	server = b.LocalAddrs()[0]
+	reply := make([]byte, 5000)
+	rand.Read(reply)
+	go b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[memswarm.Addr]) int {
+		return copy(resp, reply)
+	})
+
+	resp := make([]byte, a.MTU())
+	n, err := a.Ask(ctx, resp, server, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, reply, resp[:n])
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, sent, 5)
+	require.GreaterOrEqual(t, sent[1], 2)
+	require.GreaterOrEqual(t, sent[3], 2)
+	for i, count := range sent {
+		if count > 1 {
+			require.True(t, reported[i], "part %d was sent again, but not reported missing", i)
+		}
+	}
+}
+
+func TestHeaderVersion(t *testing.T) {
+	hdrBuf := [HeaderSize]byte{}
+	hdr := Header(hdrBuf[:])
+	require.Equal(t, uint8(0), hdr.GetVersion())
+	hdr.SetIsAsk(true)
+	hdr.SetIsNack(true)
+	hdr.SetErrorCode(0xFF)
+	hdr.SetVersion(Version)
+	require.Equal(t, uint8(Version), hdr.GetVersion())
+	require.True(t, hdr.IsAsk())
+	require.True(t, hdr.IsNack())
+	require.False(t, hdr.IsReply())
+	require.Equal(t, uint8(0xFF), hdr.GetErrorCode())
+}
+
+func TestReplyCacheLimits(t *testing.T) {
+	now := time.Now()
+	newID := func(i int) askID {
+		return askID{GroupID: GroupID{Counter: uint32(i)}, Addr: "a"}
+	}
+	rc := newReplyCache(2, 10)
+	r0, created := rc.getOrCreate(newID(0), 1)
+	require.True(t, created)
+	r1, _ := rc.getOrCreate(newID(1), 1)
+	// both entries are being served, so there is no room.
+	r2, _ := rc.getOrCreate(newID(2), 1)
+	require.Nil(t, r2)
+
+	rc.setReply(r0, 0, make([]byte, 4), 0, now.Add(time.Minute), now)
+	r2, created = rc.getOrCreate(newID(2), 1)
+	require.True(t, created)
+	require.Nil(t, rc.get(newID(0)))
+
+	// the byte limit evicts the reply which expires first.
+	rc.setReply(r1, 0, make([]byte, 6), 0, now.Add(time.Minute), now)
+	rc.setReply(r2, 0, make([]byte, 6), 0, now.Add(2*time.Minute), now)
+	require.Nil(t, rc.get(newID(1)))
+	require.NotNil(t, rc.get(newID(2)))
+	require.Equal(t, 6, rc.size)
+}
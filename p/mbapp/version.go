@@ -0,0 +1,49 @@
+package mbapp
+
+import (
+	"sync"
+	"time"
+)
+
+// versionTTL is how long the version of a peer is remembered after it last sent a message.
+const versionTTL = 10 * time.Minute
+
+// versionTable holds the protocol version of the last message received from each peer.
+type versionTable struct {
+	mu    sync.Mutex
+	peers map[string]peerVersion
+}
+
+type peerVersion struct {
+	version  uint8
+	lastSeen time.Time
+}
+
+func newVersionTable() *versionTable {
+	return &versionTable{peers: make(map[string]peerVersion)}
+}
+
+// observe records that the peer sent a message with protocol version v.
+func (t *versionTable) observe(peer string, v uint8, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[peer] = peerVersion{version: v, lastSeen: now}
+}
+
+// get returns the protocol version of the peer, or 0 if it has not sent a message.
+func (t *versionTable) get(peer string) uint8 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.peers[peer].version
+}
+
+// purge removes the peers which have not sent a message since versionTTL before now.
+func (t *versionTable) purge(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, pv := range t.peers {
+		if now.Sub(pv.lastSeen) > versionTTL {
+			delete(t.peers, k)
+		}
+	}
+}
@@ -41,6 +41,9 @@ type ChannelConfig struct {
 	// RejectAfterTime is the duration after session creation when the session will send and
 	// received messages.
 	RejectAfterTime time.Duration
+	// AppVersion is sent to the other party in every handshake, see Channel.RemoteAppVersion.
+	// Applications can use it to agree on a message format. It is optional.
+	AppVersion uint32
 }
 
 type Channel struct {
@@ -55,12 +58,15 @@ type Channel struct {
 	sessions        [3]sessionEntry
 	remoteKey       x509.PublicKey
 	remoteTimestamp tai64.TAI64N
+	// remoteAppVersion is the AppVersion of the session which last became ready, or delivered data.
+	remoteAppVersion uint32
 	// ready is closed, and reset whenever the current session changes.
 	ready chan struct{}
 	// lastReceived is the last time we received a message through the current session.
 	lastReceived time.Time
 	// lastSent is the las time we sent a message through any session.
 	lastSent time.Time
+	counters channelCounters
 
 	rekeyTimer     *Timer
 	handshakeTimer *Timer
@@ -115,10 +121,34 @@ func (c *Channel) Send(ctx context.Context, x p2p.IOVec) error {
 	}
 	return c.doThenSend(func() ([]byte, error) {
 		now := time.Now()
-		return s.Send(nil, p2p.VecBytes(nil, x), now)
+		out, err := s.Send(nil, p2p.VecBytes(nil, x), now)
+		if err != nil {
+			return nil, err
+		}
+		c.onSent(now, p2p.VecSize(x))
+		return out, nil
 	})
 }
 
+// Seal encrypts x using the current session and appends the resulting message to out.
+// Unlike Send, Seal does not call the SendFunc, the caller is responsible for transmitting the message.
+// Seal blocks until a Session has been established or the context is cancelled.
+func (c *Channel) Seal(ctx context.Context, out []byte, x p2p.IOVec) ([]byte, error) {
+	s, err := c.getOrInit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	out, err = s.Send(out, p2p.VecBytes(nil, x), now)
+	if err != nil {
+		return nil, err
+	}
+	c.onSent(now, p2p.VecSize(x))
+	return out, nil
+}
+
 // Deliver decrypts the payload in x if it contains application data, and appends it to out.
 // if err != nil, then an error occured.  The Channel is capable of recovering.
 // if out != nil, then it is application data.
@@ -141,18 +171,27 @@ func (c *Channel) Deliver(out, x []byte) ([]byte, error) {
 	now := time.Now()
 	var appData []byte
 	if err := c.doThenSend(func() ([]byte, error) {
+		var replayed, decryptFailed bool
 		for i, se := range c.sessions {
 			s := se.Session
 			if s == nil {
 				continue
 			}
 			readyBefore := s.IsReady()
-			isApp, out, err := s.Deliver(out, x, now)
+			isApp, out, err := s.deliver(out, x, now)
 			if err != nil {
+				switch err.(type) {
+				case errReplayedNonce:
+					replayed = true
+				case ErrDecryptionFailure:
+					decryptFailed = true
+				}
 				continue
 			}
 			if isApp {
 				appData = out
+				c.remoteAppVersion = s.RemoteAppVersion()
+				c.onReceived(now, len(out))
 				return nil, nil
 			}
 			// if the session became ready, then make it the current and notify.
@@ -171,6 +210,11 @@ func (c *Channel) Deliver(out, x []byte) ([]byte, error) {
 		}
 		// The message did not match a session so now check if we can create a new session.
 		if !IsInitHello(x) {
+			if replayed {
+				c.counters.replayRejected++
+			} else if decryptFailed {
+				c.counters.decryptionFailures++
+			}
 			return nil, errors.New("message did not match a session")
 		}
 		sid := blake2b.Sum256(x)
@@ -233,6 +277,15 @@ func (c *Channel) LastSent() time.Time {
 	return c.lastSent
 }
 
+// RemoteAppVersion returns the AppVersion sent by the other party.
+// It is 0 until a session has been established, and for parties which do not send an AppVersion,
+// including versions of p2pke from before it was added.
+func (c *Channel) RemoteAppVersion() uint32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.remoteAppVersion
+}
+
 // WaitReady blocks until a session has been established.
 // It will initiate a session if none exists.
 // After WaitReady returns: RemoteKey() != nil
@@ -250,6 +303,7 @@ func (c *Channel) newInit(now time.Time) ([32]byte, *Session) {
 		Logger:      c.params.Logger,
 		Now:         now,
 		RejectAfter: c.params.RejectAfterTime,
+		AppVersion:  c.params.AppVersion,
 	})
 	out := s.Handshake(nil)
 	id := blake2b.Sum256(out)
@@ -289,6 +343,7 @@ func (c *Channel) newResp(m0 []byte, minTime tai64.TAI64N) (*Session, error) {
 		Logger:      c.log,
 		Now:         now,
 		RejectAfter: c.params.RejectAfterTime,
+		AppVersion:  c.params.AppVersion,
 	})
 	_, _, err = s.Deliver(nil, m0, now)
 	if err != nil {
@@ -329,7 +384,11 @@ func (c *Channel) onReadySession(now time.Time) error {
 		c.setNext(sessionEntry{})
 		return errors.New("session negotiated with wrong peer")
 	}
+	if !c.remoteKey.IsZero() {
+		c.counters.rekeys++
+	}
 	c.remoteKey = se.Session.RemoteKey()
+	c.remoteAppVersion = se.Session.RemoteAppVersion()
 	c.lastReceived = now
 	c.remoteTimestamp = se.Session.InitHelloTime()
 	c.setCurrent(se)
@@ -442,11 +501,15 @@ func (c *Channel) onHandshake() {
 	func() {
 		c.mu.Lock()
 		defer c.mu.Unlock()
-		for _, se := range c.sessions {
+		for i, se := range c.sessions {
 			if se.Session != nil && !se.Session.IsReady() {
 				out := se.Session.Handshake(nil)
 				if len(out) > 0 {
 					toSend = append(toSend, out)
+					if se.handshakesSent > 0 {
+						c.counters.handshakeRetries++
+					}
+					c.sessions[i].handshakesSent++
 				}
 			}
 		}
@@ -481,7 +544,25 @@ func (c *Channel) isFatal(err error) bool {
 	return false
 }
 
+// onSent is called with the mutex held, after application data has been encrypted.
+// lastSent is not changed, the stats are kept separately.
+func (c *Channel) onSent(now time.Time, n int) {
+	c.counters.lastSent = now
+	c.counters.messagesSent++
+	c.counters.bytesSent += uint64(n)
+}
+
+// onReceived is called with the mutex held, after application data has been decrypted.
+// lastReceived is not changed, it decides when to rekey.
+func (c *Channel) onReceived(now time.Time, n int) {
+	c.counters.lastReceived = now
+	c.counters.messagesReceived++
+	c.counters.bytesReceived += uint64(n)
+}
+
 type sessionEntry struct {
 	ID      [32]byte
 	Session *Session
+	// handshakesSent is the number of handshake messages sent by the handshake timer for this session.
+	handshakesSent int
 }
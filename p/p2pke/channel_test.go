@@ -3,6 +3,7 @@ package p2pke
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
@@ -50,6 +51,25 @@ func TestChannelBidi(t *testing.T) {
 	require.NoError(t, eg.Wait())
 }
 
+func TestChannelAppVersion(t *testing.T) {
+	ctx := context.Background()
+	c1, c2 := newChannelPair(t, func([]byte) {}, func([]byte) {})
+	// c2 is a party which does not send an AppVersion.
+	c1.params.AppVersion = 2
+	require.Equal(t, uint32(0), c1.RemoteAppVersion())
+	require.NoError(t, c1.Send(ctx, p2p.IOVec{[]byte("test data")}))
+	require.Equal(t, uint32(0), c1.RemoteAppVersion())
+	require.Equal(t, uint32(2), c2.RemoteAppVersion())
+
+	// the version is exchanged again when the channel rekeys.
+	c2.params.AppVersion = 3
+	c2.onRekey()
+	require.Eventually(t, func() bool {
+		return c1.RemoteAppVersion() == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, uint32(2), c2.RemoteAppVersion())
+}
+
 func newChannelPair(t testing.TB, fn1, fn2 func([]byte)) (c1, c2 *Channel) {
 	reg := x509.DefaultRegistry()
 	c1 = NewChannel(ChannelConfig{
@@ -86,3 +106,51 @@ func newChannelPair(t testing.TB, fn1, fn2 func([]byte)) (c1, c2 *Channel) {
 	})
 	return c1, c2
 }
+
+func TestChannelStats(t *testing.T) {
+	ctx := context.Background()
+	var c2Out []string
+	c1, c2 := newChannelPair(t, func(x []byte) {}, func(x []byte) {
+		c2Out = append(c2Out, string(x))
+	})
+	testData := "test data"
+	require.NoError(t, c1.WaitReady(ctx))
+	lastReceived := c2.LastReceived()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c1.Send(ctx, p2p.IOVec{[]byte(testData)}))
+	}
+	require.Len(t, c2Out, 3)
+
+	// deliver a message from c1 to c2 twice
+	lastMsg, err := c1.Seal(ctx, nil, p2p.IOVec{[]byte(testData)})
+	require.NoError(t, err)
+	out, err := c2.Deliver(nil, lastMsg)
+	require.NoError(t, err)
+	require.NotNil(t, out)
+	out, err = c2.Deliver(nil, lastMsg)
+	require.NoError(t, err)
+	require.Nil(t, out)
+	// corrupt a message
+	lastMsg[len(lastMsg)-1] ^= 1
+	out, err = c2.Deliver(nil, lastMsg)
+	require.NoError(t, err)
+	require.Nil(t, out)
+
+	s1, s2 := c1.Stats(), c2.Stats()
+	require.Equal(t, uint64(4), s1.MessagesSent)
+	require.Equal(t, uint64(4*len(testData)), s1.BytesSent)
+	require.Equal(t, uint64(4), s2.MessagesReceived)
+	require.Equal(t, uint64(4*len(testData)), s2.BytesReceived)
+	require.Equal(t, uint64(1), s2.ReplayRejected)
+	require.Equal(t, uint64(1), s2.DecryptionFailures)
+	require.NotNil(t, s1.Current)
+	require.True(t, s1.Current.Ready)
+	require.True(t, s1.Current.IsInit)
+	require.Equal(t, uint64(4), s1.Current.NoncesUsed)
+	require.Nil(t, s1.Next)
+	require.Equal(t, c2.LocalKey(), s1.RemoteKey)
+	require.False(t, s1.LastSent.IsZero())
+	require.False(t, s2.LastReceived.IsZero())
+	// application data does not change the time used to decide when to rekey.
+	require.Equal(t, lastReceived, c2.LastReceived())
+}
@@ -24,6 +24,17 @@ func (e ErrDecryptionFailure) Error() string {
 	return fmt.Sprintf("p2pke: decryption failure: nonce=%d noise=%v", e.Nonce, e.NoiseErr)
 }
 
+// errReplayedNonce is used within the package when a message decrypts successfully,
+// but its nonce has already been seen, or is too old to be checked.
+// Session.Deliver does not return it, replayed messages are ignored.
+type errReplayedNonce struct {
+	Nonce uint32
+}
+
+func (e errReplayedNonce) Error() string {
+	return fmt.Sprintf("p2pke: replayed nonce: nonce=%d", e.Nonce)
+}
+
 // ErrEarlyData is returned by the session when application data arrives early.
 // There is no way to verify this data without a
 type ErrEarlyData struct {
@@ -22,6 +22,7 @@ type Session struct {
 	privateKey privateKey
 	isInit     bool
 	log        *zap.Logger
+	createdAt  time.Time
 	expiresAt  time.Time
 
 	// handshake
@@ -30,6 +31,9 @@ type Session struct {
 	hs            *noise.HandshakeState
 	initHelloTime tai64.TAI64N
 	remoteKey     publicKey
+	appVersion    uint32
+	// remoteAppVersion is the AppVersion sent by the other party, 0 if it did not send one.
+	remoteAppVersion uint32
 
 	// ciphers
 	cipherOut, cipherIn noise.Cipher
@@ -45,6 +49,8 @@ type SessionConfig struct {
 	Now         time.Time
 	RejectAfter time.Duration
 	Logger      *zap.Logger
+	// AppVersion is sent to the other party during the handshake. It is optional.
+	AppVersion uint32
 }
 
 func NewSession(params SessionConfig) *Session {
@@ -64,13 +70,16 @@ func NewSession(params SessionConfig) *Session {
 		},
 		isInit:    params.IsInit,
 		log:       params.Logger,
+		createdAt: params.Now,
 		expiresAt: params.Now.Add(params.RejectAfter),
 		hs:        hs,
 		rp:        &replay.Filter{},
+
+		appVersion: params.AppVersion,
 	}
 	if s.isInit {
 		s.initHelloTime = tai64.FromGoTime(params.Now)
-		s.msgCache[0] = writeInitHello(nil, s.hs, &s.privateKey, s.initHelloTime)
+		s.msgCache[0] = writeInitHello(nil, s.hs, &s.privateKey, s.initHelloTime, s.appVersion)
 	}
 	return s
 }
@@ -97,6 +106,15 @@ func (s *Session) Handshake(out []byte) []byte {
 //
 // }
 func (s *Session) Deliver(out []byte, incoming []byte, now time.Time) (bool, []byte, error) {
+	isApp, out, err := s.deliver(out, incoming, now)
+	if _, ok := err.(errReplayedNonce); ok {
+		return false, nil, nil
+	}
+	return isApp, out, err
+}
+
+// deliver is Deliver, except that replayed messages return errReplayedNonce, so that the Channel can count them.
+func (s *Session) deliver(out []byte, incoming []byte, now time.Time) (bool, []byte, error) {
 	if err := s.checkExpired(now); err != nil {
 		return false, nil, err
 	}
@@ -120,7 +138,7 @@ func (s *Session) Deliver(out []byte, incoming []byte, now time.Time) (bool, []b
 			return false, nil, ErrDecryptionFailure{Nonce: nonce, NoiseErr: err}
 		}
 		if !s.rp.ValidateCounter(uint64(nonce), MaxNonce) {
-			return false, nil, nil
+			return false, nil, errReplayedNonce{Nonce: nonce}
 		}
 		s.hsIndex = 8 // successfully received a packet
 		return true, out, nil
@@ -159,6 +177,10 @@ func (s *Session) RemoteKey() x509.PublicKey {
 	return s.remoteKey.Key
 }
 
+func (s *Session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
 func (s *Session) ExpiresAt() time.Time {
 	return s.expiresAt
 }
@@ -167,6 +189,12 @@ func (s *Session) IsInit() bool {
 	return s.isInit
 }
 
+// RemoteAppVersion returns the AppVersion sent by the other party during the handshake.
+// It is 0 if the other party did not send one, or the handshake has not reached that point.
+func (s *Session) RemoteAppVersion() uint32 {
+	return s.remoteAppVersion
+}
+
 func (s *Session) InitHelloTime() tai64.TAI64N {
 	return s.initHelloTime
 }
@@ -231,11 +259,12 @@ func (s *Session) readHandshake(msg Message) error {
 	nonce := msg.GetNonce()
 	switch {
 	case !s.isInit && s.hsIndex == 0 && nonce == nonceInitHello:
-		res, err := readInitHello(s.registry, s.hs, &s.privateKey, msg)
+		res, err := readInitHello(s.registry, s.hs, &s.privateKey, s.appVersion, msg)
 		if err != nil {
 			return err
 		}
 		s.remoteKey = res.RemoteKey
+		s.remoteAppVersion = res.AppVersion
 		s.initHelloTime = res.Timestamp
 		s.msgCache[1] = res.RespHello
 		s.cipherOut, s.cipherIn = res.CipherOut, res.CipherIn
@@ -249,6 +278,7 @@ func (s *Session) readHandshake(msg Message) error {
 		s.msgCache[2] = res.InitDone
 		s.cipherOut, s.cipherIn = res.CipherOut, res.CipherIn
 		s.remoteKey = res.RemoteKey
+		s.remoteAppVersion = res.AppVersion
 		s.hsIndex = 2 // the initiator doesn't know if the server got the initDone yet.
 	case !s.isInit && s.hsIndex == 1 && nonce == nonceInitDone:
 		res, err := readInitDone(s.hs, &s.remoteKey, s.cipherIn, s.cipherOut, msg)
@@ -273,7 +303,7 @@ func (s *Session) readHandshake(msg Message) error {
 }
 
 // writeInit writes an InitHello message to out using hs, and initHelloTime
-func writeInitHello(out []byte, hs *noise.HandshakeState, privateKey *privateKey, initHelloTime tai64.TAI64N) []byte {
+func writeInitHello(out []byte, hs *noise.HandshakeState, privateKey *privateKey, initHelloTime tai64.TAI64N, appVersion uint32) []byte {
 	msg := newMessage(0)
 	tsBytes := initHelloTime.Marshal()
 	var err error
@@ -283,6 +313,7 @@ func writeInitHello(out []byte, hs *noise.HandshakeState, privateKey *privateKey
 		TimestampTai64N: tsBytes[:],
 		KeyX509:         keyX509,
 		Sig:             sig,
+		AppVersion:      appVersion,
 	})
 	initHelloData = appendUint16(initHelloData, uint16(len(initHelloData)))
 	msg, _, _, err = hs.WriteMessage(msg, initHelloData)
@@ -296,11 +327,12 @@ type initHelloResult struct {
 	CipherOut, CipherIn noise.Cipher
 	Timestamp           tai64.TAI64N
 	RemoteKey           publicKey
+	AppVersion          uint32
 	RespHello           []byte
 }
 
 // readInitHello
-func readInitHello(reg x509.Registry, hs *noise.HandshakeState, privateKey *privateKey, msg Message) (*initHelloResult, error) {
+func readInitHello(reg x509.Registry, hs *noise.HandshakeState, privateKey *privateKey, appVersion uint32, msg Message) (*initHelloResult, error) {
 	payload, _, _, err := hs.ReadMessage(nil, msg.Body())
 	if err != nil {
 		return nil, err
@@ -322,19 +354,21 @@ func readInitHello(reg x509.Registry, hs *noise.HandshakeState, privateKey *priv
 	cb := hs.ChannelBinding()
 	keyX509, sig := makeChannelAuthClaim(privateKey, cb)
 	msg2, cs1, cs2, err := hs.WriteMessage(msg2, marshal(nil, &RespHello{
-		KeyX509: keyX509,
-		Sig:     sig,
+		KeyX509:    keyX509,
+		Sig:        sig,
+		AppVersion: appVersion,
 	}))
 	if err != nil {
 		panic(err)
 	}
 	cipherOut, cipherIn := pickCS(false, cs1, cs2)
 	return &initHelloResult{
-		CipherOut: cipherOut,
-		CipherIn:  cipherIn,
-		Timestamp: timestamp,
-		RemoteKey: pubKey,
-		RespHello: msg2,
+		CipherOut:  cipherOut,
+		CipherIn:   cipherIn,
+		Timestamp:  timestamp,
+		RemoteKey:  pubKey,
+		AppVersion: hello.AppVersion,
+		RespHello:  msg2,
 	}, nil
 }
 
@@ -342,6 +376,7 @@ func readInitHello(reg x509.Registry, hs *noise.HandshakeState, privateKey *priv
 type respHelloResult struct {
 	CipherOut, CipherIn noise.Cipher
 	RemoteKey           publicKey
+	AppVersion          uint32
 	InitDone            []byte
 }
 
@@ -372,10 +407,11 @@ func readRespHello(reg x509.Registry, hs *noise.HandshakeState, privateKey *priv
 		panic(err)
 	}
 	return &respHelloResult{
-		CipherIn:  cipherIn,
-		CipherOut: cipherOut,
-		RemoteKey: pubKey,
-		InitDone:  msg2,
+		CipherIn:   cipherIn,
+		CipherOut:  cipherOut,
+		RemoteKey:  pubKey,
+		AppVersion: respHello.AppVersion,
+		InitDone:   msg2,
 	}, nil
 }
 
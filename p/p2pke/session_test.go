@@ -72,6 +72,32 @@ func TestHandshakeRepeats(t *testing.T) {
 	require.Equal(t, s2.LocalKey(), s1.RemoteKey())
 }
 
+func TestSessionReplay(t *testing.T) {
+	s1, s2 := newTestPair(t)
+	m := s1.Handshake(nil)
+	for i := 0; len(m) > 0; i++ {
+		dst := s2
+		if i%2 == 1 {
+			dst = s1
+		}
+		var err error
+		_, m, err = dst.Deliver(nil, m, time.Now())
+		require.NoError(t, err)
+	}
+	msg, err := s1.Send(nil, []byte("hello"), time.Now())
+	require.NoError(t, err)
+	isApp, out, err := s2.Deliver(nil, msg, time.Now())
+	require.NoError(t, err)
+	require.True(t, isApp)
+	require.Equal(t, "hello", string(out))
+
+	// a replayed message is ignored.
+	isApp, out, err = s2.Deliver(nil, msg, time.Now())
+	require.NoError(t, err)
+	require.False(t, isApp)
+	require.Nil(t, out)
+}
+
 func logMsg(t *testing.T, direction Direction, data []byte) {
 	t.Logf("%v: %q", direction, data)
 }
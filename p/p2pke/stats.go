@@ -0,0 +1,122 @@
+package p2pke
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+// SessionStats is a snapshot of the state of a Session.
+type SessionStats struct {
+	IsInit bool
+	// HandshakeState is the position of the session in the handshake state machine.
+	// See the README for the meaning of each state.
+	HandshakeState uint8
+	// Ready is true if the session can send and receive application data.
+	Ready bool
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// Age is the amount of time since the session was created.
+	Age time.Duration
+	// NoncesUsed is the number of nonces which have been used to send application data.
+	// A session cannot be used after MaxNonce - noncePostHandshake messages.
+	NoncesUsed uint64
+}
+
+// Stats returns a snapshot of the session's state at time now.
+func (s *Session) Stats(now time.Time) SessionStats {
+	var used uint64
+	if nonce := atomic.LoadUint64(&s.nonce); nonce > noncePostHandshake {
+		used = nonce - noncePostHandshake
+	}
+	return SessionStats{
+		IsInit:         s.isInit,
+		HandshakeState: s.hsIndex,
+		Ready:          s.IsReady(),
+		CreatedAt:      s.createdAt,
+		ExpiresAt:      s.expiresAt,
+		Age:            now.Sub(s.createdAt),
+		NoncesUsed:     used,
+	}
+}
+
+// ChannelStats is a snapshot of the state of a Channel.
+type ChannelStats struct {
+	// RemoteKey is zero if there has been no successful handshake.
+	RemoteKey x509.PublicKey
+	// Previous, Current, and Next are the sessions held by the channel.
+	// They are nil if the channel does not have a session in that position.
+	Previous, Current, Next *SessionStats
+
+	// LastSent and LastReceived are the last times application data was sent or received.
+	// They are unlike Channel.LastSent and Channel.LastReceived, which are used to decide when to rekey.
+	LastSent     time.Time
+	LastReceived time.Time
+
+	// Rekeys is the number of times a new session has replaced an established session.
+	Rekeys uint64
+	// HandshakeRetries is the number of handshake messages which have been resent
+	// because the other party did not respond.
+	HandshakeRetries uint64
+	// ReplayRejected is the number of messages dropped by a replay filter.
+	ReplayRejected uint64
+	// DecryptionFailures is the number of data messages which did not decrypt under any session.
+	DecryptionFailures uint64
+
+	MessagesSent     uint64
+	MessagesReceived uint64
+	// BytesSent and BytesReceived count application data, not including protocol overhead.
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// Stats returns a snapshot of the channel's state.
+func (c *Channel) Stats() ChannelStats {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var sessStats [3]*SessionStats
+	for i, se := range c.sessions {
+		if se.Session != nil {
+			ss := se.Session.Stats(now)
+			sessStats[i] = &ss
+		}
+	}
+	return ChannelStats{
+		RemoteKey: c.remoteKey,
+		Previous:  sessStats[0],
+		Current:   sessStats[1],
+		Next:      sessStats[2],
+
+		LastSent:     c.counters.lastSent,
+		LastReceived: c.counters.lastReceived,
+
+		Rekeys:             c.counters.rekeys,
+		HandshakeRetries:   c.counters.handshakeRetries,
+		ReplayRejected:     c.counters.replayRejected,
+		DecryptionFailures: c.counters.decryptionFailures,
+
+		MessagesSent:     c.counters.messagesSent,
+		MessagesReceived: c.counters.messagesReceived,
+		BytesSent:        c.counters.bytesSent,
+		BytesReceived:    c.counters.bytesReceived,
+	}
+}
+
+// channelCounters are protected by the Channel's mutex.
+type channelCounters struct {
+	lastSent     time.Time
+	lastReceived time.Time
+
+	rekeys             uint64
+	handshakeRetries   uint64
+	replayRejected     uint64
+	decryptionFailures uint64
+
+	messagesSent     uint64
+	messagesReceived uint64
+	bytesSent        uint64
+	bytesReceived    uint64
+}
@@ -1,6 +1,7 @@
 package p2ptest
 
 import (
+	"math/rand"
 	"sync"
 
 	"go.brendoncarroll.net/p2p/s/memswarm"
@@ -52,6 +53,18 @@ func NewDropFirstTuple() func(*memswarm.Message) bool {
 	}
 }
 
+// NewDropRandom returns a Message transformer which drops messages with probability p.
+// The random source is seeded with seed, so the same messages are dropped each run.
+func NewDropRandom(p float64, seed int64) func(*memswarm.Message) bool {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+	return func(*memswarm.Message) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rng.Float64() >= p
+	}
+}
+
 func min(a, b memswarm.Addr) memswarm.Addr {
 	if a.N < b.N {
 		return a
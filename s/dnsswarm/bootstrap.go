@@ -0,0 +1,126 @@
+package dnsswarm
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// TXTPrefix is the prefix of TXT records which contain peer addresses.
+// It is the same as the prefix used for multiaddrs in the libp2p dnsaddr convention.
+const TXTPrefix = "dnsaddr="
+
+// LookupSRV returns the SRV records for the service, in the order they should be tried.
+// Records are ordered by priority, and records with the same priority are shuffled according to their weights, as in RFC 2782.
+func LookupSRV(ctx context.Context, r Resolver, service, proto, name string) ([]SRVTarget, error) {
+	srvs, _, err := r.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+	var ret []SRVTarget
+	for i := 0; i < len(srvs); {
+		j := i
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j])
+		for _, srv := range srvs[i:j] {
+			// a target of "." means the service is not available.
+			if srv.Target == "." {
+				continue
+			}
+			ret = append(ret, SRVTarget{Host: canonicalName(srv.Target), Port: srv.Port})
+		}
+		i = j
+	}
+	return ret, nil
+}
+
+// SRVTarget is a host and port from an SRV record.
+type SRVTarget struct {
+	Host string
+	Port uint16
+}
+
+// BootstrapSRV returns an address for each target of the SRV records for the service, in the order they should be tried.
+// mk creates the address for a target. It will usually return a HostAddr, which is resolved when it is used.
+func BootstrapSRV[H p2p.Addr](ctx context.Context, r Resolver, service, proto, name string, mk func(SRVTarget) (H, error)) ([]H, error) {
+	targets, err := LookupSRV(ctx, r, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]H, 0, len(targets))
+	for _, target := range targets {
+		addr, err := mk(target)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, addr)
+	}
+	return ret, nil
+}
+
+// BootstrapTXT returns the addresses in the TXT records for name.
+// Records without TXTPrefix are ignored.
+// The rest of the record is parsed with parser, which could be a multiswarm.AddrSchema's ParseAddr to parse multiaddrs.
+// Records which cannot be parsed are skipped, but it is an error if none of the records can be parsed.
+func BootstrapTXT[A p2p.Addr](ctx context.Context, r Resolver, name string, parser p2p.AddrParser[A]) ([]A, error) {
+	txts, _, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var ret []A
+	var firstErr error
+	for _, txt := range txts {
+		data, ok := strings.CutPrefix(txt, TXTPrefix)
+		if !ok {
+			continue
+		}
+		addr, err := parser([]byte(data))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ret = append(ret, addr)
+	}
+	if len(ret) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("dnsswarm: no addresses in TXT records for %s", name)
+	}
+	return ret, nil
+}
+
+// shuffleByWeight orders srvs randomly, with records with larger weights more likely to be first.
+func shuffleByWeight(srvs []*net.SRV) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(srvs) > 1 {
+		s := 0
+		n := rand.Intn(sum)
+		for i := range srvs {
+			s += int(srvs[i].Weight)
+			if s > n {
+				if i > 0 {
+					srvs[0], srvs[i] = srvs[i], srvs[0]
+				}
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
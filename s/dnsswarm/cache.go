@@ -0,0 +1,164 @@
+package dnsswarm
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultNegativeTTL is how long a Cache remembers failed lookups.
+	DefaultNegativeTTL = 5 * time.Second
+	// DefaultMaxTTL limits how long a Cache remembers successful lookups.
+	DefaultMaxTTL = time.Hour
+)
+
+// CacheOption configures a Cache
+type CacheOption func(c *Cache)
+
+// WithNegativeTTL sets how long failed lookups are remembered.
+func WithNegativeTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithMaxTTL limits how long successful lookups are remembered, regardless of their TTL.
+func WithMaxTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.maxTTL = ttl
+	}
+}
+
+var _ Resolver = &Cache{}
+
+// Cache is a Resolver which remembers the results of another Resolver, until their TTL expires.
+// Concurrent lookups of the same name share a single lookup.
+type Cache struct {
+	inner       Resolver
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	now         func() time.Time
+
+	sf        singleflight.Group
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	nextSweep time.Time
+}
+
+type cacheEntry struct {
+	value   any
+	err     error
+	expires time.Time
+}
+
+// NewCache returns a Cache which remembers the results of inner.
+func NewCache(inner Resolver, opts ...CacheOption) *Cache {
+	c := &Cache{
+		inner:       inner,
+		negativeTTL: DefaultNegativeTTL,
+		maxTTL:      DefaultMaxTTL,
+		now:         time.Now,
+
+		entries: map[string]cacheEntry{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Cache) LookupIP(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	return cacheLookup(ctx, c, "ip/"+canonicalName(host), func(ctx context.Context) ([]netip.Addr, time.Duration, error) {
+		return c.inner.LookupIP(ctx, host)
+	})
+}
+
+func (c *Cache) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	return cacheLookup(ctx, c, "srv/"+canonicalName(srvName(service, proto, name)), func(ctx context.Context) ([]*net.SRV, time.Duration, error) {
+		return c.inner.LookupSRV(ctx, service, proto, name)
+	})
+}
+
+func (c *Cache) LookupTXT(ctx context.Context, name string) ([]string, time.Duration, error) {
+	return cacheLookup(ctx, c, "txt/"+canonicalName(name), func(ctx context.Context) ([]string, time.Duration, error) {
+		return c.inner.LookupTXT(ctx, name)
+	})
+}
+
+// Flush forgets all the results.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]cacheEntry{}
+}
+
+// cacheLookup returns the entry for key if it has not expired, otherwise it calls fn and stores the result.
+// The returned TTL is the time remaining until the entry expires.
+func cacheLookup[T any](ctx context.Context, c *Cache, key string, fn func(context.Context) ([]T, time.Duration, error)) ([]T, time.Duration, error) {
+	if ent, ok := c.get(key); ok {
+		return entryResult[T](ent, c.now())
+	}
+	// the lookup is shared with other callers, so it must not be cancelled by this caller's ctx.
+	ch := c.sf.DoChan(key, func() (any, error) {
+		values, ttl, err := fn(context.WithoutCancel(ctx))
+		if err != nil {
+			ttl = c.negativeTTL
+		}
+		if ttl > c.maxTTL {
+			ttl = c.maxTTL
+		}
+		ent := cacheEntry{value: values, err: err, expires: c.now().Add(ttl)}
+		if ttl > 0 {
+			c.put(key, ent)
+		}
+		return ent, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, 0, res.Err
+		}
+		return entryResult[T](res.Val.(cacheEntry), c.now())
+	}
+}
+
+func entryResult[T any](ent cacheEntry, now time.Time) ([]T, time.Duration, error) {
+	if ent.err != nil {
+		return nil, 0, ent.err
+	}
+	values := ent.value.([]T)
+	return append([]T{}, values...), ent.expires.Sub(now), nil
+}
+
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, exists := c.entries[key]
+	if !exists || !c.now().Before(ent.expires) {
+		return cacheEntry{}, false
+	}
+	return ent, true
+}
+
+func (c *Cache) put(key string, ent cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = ent
+	// expired entries are removed at most once per negativeTTL, so the cache does not grow forever.
+	now := c.now()
+	if now.After(c.nextSweep) {
+		for k, ent := range c.entries {
+			if !now.Before(ent.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextSweep = now.Add(c.negativeTTL)
+	}
+}
@@ -0,0 +1,183 @@
+// package dnsswarm allows swarms to send to addresses with host names.
+//
+// The host names are resolved when they are sent to, rather than when they are parsed,
+// and the results are cached until their TTL expires.
+// Swarms created by this package can be used by swarms which wrap another swarm,
+// for example a quicswarm on a dnsswarm on a udpswarm has quicswarm.Addr[udpswarm.HostAddr] addresses.
+package dnsswarm
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// HostAddr is an address containing a host name.
+// The host name is resolved to IP addresses, which are used to create addresses of type A.
+type HostAddr[A p2p.Addr] interface {
+	p2p.Addr
+	// GetHost returns the host name, or IP address.
+	GetHost() string
+	// WithIP returns the address for the host at ip.
+	WithIP(ip netip.Addr) A
+}
+
+// Resolve returns the addresses of x's host.
+// If the host is an IP address, it is not looked up.
+func Resolve[A p2p.Addr, H HostAddr[A]](ctx context.Context, r Resolver, x H) ([]A, error) {
+	host := x.GetHost()
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []A{x.WithIP(ip.Unmap())}, nil
+	}
+	ips, _, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("dnsswarm: no ips for %s", host)
+	}
+	ret := make([]A, len(ips))
+	for i, ip := range ips {
+		ret[i] = x.WithIP(ip.Unmap())
+	}
+	return ret, nil
+}
+
+// DefaultResolver returns a Cache of a NetResolver, which uses the system's resolver.
+func DefaultResolver() *Cache {
+	return NewCache(NewNetResolver(nil, DefaultTTL))
+}
+
+// New creates a swarm with HostAddrs, which resolves them and sends to x.
+// upward converts the addresses of x, which are used as message sources and local addresses.
+// If r is nil, DefaultResolver is used.
+// r is used for every Tell, so it should cache results, as a Cache does.
+func New[A p2p.Addr, H HostAddr[A]](x p2p.Swarm[A], r Resolver, upward func(A) H, parser p2p.AddrParser[H]) p2p.Swarm[H] {
+	return newSwarm(x, r, upward, parser)
+}
+
+func NewAsk[A p2p.Addr, H HostAddr[A]](x p2p.AskSwarm[A], r Resolver, upward func(A) H, parser p2p.AddrParser[H]) p2p.AskSwarm[H] {
+	s := newSwarm[A, H](x, r, upward, parser)
+	return p2p.ComposeAskSwarm[H](s, asker[A, H]{swarm: s, inner: x})
+}
+
+func NewSecure[A p2p.Addr, H HostAddr[A], Pub any](x p2p.SecureSwarm[A, Pub], r Resolver, upward func(A) H, parser p2p.AddrParser[H]) p2p.SecureSwarm[H, Pub] {
+	s := newSwarm[A, H](x, r, upward, parser)
+	return p2p.ComposeSecureSwarm[H, Pub](s, secure[A, H, Pub]{swarm: s, inner: x})
+}
+
+func NewSecureAsk[A p2p.Addr, H HostAddr[A], Pub any](x p2p.SecureAskSwarm[A, Pub], r Resolver, upward func(A) H, parser p2p.AddrParser[H]) p2p.SecureAskSwarm[H, Pub] {
+	s := newSwarm[A, H](x, r, upward, parser)
+	return p2p.ComposeSecureAskSwarm[H, Pub](s,
+		asker[A, H]{swarm: s, inner: x},
+		secure[A, H, Pub]{swarm: s, inner: x},
+	)
+}
+
+type swarm[A p2p.Addr, H HostAddr[A]] struct {
+	p2p.Swarm[A]
+	resolver  Resolver
+	upward    func(A) H
+	parseAddr p2p.AddrParser[H]
+}
+
+func newSwarm[A p2p.Addr, H HostAddr[A]](x p2p.Swarm[A], r Resolver, upward func(A) H, parser p2p.AddrParser[H]) *swarm[A, H] {
+	if r == nil {
+		r = DefaultResolver()
+	}
+	return &swarm[A, H]{
+		Swarm:     x,
+		resolver:  r,
+		upward:    upward,
+		parseAddr: parser,
+	}
+}
+
+func (s *swarm[A, H]) Tell(ctx context.Context, dst H, data p2p.IOVec) error {
+	return s.forEach(ctx, dst, func(dst A) error {
+		return s.Swarm.Tell(ctx, dst, data)
+	})
+}
+
+func (s *swarm[A, H]) Receive(ctx context.Context, th func(p2p.Message[H])) error {
+	return s.Swarm.Receive(ctx, func(m p2p.Message[A]) {
+		th(p2p.Message[H]{
+			Src:     s.upward(m.Src),
+			Dst:     s.upward(m.Dst),
+			Payload: m.Payload,
+		})
+	})
+}
+
+func (s *swarm[A, H]) LocalAddrs() []H {
+	xs := s.Swarm.LocalAddrs()
+	ys := make([]H, len(xs))
+	for i := range xs {
+		ys[i] = s.upward(xs[i])
+	}
+	return ys
+}
+
+func (s *swarm[A, H]) ParseAddr(data []byte) (H, error) {
+	return s.parseAddr(data)
+}
+
+// forEach resolves dst, and calls fn with each of the addresses in order, until one succeeds.
+// The error from the last address is returned if none succeed.
+func (s *swarm[A, H]) forEach(ctx context.Context, dst H, fn func(A) error) error {
+	addrs, err := Resolve[A](ctx, s.resolver, dst)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err = fn(addr); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+type asker[A p2p.Addr, H HostAddr[A]] struct {
+	swarm *swarm[A, H]
+	inner interface {
+		p2p.Asker[A]
+		p2p.AskServer[A]
+	}
+}
+
+func (a asker[A, H]) Ask(ctx context.Context, resp []byte, dst H, req p2p.IOVec) (n int, err error) {
+	err = a.swarm.forEach(ctx, dst, func(dst A) error {
+		n, err = a.inner.Ask(ctx, resp, dst, req)
+		return err
+	})
+	return n, err
+}
+
+func (a asker[A, H]) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[H]) int) error {
+	return a.inner.ServeAsk(ctx, func(ctx context.Context, resp []byte, m p2p.Message[A]) int {
+		return fn(ctx, resp, p2p.Message[H]{
+			Src:     a.swarm.upward(m.Src),
+			Dst:     a.swarm.upward(m.Dst),
+			Payload: m.Payload,
+		})
+	})
+}
+
+type secure[A p2p.Addr, H HostAddr[A], Pub any] struct {
+	swarm *swarm[A, H]
+	inner p2p.Secure[A, Pub]
+}
+
+func (s secure[A, H, Pub]) PublicKey() Pub {
+	return s.inner.PublicKey()
+}
+
+func (s secure[A, H, Pub]) LookupPublicKey(ctx context.Context, target H) (pub Pub, err error) {
+	err = s.swarm.forEach(ctx, target, func(target A) error {
+		pub, err = s.inner.LookupPublicKey(ctx, target)
+		return err
+	})
+	return pub, err
+}
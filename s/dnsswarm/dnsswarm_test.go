@@ -0,0 +1,176 @@
+package dnsswarm
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/s/swarmtest"
+	"go.brendoncarroll.net/p2p/s/udpswarm"
+)
+
+func TestSwarm(t *testing.T) {
+	t.Parallel()
+	r := NewCache(NewMemResolver())
+	swarmtest.TestSwarm(t, func(t testing.TB, xs []p2p.Swarm[udpswarm.HostAddr]) {
+		for i := range xs {
+			xs[i] = newUDP(t, r)
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+	})
+}
+
+func TestTellHostName(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	mr := NewMemResolver()
+	r := NewCache(mr)
+	a, b := newUDP(t, r), newUDP(t, r)
+	bAddr := b.LocalAddrs()[0]
+
+	// the name is not set, so it cannot be resolved.
+	dst := udpswarm.HostAddr{Host: "b.example.com", Port: bAddr.Port}
+	require.Error(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	r.Flush()
+
+	mr.SetIPs("b.example.com", time.Minute, netip.MustParseAddr(bAddr.Host))
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	var msg p2p.Message[udpswarm.HostAddr]
+	require.NoError(t, p2p.Receive[udpswarm.HostAddr](ctx, b, &msg))
+	require.Equal(t, "hello", string(msg.Payload))
+	require.Equal(t, a.LocalAddrs()[0], msg.Src)
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemResolver()
+	r.SetIPs("example.com", time.Minute, netip.MustParseAddr("::ffff:1.2.3.4"), netip.MustParseAddr("2001:db8::1"))
+
+	addrs, err := Resolve[udpswarm.Addr](ctx, r, udpswarm.HostAddr{Host: "Example.com.", Port: 80})
+	require.NoError(t, err)
+	require.Equal(t, []udpswarm.Addr{
+		{IP: netip.MustParseAddr("1.2.3.4"), Port: 80},
+		{IP: netip.MustParseAddr("2001:db8::1"), Port: 80},
+	}, addrs)
+
+	// IP addresses are not looked up.
+	addrs, err = Resolve[udpswarm.Addr](ctx, r, udpswarm.HostAddr{Host: "10.0.0.1", Port: 80})
+	require.NoError(t, err)
+	require.Equal(t, []udpswarm.Addr{{IP: netip.MustParseAddr("10.0.0.1"), Port: 80}}, addrs)
+
+	_, err = Resolve[udpswarm.Addr](ctx, r, udpswarm.HostAddr{Host: "missing.example.com", Port: 80})
+	require.Error(t, err)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	mr := NewMemResolver()
+	inner := &countingResolver{Resolver: mr}
+	c := NewCache(inner, WithNegativeTTL(time.Second), WithMaxTTL(time.Hour))
+	now := time.Unix(0, 0)
+	c.now = func() time.Time { return now }
+
+	ip1, ip2 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	mr.SetIPs("example.com", time.Minute, ip1)
+	ips, ttl, err := c.LookupIP(ctx, "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{ip1}, ips)
+	require.Equal(t, time.Minute, ttl)
+
+	// the record changes, but the old one has not expired.
+	mr.SetIPs("example.com", 10*time.Hour, ip2)
+	now = now.Add(59 * time.Second)
+	ips, ttl, err = c.LookupIP(ctx, "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{ip1}, ips)
+	require.Equal(t, time.Second, ttl)
+	require.EqualValues(t, 1, inner.n.Load())
+
+	// after the TTL, the record is looked up again, and the TTL is limited to the max.
+	now = now.Add(time.Second)
+	ips, ttl, err = c.LookupIP(ctx, "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{ip2}, ips)
+	require.Equal(t, time.Hour, ttl)
+	require.EqualValues(t, 2, inner.n.Load())
+
+	// failures are remembered for the negative TTL.
+	_, _, err = c.LookupIP(ctx, "missing.example.com")
+	require.Error(t, err)
+	mr.SetIPs("missing.example.com", time.Minute, ip1)
+	_, _, err = c.LookupIP(ctx, "missing.example.com")
+	require.Error(t, err)
+	require.EqualValues(t, 3, inner.n.Load())
+	now = now.Add(time.Second)
+	ips, _, err = c.LookupIP(ctx, "missing.example.com")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{ip1}, ips)
+	require.EqualValues(t, 4, inner.n.Load())
+}
+
+func TestBootstrapSRV(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemResolver()
+	r.SetSRV("p2p", "udp", "example.com", time.Minute,
+		&net.SRV{Target: "b.example.com.", Port: 2, Priority: 20, Weight: 1},
+		&net.SRV{Target: "a.example.com.", Port: 1, Priority: 10, Weight: 1},
+		&net.SRV{Target: ".", Port: 0, Priority: 30},
+	)
+	addrs, err := BootstrapSRV(ctx, r, "p2p", "udp", "example.com", func(x SRVTarget) (udpswarm.HostAddr, error) {
+		return udpswarm.HostAddr{Host: x.Host, Port: x.Port}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []udpswarm.HostAddr{
+		{Host: "a.example.com", Port: 1},
+		{Host: "b.example.com", Port: 2},
+	}, addrs)
+
+	_, err = BootstrapSRV(ctx, r, "p2p", "tcp", "example.com", func(x SRVTarget) (udpswarm.HostAddr, error) {
+		return udpswarm.HostAddr{Host: x.Host, Port: x.Port}, nil
+	})
+	require.Error(t, err)
+}
+
+func TestBootstrapTXT(t *testing.T) {
+	ctx := context.Background()
+	r := NewMemResolver()
+	r.SetTXT("_dnsaddr.example.com", time.Minute,
+		"v=spf1 -all",
+		TXTPrefix+"a.example.com:1234",
+		TXTPrefix+"not an address",
+		TXTPrefix+"10.0.0.1:5678",
+	)
+	addrs, err := BootstrapTXT(ctx, r, "_dnsaddr.example.com", udpswarm.ParseHostAddr)
+	require.NoError(t, err)
+	require.Equal(t, []udpswarm.HostAddr{
+		{Host: "a.example.com", Port: 1234},
+		{Host: "10.0.0.1", Port: 5678},
+	}, addrs)
+
+	r.SetTXT("_dnsaddr.example.com", time.Minute, TXTPrefix+"not an address")
+	_, err = BootstrapTXT(ctx, r, "_dnsaddr.example.com", udpswarm.ParseHostAddr)
+	require.Error(t, err)
+}
+
+func newUDP(t testing.TB, r Resolver) p2p.Swarm[udpswarm.HostAddr] {
+	s, err := udpswarm.New("127.0.0.1:")
+	require.NoError(t, err)
+	return New[udpswarm.Addr](s, r, udpswarm.HostAddrOf, udpswarm.ParseHostAddr)
+}
+
+type countingResolver struct {
+	Resolver
+	n atomic.Int32
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	r.n.Add(1)
+	return r.Resolver.LookupIP(ctx, host)
+}
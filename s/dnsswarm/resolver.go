@@ -0,0 +1,157 @@
+package dnsswarm
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long results from a NetResolver are cached.
+const DefaultTTL = time.Minute
+
+// Resolver looks up DNS records.
+// Each lookup also returns how long the result can be cached for.
+type Resolver interface {
+	// LookupIP returns the IP addresses of host.
+	LookupIP(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+	// LookupSRV returns the SRV records for the service, as in net.LookupSRV.
+	LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error)
+	// LookupTXT returns the TXT records for name.
+	LookupTXT(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+var _ Resolver = &NetResolver{}
+
+// NetResolver is a Resolver which uses a net.Resolver.
+// net.Resolver does not return the TTLs of records, so a NetResolver returns the same TTL for every lookup.
+type NetResolver struct {
+	r   *net.Resolver
+	ttl time.Duration
+}
+
+// NewNetResolver returns a NetResolver which uses r, or net.DefaultResolver if r is nil.
+// ttl is returned for every lookup.
+func NewNetResolver(r *net.Resolver, ttl time.Duration) *NetResolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &NetResolver{r: r, ttl: ttl}
+}
+
+func (r *NetResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	ips, err := r.r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips, r.ttl, nil
+}
+
+func (r *NetResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	_, srvs, err := r.r.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return srvs, r.ttl, nil
+}
+
+func (r *NetResolver) LookupTXT(ctx context.Context, name string) ([]string, time.Duration, error) {
+	txts, err := r.r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return txts, r.ttl, nil
+}
+
+var _ Resolver = &MemResolver{}
+
+// MemResolver is an in memory Resolver, for tests and for static configuration.
+// Names which have not been set are not found.
+type MemResolver struct {
+	mu   sync.Mutex
+	ips  map[string]memRecord[netip.Addr]
+	srvs map[string]memRecord[*net.SRV]
+	txts map[string]memRecord[string]
+}
+
+type memRecord[T any] struct {
+	values []T
+	ttl    time.Duration
+}
+
+func NewMemResolver() *MemResolver {
+	return &MemResolver{
+		ips:  map[string]memRecord[netip.Addr]{},
+		srvs: map[string]memRecord[*net.SRV]{},
+		txts: map[string]memRecord[string]{},
+	}
+}
+
+// SetIPs sets the IP addresses of host.
+// Setting no ips removes host.
+func (r *MemResolver) SetIPs(host string, ttl time.Duration, ips ...netip.Addr) {
+	setRecord(&r.mu, r.ips, host, ttl, ips)
+}
+
+// SetSRV sets the SRV records for the service.
+// Setting no srvs removes the service.
+func (r *MemResolver) SetSRV(service, proto, name string, ttl time.Duration, srvs ...*net.SRV) {
+	setRecord(&r.mu, r.srvs, srvName(service, proto, name), ttl, srvs)
+}
+
+// SetTXT sets the TXT records for name.
+// Setting no txts removes name.
+func (r *MemResolver) SetTXT(name string, ttl time.Duration, txts ...string) {
+	setRecord(&r.mu, r.txts, name, ttl, txts)
+}
+
+func (r *MemResolver) LookupIP(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	return getRecord(&r.mu, r.ips, host)
+}
+
+func (r *MemResolver) LookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	return getRecord(&r.mu, r.srvs, srvName(service, proto, name))
+}
+
+func (r *MemResolver) LookupTXT(ctx context.Context, name string) ([]string, time.Duration, error) {
+	return getRecord(&r.mu, r.txts, name)
+}
+
+func setRecord[T any](mu *sync.Mutex, m map[string]memRecord[T], name string, ttl time.Duration, values []T) {
+	mu.Lock()
+	defer mu.Unlock()
+	name = canonicalName(name)
+	if len(values) == 0 {
+		delete(m, name)
+		return
+	}
+	m[name] = memRecord[T]{values: append([]T{}, values...), ttl: ttl}
+}
+
+func getRecord[T any](mu *sync.Mutex, m map[string]memRecord[T], name string) ([]T, time.Duration, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	rec, exists := m[canonicalName(name)]
+	if !exists {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return append([]T{}, rec.values...), rec.ttl, nil
+}
+
+// srvName returns the name which is looked up for a service, as in net.LookupSRV.
+func srvName(service, proto, name string) string {
+	if service == "" && proto == "" {
+		return name
+	}
+	return "_" + service + "._" + proto + "." + name
+}
+
+// canonicalName lower cases name, and removes the trailing dot from fully qualified names.
+func canonicalName(name string) string {
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	return strings.ToLower(name)
+}
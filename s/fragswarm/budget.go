@@ -0,0 +1,88 @@
+package fragswarm
+
+import "go.brendoncarroll.net/p2p/internal/bitmap"
+
+// Stats contains counters for the swarm.
+type Stats struct {
+	// Reassembling is the number of messages which have been partially received.
+	Reassembling int
+	// ReassemblyBytes is the memory used by partially received messages.
+	// It is limited by the global budget.
+	ReassemblyBytes int
+
+	// PeerBudgetDrops is the number of parts dropped because the sender had used its budget.
+	PeerBudgetDrops uint64
+	// GlobalBudgetDrops is the number of parts dropped because the global budget had been used.
+	GlobalBudgetDrops uint64
+	// DroppedBytes is the memory the parts counted in PeerBudgetDrops and GlobalBudgetDrops would have used.
+	DroppedBytes uint64
+	// Expired is the number of partially received messages which were discarded,
+	// because the rest of the parts did not arrive in time.
+	Expired uint64
+	// Invalid is the number of messages from the underlying swarm which could not be parsed.
+	Invalid uint64
+}
+
+// Stats returns a snapshot of the swarm's counters.
+func (s *Swarm[A]) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Reassembling:    len(s.aggs),
+		ReassemblyBytes: s.totalBytes,
+
+		PeerBudgetDrops:   s.counters.peerBudgetDrops,
+		GlobalBudgetDrops: s.counters.globalBudgetDrops,
+		DroppedBytes:      s.counters.droppedBytes,
+		Expired:           s.counters.expired,
+		Invalid:           s.counters.invalid,
+	}
+}
+
+// counters are protected by the Swarm's mutex.
+type counters struct {
+	peerBudgetDrops   uint64
+	globalBudgetDrops uint64
+	droppedBytes      uint64
+	expired           uint64
+	invalid           uint64
+}
+
+// partOverhead is the memory used to keep track of each part of a message being reassembled, besides the part itself.
+// It is the size of a slice header.
+const partOverhead = 24
+
+// aggOverhead is the memory used by an aggregator for a message with total parts, before any parts are added.
+func aggOverhead(total uint32) int {
+	return int(total)*partOverhead + bitmap.Size(int(total))
+}
+
+// reserve charges n bytes from peer to the reassembly budgets.
+// If either budget would be exceeded, nothing is charged, the drop is counted, and reserve returns false.
+// It must be called with s.mu held.
+func (s *Swarm[A]) reserve(peer string, n int) bool {
+	switch {
+	case s.peerBytes[peer]+n > s.config.peerBudget:
+		s.counters.peerBudgetDrops++
+	case s.totalBytes+n > s.config.globalBudget:
+		s.counters.globalBudgetDrops++
+	default:
+		s.peerBytes[peer] += n
+		s.totalBytes += n
+		return true
+	}
+	s.counters.droppedBytes += uint64(n)
+	return false
+}
+
+// release returns n bytes charged by reserve.
+// It must be called with s.mu held.
+func (s *Swarm[A]) release(peer string, n int) {
+	if n == 0 {
+		return
+	}
+	s.totalBytes -= n
+	if s.peerBytes[peer] -= n; s.peerBytes[peer] <= 0 {
+		delete(s.peerBytes, peer)
+	}
+}
@@ -3,68 +3,170 @@ package fragswarm
 import (
 	"context"
 	"encoding/binary"
+	"math"
+	"math/rand"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
 	"go.brendoncarroll.net/p2p/s/swarmutil"
 	"go.brendoncarroll.net/stdctx/logctx"
 	"golang.org/x/sync/errgroup"
 )
 
+// Overhead is the most space used by the header of each part of a plain message with at most 255 parts.
 const Overhead = 3 * binary.MaxVarintLen32
 
-func New[A p2p.Addr](x p2p.Swarm[A], mtu int) p2p.Swarm[A] {
-	return newSwarm[A](x, mtu)
+// ExtendedOverhead is the most space used by the header of each part of other messages:
+// reliable messages, messages with parity parts, and messages with more than 255 parts.
+// Versions of fragswarm without the extended header misparse it, and drop or corrupt those messages,
+// so every receiver must be upgraded before a sender uses those features.
+const ExtendedOverhead = 3 + 5*binary.MaxVarintLen32
+
+// MaxParts is the most parts a message can be split into.
+// Messages with more than 255 parts have the extended header, see ExtendedOverhead.
+const MaxParts = 1 << 16
+
+// maxFECParts is the most parts a message with parity parts can have, including the parity parts.
+const maxFECParts = 255
+
+// ackOverhead is the most space used by the header of an acknowledgement.
+const ackOverhead = 3 + 2*binary.MaxVarintLen32
+
+// ErrNotAcknowledged is returned by reliable Tells, when the receiver has not acknowledged every part after all the retries.
+var ErrNotAcknowledged = errors.New("fragswarm: message was not acknowledged")
+
+// completedTTL is how long a receiver remembers messages it has delivered,
+// so that parts which arrive later, or are sent again, do not cause the message to be delivered twice.
+const completedTTL = 10 * time.Second
+
+// reassemblyTimeout is how long a receiver waits for the rest of the parts of a message, before discarding the parts it has.
+const reassemblyTimeout = 10 * time.Second
+
+func New[A p2p.Addr](x p2p.Swarm[A], mtu int, opts ...Option) *Swarm[A] {
+	return newSwarm[A](x, mtu, opts)
+}
+
+func NewSecure[A p2p.Addr, Pub any](x p2p.SecureSwarm[A, Pub], mtu int, opts ...Option) *SecureSwarm[A, Pub] {
+	return &SecureSwarm[A, Pub]{
+		Swarm:  newSwarm[A](x, mtu, opts),
+		Secure: x,
+	}
 }
 
-func NewSecure[A p2p.Addr, Pub any](x p2p.SecureSwarm[A, Pub], mtu int) p2p.SecureSwarm[A, Pub] {
-	y := newSwarm[A](x, mtu)
-	return p2p.ComposeSecureSwarm[A, Pub](y, x)
+// SecureSwarm is a Swarm which gets its security from the underlying swarm.
+type SecureSwarm[A p2p.Addr, Pub any] struct {
+	*Swarm[A]
+	p2p.Secure[A, Pub]
 }
 
-type swarm[A p2p.Addr] struct {
+// Swarm splits messages larger than the underlying swarm's MTU into parts, and reassembles them.
+type Swarm[A p2p.Addr] struct {
 	p2p.Swarm[A]
-	mtu int
+	mtu    int
+	config config
 
-	cf context.CancelFunc
+	ctx context.Context
+	cf  context.CancelFunc
 
-	mu     sync.Mutex
-	aggs   map[aggKey]*aggregator
-	msgIDs map[string]uint32
-	tells  swarmutil.TellHub[A]
+	mu        sync.Mutex
+	aggs      map[aggKey]*aggregator
+	msgIDs    map[string]uint32
+	outgoing  map[aggKey]*outgoing
+	completed map[aggKey]completedMsg
+	tells     swarmutil.TellHub[A]
+
+	// peerBytes and totalBytes are the memory charged to the reassembly budgets.
+	peerBytes  map[string]int
+	totalBytes int
+	counters   counters
 }
 
-func newSwarm[A p2p.Addr](x p2p.Swarm[A], mtu int) *swarm[A] {
+func newSwarm[A p2p.Addr](x p2p.Swarm[A], mtu int, opts []Option) *Swarm[A] {
+	config := defaultConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.reliable {
+		config.fecRedundancy = 0
+	}
+	if config.peerBudget == 0 {
+		config.peerBudget = DefaultPeerBudgetMTUs * mtu
+	}
+	if config.globalBudget == 0 {
+		config.globalBudget = DefaultGlobalBudgetMTUs * mtu
+	}
 	ctx, cf := context.WithCancel(context.Background())
-	s := &swarm[A]{
-		Swarm: x,
-		mtu:   mtu,
+	s := &Swarm[A]{
+		Swarm:  x,
+		mtu:    mtu,
+		config: config,
 
-		cf:     cf,
-		aggs:   make(map[aggKey]*aggregator),
-		msgIDs: make(map[string]uint32),
-		tells:  swarmutil.NewTellHub[A](),
+		ctx:       ctx,
+		cf:        cf,
+		aggs:      make(map[aggKey]*aggregator),
+		msgIDs:    make(map[string]uint32),
+		outgoing:  make(map[aggKey]*outgoing),
+		completed: make(map[aggKey]completedMsg),
+		tells:     swarmutil.NewTellHub[A](),
+		peerBytes: make(map[string]int),
 	}
 	go s.recvLoops(ctx, runtime.GOMAXPROCS(0))
 	go s.cleanupLoop(ctx)
 	return s
 }
 
-func (s *swarm[A]) Tell(ctx context.Context, addr A, data p2p.IOVec) error {
+func (s *Swarm[A]) Tell(ctx context.Context, addr A, data p2p.IOVec) error {
 	if p2p.VecSize(data) > s.mtu {
 		return p2p.ErrMTUExceeded
 	}
-	underMTU := s.Swarm.MTU() - Overhead
 	s.mu.Lock()
-	id := s.msgIDs[keyForAddr(addr)]
-	s.msgIDs[keyForAddr(addr)]++
+	id, exists := s.msgIDs[keyForAddr(addr)]
+	if !exists {
+		// ids start at a random value, so the ids of a restarted sender are not mistaken for messages
+		// the receiver has already completed.
+		id = rand.Uint32()
+	}
+	s.msgIDs[keyForAddr(addr)] = id + 1
 	s.mu.Unlock()
 
-	size := p2p.VecSize(data)
 	data2 := p2p.VecBytes(nil, data)
+	if s.config.fecRedundancy > 0 {
+		return s.tellFEC(ctx, addr, id, data2)
+	}
+	if s.config.reliable {
+		parts, err := s.split(data2, ExtendedOverhead)
+		if err != nil {
+			return err
+		}
+		return s.tellReliable(ctx, addr, id, parts)
+	}
+	return s.tellPlain(ctx, addr, id, data2)
+}
+
+// tellPlain sends the message with the plain encoding.
+// Messages with at most 255 parts have the original header.
+func (s *Swarm[A]) tellPlain(ctx context.Context, addr A, id uint32, data []byte) error {
+	parts, err := s.split(data, Overhead)
+	if err != nil {
+		return err
+	}
+	if len(parts) > 255 {
+		if parts, err = s.split(data, ExtendedOverhead); err != nil {
+			return err
+		}
+	}
+	return s.sendParts(ctx, addr, header{enc: plainEncoding(len(parts)), mtype: typeData, id: id}, parts, nil)
+}
+
+// split divides data into parts which fit in the underlying swarm's MTU, after a header of overhead bytes.
+// There is always at least 1 part, and it is an error to need more than MaxParts.
+func (s *Swarm[A]) split(data []byte, overhead int) ([][]byte, error) {
+	underMTU := s.Swarm.MTU() - overhead
+	size := len(data)
 	total := size / underMTU
 	if size%underMTU > 0 {
 		total++
@@ -72,32 +174,124 @@ func (s *swarm[A]) Tell(ctx context.Context, addr A, data p2p.IOVec) error {
 	if total == 0 {
 		total = 1
 	}
-	if total == 1 {
-		msg := newMessage(id, 0, 1, data2)
-		return s.Swarm.Tell(ctx, addr, msg)
+	if total > MaxParts {
+		return nil, errors.Errorf("fragswarm: message needs %d parts, the most is %d", total, MaxParts)
 	}
-
-	eg := errgroup.Group{}
-	for part := 0; part < total; part++ {
-		part := part
+	parts := make([][]byte, total)
+	for part := range parts {
 		start := underMTU * part
 		end := size
 		if start+underMTU < end {
 			end = start + underMTU
 		}
+		parts[part] = data[start:end]
+	}
+	return parts, nil
+}
+
+// tellFEC sends the message with the reed solomon encoding.
+// If the message is too large to add any parity parts, it is sent with the plain encoding.
+func (s *Swarm[A]) tellFEC(ctx context.Context, addr A, id uint32, data []byte) error {
+	underMTU := s.Swarm.MTU() - ExtendedOverhead
+	k := (len(data) + underMTU - 1) / underMTU
+	if k == 0 {
+		k = 1
+	}
+	m := int(math.Ceil(float64(k) * s.config.fecRedundancy))
+	if k+m > maxFECParts {
+		m = maxFECParts - k
+	}
+	if m < 1 {
+		return s.tellPlain(ctx, addr, id, data)
+	}
+	// the data parts are all the same size, and the last one is padded with zeros.
+	shardSize := (len(data) + k - 1) / k
+	shards := make([][]byte, k, k+m)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if start := i * shardSize; start < len(data) {
+			copy(shards[i], data[start:])
+		}
+	}
+	code, err := newRSCode(k, m)
+	if err != nil {
+		return err
+	}
+	shards = append(shards, code.encode(shards)...)
+	h := header{enc: encReedSolomon, mtype: typeData, id: id, k: uint8(k), size: uint32(len(data))}
+	return s.sendParts(ctx, addr, h, shards, nil)
+}
+
+// sendParts sends the parts with indexes in which, or all the parts if which is nil.
+// h is the header for every part, with the part and total set by sendParts.
+func (s *Swarm[A]) sendParts(ctx context.Context, addr A, h header, parts [][]byte, which []int) error {
+	if which == nil {
+		which = make([]int, len(parts))
+		for i := range which {
+			which[i] = i
+		}
+	}
+	h.total = uint32(len(parts))
+	if len(which) == 1 {
+		h.part = uint32(which[0])
+		return s.Swarm.Tell(ctx, addr, newMessage(h, parts[which[0]]))
+	}
+	eg := errgroup.Group{}
+	for _, part := range which {
+		h := h
+		h.part = uint32(part)
 		eg.Go(func() error {
-			msg := newMessage(id, uint8(part), uint8(total), data2[start:end])
-			return s.Swarm.Tell(ctx, addr, msg)
+			return s.Swarm.Tell(ctx, addr, newMessage(h, parts[h.part]))
 		})
 	}
 	return eg.Wait()
 }
 
-func (s *swarm[A]) Receive(ctx context.Context, th func(p2p.Message[A])) error {
+// tellReliable sends the parts, and then sends the parts which the receiver is missing,
+// each time the receiver reports missing parts, or the ack timeout passes.
+func (s *Swarm[A]) tellReliable(ctx context.Context, addr A, id uint32, parts [][]byte) error {
+	if ackOverhead+bitmap.Size(len(parts)) > s.Swarm.MTU() {
+		return errors.Errorf("fragswarm: acknowledgement for %d parts does not fit in the underlying MTU", len(parts))
+	}
+	key := aggKey{addr: keyForAddr(addr), id: id}
+	out := newOutgoing(len(parts))
+	s.mu.Lock()
+	s.outgoing[key] = out
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.outgoing, key)
+		s.mu.Unlock()
+	}()
+
+	var missing []int
+	for retries := 0; ; retries++ {
+		if err := s.sendParts(ctx, addr, header{enc: plainEncoding(len(parts)), mtype: typeReliable, id: id}, parts, missing); err != nil {
+			return err
+		}
+		timer := time.NewTimer(s.config.ackTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-out.signal:
+			timer.Stop()
+		case <-timer.C:
+		}
+		if missing = out.missing(); len(missing) == 0 {
+			return nil
+		}
+		if retries >= s.config.maxRetries {
+			return errors.Wrapf(ErrNotAcknowledged, "%d of %d parts missing", len(missing), len(parts))
+		}
+	}
+}
+
+func (s *Swarm[A]) Receive(ctx context.Context, th func(p2p.Message[A])) error {
 	return s.tells.Receive(ctx, th)
 }
 
-func (s *swarm[A]) recvLoops(ctx context.Context, numWorkers int) error {
+func (s *Swarm[A]) recvLoops(ctx context.Context, numWorkers int) error {
 	eg, ctx := errgroup.WithContext(ctx)
 	for i := 0; i < numWorkers; i++ {
 		eg.Go(func() error {
@@ -118,14 +312,22 @@ func (s *swarm[A]) recvLoops(ctx context.Context, numWorkers int) error {
 }
 
 // handleTell will not retain x.Payload
-func (s *swarm[A]) handleTell(ctx context.Context, x p2p.Message[A]) error {
-	id, part, totalParts, data, err := parseMessage(x.Payload)
+func (s *Swarm[A]) handleTell(ctx context.Context, x p2p.Message[A]) error {
+	if isAck(x.Payload) {
+		return s.handleAck(x)
+	}
+	h, data, err := parseMessage(x.Payload)
 	if err != nil {
+		s.mu.Lock()
+		s.counters.invalid++
+		s.mu.Unlock()
 		logctx.Error(ctx, "error parsing message", logctx.Any("src", x.Src))
 		return err
 	}
+	id := h.id
+	reliable := h.mtype == typeReliable
 	// if there is only one part skip creating the aggregator
-	if totalParts == 1 {
+	if h.total == 1 && h.enc != encReedSolomon && !reliable {
 		return s.tells.Deliver(ctx, p2p.Message[A]{
 			Src:     x.Src,
 			Dst:     x.Dst,
@@ -134,36 +336,99 @@ func (s *swarm[A]) handleTell(ctx context.Context, x p2p.Message[A]) error {
 	}
 	key := aggKey{addr: keyForAddr(x.Src), id: id}
 	s.mu.Lock()
+	if c, done := s.completed[key]; done && !sameMessage(c.h, h) {
+		// the id has been reused by another message.
+		delete(s.completed, key)
+	} else if done {
+		s.mu.Unlock()
+		if reliable {
+			// the sender did not get the acknowledgement.
+			return s.sendAck(ctx, x.Src, id, bitmap.Full(int(h.total)))
+		}
+		// the message was assembled without this part.
+		return nil
+	}
 	agg, exists := s.aggs[key]
+	cost := len(data)
+	if !exists {
+		cost += aggOverhead(h.total)
+	}
+	if !s.reserve(key.addr, cost) {
+		s.mu.Unlock()
+		return nil
+	}
 	if !exists {
 		agg = newAggregator()
 		s.aggs[key] = agg
 	}
 	s.mu.Unlock()
-	if agg.addPart(part, totalParts, data) {
-		err = s.tells.Deliver(ctx, p2p.Message[A]{
-			Src:     x.Src,
-			Dst:     x.Dst,
-			Payload: agg.assemble(),
-		})
+	added, complete := agg.addPart(h, data, cost)
+	if !added {
 		s.mu.Lock()
-		delete(s.aggs, key)
+		s.release(key.addr, cost)
 		s.mu.Unlock()
 	}
-	return err
+	if !complete {
+		if reliable {
+			src := x.Src
+			agg.scheduleNack(s.config.nackDelay, func(have bitmap.BitMap) {
+				if err := s.sendAck(s.ctx, src, id, have); err != nil {
+					logctx.Errorln(s.ctx, "fragswarm: sending nack", err)
+				}
+			})
+		}
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.aggs, key)
+	s.release(key.addr, agg.close())
+	s.completed[key] = completedMsg{h: h, at: time.Now()}
+	s.mu.Unlock()
+	if reliable {
+		if err := s.sendAck(ctx, x.Src, id, bitmap.Full(int(h.total))); err != nil {
+			logctx.Errorln(ctx, "fragswarm: sending ack", err)
+		}
+	}
+	payload, err := agg.assemble()
+	if err != nil {
+		return err
+	}
+	return s.tells.Deliver(ctx, p2p.Message[A]{
+		Src:     x.Src,
+		Dst:     x.Dst,
+		Payload: payload,
+	})
+}
+
+func (s *Swarm[A]) handleAck(x p2p.Message[A]) error {
+	id, acked, err := parseAck(x.Payload)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	out, exists := s.outgoing[aggKey{addr: keyForAddr(x.Src), id: id}]
+	s.mu.Unlock()
+	if exists {
+		out.ack(acked)
+	}
+	return nil
+}
+
+func (s *Swarm[A]) sendAck(ctx context.Context, dst A, id uint32, have bitmap.BitMap) error {
+	return s.Swarm.Tell(ctx, dst, newAck(id, have))
 }
 
-func (s *swarm[A]) MTU() int {
+func (s *Swarm[A]) MTU() int {
 	return s.mtu
 }
 
-func (s *swarm[A]) Close() error {
+func (s *Swarm[A]) Close() error {
 	s.cf()
 	return s.Swarm.Close()
 }
 
-func (s *swarm[A]) cleanupLoop(ctx context.Context) {
-	ticker := time.NewTicker(time.Minute)
+func (s *Swarm[A]) cleanupLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	for {
 		s.cleanup()
@@ -175,14 +440,21 @@ func (s *swarm[A]) cleanupLoop(ctx context.Context) {
 	}
 }
 
-func (s *swarm[A]) cleanup() {
+func (s *Swarm[A]) cleanup() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	now := time.Now()
-	cutoff := now.Add(-10 * time.Second)
+	cutoff := now.Add(-reassemblyTimeout)
 	for k, a := range s.aggs {
 		if a.createdAt.Before(cutoff) {
+			s.release(k.addr, a.close())
 			delete(s.aggs, k)
+			s.counters.expired++
+		}
+	}
+	for k, c := range s.completed {
+		if c.at.Before(now.Add(-completedTTL)) {
+			delete(s.completed, k)
 		}
 	}
 }
@@ -192,82 +464,174 @@ type aggKey struct {
 	id   uint32
 }
 
+// completedMsg is a message which has been delivered.
+type completedMsg struct {
+	// h is the header of the last part received, only its message fields are used.
+	h  header
+	at time.Time
+}
+
+// sameMessage returns true if parts with headers a and b could be parts of the same message.
+func sameMessage(a, b header) bool {
+	return a.enc == b.enc && a.mtype == b.mtype && a.total == b.total && a.k == b.k && a.size == b.size
+}
+
 type aggregator struct {
 	mu        sync.Mutex
 	createdAt time.Time
+	// first is the header of the first part received, which later parts must match.
+	first     header
 	parts     [][]byte
+	have      bitmap.BitMap
+	count     int
+	done      bool
+	nackTimer *time.Timer
+	// charged is the memory charged to the reassembly budgets for the parts.
+	charged int
 }
 
 func newAggregator() *aggregator {
 	return &aggregator{createdAt: time.Now()}
 }
 
-func (a *aggregator) addPart(part, total uint8, data []byte) bool {
+// addPart adds data, and charges cost to the aggregator.
+// added is false if the part was not kept, and the caller should release cost.
+// complete is true if the message can be assembled after adding data.
+// It is only true once, even if parts are received again.
+// Parts which do not match the first part are not kept.
+func (a *aggregator) addPart(h header, data []byte, cost int) (added, complete bool) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	if a.parts == nil {
-		a.parts = make([][]byte, total)
+		a.first = h
+		a.parts = make([][]byte, h.total)
+		a.have = bitmap.New(int(h.total))
 	}
-	a.parts[int(part)] = append([]byte{}, data...)
-	for i := range a.parts {
-		if a.parts[i] == nil {
-			return false
-		}
+	if a.done || !a.matches(h, data) || a.have.Get(int(h.part)) {
+		return false, false
+	}
+	a.parts[int(h.part)] = append([]byte{}, data...)
+	a.have.Set(int(h.part), true)
+	a.charged += cost
+	a.count++
+	if a.count < a.needed() {
+		return true, false
+	}
+	a.done = true
+	if a.nackTimer != nil {
+		a.nackTimer.Stop()
+	}
+	return true, true
+}
+
+func (a *aggregator) matches(h header, data []byte) bool {
+	if !sameMessage(h, a.first) {
+		return false
+	}
+	if h.enc == encReedSolomon && a.count > 0 && len(data) != len(a.parts[a.first.part]) {
+		return false
 	}
 	return true
 }
 
-func (a *aggregator) assemble() []byte {
+// needed returns the number of parts needed to assemble the message.
+func (a *aggregator) needed() int {
+	if a.first.enc == encReedSolomon {
+		return int(a.first.k)
+	}
+	return len(a.parts)
+}
+
+// scheduleNack calls fn with the parts which have been received, after delay, unless another part is received first.
+func (a *aggregator) scheduleNack(delay time.Duration, fn func(have bitmap.BitMap)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nackTimer != nil {
+		a.nackTimer.Stop()
+	}
+	a.nackTimer = time.AfterFunc(delay, func() {
+		a.mu.Lock()
+		if a.done {
+			a.mu.Unlock()
+			return
+		}
+		have := a.have.Clone()
+		a.mu.Unlock()
+		fn(have)
+	})
+}
+
+// close stops the aggregator from adding parts, and returns the memory charged to the reassembly budgets.
+// The parts can still be assembled.
+func (a *aggregator) close() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.done = true
+	if a.nackTimer != nil {
+		a.nackTimer.Stop()
+	}
+	return a.charged
+}
+
+func (a *aggregator) assemble() ([]byte, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	if a.parts == nil {
-		return nil
+		return nil, nil
 	}
-	var buf []byte
-	for _, part := range a.parts {
+	parts := a.parts
+	if a.first.enc == encReedSolomon {
+		code, err := newRSCode(int(a.first.k), len(a.parts)-int(a.first.k))
+		if err != nil {
+			return nil, err
+		}
+		if err := code.reconstruct(a.parts); err != nil {
+			return nil, err
+		}
+		parts = a.parts[:a.first.k]
+	}
+	buf := []byte{}
+	for _, part := range parts {
 		buf = append(buf, part...)
 	}
-	return buf
+	if a.first.enc == encReedSolomon {
+		buf = buf[:a.first.size]
+	}
+	return buf, nil
 }
 
-func newMessage(id uint32, part uint8, total uint8, data []byte) p2p.IOVec {
-	var msg [][]byte
-	msg = appendUvarint(msg, uint64(id))
-	msg = appendUvarint(msg, uint64(part))
-	msg = appendUvarint(msg, uint64(total))
-	msg = append(msg, data)
-	return msg
+// outgoing is a reliable message which is being sent.
+type outgoing struct {
+	mu     sync.Mutex
+	acked  bitmap.BitMap
+	signal chan struct{}
 }
 
-func parseMessage(x []byte) (id uint32, part uint8, total uint8, data []byte, err error) {
-	fields := [3]uint64{}
-	var n int
-	if err := func() error {
-		for i := range fields {
-			field, n2 := binary.Uvarint(x[n:])
-			if n2 < 1 {
-				return errors.Errorf("invalid message")
-			}
-			fields[i] = field
-			n += n2
-		}
-		id = uint32(fields[0])
-		part = uint8(fields[1])
-		total = uint8(fields[2])
-		if part >= total {
-			return errors.Errorf("part >= total")
-		}
-		return nil
-	}(); err != nil {
-		return 0, 0, 0, nil, err
+func newOutgoing(total int) *outgoing {
+	return &outgoing{
+		acked:  bitmap.New(total),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (o *outgoing) ack(acked bitmap.BitMap) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if acked.Len() != o.acked.Len() {
+		return
+	}
+	o.acked.Or(acked)
+	select {
+	case o.signal <- struct{}{}:
+	default:
 	}
-	return id, part, total, x[n:], nil
 }
 
-func appendUvarint(b p2p.IOVec, x uint64) p2p.IOVec {
-	buf := [binary.MaxVarintLen64]byte{}
-	n := binary.PutUvarint(buf[:], x)
-	return append(b, buf[:n])
+// missing returns the parts which have not been acknowledged
+func (o *outgoing) missing() []int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.acked.Unset()
 }
 
 func keyForAddr(x p2p.Addr) string {
@@ -2,10 +2,16 @@ package fragswarm
 
 import (
 	"context"
+	"encoding/binary"
+	"math/rand"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
+	"go.brendoncarroll.net/p2p/p2ptest"
 	"go.brendoncarroll.net/p2p/s/memswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
 )
@@ -23,6 +29,32 @@ func TestSwarm(t *testing.T) {
 	})
 }
 
+func TestReliableSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSwarm(t, func(t testing.TB, xs []p2p.Swarm[memswarm.Addr]) {
+		r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+		for i := range xs {
+			xs[i] = New[memswarm.Addr](r.NewSwarm(), 1<<16, WithReliable())
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+	})
+}
+
+func TestFECSwarm(t *testing.T) {
+	t.Parallel()
+	swarmtest.TestSwarm(t, func(t testing.TB, xs []p2p.Swarm[memswarm.Addr]) {
+		r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+		for i := range xs {
+			xs[i] = New[memswarm.Addr](r.NewSwarm(), 1<<16, WithFEC(0.5))
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+	})
+}
+
 func TestFragment(t *testing.T) {
 	ctx := context.Background()
 	r := memswarm.NewRealm(memswarm.WithMTU(100), memswarm.WithQueueLen(100))
@@ -48,3 +80,263 @@ func TestFragment(t *testing.T) {
 	<-done
 	require.Equal(t, send, recv.Payload)
 }
+
+func TestSenderRestart(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	r := memswarm.NewRealm(memswarm.WithMTU(100), memswarm.WithQueueLen(100))
+	const mtu = 1024
+	x := r.NewSwarm()
+	b := New[memswarm.Addr](r.NewSwarm(), mtu)
+	defer b.Close()
+	dst := b.LocalAddrs()[0]
+	tell := func(a *Swarm[memswarm.Addr], size int) {
+		send := make([]byte, size)
+		rand.Read(send)
+		require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{send}))
+		var recv p2p.Message[memswarm.Addr]
+		require.NoError(t, p2p.Receive[memswarm.Addr](ctx, b, &recv))
+		require.Equal(t, send, recv.Payload)
+	}
+	a1 := New[memswarm.Addr](x, mtu)
+	tell(a1, mtu)
+	// a new Swarm on the same address is a restarted sender.
+	a2 := New[memswarm.Addr](x, mtu)
+	defer a2.Close()
+	tell(a2, mtu)
+
+	// a message which reuses the id of a completed message, but has a different number of parts, is delivered.
+	a2.mu.Lock()
+	a2.msgIDs[keyForAddr(dst)]--
+	a2.mu.Unlock()
+	tell(a2, mtu/2)
+}
+
+func TestManyParts(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	r := memswarm.NewRealm(memswarm.WithMTU(100), memswarm.WithQueueLen(1000))
+	// more than 255 parts.
+	const mtu = 300 * (100 - Overhead)
+	for _, opts := range [][]Option{nil, {WithReliable()}} {
+		a := New[memswarm.Addr](r.NewSwarm(), mtu, opts...)
+		b := New[memswarm.Addr](r.NewSwarm(), mtu)
+		send := make([]byte, mtu)
+		rand.Read(send)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send})
+		}()
+		var recv p2p.Message[memswarm.Addr]
+		require.NoError(t, p2p.Receive[memswarm.Addr](ctx, b, &recv))
+		require.Equal(t, send, recv.Payload)
+		require.NoError(t, <-errc)
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	}
+
+	// the parts do not fit in the header.
+	a := New[memswarm.Addr](r.NewSwarm(), (MaxParts+1)*(100-Overhead))
+	defer a.Close()
+	err := a.Tell(ctx, a.LocalAddrs()[0], p2p.IOVec{make([]byte, a.MTU())})
+	require.ErrorContains(t, err, "parts")
+}
+
+func TestBudget(t *testing.T) {
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(100))
+	b := New[memswarm.Addr](r.NewSwarm(), 1<<16, WithPeerBudget(1000), WithGlobalBudget(1500))
+	defer b.Close()
+	// send the first part of messages which are never finished.
+	const cost = 50 + 10*partOverhead + 2
+	startMessages := func(x p2p.Swarm[memswarm.Addr]) {
+		for i := 0; i < 10; i++ {
+			h := header{enc: encPlain, mtype: typeData, id: uint32(i), part: 0, total: 10}
+			require.NoError(t, x.Tell(ctx, b.LocalAddrs()[0], newMessage(h, make([]byte, 50))))
+		}
+	}
+	c1 := r.NewSwarm()
+	startMessages(c1)
+	require.Eventually(t, func() bool {
+		return b.Stats().PeerBudgetDrops == 7
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 3, b.Stats().Reassembling)
+	require.Equal(t, 3*cost, b.Stats().ReassemblyBytes)
+
+	c2 := r.NewSwarm()
+	startMessages(c2)
+	require.Eventually(t, func() bool {
+		return b.Stats().GlobalBudgetDrops == 8
+	}, time.Second, time.Millisecond)
+	stats := b.Stats()
+	require.Equal(t, 5, stats.Reassembling)
+	require.Equal(t, 5*cost, stats.ReassemblyBytes)
+	require.Equal(t, uint64(15*cost), stats.DroppedBytes)
+
+	// expired messages release their budget.
+	b.mu.Lock()
+	for _, agg := range b.aggs {
+		agg.createdAt = agg.createdAt.Add(-2 * reassemblyTimeout)
+	}
+	b.mu.Unlock()
+	b.cleanup()
+	stats = b.Stats()
+	require.Equal(t, 0, stats.Reassembling)
+	require.Equal(t, 0, stats.ReassemblyBytes)
+	require.Equal(t, uint64(5), stats.Expired)
+	require.Empty(t, b.peerBytes)
+}
+
+func TestReliable(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	// drop a third of the messages, including acknowledgements.
+	r := memswarm.NewRealm(
+		memswarm.WithMTU(100),
+		memswarm.WithQueueLen(100),
+		memswarm.WithTellTransform(p2ptest.NewDropRandom(1.0/3, 0)),
+	)
+	const mtu = 4096
+	a := New[memswarm.Addr](r.NewSwarm(), mtu, WithReliable(), WithAckTimeout(50*time.Millisecond), WithMaxRetries(20))
+	b := New[memswarm.Addr](r.NewSwarm(), mtu)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 3; i++ {
+		send := make([]byte, mtu)
+		for j := range send {
+			send[j] = uint8(i + j)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			errc <- a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send})
+		}()
+		var recv p2p.Message[memswarm.Addr]
+		require.NoError(t, p2p.Receive[memswarm.Addr](ctx, b, &recv))
+		require.Equal(t, send, recv.Payload)
+		require.NoError(t, <-errc)
+	}
+}
+
+func TestReliableRetryLimit(t *testing.T) {
+	ctx := context.Background()
+	var drop atomic.Bool
+	r := memswarm.NewRealm(
+		memswarm.WithMTU(100),
+		memswarm.WithTellTransform(func(*memswarm.Message) bool {
+			return !drop.Load()
+		}),
+	)
+	a := New[memswarm.Addr](r.NewSwarm(), 1024, WithReliable(), WithAckTimeout(10*time.Millisecond), WithMaxRetries(2))
+	b := New[memswarm.Addr](r.NewSwarm(), 1024)
+	defer a.Close()
+	defer b.Close()
+
+	drop.Store(true)
+	err := a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{make([]byte, 1024)})
+	require.ErrorIs(t, err, ErrNotAcknowledged)
+}
+
+func TestFEC(t *testing.T) {
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	// drop every fourth message, which is less than the parity parts of each message.
+	var count atomic.Int32
+	r := memswarm.NewRealm(
+		memswarm.WithMTU(100),
+		memswarm.WithQueueLen(100),
+		memswarm.WithTellTransform(func(*memswarm.Message) bool {
+			return count.Add(1)%4 != 0
+		}),
+	)
+	const mtu = 2000
+	a := New[memswarm.Addr](r.NewSwarm(), mtu, WithFEC(0.5))
+	b := New[memswarm.Addr](r.NewSwarm(), mtu)
+	defer a.Close()
+	defer b.Close()
+
+	for _, size := range []int{0, 1, 50, 1000, mtu} {
+		send := make([]byte, size)
+		rand.Read(send)
+		require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{send}))
+		var recv p2p.Message[memswarm.Addr]
+		require.NoError(t, p2p.Receive[memswarm.Addr](ctx, b, &recv))
+		require.Equal(t, send, append([]byte{}, recv.Payload...), "size=%d", size)
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	for _, km := range [][2]int{{1, 1}, {4, 2}, {10, 3}, {200, 55}} {
+		k, m := km[0], km[1]
+		code, err := newRSCode(k, m)
+		require.NoError(t, err)
+		data := make([][]byte, k)
+		for i := range data {
+			data[i] = make([]byte, 32)
+			rand.Read(data[i])
+		}
+		shards := append(append([][]byte{}, data...), code.encode(data)...)
+		// remove m random shards
+		for _, i := range rand.Perm(k + m)[:m] {
+			shards[i] = nil
+		}
+		require.NoError(t, code.reconstruct(shards))
+		require.Equal(t, data, shards[:k])
+
+		// removing one more shard is too many.
+		shards = append(append([][]byte{}, data...), code.encode(data)...)
+		for _, i := range rand.Perm(k + m)[:m+1] {
+			shards[i] = nil
+		}
+		require.Error(t, code.reconstruct(shards))
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	h := header{enc: encReedSolomon, mtype: typeData, id: 7, part: 3, total: 5, k: 4, size: 10}
+	msg := p2p.VecBytes(nil, newMessage(h, []byte("abc")))
+	h2, data, err := parseMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, h, h2)
+	require.Equal(t, "abc", string(data))
+
+	// k is checked before it is truncated to 8 bits, 260 would otherwise be read as 4.
+	msg = append([]byte{}, extendedPrefix...)
+	msg = append(msg, encReedSolomon<<4|typeData)
+	for _, field := range []uint64{7, 3, 5, 260, 10} {
+		msg = binary.AppendUvarint(msg, field)
+	}
+	msg = append(msg, "abc"...)
+	_, _, err = parseMessage(msg)
+	require.Error(t, err)
+
+	// the wide encoding can have more than 255 parts, but the plain encoding cannot.
+	h = header{enc: encWide, mtype: typeReliable, id: 7, part: 299, total: 300}
+	msg = p2p.VecBytes(nil, newMessage(h, []byte("abc")))
+	h2, _, err = parseMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, h, h2)
+	msg[len(extendedPrefix)] = encPlain<<4 | typeReliable
+	_, _, err = parseMessage(msg)
+	require.Error(t, err)
+
+	id, acked, err := parseAck(p2p.VecBytes(nil, newAck(7, bitmap.Full(300))))
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), id)
+	require.Equal(t, 300, acked.Len())
+	require.True(t, acked.AllSet())
+
+	// unknown encodings are rejected.
+	msg[len(extendedPrefix)] = 0xf<<4 | typeData
+	_, _, err = parseMessage(msg)
+	require.Error(t, err)
+
+	// plain messages with at most 255 parts have the original header.
+	h = header{enc: encPlain, mtype: typeData, id: 300, part: 1, total: 2}
+	msg = p2p.VecBytes(nil, newMessage(h, []byte("abc")))
+	require.Equal(t, []byte{0xac, 0x02, 0x01, 0x02, 'a', 'b', 'c'}, msg)
+	h2, data, err = parseMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, h, h2)
+	require.Equal(t, "abc", string(data))
+}
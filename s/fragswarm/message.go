@@ -0,0 +1,207 @@
+package fragswarm
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/internal/bitmap"
+)
+
+// Parts of plain messages with at most 255 parts have the original header: id, part, total.
+// All other messages start with extendedPrefix, followed by a byte containing the encoding in the high 4 bits,
+// and the message type in the low 4 bits.
+// The encoding is the version of the rest of the header.
+// extendedPrefix is a uvarint with a redundant continuation byte, which the original header never starts with,
+// so receivers can tell the two apart. Versions of fragswarm which only understand the original header
+// read it as message 0, and cannot receive messages with the extended header.
+
+// extendedPrefix starts every message with the extended header.
+var extendedPrefix = []byte{0x80, 0x00}
+
+// encodings
+const (
+	// encPlain messages are split into parts, which are concatenated by the receiver.
+	// The header is: id, part, total
+	// Parts of encPlain messages of type typeData are sent with the original header.
+	encPlain = uint8(iota)
+	// encReedSolomon messages are split into k data parts, and parity parts are added,
+	// so the receiver can reconstruct the message from any k parts.
+	// The header is: id, part, total, k, size
+	encReedSolomon
+	// encWide is encPlain for messages with more than 255 parts.
+	// Senders use encPlain when the counters fit.
+	// The header is: id, part, total
+	encWide
+)
+
+// message types
+const (
+	// typeData is a part of a message.
+	typeData = uint8(iota)
+	// typeReliable is a part of a message, which the receiver must acknowledge.
+	// It is only used with encPlain and encWide.
+	typeReliable
+	// typeAck acknowledges the parts of a reliable message, with a bit for each part.
+	// Unset bits are parts which the receiver is missing.
+	// It is only used with encPlain and encWide, matching the parts it acknowledges.
+	typeAck
+)
+
+type header struct {
+	enc   uint8
+	mtype uint8
+	id    uint32
+	part  uint32
+	total uint32
+
+	// k is the number of data parts, and size is the size of the message.
+	// They are only used by encReedSolomon.
+	k    uint8
+	size uint32
+}
+
+func newMessage(h header, data []byte) p2p.IOVec {
+	var msg p2p.IOVec
+	if !isOriginal(h) {
+		msg = append(msg, extendedPrefix, []byte{h.enc<<4 | h.mtype})
+	}
+	msg = appendUvarint(msg, uint64(h.id))
+	msg = appendUvarint(msg, uint64(h.part))
+	msg = appendUvarint(msg, uint64(h.total))
+	if h.enc == encReedSolomon {
+		msg = appendUvarint(msg, uint64(h.k))
+		msg = appendUvarint(msg, uint64(h.size))
+	}
+	msg = append(msg, data)
+	return msg
+}
+
+// isOriginal returns true if the part with header h is sent with the original header.
+func isOriginal(h header) bool {
+	return h.enc == encPlain && h.mtype == typeData
+}
+
+func hasExtendedPrefix(x []byte) bool {
+	return bytes.HasPrefix(x, extendedPrefix)
+}
+
+func parseMessage(x []byte) (h header, data []byte, err error) {
+	var n, numFields int
+	if hasExtendedPrefix(x) {
+		n = len(extendedPrefix) + 1
+		if len(x) < n {
+			return header{}, nil, errors.Errorf("invalid message")
+		}
+		h.enc, h.mtype = x[n-1]>>4, x[n-1]&0x0f
+	} else {
+		h.enc, h.mtype = encPlain, typeData
+	}
+	switch h.enc {
+	case encPlain, encWide:
+		if h.mtype != typeData && h.mtype != typeReliable {
+			return header{}, nil, errors.Errorf("invalid message type %d", h.mtype)
+		}
+		numFields = 3
+	case encReedSolomon:
+		if h.mtype != typeData {
+			return header{}, nil, errors.Errorf("invalid message type %d", h.mtype)
+		}
+		numFields = 5
+	default:
+		return header{}, nil, errors.Errorf("unsupported encoding %d", h.enc)
+	}
+	fields := make([]uint64, numFields)
+	for i := range fields {
+		field, n2 := binary.Uvarint(x[n:])
+		if n2 < 1 {
+			return header{}, nil, errors.Errorf("invalid message")
+		}
+		fields[i] = field
+		n += n2
+	}
+	if fields[2] > maxTotal(h.enc) {
+		return header{}, nil, errors.Errorf("too many parts %d", fields[2])
+	}
+	h.id = uint32(fields[0])
+	h.part = uint32(fields[1])
+	h.total = uint32(fields[2])
+	if h.part >= h.total {
+		return header{}, nil, errors.Errorf("part >= total")
+	}
+	data = x[n:]
+	if h.enc == encReedSolomon {
+		// check the fields before they are truncated.
+		if fields[3] < 1 || fields[3] > uint64(h.total) {
+			return header{}, nil, errors.Errorf("invalid number of data parts %d", fields[3])
+		}
+		if fields[4] > fields[3]*uint64(len(data)) {
+			return header{}, nil, errors.Errorf("size is larger than data parts")
+		}
+		h.k = uint8(fields[3])
+		h.size = uint32(fields[4])
+	}
+	return h, data, nil
+}
+
+// maxTotal returns the most parts a message with the encoding can have.
+func maxTotal(enc uint8) uint64 {
+	if enc == encWide {
+		return MaxParts
+	}
+	return 255
+}
+
+// plainEncoding returns the encoding for a message of total parts, without parity parts.
+func plainEncoding(total int) uint8 {
+	if total > 255 {
+		return encWide
+	}
+	return encPlain
+}
+
+// Acknowledgements always have the extended header.
+func newAck(id uint32, have bitmap.BitMap) p2p.IOVec {
+	msg := p2p.IOVec{extendedPrefix, {plainEncoding(have.Len())<<4 | typeAck}}
+	msg = appendUvarint(msg, uint64(id))
+	msg = appendUvarint(msg, uint64(have.Len()))
+	msg = append(msg, have.Bytes())
+	return msg
+}
+
+func isAck(x []byte) bool {
+	if !hasExtendedPrefix(x) || len(x) <= len(extendedPrefix) {
+		return false
+	}
+	b := x[len(extendedPrefix)]
+	return b == encPlain<<4|typeAck || b == encWide<<4|typeAck
+}
+
+func parseAck(x []byte) (id uint32, acked bitmap.BitMap, err error) {
+	if !isAck(x) {
+		return 0, bitmap.BitMap{}, errors.Errorf("not an ack")
+	}
+	n := len(extendedPrefix) + 1
+	id64, n2 := binary.Uvarint(x[n:])
+	if n2 < 1 {
+		return 0, bitmap.BitMap{}, errors.Errorf("invalid ack")
+	}
+	n += n2
+	total, n2 := binary.Uvarint(x[n:])
+	if n2 < 1 || total == 0 || total > maxTotal(x[len(extendedPrefix)]>>4) {
+		return 0, bitmap.BitMap{}, errors.Errorf("invalid ack")
+	}
+	n += n2
+	acked, ok := bitmap.FromBytes(x[n:], int(total))
+	if !ok {
+		return 0, bitmap.BitMap{}, errors.Errorf("ack bitmap is wrong length")
+	}
+	return uint32(id64), acked, nil
+}
+
+func appendUvarint(b p2p.IOVec, x uint64) p2p.IOVec {
+	buf := [binary.MaxVarintLen64]byte{}
+	n := binary.PutUvarint(buf[:], x)
+	return append(b, buf[:n])
+}
@@ -0,0 +1,113 @@
+package fragswarm
+
+import "time"
+
+const (
+	// DefaultAckTimeout is how long a reliable Tell waits for an acknowledgement before sending the missing parts again.
+	DefaultAckTimeout = 250 * time.Millisecond
+	// DefaultMaxRetries is how many times a reliable Tell sends the missing parts again, before giving up.
+	DefaultMaxRetries = 8
+	// DefaultNackDelay is how long a receiver waits after receiving a part, before reporting the missing parts.
+	DefaultNackDelay = 20 * time.Millisecond
+
+	// DefaultPeerBudgetMTUs is the default per-peer reassembly budget, as a multiple of the swarm's MTU.
+	DefaultPeerBudgetMTUs = 4
+	// DefaultGlobalBudgetMTUs is the default global reassembly budget, as a multiple of the swarm's MTU.
+	DefaultGlobalBudgetMTUs = 64
+)
+
+type config struct {
+	reliable   bool
+	ackTimeout time.Duration
+	maxRetries int
+	nackDelay  time.Duration
+
+	fecRedundancy float64
+
+	peerBudget   int
+	globalBudget int
+}
+
+func defaultConfig() config {
+	return config{
+		ackTimeout: DefaultAckTimeout,
+		maxRetries: DefaultMaxRetries,
+		nackDelay:  DefaultNackDelay,
+	}
+}
+
+type Option func(c *config)
+
+// WithReliable causes Tells to wait until the receiver has acknowledged every part of the message.
+// The receiver acknowledges parts with a bitmap, and lost parts are sent again.
+// Receivers always acknowledge reliable messages, so only senders need this option.
+func WithReliable() Option {
+	return func(c *config) {
+		c.reliable = true
+	}
+}
+
+// WithAckTimeout sets how long a reliable Tell waits for an acknowledgement before sending the missing parts again.
+func WithAckTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.ackTimeout = d
+	}
+}
+
+// WithMaxRetries sets how many times a reliable Tell sends the missing parts again, before it fails with ErrNotAcknowledged.
+// If n < 0, the missing parts are never sent again.
+func WithMaxRetries(n int) Option {
+	if n < 0 {
+		n = 0
+	}
+	return func(c *config) {
+		c.maxRetries = n
+	}
+}
+
+// WithNackDelay sets how long a receiver waits after receiving a part, before telling the sender which parts are missing.
+func WithNackDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.nackDelay = d
+	}
+}
+
+// WithFEC adds parity parts to messages, so that they can be reassembled without all the parts.
+// redundancy is the number of parity parts, as a fraction of the data parts, and is rounded up.
+// For example, with a redundancy of 0.25, messages of 8 parts have 2 parity parts, and can be reassembled from any 8 of the 10 parts.
+// Receivers can always reassemble messages with parity parts, so only senders need this option.
+// If redundancy is not positive, no parity parts are added.
+// WithFEC has no effect if WithReliable is also used.
+func WithFEC(redundancy float64) Option {
+	if !(redundancy > 0) {
+		redundancy = 0
+	}
+	return func(c *config) {
+		c.fecRedundancy = redundancy
+	}
+}
+
+// WithPeerBudget sets the most memory, in bytes, which partially received messages from a single peer can use.
+// Parts which would exceed the budget are dropped, and counted in Stats.
+// A budget smaller than the MTU prevents the largest messages from being received.
+// The default is DefaultPeerBudgetMTUs times the MTU, which is also used if n <= 0.
+func WithPeerBudget(n int) Option {
+	if n < 0 {
+		n = 0
+	}
+	return func(c *config) {
+		c.peerBudget = n
+	}
+}
+
+// WithGlobalBudget sets the most memory, in bytes, which partially received messages from all peers can use.
+// Parts which would exceed the budget are dropped, and counted in Stats.
+// The default is DefaultGlobalBudgetMTUs times the MTU, which is also used if n <= 0.
+func WithGlobalBudget(n int) Option {
+	if n < 0 {
+		n = 0
+	}
+	return func(c *config) {
+		c.globalBudget = n
+	}
+}
@@ -0,0 +1,187 @@
+package fragswarm
+
+import (
+	"github.com/pkg/errors"
+)
+
+// rsCode is a systematic Reed-Solomon erasure code over GF(2^8).
+// Messages are split into k data shards, and m parity shards are added,
+// so that the data can be reconstructed from any k of the k+m shards.
+//
+// The parity shards are computed with a Cauchy matrix, every square submatrix of which is invertible.
+type rsCode struct {
+	k, m int
+	// parity is an m x k matrix, row i computes parity shard i from the data shards.
+	parity [][]byte
+}
+
+// maxShards is the most shards a rsCode can have, since the matrix rows and columns need distinct field elements.
+const maxShards = 256
+
+func newRSCode(k, m int) (*rsCode, error) {
+	if k < 1 || m < 0 || k+m > maxShards {
+		return nil, errors.Errorf("invalid reed solomon code k=%d m=%d", k, m)
+	}
+	parity := make([][]byte, m)
+	for i := range parity {
+		parity[i] = make([]byte, k)
+		for j := range parity[i] {
+			// x_i = k + i and y_j = j are distinct, so x_i + y_j is never 0.
+			parity[i][j] = gfInv(uint8(k+i) ^ uint8(j))
+		}
+	}
+	return &rsCode{k: k, m: m, parity: parity}, nil
+}
+
+// encode returns the parity shards for the data shards, which must all be the same length.
+func (c *rsCode) encode(data [][]byte) [][]byte {
+	if len(data) != c.k {
+		panic("rsCode: wrong number of data shards")
+	}
+	size := len(data[0])
+	out := make([][]byte, c.m)
+	for i := range out {
+		out[i] = make([]byte, size)
+		for j := range data {
+			gfMulAdd(out[i], data[j], c.parity[i][j])
+		}
+	}
+	return out
+}
+
+// reconstruct fills in the missing data shards.
+// shards has the k data shards followed by the m parity shards, with nil for missing shards.
+// At least k shards must be present, and they must all be the same length.
+func (c *rsCode) reconstruct(shards [][]byte) error {
+	if len(shards) != c.k+c.m {
+		return errors.Errorf("rsCode: wrong number of shards %d", len(shards))
+	}
+	missingData := false
+	for i := 0; i < c.k; i++ {
+		if shards[i] == nil {
+			missingData = true
+			break
+		}
+	}
+	if !missingData {
+		return nil
+	}
+	// choose k of the present shards, and the rows of the encoding matrix which produced them.
+	rows := make([][]byte, 0, c.k)
+	inputs := make([][]byte, 0, c.k)
+	for i := 0; i < len(shards) && len(rows) < c.k; i++ {
+		if shards[i] == nil {
+			continue
+		}
+		if i < c.k {
+			row := make([]byte, c.k)
+			row[i] = 1
+			rows = append(rows, row)
+		} else {
+			rows = append(rows, c.parity[i-c.k])
+		}
+		inputs = append(inputs, shards[i])
+	}
+	if len(rows) < c.k {
+		return errors.Errorf("rsCode: need %d shards, have %d", c.k, len(rows))
+	}
+	inv, err := gfInvertMatrix(rows)
+	if err != nil {
+		return err
+	}
+	size := len(inputs[0])
+	for i := 0; i < c.k; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for j := range inputs {
+			gfMulAdd(out, inputs[j], inv[i][j])
+		}
+		shards[i] = out
+	}
+	return nil
+}
+
+// GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("gfInv: 0 has no inverse")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd sets out = out + c * in, for each element.
+func gfMulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, x := range in {
+		if x != 0 {
+			out[i] ^= gfExp[int(gfLog[x])+logC]
+		}
+	}
+}
+
+// gfInvertMatrix inverts the square matrix m by Gauss-Jordan elimination.
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	// work is m with the identity matrix appended to each row.
+	work := make([][]byte, n)
+	for i := range work {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("gfInvertMatrix: matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		if c := work[col][col]; c != 1 {
+			cInv := gfInv(c)
+			for j := range work[col] {
+				work[col][j] = gfMul(work[col][j], cInv)
+			}
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				gfMulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
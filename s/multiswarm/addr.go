@@ -6,6 +6,7 @@ import (
 
 	"github.com/pkg/errors"
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/multiaddr"
 )
 
 var _ p2p.UnwrapAddr = Addr{}
@@ -70,18 +71,61 @@ var addrRe = regexp.MustCompile(`^(.+?)://(.+)$`)
 
 type parserFunc = p2p.AddrParser[p2p.Addr]
 
+// MultiaddrParser converts a multiaddr to an Addr.
+// maconv.Schemes.FromMultiaddr is a MultiaddrParser for the swarms in this module.
+type MultiaddrParser = func(multiaddr.Multiaddr) (Addr, error)
+
 // AddrSchema is an address scheme for parsing addresses from multiple swarms
 type AddrSchema struct {
-	parsers map[string]parserFunc
+	parsers  map[string]parserFunc
+	maParser MultiaddrParser
+}
+
+// WithMultiaddrs returns a copy of the schema, which also parses multiaddrs using fn.
+func (as AddrSchema) WithMultiaddrs(fn MultiaddrParser) AddrSchema {
+	as.maParser = fn
+	return as
 }
 
+// ParseAddr parses an address in the scheme://inner format.
+// If the schema was created using WithMultiaddrs, ParseAddr also parses multiaddrs in the text format.
 func (as AddrSchema) ParseAddr(x []byte) (Addr, error) {
+	if as.maParser != nil && bytes.HasPrefix(x, []byte("/")) {
+		ma, err := multiaddr.Parse(string(x))
+		if err != nil {
+			return Addr{}, err
+		}
+		return as.ParseMultiaddr(ma)
+	}
+	return parseAddr(x, func(scheme string) (parserFunc, bool) {
+		parser, exists := as.parsers[scheme]
+		return parser, exists
+	})
+}
+
+// ParseMultiaddr converts ma to an Addr, using the MultiaddrParser passed to WithMultiaddrs.
+func (as AddrSchema) ParseMultiaddr(ma multiaddr.Multiaddr) (Addr, error) {
+	if as.maParser == nil {
+		return Addr{}, errors.New("multiswarm.Schema does not parse multiaddrs")
+	}
+	addr, err := as.maParser(ma)
+	if err != nil {
+		return Addr{}, err
+	}
+	if _, exists := as.parsers[addr.Scheme]; !exists {
+		return Addr{}, errors.Errorf("%v does not exist in muiltiswarm.Schema", addr.Scheme)
+	}
+	return addr, nil
+}
+
+// parseAddr parses x, using the parser returned by getParser for its scheme.
+func parseAddr(x []byte, getParser func(scheme string) (parserFunc, bool)) (Addr, error) {
 	groups := addrRe.FindSubmatch(x)
 	if len(groups) != 3 {
 		return Addr{}, errors.New("could not unmarshal")
 	}
 	scheme := string(groups[1])
-	parser, exists := as.parsers[scheme]
+	parser, exists := getParser(scheme)
 	if !exists {
 		return Addr{}, errors.Errorf("%v does not exist in muiltiswarm.Schema", scheme)
 	}
@@ -0,0 +1,307 @@
+package multiswarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// DefaultAttemptDelay is the time between starting connection attempts to a peer's addresses.
+// It is the Connection Attempt Delay recommended by RFC 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// DefaultRaceTimeout limits the time spent racing connection attempts to a peer.
+const DefaultRaceTimeout = 30 * time.Second
+
+// ConnectFunc connects to the peer id at addr.
+// It returns nil once the peer has been reached.
+type ConnectFunc func(ctx context.Context, id p2p.PeerID, addr Addr) error
+
+// ConnectByLookup returns a ConnectFunc which connects by looking up the public key at the address,
+// and checks that the key's fingerprint is the peer's id.
+// Swarms which establish a session to look up a key, such as quicswarm and p2pkeswarm, are connected by this.
+func ConnectByLookup[Pub any](x p2p.Secure[Addr, Pub], fp p2p.Fingerprinter[Pub]) ConnectFunc {
+	return func(ctx context.Context, id p2p.PeerID, addr Addr) error {
+		pubKey, err := x.LookupPublicKey(ctx, addr)
+		if err != nil {
+			return err
+		}
+		if have := fp(pubKey); have != id {
+			return fmt.Errorf("multiswarm: wrong peer at %v HAVE: %v WANT: %v", addr, have, id)
+		}
+		return nil
+	}
+}
+
+// DialerOption configures a Dialer
+type DialerOption func(d *Dialer)
+
+// WithAttemptDelay sets the time between starting connection attempts.
+func WithAttemptDelay(delay time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.attemptDelay = delay
+	}
+}
+
+// WithRaceTimeout sets the time after which racing connection attempts to a peer fails.
+// The race fails at the timeout, even if a ConnectFunc ignores its context and does not return.
+func WithRaceTimeout(timeout time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.raceTimeout = timeout
+	}
+}
+
+// Dialer sends to peers which have several addresses, possibly in different transports.
+// The first time a peer is contacted, connection attempts to all of its addresses are raced,
+// with staggered starts, as in RFC 8305 (Happy Eyeballs).
+// The address which connects first is remembered, and used for later Tells and Asks,
+// until sending to it fails.
+type Dialer struct {
+	swarm        p2p.Swarm[Addr]
+	connect      ConnectFunc
+	attemptDelay time.Duration
+	raceTimeout  time.Duration
+
+	mu      sync.Mutex
+	addrs   map[p2p.PeerID][]Addr
+	chosen  map[p2p.PeerID]Addr
+	dialing map[p2p.PeerID]*dialCall
+}
+
+// dialCall is a race for a peer, which concurrent callers can wait on.
+type dialCall struct {
+	done chan struct{}
+	addr Addr
+	err  error
+}
+
+// NewDialer creates a Dialer, which sends using x, and uses connect to attempt connections.
+func NewDialer(x p2p.Swarm[Addr], connect ConnectFunc, opts ...DialerOption) *Dialer {
+	d := &Dialer{
+		swarm:        x,
+		connect:      connect,
+		attemptDelay: DefaultAttemptDelay,
+		raceTimeout:  DefaultRaceTimeout,
+
+		addrs:   map[p2p.PeerID][]Addr{},
+		chosen:  map[p2p.PeerID]Addr{},
+		dialing: map[p2p.PeerID]*dialCall{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// SetAddrs sets the addresses of the peer id.
+// The order of addrs is the order of preference, but attempts alternate between transports and IP families.
+// If the remembered address for the peer is not in addrs, it is forgotten.
+// Calling SetAddrs with no addrs removes the peer.
+func (d *Dialer) SetAddrs(id p2p.PeerID, addrs []Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(addrs) == 0 {
+		delete(d.addrs, id)
+		delete(d.chosen, id)
+		return
+	}
+	d.addrs[id] = append([]Addr{}, addrs...)
+	if chosen, exists := d.chosen[id]; exists && !containsAddr(addrs, chosen) {
+		delete(d.chosen, id)
+	}
+}
+
+// Chosen returns the address which is used for the peer id, if one has connected.
+func (d *Dialer) Chosen(id p2p.PeerID) (Addr, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addr, exists := d.chosen[id]
+	return addr, exists
+}
+
+// Dial returns the address to use for the peer id.
+// If no address is remembered, connections to the peer's addresses are raced, and the first to connect is returned.
+func (d *Dialer) Dial(ctx context.Context, id p2p.PeerID) (Addr, error) {
+	d.mu.Lock()
+	if addr, exists := d.chosen[id]; exists {
+		d.mu.Unlock()
+		return addr, nil
+	}
+	call, exists := d.dialing[id]
+	if !exists {
+		addrs := d.addrs[id]
+		if len(addrs) == 0 {
+			d.mu.Unlock()
+			return Addr{}, fmt.Errorf("multiswarm: no addresses for peer %v", id)
+		}
+		call = &dialCall{done: make(chan struct{})}
+		d.dialing[id] = call
+		go d.race(id, interleave(addrs), call)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return Addr{}, ctx.Err()
+	case <-call.done:
+		return call.addr, call.err
+	}
+}
+
+// Tell sends data to the peer id, at the address returned by Dial.
+// If sending fails, the address is forgotten, unless ctx was cancelled.
+func (d *Dialer) Tell(ctx context.Context, id p2p.PeerID, data p2p.IOVec) error {
+	addr, err := d.Dial(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = d.swarm.Tell(ctx, addr, data)
+	if err != nil && ctx.Err() == nil {
+		d.forget(id, addr)
+	}
+	return err
+}
+
+// Ask sends an Ask to the peer id, at the address returned by Dial.
+// If the ask fails, the address is forgotten, unless ctx was cancelled.
+// The Dialer's swarm must be a p2p.Asker.
+func (d *Dialer) Ask(ctx context.Context, resp []byte, id p2p.PeerID, data p2p.IOVec) (int, error) {
+	asker, ok := d.swarm.(p2p.Asker[Addr])
+	if !ok {
+		return 0, fmt.Errorf("multiswarm: %T cannot ask", d.swarm)
+	}
+	addr, err := d.Dial(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := asker.Ask(ctx, resp, addr, data)
+	if err != nil && ctx.Err() == nil {
+		d.forget(id, addr)
+	}
+	return n, err
+}
+
+// forget stops using addr for the peer id, so the next Dial races all the peer's addresses again.
+func (d *Dialer) forget(id p2p.PeerID, addr Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if chosen, exists := d.chosen[id]; exists && addrEqual(chosen, addr) {
+		delete(d.chosen, id)
+	}
+}
+
+// race attempts to connect to each of addrs in order.
+// Each attempt starts after the previous one fails, or after attemptDelay, whichever is first.
+// The first attempt to succeed cancels the others.
+// The race fails after raceTimeout, without waiting for attempts which have not returned.
+func (d *Dialer) race(id p2p.PeerID, addrs []Addr, call *dialCall) {
+	ctx, cf := context.WithTimeout(context.Background(), d.raceTimeout)
+	defer cf()
+	type result struct {
+		addr Addr
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	var errs []error
+	next, pending := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// results is buffered, so attempts which return later do not block.
+			call.err = fmt.Errorf("multiswarm: could not connect to peer %v: %w", id, errors.Join(append(errs, ctx.Err())...))
+			d.finish(id, call)
+			return
+		case <-timer.C:
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				call.addr = res.addr
+				d.finish(id, call)
+				return
+			}
+			errs = append(errs, res.err)
+			if next == len(addrs) && pending == 0 {
+				call.err = fmt.Errorf("multiswarm: could not connect to peer %v: %w", id, errors.Join(errs...))
+				d.finish(id, call)
+				return
+			}
+			// a failure starts the next attempt without waiting.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		if next < len(addrs) {
+			addr := addrs[next]
+			next++
+			pending++
+			go func() {
+				results <- result{addr: addr, err: d.connect(ctx, id, addr)}
+			}()
+			timer.Reset(d.attemptDelay)
+		}
+	}
+}
+
+func (d *Dialer) finish(id p2p.PeerID, call *dialCall) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.dialing, id)
+	// the addresses may have changed during the race.
+	if call.err == nil && containsAddr(d.addrs[id], call.addr) {
+		d.chosen[id] = call.addr
+	}
+	close(call.done)
+}
+
+// interleave orders addrs so that consecutive addresses are from different transports and IP families, where possible.
+// Addresses in the same transport and family stay in the order they were given.
+func interleave(addrs []Addr) []Addr {
+	var keys []string
+	groups := map[string][]Addr{}
+	for _, addr := range addrs {
+		k := addr.Scheme
+		if ip, ok := p2p.ExtractIP(addr.Addr); ok {
+			if ip.Unmap().Is4() {
+				k += "/4"
+			} else {
+				k += "/6"
+			}
+		}
+		if _, exists := groups[k]; !exists {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], addr)
+	}
+	ret := make([]Addr, 0, len(addrs))
+	for len(ret) < len(addrs) {
+		for _, k := range keys {
+			if len(groups[k]) > 0 {
+				ret = append(ret, groups[k][0])
+				groups[k] = groups[k][1:]
+			}
+		}
+	}
+	return ret
+}
+
+func addrEqual(a, b Addr) bool {
+	return a.Scheme == b.Scheme && p2p.CompareAddrs(a.Addr, b.Addr) == 0
+}
+
+func containsAddr(addrs []Addr, x Addr) bool {
+	for _, addr := range addrs {
+		if addrEqual(addr, x) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+// package maconv converts between the addresses of the swarms in this module and multiaddrs.
+//
+// The addresses are converted as follows:
+//
+//	udpswarm.Addr                    /ip4/1.2.3.4/udp/1234
+//	quicswarm.Addr[udpswarm.Addr]    /ip4/1.2.3.4/udp/1234/quic-v1/p2p/<id>
+//	p2pkeswarm.Addr[udpswarm.Addr]   /ip4/1.2.3.4/udp/1234/p2pke/p2p/<id>
+//	sshswarm.Addr                    /ip4/1.2.3.4/tcp/22/ssh/<fingerprint>
+//
+// PeerIDs are encoded as sha3-256 multihashes, since they are sha3-256 hashes of public keys.
+package maconv
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/multiaddr"
+	"go.brendoncarroll.net/p2p/s/multiswarm"
+	"go.brendoncarroll.net/p2p/s/p2pkeswarm"
+	"go.brendoncarroll.net/p2p/s/quicswarm"
+	"go.brendoncarroll.net/p2p/s/sshswarm"
+	"go.brendoncarroll.net/p2p/s/udpswarm"
+)
+
+// sshFingerprintPrefix is the prefix of the fingerprints produced by ssh.FingerprintSHA256
+const sshFingerprintPrefix = "SHA256:"
+
+// ToMultiaddr converts x to a multiaddr.
+// x can be any of the address types listed in the package documentation, or a multiswarm.Addr containing one.
+func ToMultiaddr(x p2p.Addr) (multiaddr.Multiaddr, error) {
+	switch x := x.(type) {
+	case multiswarm.Addr:
+		return ToMultiaddr(x.Addr)
+	case udpswarm.Addr:
+		return FromUDP(x), nil
+	case quicswarm.Addr[udpswarm.Addr]:
+		return FromQUIC(x), nil
+	case p2pkeswarm.Addr[udpswarm.Addr]:
+		return FromP2PKE(x), nil
+	case sshswarm.Addr:
+		return FromSSH(x)
+	default:
+		return nil, fmt.Errorf("maconv: cannot convert %T to a multiaddr", x)
+	}
+}
+
+// FromMultiaddr converts ma to the address type which it describes.
+func FromMultiaddr(ma multiaddr.Multiaddr) (p2p.Addr, error) {
+	switch {
+	case isUDP(ma):
+		return ToUDP(ma)
+	case isQUIC(ma):
+		return ToQUIC(ma)
+	case isP2PKE(ma):
+		return ToP2PKE(ma)
+	case isSSH(ma):
+		return ToSSH(ma)
+	default:
+		return nil, fmt.Errorf("maconv: no address type for %v", ma)
+	}
+}
+
+// FromUDP converts a udpswarm.Addr
+func FromUDP(a udpswarm.Addr) multiaddr.Multiaddr {
+	return appendIP(nil, a.IP, multiaddr.CodeUDP, a.Port)
+}
+
+// ToUDP converts a multiaddr of the form /ip4/<ip>/udp/<port>
+func ToUDP(ma multiaddr.Multiaddr) (udpswarm.Addr, error) {
+	if !isUDP(ma) {
+		return udpswarm.Addr{}, fmt.Errorf("maconv: %v is not a udpswarm address", ma)
+	}
+	ip, port := splitIP(ma)
+	return udpswarm.Addr{IP: ip, Port: port}, nil
+}
+
+// FromQUIC converts a quicswarm.Addr over UDP
+func FromQUIC(a quicswarm.Addr[udpswarm.Addr]) multiaddr.Multiaddr {
+	ma := FromUDP(a.Addr)
+	ma = append(ma, multiaddr.Component{Code: multiaddr.CodeQUICv1})
+	return appendPeerID(ma, a.ID)
+}
+
+// ToQUIC converts a multiaddr of the form /ip4/<ip>/udp/<port>/quic-v1/p2p/<id>
+func ToQUIC(ma multiaddr.Multiaddr) (quicswarm.Addr[udpswarm.Addr], error) {
+	if !isQUIC(ma) {
+		return quicswarm.Addr[udpswarm.Addr]{}, fmt.Errorf("maconv: %v is not a quicswarm address", ma)
+	}
+	id, err := peerIDFrom(ma[len(ma)-1])
+	if err != nil {
+		return quicswarm.Addr[udpswarm.Addr]{}, err
+	}
+	ip, port := splitIP(ma)
+	return quicswarm.Addr[udpswarm.Addr]{
+		ID:   id,
+		Addr: udpswarm.Addr{IP: ip, Port: port},
+	}, nil
+}
+
+// FromP2PKE converts a p2pkeswarm.Addr over UDP
+func FromP2PKE(a p2pkeswarm.Addr[udpswarm.Addr]) multiaddr.Multiaddr {
+	ma := FromUDP(a.Addr)
+	ma = append(ma, multiaddr.Component{Code: multiaddr.CodeP2PKE})
+	return appendPeerID(ma, a.ID)
+}
+
+// ToP2PKE converts a multiaddr of the form /ip4/<ip>/udp/<port>/p2pke/p2p/<id>
+func ToP2PKE(ma multiaddr.Multiaddr) (p2pkeswarm.Addr[udpswarm.Addr], error) {
+	if !isP2PKE(ma) {
+		return p2pkeswarm.Addr[udpswarm.Addr]{}, fmt.Errorf("maconv: %v is not a p2pkeswarm address", ma)
+	}
+	id, err := peerIDFrom(ma[len(ma)-1])
+	if err != nil {
+		return p2pkeswarm.Addr[udpswarm.Addr]{}, err
+	}
+	ip, port := splitIP(ma)
+	return p2pkeswarm.Addr[udpswarm.Addr]{
+		ID:   id,
+		Addr: udpswarm.Addr{IP: ip, Port: port},
+	}, nil
+}
+
+// FromSSH converts a sshswarm.Addr.
+// It is an error if the address does not have a SHA256 fingerprint.
+func FromSSH(a sshswarm.Addr) (multiaddr.Multiaddr, error) {
+	if !strings.HasPrefix(a.Fingerprint, sshFingerprintPrefix) {
+		return nil, fmt.Errorf("maconv: %q is not a SHA256 fingerprint", a.Fingerprint)
+	}
+	fp, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(a.Fingerprint, sshFingerprintPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("maconv: parsing fingerprint: %w", err)
+	}
+	if len(fp) != 32 {
+		return nil, fmt.Errorf("maconv: fingerprint is wrong length %d", len(fp))
+	}
+	ma := appendIP(nil, a.IP, multiaddr.CodeTCP, a.Port)
+	return append(ma, multiaddr.Component{Code: multiaddr.CodeSSH, Value: fp}), nil
+}
+
+// ToSSH converts a multiaddr of the form /ip4/<ip>/tcp/<port>/ssh/<fingerprint>
+func ToSSH(ma multiaddr.Multiaddr) (sshswarm.Addr, error) {
+	if !isSSH(ma) {
+		return sshswarm.Addr{}, fmt.Errorf("maconv: %v is not a sshswarm address", ma)
+	}
+	ip, port := splitIP(ma)
+	return sshswarm.Addr{
+		Fingerprint: sshFingerprintPrefix + base64.RawStdEncoding.EncodeToString(ma[2].Value),
+		IP:          ip,
+		Port:        port,
+	}, nil
+}
+
+func isUDP(ma multiaddr.Multiaddr) bool {
+	return len(ma) == 2 && hasIPPrefix(ma, multiaddr.CodeUDP)
+}
+
+func isQUIC(ma multiaddr.Multiaddr) bool {
+	return len(ma) == 4 && hasIPPrefix(ma, multiaddr.CodeUDP, multiaddr.CodeQUICv1, multiaddr.CodeP2P)
+}
+
+func isP2PKE(ma multiaddr.Multiaddr) bool {
+	return len(ma) == 4 && hasIPPrefix(ma, multiaddr.CodeUDP, multiaddr.CodeP2PKE, multiaddr.CodeP2P)
+}
+
+func isSSH(ma multiaddr.Multiaddr) bool {
+	return len(ma) == 3 && hasIPPrefix(ma, multiaddr.CodeTCP, multiaddr.CodeSSH)
+}
+
+// hasIPPrefix returns true if ma starts with an ip4 or ip6 component, followed by codes.
+func hasIPPrefix(ma multiaddr.Multiaddr, codes ...multiaddr.Code) bool {
+	return ma.HasPrefix(append([]multiaddr.Code{multiaddr.CodeIP4}, codes...)...) ||
+		ma.HasPrefix(append([]multiaddr.Code{multiaddr.CodeIP6}, codes...)...)
+}
+
+func appendIP(ma multiaddr.Multiaddr, ip netip.Addr, portCode multiaddr.Code, port uint16) multiaddr.Multiaddr {
+	ip = ip.Unmap()
+	ipCode := multiaddr.CodeIP6
+	if ip.Is4() {
+		ipCode = multiaddr.CodeIP4
+	}
+	return append(ma,
+		multiaddr.Component{Code: ipCode, Value: ip.AsSlice()},
+		multiaddr.Component{Code: portCode, Value: binary.BigEndian.AppendUint16(nil, port)},
+	)
+}
+
+// splitIP returns the ip and port from the first 2 components of ma, which must have been checked by hasIPPrefix.
+func splitIP(ma multiaddr.Multiaddr) (netip.Addr, uint16) {
+	ip, _ := netip.AddrFromSlice(ma[0].Value)
+	return ip, binary.BigEndian.Uint16(ma[1].Value)
+}
+
+func appendPeerID(ma multiaddr.Multiaddr, id p2p.PeerID) multiaddr.Multiaddr {
+	return append(ma, multiaddr.Component{
+		Code:  multiaddr.CodeP2P,
+		Value: multiaddr.NewMultihash(multiaddr.MultihashSHA3_256, id[:]),
+	})
+}
+
+func peerIDFrom(c multiaddr.Component) (p2p.PeerID, error) {
+	code, digest, err := multiaddr.SplitMultihash(c.Value)
+	if err != nil {
+		return p2p.PeerID{}, err
+	}
+	if code != multiaddr.MultihashSHA3_256 || len(digest) != p2p.PeerIDSize {
+		return p2p.PeerID{}, fmt.Errorf("maconv: peer id must be a sha3-256 multihash")
+	}
+	return p2p.PeerID(digest), nil
+}
+
+// Schemes are the multiswarm schemes which the transports are added under.
+// An empty scheme means the transport is not in the multiswarm.
+type Schemes struct {
+	UDP   string
+	QUIC  string
+	P2PKE string
+	SSH   string
+}
+
+// FromMultiaddr converts ma to a multiswarm.Addr, with the scheme for its address type.
+func (s Schemes) FromMultiaddr(ma multiaddr.Multiaddr) (multiswarm.Addr, error) {
+	addr, err := FromMultiaddr(ma)
+	if err != nil {
+		return multiswarm.Addr{}, err
+	}
+	var scheme string
+	switch addr.(type) {
+	case udpswarm.Addr:
+		scheme = s.UDP
+	case quicswarm.Addr[udpswarm.Addr]:
+		scheme = s.QUIC
+	case p2pkeswarm.Addr[udpswarm.Addr]:
+		scheme = s.P2PKE
+	case sshswarm.Addr:
+		scheme = s.SSH
+	}
+	if scheme == "" {
+		return multiswarm.Addr{}, fmt.Errorf("maconv: no scheme for %T", addr)
+	}
+	return multiswarm.Addr{Scheme: scheme, Addr: addr}, nil
+}
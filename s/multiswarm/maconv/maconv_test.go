@@ -0,0 +1,115 @@
+package maconv
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/multiaddr"
+	"go.brendoncarroll.net/p2p/s/multiswarm"
+	"go.brendoncarroll.net/p2p/s/p2pkeswarm"
+	"go.brendoncarroll.net/p2p/s/quicswarm"
+	"go.brendoncarroll.net/p2p/s/sshswarm"
+	"go.brendoncarroll.net/p2p/s/udpswarm"
+)
+
+func TestRoundTrip(t *testing.T) {
+	id := p2p.PeerID{1, 2, 3}
+	udp4 := udpswarm.Addr{IP: netip.MustParseAddr("192.168.1.1"), Port: 1234}
+	udp6 := udpswarm.Addr{IP: netip.MustParseAddr("fe80::1"), Port: 5678}
+	tcs := []struct {
+		Addr p2p.Addr
+		Text string
+	}{
+		{udp4, "/ip4/192.168.1.1/udp/1234"},
+		{udp6, "/ip6/fe80::1/udp/5678"},
+		{
+			quicswarm.Addr[udpswarm.Addr]{ID: id, Addr: udp4},
+			"/ip4/192.168.1.1/udp/1234/quic-v1/p2p/" + encodeID(id),
+		},
+		{
+			p2pkeswarm.Addr[udpswarm.Addr]{ID: id, Addr: udp6},
+			"/ip6/fe80::1/udp/5678/p2pke/p2p/" + encodeID(id),
+		},
+		{
+			sshswarm.Addr{
+				Fingerprint: "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA/+8",
+				IP:          netip.MustParseAddr("10.0.0.1"),
+				Port:        22,
+			},
+			"/ip4/10.0.0.1/tcp/22/ssh/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA_-8",
+		},
+	}
+	for _, tc := range tcs {
+		ma, err := ToMultiaddr(tc.Addr)
+		require.NoError(t, err)
+		require.Equal(t, tc.Text, ma.String())
+
+		data, err := ma.MarshalBinary()
+		require.NoError(t, err)
+		ma2, err := multiaddr.ParseBinary(data)
+		require.NoError(t, err)
+		addr, err := FromMultiaddr(ma2)
+		require.NoError(t, err)
+		require.Equal(t, tc.Addr, addr)
+	}
+}
+
+func TestIPv4Mapped(t *testing.T) {
+	addr := udpswarm.Addr{IP: netip.MustParseAddr("::ffff:127.0.0.1"), Port: 1}
+	ma, err := ToMultiaddr(addr)
+	require.NoError(t, err)
+	require.Equal(t, "/ip4/127.0.0.1/udp/1", ma.String())
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, x := range []string{
+		"/ip4/127.0.0.1",
+		"/ip4/127.0.0.1/tcp/1",
+		"/ip4/127.0.0.1/udp/1/quic-v1",
+		"/dns/example.com/udp/1",
+	} {
+		ma, err := multiaddr.Parse(x)
+		require.NoError(t, err)
+		_, err = FromMultiaddr(ma)
+		require.Error(t, err, x)
+	}
+	// sha2-256 multihash
+	ma, err := multiaddr.Parse("/ip4/127.0.0.1/udp/1/quic-v1/p2p/QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N")
+	require.NoError(t, err)
+	_, err = FromMultiaddr(ma)
+	require.Error(t, err)
+}
+
+func TestSchema(t *testing.T) {
+	s, err := udpswarm.New("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	schema := multiswarm.NewSchemaFromSwarms(map[string]multiswarm.DynSwarm{
+		"udp": multiswarm.WrapSwarm[udpswarm.Addr](s),
+	})
+	// without WithMultiaddrs, multiaddrs are not parsed.
+	_, err = schema.ParseAddr([]byte("/ip4/127.0.0.1/udp/1234"))
+	require.Error(t, err)
+
+	schema = schema.WithMultiaddrs(Schemes{UDP: "udp", QUIC: "quic"}.FromMultiaddr)
+	addr, err := schema.ParseAddr([]byte("/ip4/127.0.0.1/udp/1234"))
+	require.NoError(t, err)
+	require.Equal(t, multiswarm.Addr{
+		Scheme: "udp",
+		Addr:   udpswarm.Addr{IP: netip.MustParseAddr("127.0.0.1"), Port: 1234},
+	}, addr)
+
+	// quic is not in the schema
+	_, err = schema.ParseAddr([]byte("/ip4/127.0.0.1/udp/1234/quic-v1/p2p/" + encodeID(p2p.PeerID{})))
+	require.Error(t, err)
+	// ssh has no scheme
+	_, err = schema.ParseAddr([]byte("/ip4/127.0.0.1/tcp/22/ssh/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"))
+	require.Error(t, err)
+}
+
+func encodeID(id p2p.PeerID) string {
+	ma := appendPeerID(nil, id)
+	return ma.String()[len("/p2p/"):]
+}
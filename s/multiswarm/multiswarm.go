@@ -3,16 +3,17 @@ package multiswarm
 import (
 	"context"
 	"math"
+	"sync"
 
 	"github.com/pkg/errors"
 	"go.brendoncarroll.net/p2p"
 	"go.brendoncarroll.net/p2p/s/swarmutil"
 	"go.brendoncarroll.net/stdctx/logctx"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
 	ErrTransportNotExist = errors.New("transport does not exist for scheme")
+	ErrTransportExists   = errors.New("transport already exists for scheme")
 )
 
 type (
@@ -42,64 +43,169 @@ func WrapSecureAskSwarm[T p2p.Addr, Pub any](x p2p.SecureAskSwarm[T, Pub]) DynSe
 
 // New creates a swarm with a multiplexed addressed space from
 // the elements of m
-func New(m map[string]DynSwarm) p2p.Swarm[Addr] {
-	ms := newMultiSwarm(m)
-	go ms.recvLoops(context.Background())
-	return ms
+func New(m map[string]DynSwarm) *Swarm {
+	ms := newMultiSwarm()
+	for name, x := range m {
+		ms.add(name, x)
+	}
+	return &Swarm{multiSwarm: ms}
 }
 
-func NewSecure[Pub any](m map[string]DynSecureSwarm[Pub]) p2p.SecureSwarm[Addr, Pub] {
-	ms := newMultiSwarm(convertSecure(m))
-	msec := multiSecure[Pub]{}
-	for name, s := range m {
-		msec[name] = s
+func NewSecure[Pub any](m map[string]DynSecureSwarm[Pub]) *SecureSwarm[Pub] {
+	ms := newMultiSwarm()
+	msec := newMultiSecure[Pub]()
+	for name, x := range m {
+		ms.add(name, x)
+		msec.add(name, x)
 	}
-	go ms.recvLoops(context.Background())
-	return p2p.ComposeSecureSwarm[Addr, Pub](ms, msec)
+	return &SecureSwarm[Pub]{multiSwarm: ms, multiSecure: msec}
 }
 
-func NewSecureAsk[Pub any](m map[string]DynSecureAskSwarm[Pub]) p2p.SecureAskSwarm[Addr, Pub] {
-	ms := newMultiSwarm(convertSecureAsk(m))
-	ma := newMultiAsker(map[string]p2p.AskSwarm[p2p.Addr]{})
-	msec := multiSecure[Pub]{}
+func NewSecureAsk[Pub any](m map[string]DynSecureAskSwarm[Pub]) *SecureAskSwarm[Pub] {
+	ms := newMultiSwarm()
+	ma := newMultiAsker()
+	msec := newMultiSecure[Pub]()
+	for name, x := range m {
+		ms.add(name, x)
+		ma.add(name, x)
+		msec.add(name, x)
+	}
+	return &SecureAskSwarm[Pub]{multiSwarm: ms, multiAsker: ma, multiSecure: msec}
+}
+
+// Swarm is the swarm returned by New.
+// Transports can be added and removed while it is in use.
+type Swarm struct {
+	*multiSwarm
+}
+
+// AddTransport adds x to the swarm, with addresses in the scheme name.
+// Messages received by x are received from the swarm, until x is removed.
+func (s *Swarm) AddTransport(name string, x DynSwarm) error {
+	return s.multiSwarm.add(name, x)
+}
+
+// RemoveTransport removes the transport with the scheme name from the swarm, and closes it.
+func (s *Swarm) RemoveTransport(name string) error {
+	return s.multiSwarm.remove(name)
+}
 
-	for name, s := range m {
-		ma.swarms[name] = s
-		msec[name] = s
+// SecureSwarm is the swarm returned by NewSecure.
+// Transports can be added and removed while it is in use.
+type SecureSwarm[Pub any] struct {
+	*multiSwarm
+	*multiSecure[Pub]
+}
+
+// AddTransport adds x to the swarm, with addresses in the scheme name.
+func (s *SecureSwarm[Pub]) AddTransport(name string, x DynSecureSwarm[Pub]) error {
+	if err := s.multiSwarm.add(name, x); err != nil {
+		return err
 	}
-	ctx := context.Background()
-	go func() {
-		if err := ms.recvLoops(ctx); err != nil && !errors.Is(err, p2p.ErrClosed) {
-			logctx.Errorln(ctx, err)
-		}
-	}()
-	go func() {
-		if err := ma.serveLoops(ctx); err != nil && !errors.Is(err, p2p.ErrClosed) {
-			logctx.Errorln(ctx, err)
-		}
-	}()
-	return p2p.ComposeSecureAskSwarm[Addr, Pub](ms, ma, msec)
+	s.multiSecure.add(name, x)
+	return nil
+}
+
+// RemoveTransport removes the transport with the scheme name from the swarm, and closes it.
+func (s *SecureSwarm[Pub]) RemoveTransport(name string) error {
+	s.multiSecure.remove(name)
+	return s.multiSwarm.remove(name)
+}
+
+// SecureAskSwarm is the swarm returned by NewSecureAsk.
+// Transports can be added and removed while it is in use.
+type SecureAskSwarm[Pub any] struct {
+	*multiSwarm
+	*multiAsker
+	*multiSecure[Pub]
+}
+
+// AddTransport adds x to the swarm, with addresses in the scheme name.
+func (s *SecureAskSwarm[Pub]) AddTransport(name string, x DynSecureAskSwarm[Pub]) error {
+	if err := s.multiSwarm.add(name, x); err != nil {
+		return err
+	}
+	s.multiAsker.add(name, x)
+	s.multiSecure.add(name, x)
+	return nil
+}
+
+// RemoveTransport removes the transport with the scheme name from the swarm, and closes it.
+func (s *SecureAskSwarm[Pub]) RemoveTransport(name string) error {
+	s.multiSecure.remove(name)
+	s.multiAsker.remove(name)
+	return s.multiSwarm.remove(name)
+}
+
+func (s *SecureAskSwarm[Pub]) Close() error {
+	s.multiAsker.close()
+	return s.multiSwarm.Close()
 }
 
 type multiSwarm struct {
-	ctx        context.Context
-	addrSchema AddrSchema
-	swarms     map[string]DynSwarm
-	tells      swarmutil.TellHub[Addr]
+	ctx   context.Context
+	cf    context.CancelFunc
+	tells swarmutil.TellHub[Addr]
+
+	mu     sync.RWMutex
+	closed bool
+	swarms map[string]DynSwarm
+	// cancels stops the receive loop for each transport.
+	cancels map[string]context.CancelFunc
 }
 
-func newMultiSwarm(m map[string]DynSwarm) *multiSwarm {
+func newMultiSwarm() *multiSwarm {
+	ctx, cf := context.WithCancel(context.Background())
 	s := &multiSwarm{
-		ctx:        context.Background(),
-		addrSchema: NewSchemaFromSwarms(m),
-		swarms:     m,
-		tells:      swarmutil.NewTellHub[Addr](),
+		ctx:     ctx,
+		cf:      cf,
+		tells:   swarmutil.NewTellHub[Addr](),
+		swarms:  map[string]DynSwarm{},
+		cancels: map[string]context.CancelFunc{},
 	}
 	return s
 }
 
+func (mt *multiSwarm) add(name string, x DynSwarm) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.closed {
+		return p2p.ErrClosed
+	}
+	if _, exists := mt.swarms[name]; exists {
+		return ErrTransportExists
+	}
+	ctx, cf := context.WithCancel(mt.ctx)
+	mt.swarms[name] = x
+	mt.cancels[name] = cf
+	go mt.recvLoop(ctx, name, x)
+	return nil
+}
+
+func (mt *multiSwarm) remove(name string) error {
+	mt.mu.Lock()
+	x, exists := mt.swarms[name]
+	if exists {
+		mt.cancels[name]()
+		delete(mt.swarms, name)
+		delete(mt.cancels, name)
+	}
+	mt.mu.Unlock()
+	if !exists {
+		return ErrTransportNotExist
+	}
+	return x.Close()
+}
+
+func (mt *multiSwarm) getSwarm(scheme string) (DynSwarm, bool) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	x, ok := mt.swarms[scheme]
+	return x, ok
+}
+
 func (mt *multiSwarm) Tell(ctx context.Context, dst Addr, data p2p.IOVec) error {
-	t, ok := mt.swarms[dst.Scheme]
+	t, ok := mt.getSwarm(dst.Scheme)
 	if !ok {
 		return ErrTransportNotExist
 	}
@@ -110,33 +216,37 @@ func (mt *multiSwarm) Receive(ctx context.Context, th func(p2p.Message[Addr])) e
 	return mt.tells.Receive(ctx, th)
 }
 
-func (mt *multiSwarm) recvLoops(ctx context.Context) error {
-	eg := errgroup.Group{}
-	for tname, t := range mt.swarms {
-		tname := tname
-		t := t
-		eg.Go(func() error {
-			for {
-				if err := t.Receive(ctx, func(m p2p.Message[p2p.Addr]) {
-					mt.tells.Deliver(ctx, p2p.Message[Addr]{
-						Src:     Addr{Scheme: tname, Addr: m.Src},
-						Dst:     Addr{Scheme: tname, Addr: m.Dst},
-						Payload: m.Payload,
-					})
-				}); err != nil {
-					return err
-				}
+// recvLoop delivers the messages received by the transport t, until ctx is cancelled.
+func (mt *multiSwarm) recvLoop(ctx context.Context, tname string, t DynSwarm) {
+	for {
+		if err := t.Receive(ctx, func(m p2p.Message[p2p.Addr]) {
+			mt.tells.Deliver(ctx, p2p.Message[Addr]{
+				Src:     Addr{Scheme: tname, Addr: m.Src},
+				Dst:     Addr{Scheme: tname, Addr: m.Dst},
+				Payload: m.Payload,
+			})
+		}); err != nil {
+			if ctx.Err() == nil && !errors.Is(err, p2p.ErrClosed) {
+				logctx.Errorln(ctx, "multiswarm: receiving from", tname, err)
 			}
-		})
+			return
+		}
 	}
-	return eg.Wait()
 }
 
 func (ms *multiSwarm) ParseAddr(data []byte) (Addr, error) {
-	return ms.addrSchema.ParseAddr(data)
+	return parseAddr(data, func(scheme string) (parserFunc, bool) {
+		x, ok := ms.getSwarm(scheme)
+		if !ok {
+			return nil, false
+		}
+		return x.ParseAddr, true
+	})
 }
 
 func (mt *multiSwarm) MTU() int {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
 	ret := math.MaxInt
 	for _, s := range mt.swarms {
 		if m := s.MTU(); m < ret {
@@ -147,6 +257,8 @@ func (mt *multiSwarm) MTU() int {
 }
 
 func (mt *multiSwarm) LocalAddrs() (ret []Addr) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
 	for tname, t := range mt.swarms {
 		for _, addr := range t.LocalAddrs() {
 			a := Addr{
@@ -160,32 +272,77 @@ func (mt *multiSwarm) LocalAddrs() (ret []Addr) {
 }
 
 func (mt *multiSwarm) Close() error {
+	mt.mu.Lock()
+	mt.closed = true
+	swarms := mt.swarms
+	mt.swarms = map[string]DynSwarm{}
+	mt.cancels = map[string]context.CancelFunc{}
+	mt.mu.Unlock()
+
+	// stop delivering before the transports are closed, they may be waiting for a message to be delivered.
+	mt.cf()
+	mt.tells.CloseWithError(p2p.ErrClosed)
 	var err error
-	for _, t := range mt.swarms {
+	for _, t := range swarms {
 		if err2 := t.Close(); err2 != nil {
 			err = err2
 			logctx.Errorln(mt.ctx, "closing swarms", err)
 		}
 	}
-	mt.tells.CloseWithError(p2p.ErrClosed)
 	return err
 }
 
 type multiAsker struct {
-	swarms map[string]p2p.AskSwarm[p2p.Addr]
-	asks   swarmutil.AskHub[Addr]
+	asks swarmutil.AskHub[Addr]
+
+	mu      sync.RWMutex
+	swarms  map[string]p2p.AskSwarm[p2p.Addr]
+	cancels map[string]context.CancelFunc
 }
 
-func newMultiAsker(m map[string]p2p.AskSwarm[p2p.Addr]) *multiAsker {
+func newMultiAsker() *multiAsker {
 	ma := &multiAsker{
-		swarms: m,
-		asks:   swarmutil.NewAskHub[Addr](),
+		asks:    swarmutil.NewAskHub[Addr](),
+		swarms:  map[string]p2p.AskSwarm[p2p.Addr]{},
+		cancels: map[string]context.CancelFunc{},
 	}
 	return ma
 }
 
+func (ma *multiAsker) add(name string, x p2p.AskSwarm[p2p.Addr]) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ctx, cf := context.WithCancel(context.Background())
+	ma.swarms[name] = x
+	ma.cancels[name] = cf
+	go ma.serveLoop(ctx, name, x)
+}
+
+func (ma *multiAsker) remove(name string) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	if cf, exists := ma.cancels[name]; exists {
+		cf()
+	}
+	delete(ma.swarms, name)
+	delete(ma.cancels, name)
+}
+
+func (ma *multiAsker) close() {
+	ma.mu.Lock()
+	for _, cf := range ma.cancels {
+		cf()
+	}
+	ma.swarms = map[string]p2p.AskSwarm[p2p.Addr]{}
+	ma.cancels = map[string]context.CancelFunc{}
+	ma.mu.Unlock()
+	ma.asks.CloseWithError(p2p.ErrClosed)
+}
+
 func (ma *multiAsker) Ask(ctx context.Context, resp []byte, dst Addr, data p2p.IOVec) (int, error) {
+	ma.mu.RLock()
 	t, ok := ma.swarms[dst.Scheme]
+	ma.mu.RUnlock()
 	if !ok {
 		return 0, ErrTransportNotExist
 	}
@@ -196,71 +353,74 @@ func (ma *multiAsker) ServeAsk(ctx context.Context, fn func(context.Context, []b
 	return ma.asks.ServeAsk(ctx, fn)
 }
 
-func (ma *multiAsker) serveLoops(ctx context.Context) error {
-	eg := errgroup.Group{}
-	for scheme, t := range ma.swarms {
-		scheme := scheme
-		t := t
-		eg.Go(func() error {
-			for {
-				err := t.ServeAsk(ctx, func(ctx context.Context, reqData []byte, msg p2p.Message[p2p.Addr]) int {
-					msg2 := p2p.Message[Addr]{
-						Src: Addr{
-							Scheme: scheme,
-							Addr:   msg.Src,
-						},
-						Dst: Addr{
-							Scheme: scheme,
-							Addr:   msg.Dst,
-						},
-						Payload: msg.Payload,
-					}
-					n, err := ma.asks.Deliver(ctx, reqData, msg2)
-					if err != nil {
-						logctx.Errorln(ctx, "multiswarm: while handling ask", err)
-						return -1
-					}
-					return n
-				})
-				if err != nil {
-					return err
-				}
+// serveLoop serves the asks received by the transport t, until ctx is cancelled.
+func (ma *multiAsker) serveLoop(ctx context.Context, scheme string, t p2p.AskSwarm[p2p.Addr]) {
+	for {
+		err := t.ServeAsk(ctx, func(ctx context.Context, reqData []byte, msg p2p.Message[p2p.Addr]) int {
+			msg2 := p2p.Message[Addr]{
+				Src: Addr{
+					Scheme: scheme,
+					Addr:   msg.Src,
+				},
+				Dst: Addr{
+					Scheme: scheme,
+					Addr:   msg.Dst,
+				},
+				Payload: msg.Payload,
+			}
+			n, err := ma.asks.Deliver(ctx, reqData, msg2)
+			if err != nil {
+				logctx.Errorln(ctx, "multiswarm: while handling ask", err)
+				return -1
 			}
+			return n
 		})
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, p2p.ErrClosed) {
+				logctx.Errorln(ctx, "multiswarm: serving asks from", scheme, err)
+			}
+			return
+		}
 	}
-	return eg.Wait()
 }
 
-type multiSecure[Pub any] map[string]p2p.Secure[p2p.Addr, Pub]
+type multiSecure[Pub any] struct {
+	mu      sync.RWMutex
+	secures map[string]p2p.Secure[p2p.Addr, Pub]
+}
+
+func newMultiSecure[Pub any]() *multiSecure[Pub] {
+	return &multiSecure[Pub]{secures: map[string]p2p.Secure[p2p.Addr, Pub]{}}
+}
+
+func (ms *multiSecure[Pub]) add(name string, x p2p.Secure[p2p.Addr, Pub]) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.secures[name] = x
+}
 
-func (ms multiSecure[Pub]) PublicKey() (ret Pub) {
-	for _, s := range ms {
+func (ms *multiSecure[Pub]) remove(name string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.secures, name)
+}
+
+func (ms *multiSecure[Pub]) PublicKey() (ret Pub) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, s := range ms.secures {
 		return s.PublicKey()
 	}
 	return ret
 }
 
-func (ms multiSecure[Pub]) LookupPublicKey(ctx context.Context, a Addr) (Pub, error) {
-	t, ok := ms[a.Scheme]
+func (ms *multiSecure[Pub]) LookupPublicKey(ctx context.Context, a Addr) (Pub, error) {
+	ms.mu.RLock()
+	t, ok := ms.secures[a.Scheme]
+	ms.mu.RUnlock()
 	if !ok {
 		var zero Pub
 		return zero, errors.Errorf("invalid transport: %s", a.Scheme)
 	}
 	return t.LookupPublicKey(ctx, a.Addr)
 }
-
-func convertSecure[Pub any](x map[string]DynSecureSwarm[Pub]) map[string]DynSwarm {
-	y := make(map[string]DynSwarm)
-	for k, v := range x {
-		y[k] = v
-	}
-	return y
-}
-
-func convertSecureAsk[Pub any](x map[string]DynSecureAskSwarm[Pub]) map[string]DynSwarm {
-	y := make(map[string]DynSwarm)
-	for k, v := range x {
-		y[k] = v
-	}
-	return y
-}
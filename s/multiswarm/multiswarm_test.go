@@ -1,12 +1,19 @@
 package multiswarm
 
 import (
+	"context"
+	"errors"
+	"net/netip"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
 	"go.brendoncarroll.net/p2p"
 	"go.brendoncarroll.net/p2p/s/memswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
+	"go.brendoncarroll.net/p2p/s/udpswarm"
 )
 
 func TestMultiSwarm(t *testing.T) {
@@ -46,3 +53,205 @@ func TestMultiSwarm(t *testing.T) {
 		})
 	})
 }
+
+func TestAddRemoveTransport(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r1 := memswarm.NewSecureRealm[string]()
+	r2 := memswarm.NewSecureRealm[string]()
+	newSwarm := func(i int) *SecureAskSwarm[string] {
+		pubKey := strconv.Itoa(i)
+		x := NewSecureAsk(map[string]DynSecureAskSwarm[string]{
+			"mem1": WrapSecureAskSwarm[memswarm.Addr, string](r1.NewSwarm(pubKey)),
+		})
+		require.NoError(t, x.AddTransport("mem2", WrapSecureAskSwarm[memswarm.Addr, string](r2.NewSwarm(pubKey))))
+		return x
+	}
+	a, b := newSwarm(0), newSwarm(1)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	require.ErrorIs(t, a.AddTransport("mem2", WrapSecureAskSwarm[memswarm.Addr, string](r2.NewSwarm("2"))), ErrTransportExists)
+
+	dst := addrWithScheme(t, b.LocalAddrs(), "mem2")
+	data, err := dst.MarshalText()
+	require.NoError(t, err)
+	_, err = a.ParseAddr(data)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			if err := b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr]) int {
+				return copy(resp, req.Payload)
+			}); err != nil {
+				return
+			}
+		}
+	}()
+	var m p2p.Message[Addr]
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr](ctx, b, &m))
+	require.Equal(t, "mem2", m.Src.Scheme)
+	resp := make([]byte, 16)
+	n, err := a.Ask(ctx, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+	pub, err := a.LookupPublicKey(ctx, dst)
+	require.NoError(t, err)
+	require.Equal(t, "1", pub)
+
+	require.NoError(t, a.RemoveTransport("mem2"))
+	require.ErrorIs(t, a.RemoveTransport("mem2"), ErrTransportNotExist)
+	require.ErrorIs(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}), ErrTransportNotExist)
+	_, err = a.ParseAddr(data)
+	require.Error(t, err)
+	for _, addr := range a.LocalAddrs() {
+		require.NotEqual(t, "mem2", addr.Scheme)
+	}
+	// the other transport is still used.
+	require.NoError(t, a.Tell(ctx, addrWithScheme(t, b.LocalAddrs(), "mem1"), p2p.IOVec{[]byte("hello")}))
+}
+
+func addrWithScheme(t testing.TB, addrs []Addr, scheme string) Addr {
+	for _, addr := range addrs {
+		if addr.Scheme == scheme {
+			return addr
+		}
+	}
+	t.Fatalf("no address with scheme %s in %v", scheme, addrs)
+	return Addr{}
+}
+
+func TestDialer(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r1 := memswarm.NewRealm()
+	r2 := memswarm.NewRealm()
+	newSwarm := func() *Swarm {
+		return New(map[string]DynSwarm{
+			"mem1": WrapSwarm[memswarm.Addr](r1.NewSwarm()),
+			"mem2": WrapSwarm[memswarm.Addr](r2.NewSwarm()),
+		})
+	}
+	a, b := newSwarm(), newSwarm()
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	id := p2p.PeerID{1}
+	addrs := []Addr{addrWithScheme(t, b.LocalAddrs(), "mem1"), addrWithScheme(t, b.LocalAddrs(), "mem2")}
+
+	var attempts atomic.Int32
+	// mem1 never connects, mem2 connects immediately.
+	hangMem1 := func(ctx context.Context, _ p2p.PeerID, addr Addr) error {
+		attempts.Add(1)
+		if addr.Scheme == "mem1" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+	const delay = 100 * time.Millisecond
+	d := NewDialer(a, hangMem1, WithAttemptDelay(delay))
+	d.SetAddrs(id, addrs)
+	start := time.Now()
+	require.NoError(t, d.Tell(ctx, id, p2p.IOVec{[]byte("hello")}))
+	require.GreaterOrEqual(t, time.Since(start), delay)
+	chosen, ok := d.Chosen(id)
+	require.True(t, ok)
+	require.Equal(t, "mem2", chosen.Scheme)
+	var m p2p.Message[Addr]
+	require.NoError(t, p2p.Receive[Addr](ctx, b, &m))
+	require.Equal(t, "mem2", m.Dst.Scheme)
+
+	// the chosen address is used without connecting again.
+	require.NoError(t, d.Tell(ctx, id, p2p.IOVec{[]byte("hello")}))
+	require.Equal(t, int32(2), attempts.Load())
+
+	// a failed attempt starts the next one without waiting.
+	failMem1 := func(ctx context.Context, _ p2p.PeerID, addr Addr) error {
+		if addr.Scheme == "mem1" {
+			return errors.New("unreachable")
+		}
+		return nil
+	}
+	d = NewDialer(a, failMem1, WithAttemptDelay(time.Hour))
+	d.SetAddrs(id, addrs)
+	addr, err := d.Dial(ctx, id)
+	require.NoError(t, err)
+	require.Equal(t, "mem2", addr.Scheme)
+
+	// changing the addresses forgets the chosen address.
+	d.SetAddrs(id, addrs[:1])
+	_, ok = d.Chosen(id)
+	require.False(t, ok)
+	_, err = d.Dial(ctx, id)
+	require.ErrorContains(t, err, "unreachable")
+
+	// a Tell which fails because its context is cancelled does not forget the chosen address.
+	d = NewDialer(ctxSwarm{a}, failMem1)
+	d.SetAddrs(id, addrs)
+	_, err = d.Dial(ctx, id)
+	require.NoError(t, err)
+	cancelled, cf := context.WithCancel(ctx)
+	cf()
+	require.ErrorIs(t, d.Tell(cancelled, id, p2p.IOVec{[]byte("hello")}), context.Canceled)
+	_, ok = d.Chosen(id)
+	require.True(t, ok)
+}
+
+func TestDialerRaceTimeout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a := New(map[string]DynSwarm{
+		"mem1": WrapSwarm[memswarm.Addr](memswarm.NewRealm().NewSwarm()),
+	})
+	t.Cleanup(func() { require.NoError(t, a.Close()) })
+	id := p2p.PeerID{1}
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	var attempts atomic.Int32
+	// ignoreCtx never returns while the test is running.
+	ignoreCtx := func(context.Context, p2p.PeerID, Addr) error {
+		attempts.Add(1)
+		<-release
+		return nil
+	}
+	d := NewDialer(a, ignoreCtx, WithRaceTimeout(50*time.Millisecond))
+	d.SetAddrs(id, a.LocalAddrs())
+	for i := 1; i <= 2; i++ {
+		ctx, cf := context.WithTimeout(ctx, 3*time.Second)
+		_, err := d.Dial(ctx, id)
+		cf()
+		require.ErrorContains(t, err, "could not connect")
+		// every Dial starts a new race.
+		require.Equal(t, int32(i), attempts.Load())
+	}
+}
+
+// ctxSwarm fails Tells if the context is done.
+type ctxSwarm struct {
+	p2p.Swarm[Addr]
+}
+
+func (s ctxSwarm) Tell(ctx context.Context, dst Addr, data p2p.IOVec) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Swarm.Tell(ctx, dst, data)
+}
+
+func TestInterleave(t *testing.T) {
+	ip := func(s string) p2p.Addr {
+		return udpswarm.Addr{IP: netip.MustParseAddr(s), Port: 1}
+	}
+	in := []Addr{
+		{Scheme: "quic", Addr: ip("::1")},
+		{Scheme: "quic", Addr: ip("::2")},
+		{Scheme: "quic", Addr: ip("127.0.0.1")},
+		{Scheme: "ssh", Addr: ip("::1")},
+	}
+	out := interleave(in)
+	require.Equal(t, []Addr{in[0], in[2], in[3], in[1]}, out)
+}
@@ -0,0 +1,322 @@
+package p2pkeswarm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.brendoncarroll.net/stdctx/logctx"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/x509"
+	"go.brendoncarroll.net/p2p/p/p2pke"
+)
+
+const (
+	// maxAskTimeout is the longest a handler will run for a single request.
+	maxAskTimeout = 30 * time.Second
+	// servedAskTTL is how long a response is kept after a request has been served,
+	// so it can be resent if the requester retransmits.
+	servedAskTTL = 30 * time.Second
+)
+
+// Error codes sent in ask responses.
+const (
+	AskCodeOK = uint8(iota)
+	// AskCodeHandlerError means the handler returned a value < 0
+	AskCodeHandlerError
+	// AskCodeTimeout means the request was not served before its deadline.
+	AskCodeTimeout
+)
+
+// ErrAskFailed is returned by Ask when the remote party was unable to produce a response.
+type ErrAskFailed struct {
+	Addr p2p.Addr
+	Code uint8
+}
+
+func (e ErrAskFailed) Error() string {
+	switch e.Code {
+	case AskCodeHandlerError:
+		return fmt.Sprintf("p2pkeswarm: ask to %v failed: handler error", e.Addr)
+	case AskCodeTimeout:
+		return fmt.Sprintf("p2pkeswarm: ask to %v failed: timeout", e.Addr)
+	default:
+		return fmt.Sprintf("p2pkeswarm: ask to %v failed: code=%d", e.Addr, e.Code)
+	}
+}
+
+// Ask implements p2p.Asker.Ask
+// The request is retransmitted until a response arrives or the context is cancelled.
+func (s *Swarm[T]) Ask(ctx context.Context, resp []byte, dst Addr[T], req p2p.IOVec) (int, error) {
+	if p2p.VecSize(req) > s.MTU() {
+		return 0, p2p.ErrMTUExceeded
+	}
+	ctx, cf := context.WithTimeout(ctx, maxAskTimeout)
+	defer cf()
+	c, err := s.getFullAddr(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	if !hasHeader(c) {
+		return 0, ErrAskUnsupported
+	}
+	id := s.asker.nextID()
+	a := s.asker.createAsk(id, dst.ID, resp)
+	defer s.asker.removeAsk(id)
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	msg := append(p2p.IOVec{makeAskReq(id, timeout)}, req...)
+	rto := s.config.askRetryMin
+	timer := time.NewTimer(rto)
+	defer timer.Stop()
+	for {
+		if err := c.Send(ctx, msg); err != nil {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-a.done:
+		case <-timer.C:
+			rto = min(2*rto, s.config.askRetryMax)
+			timer.Reset(rto)
+			continue
+		}
+		break
+	}
+	switch {
+	case a.errCode != AskCodeOK:
+		return 0, ErrAskFailed{Addr: dst, Code: a.errCode}
+	case a.n > len(resp):
+		return 0, io.ErrShortBuffer
+	default:
+		return a.n, nil
+	}
+}
+
+// ServeAsk implements p2p.AskServer.ServeAsk
+func (s *Swarm[T]) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[Addr[T]]) int) error {
+	return s.askHub.ServeAsk(ctx, fn)
+}
+
+// handleAskRequest is called for every request, including retransmissions.
+// Each request is only delivered to the application once.
+func (s *Swarm[T]) handleAskRequest(c *p2pke.Channel, src, dst Addr[T], x []byte) error {
+	id, timeout, body, err := parseAskReq(x)
+	if err != nil {
+		return err
+	}
+	key := servedKey{Peer: src.ID, ID: id}
+	if sa, exists := s.served.get(key); exists {
+		return s.resendResponse(c, sa)
+	}
+	if !s.acquireServing() {
+		// the requester will retransmit, and the request can be served then.
+		logctx.Debugln(s.ctx, "p2pkeswarm: too many asks being served, dropping request from", src)
+		return nil
+	}
+	if timeout <= 0 || timeout > maxAskTimeout {
+		timeout = maxAskTimeout
+	}
+	var created bool
+	sa := s.served.getOrCreate(key, func() *servedAsk {
+		created = true
+		// the entry expires even if the handler never returns.
+		return &servedAsk{expiresAt: time.Now().Add(timeout + servedAskTTL)}
+	})
+	if !created {
+		s.releaseServing()
+		return s.resendResponse(c, sa)
+	}
+	go func() {
+		defer s.releaseServing()
+		ctx, cf := context.WithTimeout(s.ctx, timeout)
+		defer cf()
+		respBuf := make([]byte, s.MTU())
+		code := AskCodeOK
+		n, err := s.askHub.Deliver(ctx, respBuf, p2p.Message[Addr[T]]{
+			Src:     src,
+			Dst:     dst,
+			Payload: body,
+		})
+		switch {
+		case p2p.IsErrClosed(err):
+			return
+		case err != nil:
+			code, n = AskCodeTimeout, 0
+		case n < 0:
+			code, n = AskCodeHandlerError, 0
+		}
+		resp := append(makeAskResp(id, code), respBuf[:n]...)
+		sa.setResponse(resp, time.Now().Add(servedAskTTL))
+		if err := s.sendResponse(c, resp); err != nil {
+			logctx.Debugln(ctx, "p2pkeswarm: sending ask response", err)
+		}
+	}()
+	return nil
+}
+
+// handleAskResponse completes the ask with the response in x, if remoteKey is allowed to answer for the asked peer.
+// A transitioned PeerID is answered by the peer's new key, so this uses isPeer rather than comparing fingerprints.
+func (s *Swarm[T]) handleAskResponse(remoteKey *x509.PublicKey, x []byte) error {
+	id, code, body, err := parseAskResp(x)
+	if err != nil {
+		return err
+	}
+	a := s.asker.getAsk(id)
+	if a == nil || !s.isPeer(a.peer, remoteKey) {
+		return nil
+	}
+	a.complete(body, code)
+	return nil
+}
+
+// resendResponse resends the response to a retransmitted request, if it has been served.
+func (s *Swarm[T]) resendResponse(c *p2pke.Channel, sa *servedAsk) error {
+	if resp := sa.getResponse(); resp != nil {
+		return s.sendResponse(c, resp)
+	}
+	return nil
+}
+
+// acquireServing returns true if another request can be served.
+// Each successful call must be followed by a call to releaseServing.
+func (s *Swarm[T]) acquireServing() bool {
+	if s.serving == nil {
+		return true
+	}
+	select {
+	case s.serving <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Swarm[T]) releaseServing() {
+	if s.serving != nil {
+		<-s.serving
+	}
+}
+
+func (s *Swarm[T]) sendResponse(c *p2pke.Channel, resp []byte) error {
+	ctx, cf := context.WithTimeout(s.ctx, s.config.tellTimeout)
+	defer cf()
+	return c.Send(ctx, p2p.IOVec{resp})
+}
+
+// purgeServed removes responses which are too old to be asked for again.
+func (s *Swarm[T]) purgeServed(now time.Time) {
+	s.served.purge(func(_ servedKey, sa *servedAsk) bool {
+		return !sa.isExpired(now)
+	})
+}
+
+type ask struct {
+	peer    p2p.PeerID
+	once    sync.Once
+	done    chan struct{}
+	respBuf []byte
+	n       int
+	errCode uint8
+}
+
+// complete sets the response, n is set to the length of resp, even if it does not fit in the buffer.
+func (a *ask) complete(resp []byte, errCode uint8) {
+	a.once.Do(func() {
+		a.errCode = errCode
+		copy(a.respBuf, resp)
+		a.n = len(resp)
+		close(a.done)
+	})
+}
+
+type asker struct {
+	counter uint64
+
+	mu       sync.RWMutex
+	inFlight map[uint64]*ask
+}
+
+func newAsker() *asker {
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic(err)
+	}
+	return &asker{
+		counter:  binary.BigEndian.Uint64(seed[:]),
+		inFlight: make(map[uint64]*ask),
+	}
+}
+
+func (a *asker) nextID() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.counter++
+	return a.counter
+}
+
+func (a *asker) createAsk(id uint64, peer p2p.PeerID, respBuf []byte) *ask {
+	ask := &ask{
+		peer:    peer,
+		done:    make(chan struct{}),
+		respBuf: respBuf,
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight[id] = ask
+	return ask
+}
+
+func (a *asker) getAsk(id uint64) *ask {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.inFlight[id]
+}
+
+func (a *asker) removeAsk(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inFlight, id)
+}
+
+type servedKey struct {
+	Peer p2p.PeerID
+	ID   uint64
+}
+
+// servedAsk holds the response to a request, once it has been served.
+// expiresAt is set when the request arrives, and extended when the response is set.
+type servedAsk struct {
+	mu        sync.Mutex
+	resp      []byte
+	expiresAt time.Time
+}
+
+func (sa *servedAsk) setResponse(resp []byte, expiresAt time.Time) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.resp = resp
+	sa.expiresAt = expiresAt
+}
+
+func (sa *servedAsk) getResponse() []byte {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.resp
+}
+
+// isExpired returns true if the entry is no longer needed.
+func (sa *servedAsk) isExpired(now time.Time) bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return now.After(sa.expiresAt)
+}
@@ -0,0 +1,255 @@
+package p2pkeswarm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+var (
+	// ErrAskUnsupported is returned by Ask for peers running a version of p2pkeswarm without Asks.
+	ErrAskUnsupported = errors.New("p2pkeswarm: peer does not support asks")
+	// errTooManyChannels is returned by addChannel when there is no room for an incoming channel.
+	errTooManyChannels = errors.New("p2pkeswarm: too many channels")
+)
+
+// Stats contains counters for the swarm as a whole.
+type Stats struct {
+	// Channels is the number of channels currently held.
+	Channels int
+	// PendingHandshakes is the number of channels created by incoming handshakes, which have not completed.
+	PendingHandshakes int
+	// RejectedHandshakes is the number of incoming handshakes which were dropped
+	// because of a rate limit, or the channel table being full.
+	RejectedHandshakes uint64
+	// EvictedChannels is the number of channels removed to make room for new channels.
+	EvictedChannels uint64
+}
+
+// Stats returns counters for the swarm.
+func (s *Swarm[T]) Stats() Stats {
+	s.admitMu.Lock()
+	pending := s.pending.Len()
+	s.admitMu.Unlock()
+	return Stats{
+		Channels:           s.store.distinct(),
+		PendingHandshakes:  pending,
+		RejectedHandshakes: s.rejectedHandshakes.Load(),
+		EvictedChannels:    s.evictedChannels.Load(),
+	}
+}
+
+// addChannel returns the channel stored under key, creating it with fn if it does not exist.
+// The limits are checked, and the channel is added, while holding admitMu, so concurrent calls cannot exceed them.
+// If incoming is true, the channel is for a handshake from an unknown address, and is pending until it is established.
+// Incoming channels evict the oldest pending channel when there are too many, and are refused if there is no room.
+// Other channels never refuse, but they will evict whitelisted peers if necessary.
+func (s *Swarm[T]) addChannel(key string, incoming bool, fn func() *channelState[T]) (*channelState[T], error) {
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+	if cs, exists := s.store.get(key); exists {
+		return cs, nil
+	}
+	if max := s.config.maxPending; incoming && max > 0 && s.pending.Len() >= max {
+		s.evictPending()
+	}
+	if max := s.config.maxChannels; max > 0 && s.store.distinct() >= max {
+		if !s.evictPending() && !s.evict(!incoming) && incoming {
+			return nil, errTooManyChannels
+		}
+	}
+	cs := s.store.getOrCreate(key, fn)
+	if incoming {
+		cs.pendingElem = s.pending.PushBack(cs)
+		cs.pending.Store(true)
+	}
+	return cs, nil
+}
+
+// markEstablished removes cs from the pending channels, once it has completed a handshake.
+func (s *Swarm[T]) markEstablished(cs *channelState[T]) {
+	if !cs.isPending() {
+		return
+	}
+	if remoteKey := cs.Channel.RemoteKey(); remoteKey.IsZero() {
+		return
+	}
+	s.forgetPending(cs)
+}
+
+// forgetPending removes cs from the pending channels, if it is one.
+// It must be called when a channel is removed from the store.
+func (s *Swarm[T]) forgetPending(cs *channelState[T]) {
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+	if cs.pendingElem != nil {
+		s.pending.Remove(cs.pendingElem)
+		cs.pendingElem = nil
+		cs.pending.Store(false)
+	}
+}
+
+// evictPending removes the oldest pending channel, and returns true if there was one.
+// It must be called with admitMu held.
+func (s *Swarm[T]) evictPending() bool {
+	front := s.pending.Front()
+	if front == nil {
+		return false
+	}
+	victim := s.pending.Remove(front).(*channelState[T])
+	victim.pendingElem = nil
+	victim.pending.Store(false)
+	s.store.deleteMatching(s.keyForAddr(victim.Addr), func(cs *channelState[T]) bool {
+		return cs == victim
+	})
+	victim.Channel.Close()
+	s.evictedChannels.Add(1)
+	return true
+}
+
+// evict removes a single established channel from the store, and returns true if one was removed.
+// Channels to peers which are not whitelisted are evicted first, least recently used first.
+// If evictPreferred is true then whitelisted peers can be evicted, least recently used first.
+// Channels to peers with registered endpoints, and pending channels, are never evicted.
+// It scans every channel, so it is only called when the table is full, and there are no pending channels to evict instead.
+// It must be called with admitMu held.
+func (s *Swarm[T]) evict(evictPreferred bool) bool {
+	var victim *channelState[T]
+	victimRank := 0
+	for _, cs := range s.channelStates() {
+		var rank int
+		switch {
+		case cs.Paths != nil, cs.pendingElem != nil:
+			continue
+		case !s.isPreferred(cs):
+			rank = 2
+		case evictPreferred:
+			rank = 1
+		default:
+			continue
+		}
+		if rank > victimRank || (rank == victimRank && cs.lastActive().Before(victim.lastActive())) {
+			victim, victimRank = cs, rank
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	s.store.purge(func(_ string, cs *channelState[T]) bool {
+		return cs != victim
+	})
+	victim.Channel.Close()
+	s.evictedChannels.Add(1)
+	return true
+}
+
+// isPreferred returns true if the channel is to a whitelisted peer.
+func (s *Swarm[T]) isPreferred(cs *channelState[T]) bool {
+	remoteKey := cs.Channel.RemoteKey()
+	id := s.config.fingerprinter(&remoteKey)
+	return s.config.whitelist(Addr[T]{ID: id, Addr: cs.Addr})
+}
+
+// prefixKey returns the key used to rate limit handshakes from addr.
+// Addresses without an IP are limited individually.
+func (s *Swarm[T]) prefixKey(addr T) string {
+	ip, ok := p2p.ExtractIP(addr)
+	if !ok {
+		return s.keyForAddr(addr)
+	}
+	bits := s.config.v6PrefixLen
+	if ip.Is4() || ip.Is4In6() {
+		ip = ip.Unmap()
+		bits = s.config.v4PrefixLen
+	}
+	pfx, err := ip.Prefix(bits)
+	if err != nil {
+		return ip.String()
+	}
+	return pfx.String()
+}
+
+// isPending returns true if cs was created for an incoming handshake, which has not completed.
+func (cs *channelState[T]) isPending() bool {
+	return cs.pending.Load()
+}
+
+// lastActive returns the last time application data was sent or received through the channel.
+func (cs *channelState[T]) lastActive() time.Time {
+	ret := cs.CreatedAt
+	stats := cs.Channel.Stats()
+	for _, t := range []time.Time{stats.LastReceived, stats.LastSent} {
+		if t.After(ret) {
+			ret = t
+		}
+	}
+	return ret
+}
+
+// rateLimiter is a token bucket rate limiter, with a bucket for each key.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter which allows rate events per second, with bursts of up to burst.
+// If rate <= 0 then all events are allowed.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (rl *rateLimiter) allow(key string, now time.Time) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.refill(rl.rate, rl.burst, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// purge removes buckets which have refilled completely, they are equivalent to a missing bucket.
+func (rl *rateLimiter) purge(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for k, b := range rl.buckets {
+		b.refill(rl.rate, rl.burst, now)
+		if b.tokens >= rl.burst {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+func (b *bucket) refill(rate, burst float64, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+		b.last = now
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
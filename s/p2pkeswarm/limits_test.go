@@ -0,0 +1,104 @@
+package p2pkeswarm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/s/memswarm"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow("a", now))
+	}
+	require.False(t, rl.allow("a", now))
+	require.True(t, rl.allow("b", now))
+	require.True(t, rl.allow("a", now.Add(100*time.Millisecond)))
+
+	rl.purge(now.Add(time.Second))
+	require.Len(t, rl.buckets, 0)
+}
+
+func TestMaxChannels(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	s := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0), WithMaxChannels[memswarm.Addr](2))
+	go p2p.DiscardTells[Addr[memswarm.Addr]](ctx, s)
+	clients := make([]*Swarm[memswarm.Addr], 3)
+	for i := range clients {
+		clients[i] = New[memswarm.Addr](r.NewSwarm(), newTestKey(t, i+1))
+	}
+	t.Cleanup(func() {
+		require.NoError(t, s.Close())
+		for _, c := range clients {
+			require.NoError(t, c.Close())
+		}
+	})
+	dst := s.LocalAddrs()[0]
+	for _, c := range clients[:2] {
+		require.NoError(t, c.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	}
+	// the third handshake is rejected, so the Tell does not complete until it is cancelled.
+	ctx2, cf := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- clients[2].Tell(ctx2, dst, p2p.IOVec{[]byte("hello")})
+	}()
+	require.Eventually(t, func() bool {
+		return s.Stats().RejectedHandshakes >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cf()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+
+	stats := s.Stats()
+	require.Equal(t, 2, stats.Channels)
+	require.Equal(t, 0, stats.PendingHandshakes)
+	require.Equal(t, uint64(0), stats.EvictedChannels)
+}
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	// the server's replies to the first client are dropped, so its handshake never completes.
+	var stalled memswarm.Addr
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10), memswarm.WithTellTransform(func(m *memswarm.Message) bool {
+		return m.Dst != stalled
+	}))
+	s := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0), WithMaxPendingHandshakes[memswarm.Addr](1))
+	go p2p.DiscardTells[Addr[memswarm.Addr]](ctx, s)
+	clients := make([]*Swarm[memswarm.Addr], 2)
+	for i := range clients {
+		clients[i] = New[memswarm.Addr](r.NewSwarm(), newTestKey(t, i+1))
+	}
+	stalled = clients[0].LocalAddrs()[0].Addr
+	t.Cleanup(func() {
+		require.NoError(t, s.Close())
+		for _, c := range clients {
+			require.NoError(t, c.Close())
+		}
+	})
+	dst := s.LocalAddrs()[0]
+	ctx2, cf := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- clients[0].Tell(ctx2, dst, p2p.IOVec{[]byte("hello")})
+	}()
+	require.Eventually(t, func() bool {
+		return s.Stats().PendingHandshakes == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the pending channel is evicted to make room for the second client.
+	require.NoError(t, clients[1].Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	cf()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+	stats := s.Stats()
+	require.GreaterOrEqual(t, stats.EvictedChannels, uint64(1))
+	require.Equal(t, uint64(0), stats.RejectedHandshakes)
+}
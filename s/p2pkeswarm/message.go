@@ -0,0 +1,90 @@
+package p2pkeswarm
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.brendoncarroll.net/p2p/p/p2pke"
+)
+
+// headerSize is the size of the type header at the start of every plaintext sent through a channel,
+// to peers which have sent headerVersion.
+const headerSize = 1
+
+// headerVersion is sent as the p2pke AppVersion, to tell the peer that plaintexts start with a type header.
+// Peers which do not send it predate the header: they only send and receive Tells, with no header.
+const headerVersion = 1
+
+const (
+	// askReqHeaderSize is the type, the request id, and the timeout in milliseconds
+	askReqHeaderSize = headerSize + 8 + 4
+	// askRespHeaderSize is the type, the request id, and the error code
+	askRespHeaderSize = headerSize + 8 + 1
+	// maxHeaderSize is the largest header that can precede application data.
+	maxHeaderSize = askReqHeaderSize
+)
+
+const (
+	msgTypeTell = uint8(iota)
+	msgTypeProbe
+	msgTypeProbeReply
+	msgTypeAskReq
+	msgTypeAskResp
+	// msgTypeTransition contains a keytransition.Transition to the sender's key.
+	msgTypeTransition
+)
+
+// hasHeader returns true if the messages sent through c start with a type header.
+func hasHeader(c *p2pke.Channel) bool {
+	return c.RemoteAppVersion() >= headerVersion
+}
+
+func makeProbe(typ uint8, id uint64) []byte {
+	var buf [headerSize + 8]byte
+	buf[0] = typ
+	binary.BigEndian.PutUint64(buf[headerSize:], id)
+	return buf[:]
+}
+
+func parseProbe(x []byte) (uint64, bool) {
+	if len(x) != headerSize+8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(x[headerSize:]), true
+}
+
+func makeAskReq(id uint64, timeout time.Duration) []byte {
+	var buf [askReqHeaderSize]byte
+	buf[0] = msgTypeAskReq
+	binary.BigEndian.PutUint64(buf[headerSize:], id)
+	binary.BigEndian.PutUint32(buf[headerSize+8:], uint32(timeout/time.Millisecond))
+	return buf[:]
+}
+
+func parseAskReq(x []byte) (id uint64, timeout time.Duration, body []byte, _ error) {
+	if len(x) < askReqHeaderSize {
+		return 0, 0, nil, errors.New("ask request too short")
+	}
+	id = binary.BigEndian.Uint64(x[headerSize:])
+	timeout = time.Duration(binary.BigEndian.Uint32(x[headerSize+8:])) * time.Millisecond
+	return id, timeout, x[askReqHeaderSize:], nil
+}
+
+func makeAskResp(id uint64, code uint8) []byte {
+	var buf [askRespHeaderSize]byte
+	buf[0] = msgTypeAskResp
+	binary.BigEndian.PutUint64(buf[headerSize:], id)
+	buf[headerSize+8] = code
+	return buf[:]
+}
+
+func parseAskResp(x []byte) (id uint64, code uint8, body []byte, _ error) {
+	if len(x) < askRespHeaderSize {
+		return 0, 0, nil, errors.New("ask response too short")
+	}
+	id = binary.BigEndian.Uint64(x[headerSize:])
+	code = x[headerSize+8]
+	return id, code, x[askRespHeaderSize:], nil
+}
@@ -7,6 +7,7 @@ import (
 	"golang.org/x/crypto/sha3"
 
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
 	"go.brendoncarroll.net/p2p/f/x509"
 )
 
@@ -20,6 +21,20 @@ type swarmConfig[T p2p.Addr] struct {
 	tellTimeout   time.Duration
 	whitelist     func(Addr[T]) bool
 	registry      x509.Registry
+	probeInterval time.Duration
+	askRetryMin   time.Duration
+	askRetryMax   time.Duration
+	maxServing    int
+
+	maxChannels    int
+	maxPending     int
+	handshakeRate  float64
+	handshakeBurst int
+	v4PrefixLen    int
+	v6PrefixLen    int
+
+	transitions *keytransition.Set
+	transition  *keytransition.Transition
 }
 
 func newDefaultConfig[T p2p.Addr]() swarmConfig[T] {
@@ -29,6 +44,17 @@ func newDefaultConfig[T p2p.Addr]() swarmConfig[T] {
 		tellTimeout:   3 * time.Second,
 		whitelist:     func(Addr[T]) bool { return true },
 		registry:      x509.DefaultRegistry(),
+		probeInterval: 2 * time.Second,
+		askRetryMin:   250 * time.Millisecond,
+		askRetryMax:   2 * time.Second,
+		maxServing:    256,
+
+		maxChannels:    4096,
+		maxPending:     512,
+		handshakeRate:  10,
+		handshakeBurst: 20,
+		v4PrefixLen:    24,
+		v6PrefixLen:    48,
 	}
 }
 
@@ -61,3 +87,86 @@ func WithWhitelist[T p2p.Addr](fn func(Addr[T]) bool) Option[T] {
 		c.whitelist = fn
 	}
 }
+
+// WithProbeInterval sets the interval between probes of the paths to peers with registered endpoints.
+// A path is considered dead after 3 intervals without receiving anything.
+func WithProbeInterval[T p2p.Addr](d time.Duration) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.probeInterval = d
+	}
+}
+
+// WithMaxChannels sets the maximum number of channels the swarm will hold.
+// When the limit is reached, incoming handshakes evict pending channels, and then
+// channels to peers which are not whitelisted.  If there is nothing to evict the handshake is rejected.
+// n <= 0 means no limit.  The default is 4096.
+func WithMaxChannels[T p2p.Addr](n int) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.maxChannels = n
+	}
+}
+
+// WithMaxPendingHandshakes sets the maximum number of channels created by incoming handshakes, which have not completed.
+// When the limit is reached, each incoming handshake evicts the oldest pending channel,
+// so handshakes which will never complete cannot lock out new peers.
+// n <= 0 means no limit.  The default is 512.
+func WithMaxPendingHandshakes[T p2p.Addr](n int) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.maxPending = n
+	}
+}
+
+// WithHandshakeRateLimit limits the rate at which handshakes from a single IP prefix can create channels.
+// perSecond <= 0 disables the limit.  The default is 10 per second, with bursts of 20.
+func WithHandshakeRateLimit[T p2p.Addr](perSecond float64, burst int) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.handshakeRate = perSecond
+		c.handshakeBurst = burst
+	}
+}
+
+// WithHandshakePrefixLens sets the length of the IP prefixes used for handshake rate limiting.
+// The default is /24 for IPv4 and /48 for IPv6.
+// Addresses which do not contain an IP are rate limited individually.
+func WithHandshakePrefixLens[T p2p.Addr](v4, v6 int) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.v4PrefixLen = v4
+		c.v6PrefixLen = v6
+	}
+}
+
+// WithAskRetransmit sets the interval between retransmissions of an ask request.
+// The interval starts at min and doubles after every retransmission up to max.
+func WithAskRetransmit[T p2p.Addr](min, max time.Duration) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.askRetryMin = min
+		c.askRetryMax = max
+	}
+}
+
+// WithMaxServingAsks sets the maximum number of requests which can be served concurrently.
+// Requests which arrive when the limit is reached are dropped, and served if they are retransmitted later.
+// n <= 0 means no limit.  The default is 256.
+func WithMaxServingAsks[T p2p.Addr](n int) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.maxServing = n
+	}
+}
+
+// WithKeyTransitions sets the Set used to accept a peer's new key in place of its old PeerID.
+// Transitions announced by peers are verified and added to the set.
+// The set must use the same Fingerprinter as the swarm.
+func WithKeyTransitions[T p2p.Addr](set *keytransition.Set) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.transitions = set
+	}
+}
+
+// WithTransition sets a transition to the swarm's key, which is announced to every peer
+// the swarm establishes a channel with.
+// New panics if t.New is not the swarm's public key.
+func WithTransition[T p2p.Addr](t *keytransition.Transition) Option[T] {
+	return func(c *swarmConfig[T]) {
+		c.transition = t
+	}
+}
@@ -0,0 +1,236 @@
+package p2pkeswarm
+
+import (
+	"sync"
+	"time"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// PathInfo describes a candidate endpoint for a peer.
+type PathInfo[T p2p.Addr] struct {
+	Addr T
+	// RTT is the smoothed round trip time measured by probes.
+	// It is zero if no probe sent over the path has been answered.
+	RTT time.Duration
+	// LastReceived is the last time an authenticated message arrived over the path.
+	LastReceived time.Time
+	// Alive is true if the path has received a message recently.
+	Alive bool
+	// Active is true if the path is currently used for sending.
+	Active bool
+}
+
+// endpointTable holds the candidate endpoints registered for each peer.
+type endpointTable[T p2p.Addr] struct {
+	mu     sync.RWMutex
+	byPeer map[p2p.PeerID][]T
+	byKey  map[string]p2p.PeerID
+}
+
+func newEndpointTable[T p2p.Addr]() *endpointTable[T] {
+	return &endpointTable[T]{
+		byPeer: make(map[p2p.PeerID][]T),
+		byKey:  make(map[string]p2p.PeerID),
+	}
+}
+
+// set replaces the endpoints for id, and returns the endpoints which were previously registered.
+func (et *endpointTable[T]) set(id p2p.PeerID, addrs []T, keyFn func(T) string) []T {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	prev := et.byPeer[id]
+	for _, addr := range prev {
+		delete(et.byKey, keyFn(addr))
+	}
+	if len(addrs) == 0 {
+		delete(et.byPeer, id)
+		return prev
+	}
+	et.byPeer[id] = append([]T{}, addrs...)
+	for _, addr := range addrs {
+		et.byKey[keyFn(addr)] = id
+	}
+	return prev
+}
+
+func (et *endpointTable[T]) forPeer(id p2p.PeerID) []T {
+	et.mu.RLock()
+	defer et.mu.RUnlock()
+	return et.byPeer[id]
+}
+
+// lookup returns the peer, and all of its endpoints, if key is a registered endpoint.
+func (et *endpointTable[T]) lookup(key string) (p2p.PeerID, []T, bool) {
+	et.mu.RLock()
+	defer et.mu.RUnlock()
+	id, exists := et.byKey[key]
+	if !exists {
+		return p2p.PeerID{}, nil, false
+	}
+	return id, et.byPeer[id], true
+}
+
+// pathSet tracks the state of each candidate path to a peer, and selects the path used for sending.
+type pathSet[T p2p.Addr] struct {
+	timeout time.Duration
+
+	mu        sync.Mutex
+	paths     []pathState[T]
+	active    int
+	nextProbe uint64
+}
+
+type pathState[T p2p.Addr] struct {
+	addr         T
+	key          string
+	rtt          time.Duration
+	lastReceived time.Time
+	probeID      uint64
+	probeSentAt  time.Time
+}
+
+// newPathSet creates a pathSet for addrs.  A path is considered dead if nothing
+// has been received over it for timeout.
+func newPathSet[T p2p.Addr](addrs []T, keys []string, timeout time.Duration) *pathSet[T] {
+	paths := make([]pathState[T], len(addrs))
+	for i := range addrs {
+		paths[i] = pathState[T]{addr: addrs[i], key: keys[i]}
+	}
+	return &pathSet[T]{
+		timeout: timeout,
+		paths:   paths,
+		active:  -1,
+	}
+}
+
+// targets returns the addresses that outgoing messages should be sent to.
+// If no path has been selected, then all candidates are returned.
+func (ps *pathSet[T]) targets() []T {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.active >= 0 {
+		return []T{ps.paths[ps.active].addr}
+	}
+	ret := make([]T, len(ps.paths))
+	for i := range ps.paths {
+		ret[i] = ps.paths[i].addr
+	}
+	return ret
+}
+
+// onReceive is called when an authenticated message arrives from the endpoint with key.
+func (ps *pathSet[T]) onReceive(key string, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i := range ps.paths {
+		if ps.paths[i].key == key {
+			ps.paths[i].lastReceived = now
+		}
+	}
+	if ps.active < 0 {
+		ps.reselect(now)
+	}
+}
+
+// startProbes assigns a new probe id to every path and returns the addresses and ids to send.
+func (ps *pathSet[T]) startProbes(now time.Time) (addrs []T, ids []uint64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i := range ps.paths {
+		p := &ps.paths[i]
+		ps.nextProbe++
+		p.probeID = ps.nextProbe
+		p.probeSentAt = now
+		addrs = append(addrs, p.addr)
+		ids = append(ids, p.probeID)
+	}
+	return addrs, ids
+}
+
+// onProbeReply updates the RTT of the path which sent the probe with id.
+func (ps *pathSet[T]) onProbeReply(id uint64, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i := range ps.paths {
+		p := &ps.paths[i]
+		if p.probeID != id || p.probeSentAt.IsZero() {
+			continue
+		}
+		sample := now.Sub(p.probeSentAt)
+		if p.rtt == 0 {
+			p.rtt = sample
+		} else {
+			p.rtt = (7*p.rtt + sample) / 8
+		}
+		p.probeSentAt = time.Time{}
+		p.lastReceived = now
+		ps.reselect(now)
+		return
+	}
+}
+
+// check fails over to another path if the active path has stopped receiving.
+func (ps *pathSet[T]) check(now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.reselect(now)
+}
+
+// reselect picks the live path with the lowest RTT.
+// The active path is only replaced if it is dead, or another path is significantly faster.
+func (ps *pathSet[T]) reselect(now time.Time) {
+	best := -1
+	for i := range ps.paths {
+		if !ps.isAlive(i, now) {
+			continue
+		}
+		if best < 0 || ps.isFaster(i, best) {
+			best = i
+		}
+	}
+	switch {
+	case best < 0:
+		ps.active = -1
+	case ps.active < 0 || !ps.isAlive(ps.active, now):
+		ps.active = best
+	case ps.paths[ps.active].rtt == 0 && ps.paths[best].rtt > 0:
+		ps.active = best
+	case ps.paths[best].rtt > 0 && ps.paths[best].rtt < ps.paths[ps.active].rtt*4/5:
+		ps.active = best
+	}
+}
+
+func (ps *pathSet[T]) isAlive(i int, now time.Time) bool {
+	lr := ps.paths[i].lastReceived
+	return !lr.IsZero() && now.Sub(lr) < ps.timeout
+}
+
+// isFaster returns true if path i should be preferred over path j
+func (ps *pathSet[T]) isFaster(i, j int) bool {
+	ri, rj := ps.paths[i].rtt, ps.paths[j].rtt
+	switch {
+	case ri == 0:
+		return false
+	case rj == 0:
+		return true
+	default:
+		return ri < rj
+	}
+}
+
+func (ps *pathSet[T]) info(now time.Time) []PathInfo[T] {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ret := make([]PathInfo[T], len(ps.paths))
+	for i, p := range ps.paths {
+		ret[i] = PathInfo[T]{
+			Addr:         p.addr,
+			RTT:          p.rtt,
+			LastReceived: p.lastReceived,
+			Alive:        ps.isAlive(i, now),
+			Active:       i == ps.active,
+		}
+	}
+	return ret
+}
@@ -4,14 +4,18 @@ import (
 	"sync"
 )
 
-type store[K comparable, V any] struct {
-	mu sync.RWMutex
-	m  map[K]V
+// store is a map which is safe for concurrent use.
+// A value can be stored under multiple keys, and the store keeps count of the distinct values.
+type store[K comparable, V comparable] struct {
+	mu   sync.RWMutex
+	m    map[K]V
+	refs map[V]int
 }
 
-func newStore[K comparable, V any]() *store[K, V] {
+func newStore[K comparable, V comparable]() *store[K, V] {
 	return &store[K, V]{
-		m: make(map[K]V),
+		m:    make(map[K]V),
+		refs: make(map[V]int),
 	}
 }
 
@@ -28,11 +32,48 @@ func (s *store[K, V]) getOrCreate(k K, fn func() V) V {
 	v, exists := s.m[k]
 	if !exists {
 		v = fn()
-		s.m[k] = v
+		s.put(k, v)
 	}
 	return v
 }
 
+// getOrCreateAll returns the value stored under any of ks.
+// If there is no value, then fn is called and the result is stored under all of ks.
+func (s *store[K, V]) getOrCreateAll(ks []K, fn func() V) V {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range ks {
+		if v, exists := s.m[k]; exists {
+			return v
+		}
+	}
+	v := fn()
+	for _, k := range ks {
+		s.put(k, v)
+	}
+	return v
+}
+
+// forEach calls fn for every item in the store.
+// fn must not modify the store.
+func (s *store[K, V]) forEach(fn func(k K, v V)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, v := range s.m {
+		fn(k, v)
+	}
+}
+
+func (s *store[K, V]) delete(k K) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, exists := s.m[k]
+	if exists {
+		s.remove(k, v)
+	}
+	return v, exists
+}
+
 // purge applies the predicate fn to all items in the store.
 // If fn returns false, the item is deleted.
 func (s *store[K, V]) purge(fn func(k K, v V) bool) {
@@ -40,7 +81,7 @@ func (s *store[K, V]) purge(fn func(k K, v V) bool) {
 	defer s.mu.Unlock()
 	for k, v := range s.m {
 		if !fn(k, v) {
-			delete(s.m, k)
+			s.remove(k, v)
 		}
 	}
 }
@@ -50,6 +91,26 @@ func (s *store[K, V]) deleteMatching(k K, fn func(v V) bool) {
 	defer s.mu.Unlock()
 	v, exists := s.m[k]
 	if exists && fn(v) {
-		delete(s.m, k)
+		s.remove(k, v)
+	}
+}
+
+// distinct returns the number of distinct values in the store.
+func (s *store[K, V]) distinct() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.refs)
+}
+
+// put and remove must be called with mu held.
+func (s *store[K, V]) put(k K, v V) {
+	s.m[k] = v
+	s.refs[v]++
+}
+
+func (s *store[K, V]) remove(k K, v V) {
+	delete(s.m, k)
+	if s.refs[v]--; s.refs[v] <= 0 {
+		delete(s.refs, v)
 	}
 }
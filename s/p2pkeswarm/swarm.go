@@ -1,10 +1,15 @@
 package p2pkeswarm
 
 import (
+	"container/list"
 	"context"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"go.brendoncarroll.net/stdctx/logctx"
 	"golang.org/x/exp/constraints"
 	"golang.org/x/sync/errgroup"
@@ -16,9 +21,12 @@ import (
 	"go.brendoncarroll.net/p2p/s/udpswarm"
 )
 
-const Overhead = p2pke.Overhead
+// Overhead is the per message overhead taken up by the swarm.
+// It includes the largest header the swarm puts before application data, which is the header of an Ask request,
+// so the MTU of Tells is also reduced by that much.
+const Overhead = p2pke.Overhead + maxHeaderSize
 
-var _ p2p.SecureSwarm[Addr[udpswarm.Addr], x509.PublicKey] = &Swarm[udpswarm.Addr]{}
+var _ p2p.SecureAskSwarm[Addr[udpswarm.Addr], x509.PublicKey] = &Swarm[udpswarm.Addr]{}
 
 type Swarm[T p2p.Addr] struct {
 	inner      p2p.Swarm[T]
@@ -28,10 +36,26 @@ type Swarm[T p2p.Addr] struct {
 
 	localID p2p.PeerID
 	hub     swarmutil.TellHub[Addr[T]]
-	store   *store[string, *channelState]
-	ctx     context.Context
-	cf      context.CancelFunc
-	eg      errgroup.Group
+	askHub  swarmutil.AskHub[Addr[T]]
+	asker   *asker
+	served  *store[servedKey, *servedAsk]
+	// serving limits the number of requests being served, it is nil if there is no limit.
+	serving   chan struct{}
+	store     *store[string, *channelState[T]]
+	endpoints *endpointTable[T]
+	limiter   *rateLimiter
+
+	// admitMu protects adding channels to the store, and pending.
+	admitMu sync.Mutex
+	// pending holds the channels created by incoming handshakes which have not been established, oldest first.
+	pending *list.List
+
+	rejectedHandshakes atomic.Uint64
+	evictedChannels    atomic.Uint64
+
+	ctx context.Context
+	cf  context.CancelFunc
+	eg  errgroup.Group
 }
 
 func New[T p2p.Addr](inner p2p.Swarm[T], privateKey x509.PrivateKey, opts ...Option[T]) *Swarm[T] {
@@ -43,6 +67,9 @@ func New[T p2p.Addr](inner p2p.Swarm[T], privateKey x509.PrivateKey, opts ...Opt
 	if err != nil {
 		panic(err)
 	}
+	if t := config.transition; t != nil && !x509.EqualPublicKeys(&t.New, &pubKey) {
+		panic("p2pkeswarm: transition is not to the swarm's key")
+	}
 	ctx := config.bgCtx
 	ctx, cf := context.WithCancel(ctx)
 	s := &Swarm[T]{
@@ -52,10 +79,19 @@ func New[T p2p.Addr](inner p2p.Swarm[T], privateKey x509.PrivateKey, opts ...Opt
 		config:     config,
 		localID:    config.fingerprinter(&pubKey),
 
-		hub:   swarmutil.NewTellHub[Addr[T]](),
-		store: newStore[string, *channelState](),
-		ctx:   ctx,
-		cf:    cf,
+		hub:       swarmutil.NewTellHub[Addr[T]](),
+		askHub:    swarmutil.NewAskHub[Addr[T]](),
+		asker:     newAsker(),
+		served:    newStore[servedKey, *servedAsk](),
+		store:     newStore[string, *channelState[T]](),
+		endpoints: newEndpointTable[T](),
+		limiter:   newRateLimiter(config.handshakeRate, config.handshakeBurst),
+		pending:   list.New(),
+		ctx:       ctx,
+		cf:        cf,
+	}
+	if config.maxServing > 0 {
+		s.serving = make(chan struct{}, config.maxServing)
 	}
 	numWorkers := 1 + runtime.GOMAXPROCS(0)
 	for i := 0; i < numWorkers; i++ {
@@ -66,6 +102,9 @@ func New[T p2p.Addr](inner p2p.Swarm[T], privateKey x509.PrivateKey, opts ...Opt
 	s.eg.Go(func() error {
 		return s.cleanupLoop(ctx)
 	})
+	s.eg.Go(func() error {
+		return s.probeLoop(ctx)
+	})
 	return s
 }
 
@@ -78,7 +117,10 @@ func (s *Swarm[T]) Tell(ctx context.Context, dst Addr[T], v p2p.IOVec) error {
 	if err != nil {
 		return err
 	}
-	return c.Send(ctx, v)
+	if !hasHeader(c) {
+		return c.Send(ctx, v)
+	}
+	return c.Send(ctx, append(p2p.IOVec{{msgTypeTell}}, v...))
 }
 
 // Receive implements p2p.Swarm.Receive
@@ -115,44 +157,178 @@ func (s *Swarm[T]) LookupPublicKey(ctx context.Context, dst Addr[T]) (ret x509.P
 
 func (s *Swarm[T]) MTU() int {
 	n := s.inner.MTU() - Overhead
-	return min(n, p2pke.MaxMessageLen)
+	return min(n, p2pke.MaxMessageLen-maxHeaderSize)
 }
 
 func (s *Swarm[T]) Close() error {
 	s.cf()
 	err := s.inner.Close()
 	s.hub.CloseWithError(p2p.ErrClosed)
+	s.askHub.CloseWithError(p2p.ErrClosed)
 	s.eg.Wait()
 	return err
 }
 
+// SetEndpoints registers addrs as the candidate endpoints for the peer id.
+// Messages to and from any of the endpoints share a single channel, which probes each path,
+// sends over the live path with the lowest RTT, and fails over when a path stops receiving.
+// Any existing channels for the endpoints are closed.
+// Calling SetEndpoints with no addrs removes the registration.
+func (s *Swarm[T]) SetEndpoints(id p2p.PeerID, addrs []T) {
+	prev := s.endpoints.set(id, addrs, s.keyForAddr)
+	for _, addr := range append(prev, addrs...) {
+		if cs, exists := s.store.delete(s.keyForAddr(addr)); exists {
+			s.forgetPending(cs)
+			cs.Channel.Close()
+		}
+	}
+}
+
+// Paths returns the state of each registered endpoint for the peer id.
+func (s *Swarm[T]) Paths(id p2p.PeerID) []PathInfo[T] {
+	addrs := s.endpoints.forPeer(id)
+	if len(addrs) == 0 {
+		return nil
+	}
+	if cs, exists := s.store.get(s.keyForAddr(addrs[0])); exists && cs.Paths != nil {
+		return cs.Paths.info(time.Now())
+	}
+	ret := make([]PathInfo[T], len(addrs))
+	for i := range addrs {
+		ret[i] = PathInfo[T]{Addr: addrs[i]}
+	}
+	return ret
+}
+
+// ActivePath returns the endpoint currently used to send to the peer id.
+// It returns false if no path has been selected.
+func (s *Swarm[T]) ActivePath(id p2p.PeerID) (ret T, _ bool) {
+	for _, pi := range s.Paths(id) {
+		if pi.Active {
+			return pi.Addr, true
+		}
+	}
+	return ret, false
+}
+
+// ChannelInfo describes a channel held by the swarm.
+type ChannelInfo[T p2p.Addr] struct {
+	// Addr is the address of the remote party.
+	// Addr.ID is zero if the channel has never completed a handshake.
+	Addr      Addr[T]
+	CreatedAt time.Time
+	Stats     p2pke.ChannelStats
+	// Paths is set for peers with registered endpoints.
+	Paths []PathInfo[T]
+}
+
+// ListChannels returns information about all of the channels currently held by the swarm.
+func (s *Swarm[T]) ListChannels() []ChannelInfo[T] {
+	css := s.channelStates()
+	now := time.Now()
+	ret := make([]ChannelInfo[T], 0, len(css))
+	for _, cs := range css {
+		stats := cs.Channel.Stats()
+		ci := ChannelInfo[T]{
+			Addr:      Addr[T]{ID: cs.ID, Addr: cs.Addr},
+			CreatedAt: cs.CreatedAt,
+			Stats:     stats,
+		}
+		if ci.Addr.ID.IsZero() && !stats.RemoteKey.IsZero() {
+			ci.Addr.ID = s.config.fingerprinter(&stats.RemoteKey)
+		}
+		if cs.Paths != nil {
+			ci.Paths = cs.Paths.info(now)
+			for _, pi := range ci.Paths {
+				if pi.Active {
+					ci.Addr.Addr = pi.Addr
+				}
+			}
+		}
+		ret = append(ret, ci)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Addr.String() < ret[j].Addr.String()
+	})
+	return ret
+}
+
+// channelStates returns every distinct channelState in the store.
+// Channels to peers with registered endpoints are stored under multiple keys, but only appear once.
+func (s *Swarm[T]) channelStates() (ret []*channelState[T]) {
+	seen := make(map[*channelState[T]]struct{})
+	s.store.forEach(func(_ string, cs *channelState[T]) {
+		if _, exists := seen[cs]; exists {
+			return
+		}
+		seen[cs] = struct{}{}
+		ret = append(ret, cs)
+	})
+	return ret
+}
+
 // getFullAddr returns a p2pke.Channel which matches the full Addr addr.
+// If the peer has registered endpoints, then the peer's channel is used regardless of addr.Addr
 func (s *Swarm[T]) getFullAddr(ctx context.Context, addr Addr[T]) (*p2pke.Channel, error) {
+	if addrs := s.endpoints.forPeer(addr.ID); len(addrs) > 0 {
+		cs := s.getPeerChannel(addr.ID, addrs)
+		if err := cs.Channel.WaitReady(ctx); err != nil {
+			return nil, err
+		}
+		s.announceTransition(cs)
+		return cs.Channel, nil
+	}
 	for {
-		c := s.store.getOrCreate(s.keyForAddr(addr.Addr), func() *channelState {
-			return &channelState{
-				CreatedAt: time.Now(),
-				Channel: p2pke.NewChannel(p2pke.ChannelConfig{
-					PrivateKey: s.privateKey,
-					AcceptKey: func(pubKey *x509.PublicKey) bool {
-						id := s.config.fingerprinter(pubKey)
-						return id == addr.ID
-					},
-					Send: s.getSender(addr.Addr),
-				}),
-			}
+		c, err := s.addChannel(s.keyForAddr(addr.Addr), false, func() *channelState[T] {
+			return s.newChannelState(addr.Addr, func(pubKey *x509.PublicKey) bool {
+				return s.isPeer(addr.ID, pubKey)
+			}, s.getSender(addr.Addr), nil)
 		})
+		if err != nil {
+			return nil, err
+		}
 		if err := c.Channel.WaitReady(ctx); err != nil {
 			return nil, err
 		}
 		remoteKey := c.Channel.RemoteKey()
-		remoteID := s.config.fingerprinter(&remoteKey)
-		if remoteID == addr.ID {
+		if s.isPeer(addr.ID, &remoteKey) {
+			s.announceTransition(c)
 			return c.Channel, nil
 		}
-		s.store.deleteMatching(s.keyForAddr(addr.Addr), func(v *channelState) bool {
+		s.store.deleteMatching(s.keyForAddr(addr.Addr), func(v *channelState[T]) bool {
 			return v.Channel == c.Channel
 		})
+		s.forgetPending(c)
+	}
+}
+
+// getPeerChannel returns the channel shared by all the endpoints of a peer.
+func (s *Swarm[T]) getPeerChannel(id p2p.PeerID, addrs []T) *channelState[T] {
+	keys := make([]string, len(addrs))
+	for i := range addrs {
+		keys[i] = s.keyForAddr(addrs[i])
+	}
+	return s.store.getOrCreateAll(keys, func() *channelState[T] {
+		ps := newPathSet(addrs, keys, 3*s.config.probeInterval)
+		cs := s.newChannelState(addrs[0], func(pubKey *x509.PublicKey) bool {
+			return s.isPeer(id, pubKey)
+		}, s.getMultiSender(ps), ps)
+		cs.ID = id
+		return cs
+	})
+}
+
+func (s *Swarm[T]) newChannelState(addr T, acceptKey func(*x509.PublicKey) bool, send p2pke.SendFunc, paths *pathSet[T]) *channelState[T] {
+	return &channelState[T]{
+		Addr:      addr,
+		CreatedAt: time.Now(),
+		Channel: p2pke.NewChannel(p2pke.ChannelConfig{
+			PrivateKey: s.privateKey,
+			AcceptKey:  acceptKey,
+			Send:       send,
+			AppVersion: headerVersion,
+		}),
+		Paths: paths,
 	}
 }
 
@@ -169,33 +345,112 @@ func (s *Swarm[T]) recvLoop(ctx context.Context) error {
 }
 
 func (s *Swarm[T]) handleMessage(ctx context.Context, msg p2p.Message[T]) error {
-	cs := s.store.getOrCreate(s.keyForAddr(msg.Src), func() *channelState {
-		return &channelState{
-			CreatedAt: time.Now(),
-			Channel: p2pke.NewChannel(p2pke.ChannelConfig{
-				PrivateKey: s.privateKey,
-				AcceptKey: func(pubKey *x509.PublicKey) bool {
-					id := s.config.fingerprinter(pubKey)
-					return s.config.whitelist(Addr[T]{ID: id, Addr: msg.Src})
-				},
-				Send: s.getSender(msg.Src),
-			}),
+	key := s.keyForAddr(msg.Src)
+	var cs *channelState[T]
+	if id, addrs, ok := s.endpoints.lookup(key); ok {
+		cs = s.getPeerChannel(id, addrs)
+	} else if cs2, exists := s.store.get(key); exists {
+		cs = cs2
+	} else {
+		// Only a new handshake can create a channel.
+		// A new channel could not decrypt any other message, it would be rejected with an error
+		// after using space in the channel table, so it is dropped here instead.
+		// The sender's channel will handshake again once it stops receiving replies.
+		if !p2pke.IsInitHello(msg.Payload) {
+			return nil
 		}
-	})
+		// Dropped handshakes are counted in the stats, instead of returning an error which would be logged
+		// for every message in a flood.
+		if !s.limiter.allow(s.prefixKey(msg.Src), time.Now()) {
+			s.rejectedHandshakes.Add(1)
+			return nil
+		}
+		var err error
+		cs, err = s.addChannel(key, true, func() *channelState[T] {
+			return s.newChannelState(msg.Src, func(pubKey *x509.PublicKey) bool {
+				id := s.config.fingerprinter(pubKey)
+				return s.config.whitelist(Addr[T]{ID: id, Addr: msg.Src})
+			}, s.getSender(msg.Src), nil)
+		})
+		if err != nil {
+			s.rejectedHandshakes.Add(1)
+			return nil
+		}
+	}
 	out, err := cs.Channel.Deliver(nil, msg.Payload)
+	s.markEstablished(cs)
 	if err != nil {
 		return err
 	}
-	if out != nil {
+	if out == nil {
+		return nil
+	}
+	if s.config.transition != nil && hasHeader(cs.Channel) && !cs.announced.Load() {
+		go s.announceTransition(cs)
+	}
+	now := time.Now()
+	if !hasHeader(cs.Channel) {
+		return s.deliverTell(ctx, cs, key, msg, out, now)
+	}
+	if len(out) < headerSize {
+		return errors.New("message too short to contain header")
+	}
+	switch out[0] {
+	case msgTypeTell:
+		return s.deliverTell(ctx, cs, key, msg, out[headerSize:], now)
+	case msgTypeAskReq:
 		remoteKey := cs.Channel.RemoteKey()
-		srcID := s.config.fingerprinter(&remoteKey)
-		return s.hub.Deliver(ctx, p2p.Message[Addr[T]]{
-			Src:     Addr[T]{ID: srcID, Addr: msg.Src},
-			Dst:     Addr[T]{ID: s.localID, Addr: msg.Dst},
-			Payload: out,
-		})
+		src := Addr[T]{ID: s.config.fingerprinter(&remoteKey), Addr: msg.Src}
+		return s.handleAskRequest(cs.Channel, src, Addr[T]{ID: s.localID, Addr: msg.Dst}, out)
+	case msgTypeAskResp:
+		remoteKey := cs.Channel.RemoteKey()
+		return s.handleAskResponse(&remoteKey, out)
+	case msgTypeTransition:
+		return s.handleTransition(cs, out[headerSize:])
+	case msgTypeProbe:
+		id, ok := parseProbe(out)
+		if !ok {
+			return errors.New("invalid probe")
+		}
+		// reply over the path the probe arrived on.
+		return s.sendVia(ctx, cs.Channel, msg.Src, makeProbe(msgTypeProbeReply, id))
+	case msgTypeProbeReply:
+		id, ok := parseProbe(out)
+		if !ok {
+			return errors.New("invalid probe reply")
+		}
+		if cs.Paths != nil {
+			cs.Paths.onProbeReply(id, now)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown message type %d", out[0])
+	}
+}
+
+// deliverTell delivers payload, which arrived in msg through cs, as a Tell.
+func (s *Swarm[T]) deliverTell(ctx context.Context, cs *channelState[T], key string, msg p2p.Message[T], payload []byte, now time.Time) error {
+	if cs.Paths != nil {
+		cs.Paths.onReceive(key, now)
+	}
+	remoteKey := cs.Channel.RemoteKey()
+	srcID := s.config.fingerprinter(&remoteKey)
+	return s.hub.Deliver(ctx, p2p.Message[Addr[T]]{
+		Src:     Addr[T]{ID: srcID, Addr: msg.Src},
+		Dst:     Addr[T]{ID: s.localID, Addr: msg.Dst},
+		Payload: payload,
+	})
+}
+
+// sendVia encrypts x with c, and sends it to dst, bypassing path selection.
+func (s *Swarm[T]) sendVia(ctx context.Context, c *p2pke.Channel, dst T, x []byte) error {
+	ctx, cf := context.WithTimeout(ctx, s.config.tellTimeout)
+	defer cf()
+	data, err := c.Seal(ctx, nil, p2p.IOVec{x})
+	if err != nil {
+		return err
 	}
-	return nil
+	return s.inner.Tell(ctx, dst, p2p.IOVec{data})
 }
 
 func (s *Swarm[T]) getSender(dst T) p2pke.SendFunc {
@@ -208,6 +463,63 @@ func (s *Swarm[T]) getSender(dst T) p2pke.SendFunc {
 	}
 }
 
+// getMultiSender returns a SendFunc which sends to the active path in ps,
+// or to all the paths if there is no active path.
+func (s *Swarm[T]) getMultiSender(ps *pathSet[T]) p2pke.SendFunc {
+	return func(x []byte) {
+		for _, dst := range ps.targets() {
+			s.getSender(dst)(x)
+		}
+	}
+}
+
+// probeLoop periodically probes every path of every multi-path channel.
+func (s *Swarm[T]) probeLoop(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		var eg errgroup.Group
+		for _, cs := range s.channelStates() {
+			if cs.Paths == nil {
+				continue
+			}
+			cs := cs
+			eg.Go(func() error {
+				s.probe(ctx, cs)
+				return nil
+			})
+		}
+		eg.Wait()
+	}
+}
+
+// probe sends a probe over each path in cs, and fails over if the active path is dead.
+func (s *Swarm[T]) probe(ctx context.Context, cs *channelState[T]) {
+	now := time.Now()
+	cs.Paths.check(now)
+	if remoteKey := cs.Channel.RemoteKey(); remoteKey.IsZero() {
+		// the channel has never been established, the handshake is sent over all paths.
+		return
+	}
+	if !hasHeader(cs.Channel) {
+		// the peer would deliver probes as Tells, paths are only checked by the Tells it sends.
+		return
+	}
+	ctx, cf := context.WithTimeout(ctx, s.config.probeInterval)
+	defer cf()
+	addrs, ids := cs.Paths.startProbes(now)
+	for i := range addrs {
+		if err := s.sendVia(ctx, cs.Channel, addrs[i], makeProbe(msgTypeProbe, ids[i])); err != nil {
+			logctx.Debugln(ctx, "p2pkeswarm: sending probe", err)
+		}
+	}
+}
+
 func (s *Swarm[T]) cleanupLoop(ctx context.Context) error {
 	const (
 		gracePeriod   = 30 * time.Second
@@ -217,7 +529,8 @@ func (s *Swarm[T]) cleanupLoop(ctx context.Context) error {
 	defer ticker.Stop()
 	now := time.Now()
 	for {
-		s.store.purge(func(addr string, c *channelState) bool {
+		var removed []*channelState[T]
+		s.store.purge(func(addr string, c *channelState[T]) bool {
 			if now.Sub(c.CreatedAt) < gracePeriod {
 				return true
 			}
@@ -228,8 +541,14 @@ func (s *Swarm[T]) cleanupLoop(ctx context.Context) error {
 				return true
 			}
 			c.Channel.Close()
+			removed = append(removed, c)
 			return false
 		})
+		for _, c := range removed {
+			s.forgetPending(c)
+		}
+		s.limiter.purge(now)
+		s.purgeServed(now)
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -246,9 +565,22 @@ func (s *Swarm[T]) keyForAddr(x T) string {
 	return string(data)
 }
 
-type channelState struct {
+type channelState[T p2p.Addr] struct {
+	// Addr is the inner address that the channel was created for.
+	Addr T
+	// ID is set for channels to peers with registered endpoints.
+	ID        p2p.PeerID
 	Channel   *p2pke.Channel
 	CreatedAt time.Time
+	// Paths is set for channels to peers with registered endpoints.
+	Paths *pathSet[T]
+
+	// announced is set once the local transition has been sent over the channel.
+	announced atomic.Bool
+	// pending is set while the channel is in the swarm's pending list.
+	pending atomic.Bool
+	// pendingElem is the channel's element in the swarm's pending list, protected by admitMu.
+	pendingElem *list.Element
 }
 
 func min[T constraints.Ordered](xs ...T) (ret T) {
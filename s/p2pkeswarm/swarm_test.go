@@ -1,14 +1,21 @@
 package p2pkeswarm
 
 import (
+	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
 	"go.brendoncarroll.net/p2p/f/x509"
+	"go.brendoncarroll.net/p2p/p/p2pke"
 	"go.brendoncarroll.net/p2p/p2ptest"
 	"go.brendoncarroll.net/p2p/s/memswarm"
+	"go.brendoncarroll.net/p2p/s/multiswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
 	"go.brendoncarroll.net/p2p/s/udpswarm"
 )
@@ -34,6 +41,16 @@ func testSwarm[T p2p.Addr](t *testing.T, baseSwarms func(testing.TB, []p2p.Swarm
 		}
 		t.Cleanup(func() { swarmtest.CloseSecureSwarms(t, xs) })
 	})
+	swarmtest.TestAskSwarm(t, func(t testing.TB, xs []p2p.AskSwarm[Addr[T]]) {
+		ss := make([]p2p.Swarm[T], len(xs))
+		baseSwarms(t, ss)
+		for i := range xs {
+			privKey := newTestKey(t, i)
+			s := New(ss[i], privKey)
+			xs[i] = s
+		}
+		t.Cleanup(func() { swarmtest.CloseAskSwarms(t, xs) })
+	})
 }
 
 func TestOnUDP(t *testing.T) {
@@ -75,6 +92,26 @@ func TestOnDropFirstPairwise(t *testing.T) {
 	})
 }
 
+// serveAsks serves the asks sent to s with fn in the background, until the test ends or s is closed.
+func serveAsks(t testing.TB, ctx context.Context, s *Swarm[memswarm.Addr], fn func(context.Context, []byte, p2p.Message[Addr[memswarm.Addr]]) int) {
+	ctx, cf := context.WithCancel(ctx)
+	t.Cleanup(cf)
+	go func() {
+		for {
+			if err := s.ServeAsk(ctx, fn); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// serveEcho serves the asks sent to s by replying with the request.
+func serveEcho(t testing.TB, ctx context.Context, s *Swarm[memswarm.Addr]) {
+	serveAsks(t, ctx, s, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		return copy(resp, req.Payload)
+	})
+}
+
 func newTestKey(t testing.TB, i int) x509.PrivateKey {
 	pk := p2ptest.NewTestKey(t, i)
 	algoID, signer := x509.SignerFromStandard(pk)
@@ -83,3 +120,277 @@ func newTestKey(t testing.TB, i int) x509.PrivateKey {
 	require.NoError(t, err)
 	return privateKey
 }
+
+func TestMultiPath(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var broken atomic.Bool
+	r1 := memswarm.NewRealm(memswarm.WithQueueLen(10), memswarm.WithTellTransform(func(*memswarm.Message) bool {
+		return !broken.Load()
+	}))
+	r2 := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	newInner := func() p2p.Swarm[multiswarm.Addr] {
+		return multiswarm.New(map[string]multiswarm.DynSwarm{
+			"mem1": multiswarm.WrapSwarm[memswarm.Addr](r1.NewSwarm()),
+			"mem2": multiswarm.WrapSwarm[memswarm.Addr](r2.NewSwarm()),
+		})
+	}
+	opts := []Option[multiswarm.Addr]{WithProbeInterval[multiswarm.Addr](20 * time.Millisecond)}
+	a := New(newInner(), newTestKey(t, 0), opts...)
+	b := New(newInner(), newTestKey(t, 1), opts...)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	aID, bID := a.LocalAddrs()[0].ID, b.LocalAddrs()[0].ID
+	a.SetEndpoints(bID, innerAddrs(b.LocalAddrs()))
+	b.SetEndpoints(aID, innerAddrs(a.LocalAddrs()))
+
+	dst := b.LocalAddrs()[0]
+	_, err := a.LookupPublicKey(ctx, dst)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for _, pi := range a.Paths(bID) {
+			if !pi.Alive || pi.RTT == 0 {
+				return false
+			}
+		}
+		_, ok := a.ActivePath(bID)
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// break the first transport and check that traffic moves to the second.
+	broken.Store(true)
+	require.Eventually(t, func() bool {
+		for _, pi := range a.Paths(bID) {
+			if pi.Alive != (pi.Addr.Scheme == "mem2") {
+				return false
+			}
+		}
+		active, ok := a.ActivePath(bID)
+		return ok && active.Scheme == "mem2"
+	}, 3*time.Second, 10*time.Millisecond)
+	var m p2p.Message[Addr[multiswarm.Addr]]
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("still there?")}))
+	require.NoError(t, p2p.Receive[Addr[multiswarm.Addr]](ctx, b, &m))
+	require.Equal(t, "still there?", string(m.Payload))
+}
+
+func innerAddrs[T p2p.Addr](xs []Addr[T]) (ret []T) {
+	for _, x := range xs {
+		ret = append(ret, x.Addr)
+	}
+	return ret
+}
+
+func TestListChannels(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0))
+	b := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 1))
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	require.Len(t, a.ListChannels(), 0)
+
+	dst := b.LocalAddrs()[0]
+	const N = 3
+	for i := 0; i < N; i++ {
+		var m p2p.Message[Addr[memswarm.Addr]]
+		require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+		require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	}
+	cis := a.ListChannels()
+	require.Len(t, cis, 1)
+	require.Equal(t, dst, cis[0].Addr)
+	require.Equal(t, uint64(N), cis[0].Stats.MessagesSent)
+	require.NotNil(t, cis[0].Stats.Current)
+
+	cis = b.ListChannels()
+	require.Len(t, cis, 1)
+	require.Equal(t, a.LocalAddrs()[0], cis[0].Addr)
+	require.Equal(t, uint64(N), cis[0].Stats.MessagesReceived)
+}
+
+func TestHeaderlessPeer(t *testing.T) {
+	t.Parallel()
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0))
+	// the old peer's channel does not send an AppVersion, and its messages have no header.
+	inner := r.NewSwarm()
+	dst := a.LocalAddrs()[0]
+	c := p2pke.NewChannel(p2pke.ChannelConfig{
+		PrivateKey: newTestKey(t, 1),
+		AcceptKey:  func(*x509.PublicKey) bool { return true },
+		Send: func(x []byte) {
+			inner.Tell(ctx, dst.Addr, p2p.IOVec{x})
+		},
+	})
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, c.Close())
+		require.NoError(t, inner.Close())
+	})
+	received := make(chan string, 1)
+	go func() {
+		for {
+			if err := inner.Receive(ctx, func(m p2p.Message[memswarm.Addr]) {
+				if out, err := c.Deliver(nil, m.Payload); err == nil && out != nil {
+					received <- string(out)
+				}
+			}); err != nil {
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, c.Send(ctx, p2p.IOVec{[]byte("hello a")}))
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, a, &m))
+	require.Equal(t, "hello a", string(m.Payload))
+	require.NoError(t, a.Tell(ctx, m.Src, p2p.IOVec{[]byte("hello old peer")}))
+	require.Equal(t, "hello old peer", <-received)
+	_, err := a.Ask(ctx, make([]byte, 64), m.Src, p2p.IOVec{[]byte("ping")})
+	require.ErrorIs(t, err, ErrAskUnsupported)
+}
+
+func TestAskLossy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var count atomic.Int64
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10), memswarm.WithTellTransform(func(*memswarm.Message) bool {
+		// drop every third message
+		return count.Add(1)%3 != 0
+	}))
+	opts := []Option[memswarm.Addr]{WithAskRetransmit[memswarm.Addr](10*time.Millisecond, 100*time.Millisecond)}
+	a := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0), opts...)
+	b := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 1), opts...)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	var served atomic.Int64
+	serveAsks(t, ctx, b, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		served.Add(1)
+		return copy(resp, req.Payload)
+	})
+	for i := 0; i < 10; i++ {
+		req := fmt.Sprintf("ping %d", i)
+		resp := make([]byte, a.MTU())
+		ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+		n, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{[]byte(req)})
+		cf()
+		require.NoError(t, err)
+		require.Equal(t, req, string(resp[:n]))
+	}
+	require.Equal(t, int64(10), served.Load())
+}
+
+func TestMaxServingAsks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm()
+	a := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 0), WithAskRetransmit[memswarm.Addr](10*time.Millisecond, 20*time.Millisecond))
+	b := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 1), WithMaxServingAsks[memswarm.Addr](1))
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	started, release := make(chan struct{}), make(chan struct{})
+	serveAsks(t, ctx, b, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		if string(req.Payload) == "slow" {
+			close(started)
+			<-release
+		}
+		return copy(resp, req.Payload)
+	})
+	ask := func(ctx context.Context, req string) error {
+		resp := make([]byte, a.MTU())
+		n, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{[]byte(req)})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, req, string(resp[:n]))
+		return nil
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- ask(ctx, "slow") }()
+	<-started
+
+	// the only slot is taken, so the request is dropped.
+	ctx1, cf := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cf()
+	require.ErrorIs(t, ask(ctx1, "fast"), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, <-errCh)
+	require.NoError(t, ask(ctx, "fast"))
+}
+
+func TestServedAskExpiry(t *testing.T) {
+	now := time.Now()
+	// an entry which is still being served expires, in case the handler never returns.
+	sa := &servedAsk{expiresAt: now.Add(time.Minute)}
+	require.False(t, sa.isExpired(now))
+	require.True(t, sa.isExpired(now.Add(2*time.Minute)))
+
+	sa.setResponse([]byte("resp"), now.Add(3*time.Minute))
+	require.False(t, sa.isExpired(now.Add(2*time.Minute)))
+	require.True(t, sa.isExpired(now.Add(4*time.Minute)))
+}
+
+func TestKeyTransition(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	reg := x509.DefaultRegistry()
+	oldKey, newKey := newTestKey(t, 0), newTestKey(t, 2)
+	tr, err := keytransition.Sign(reg, &oldKey, &newKey, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	set := keytransition.NewSet(reg, DefaultFingerprinter)
+	updated := make(chan p2p.PeerID, 1)
+	set.OnTransition(func(_, newID p2p.PeerID, _ *keytransition.Transition) {
+		updated <- newID
+	})
+
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := New[memswarm.Addr](r.NewSwarm(), oldKey)
+	oldAddr := a.LocalAddrs()[0]
+	require.NoError(t, a.Close())
+	a = New[memswarm.Addr](r.NewSwarm(), newKey, WithTransition[memswarm.Addr](tr))
+	b := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 1), WithKeyTransitions[memswarm.Addr](set))
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+
+	// without the transition, the new key is not accepted for the old PeerID.
+	newPub := a.PublicKey()
+	require.False(t, b.isPeer(oldAddr.ID, &newPub))
+
+	// a announces the transition when it contacts b.
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, a.localID, m.Src.ID)
+	require.Equal(t, a.localID, <-updated)
+	require.Equal(t, a.localID, set.Resolve(oldAddr.ID, time.Now()))
+
+	require.True(t, b.isPeer(oldAddr.ID, &newPub))
+	dst := Addr[memswarm.Addr]{ID: oldAddr.ID, Addr: a.LocalAddrs()[0].Addr}
+	require.NoError(t, b.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, a, &m))
+	require.Equal(t, b.localID, m.Src.ID)
+
+	// asks to the old PeerID are answered by the new key.
+	serveEcho(t, ctx, a)
+	resp := make([]byte, b.MTU())
+	askCtx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	n, err := b.Ask(askCtx, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+}
@@ -0,0 +1,53 @@
+package p2pkeswarm
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.brendoncarroll.net/stdctx/logctx"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+// isPeer returns true if pubKey can be used by the peer with PeerID id.
+// Without a transition set that is only the case if pubKey has the PeerID id.
+func (s *Swarm[T]) isPeer(id p2p.PeerID, pubKey *x509.PublicKey) bool {
+	if s.config.transitions == nil {
+		return s.config.fingerprinter(pubKey) == id
+	}
+	return s.config.transitions.Accepts(id, pubKey, time.Now())
+}
+
+// announceTransition sends the local transition over the channel, if there is one, and it has not already been sent.
+// Peers which do not support the type header would deliver the transition as a Tell, so it is not sent to them.
+func (s *Swarm[T]) announceTransition(cs *channelState[T]) {
+	if s.config.transition == nil || !hasHeader(cs.Channel) || !cs.announced.CompareAndSwap(false, true) {
+		return
+	}
+	msg := append([]byte{msgTypeTransition}, keytransition.Marshal(nil, s.config.transition)...)
+	ctx, cf := context.WithTimeout(s.ctx, s.config.tellTimeout)
+	defer cf()
+	if err := cs.Channel.Send(ctx, p2p.IOVec{msg}); err != nil {
+		logctx.Debugln(ctx, "p2pkeswarm: announcing transition", err)
+	}
+}
+
+// handleTransition adds a transition sent by the remote party to the transition set.
+// Only transitions to the key of the sender are accepted.
+func (s *Swarm[T]) handleTransition(cs *channelState[T], x []byte) error {
+	if s.config.transitions == nil {
+		return nil
+	}
+	t, err := keytransition.Parse(x)
+	if err != nil {
+		return err
+	}
+	remoteKey := cs.Channel.RemoteKey()
+	if !x509.EqualPublicKeys(&t.New, &remoteKey) {
+		return errors.New("p2pkeswarm: transition is not to the sender's key")
+	}
+	return s.config.transitions.Add(t)
+}
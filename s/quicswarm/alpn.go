@@ -0,0 +1,249 @@
+package quicswarm
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/quic-go/quic-go"
+	"go.brendoncarroll.net/stdctx/logctx"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/x509"
+	"go.brendoncarroll.net/p2p/p2pconn"
+	"go.brendoncarroll.net/p2p/s/swarmutil"
+)
+
+// DefaultALPN is the ALPN protocol used by a swarm, unless WithALPN is given.
+// Bidirectional streams start with a byte giving the stream type.
+const DefaultALPN = "p2p/2"
+
+// LegacyALPN is the ALPN protocol used before streams had a type, every bidirectional stream is an Ask.
+// A swarm using DefaultALPN also offers and accepts LegacyALPN, so it can talk to older peers,
+// unless LegacyALPN is registered with WithProtocol or WithConnHandler.
+const LegacyALPN = "p2p"
+
+// sessErrNoProtocol is the application error code used to refuse a session for a protocol which has been closed.
+const sessErrNoProtocol = quic.ApplicationErrorCode(3)
+
+// ConnHandler serves raw QUIC connections for an ALPN protocol.
+// The peer has been authenticated, and the handshake has completed, before the handler is called.
+// The handler owns the connection, and must close it.
+type ConnHandler func(ctx context.Context, conn quic.Connection)
+
+type protocolSpec[T p2p.Addr] struct {
+	alpn string
+	opts []Option[T]
+}
+
+// Protocol returns the view of the swarm for the ALPN protocol alpn, which was registered with WithProtocol.
+// If alpn is the swarm's own protocol, then the swarm is returned.
+// Protocol returns nil if alpn was not registered.
+func (s *Swarm[T]) Protocol(alpn string) *Swarm[T] {
+	root := s.root()
+	if alpn == root.alpn {
+		return root
+	}
+	if v, exists := root.views[alpn]; exists {
+		return v
+	}
+	if alpn == LegacyALPN && root.servesLegacy() {
+		return root.Protocol(DefaultALPN)
+	}
+	return nil
+}
+
+// ALPN returns the ALPN protocol negotiated by the swarm's sessions.
+func (s *Swarm[T]) ALPN() string {
+	return s.alpn
+}
+
+// DialConn establishes a new QUIC connection to dst, using the ALPN protocol alpn.
+// The connection is not used by the swarm, and the caller must close it.
+// The peer will serve the connection with the ConnHandler it has registered for alpn.
+func (s *Swarm[T]) DialConn(ctx context.Context, dst Addr[T], alpn string) (quic.Connection, error) {
+	return s.dial(ctx, dst, []string{alpn}, false)
+}
+
+// newView creates a view of s for the ALPN protocol alpn.
+// The view starts with the configuration of s, then opts are applied.
+func (s *Swarm[T]) newView(alpn string, opts []Option[T]) *Swarm[T] {
+	v := &Swarm[T]{
+		inner:         s.inner,
+		mtu:           s.mtu,
+		registry:      s.registry,
+		fingerprinter: s.fingerprinter,
+		allowFunc:     s.allowFunc,
+		transitions:   s.transitions,
+		transition:    s.transition,
+		maxDatagram:   s.maxDatagram,
+
+		idleTimeout:           s.idleTimeout,
+		keepAlivePeriod:       s.keepAlivePeriod,
+		maxSessions:           s.maxSessions,
+		maxIncomingStreams:    s.maxIncomingStreams,
+		maxIncomingUniStreams: s.maxIncomingUniStreams,
+		streamWindow:          s.streamWindow,
+		connWindow:            s.connWindow,
+		tickets:               s.tickets,
+		trust:                 s.trust,
+
+		privateKey: s.privateKey,
+		publicKey:  s.publicKey,
+		log:        s.log,
+
+		alpn:      alpn,
+		parent:    s,
+		pconn:     s.pconn,
+		transport: s.transport,
+
+		tells:   swarmutil.NewTellHub[Addr[T]](),
+		asks:    swarmutil.NewAskHub[Addr[T]](),
+		streams: make(chan *Stream[T]),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	v.sessions = newSessionCache(v.maxSessions)
+	v.bgCtx, v.cf = context.WithCancel(logctx.NewContext(s.bgCtx, v.log))
+	return v
+}
+
+// root returns the swarm which owns the transport.
+func (s *Swarm[T]) root() *Swarm[T] {
+	if s.parent != nil {
+		return s.parent
+	}
+	return s
+}
+
+// nextProtos returns the ALPN protocols accepted by the listener.
+func (s *Swarm[T]) nextProtos() []string {
+	ret := []string{s.alpn}
+	for _, spec := range s.protocols {
+		ret = append(ret, spec.alpn)
+	}
+	for alpn := range s.connHandlers {
+		ret = append(ret, alpn)
+	}
+	if slices.Contains(ret, DefaultALPN) && s.servesLegacy() {
+		ret = append(ret, LegacyALPN)
+	}
+	return ret
+}
+
+// sessionProtos returns the ALPN protocols offered when dialing a session, in order of preference.
+func (s *Swarm[T]) sessionProtos() []string {
+	if s.alpn == DefaultALPN && s.servesLegacy() {
+		return []string{DefaultALPN, LegacyALPN}
+	}
+	return []string{s.alpn}
+}
+
+// servesLegacy returns true if LegacyALPN sessions are handled by the swarm using DefaultALPN.
+func (s *Swarm[T]) servesLegacy() bool {
+	root := s.root()
+	if root.alpn == LegacyALPN {
+		return false
+	}
+	if _, exists := root.connHandlers[LegacyALPN]; exists {
+		return false
+	}
+	for _, spec := range root.protocols {
+		if spec.alpn == LegacyALPN {
+			return false
+		}
+	}
+	return true
+}
+
+// isLegacy returns true if sess negotiated LegacyALPN, and its bidirectional streams have no type.
+func isLegacy(sess quic.Connection) bool {
+	return sess.ConnectionState().TLS.NegotiatedProtocol == LegacyALPN
+}
+
+// route passes a session accepted by the listener to the view or ConnHandler for its ALPN protocol.
+func (s *Swarm[T]) route(ctx context.Context, sess quic.Connection) {
+	alpn := sess.ConnectionState().TLS.NegotiatedProtocol
+	if fn, exists := s.connHandlers[alpn]; exists {
+		s.acceptConn(ctx, sess, fn)
+		return
+	}
+	v := s.Protocol(alpn)
+	if v == nil || v.bgCtx.Err() != nil {
+		sess.CloseWithError(sessErrNoProtocol, "protocol not available")
+		return
+	}
+	v.acceptSession(v.bgCtx, sess)
+}
+
+func (s *Swarm[T]) acceptConn(ctx context.Context, sess quic.Connection, fn ConnHandler) {
+	// connection handlers are not expected to deal with replayed 0-RTT data.
+	if err := waitHandshake(ctx, sess); err != nil {
+		return
+	}
+	addr, err := s.remoteAddrFromSession(sess)
+	if err != nil {
+		logctx.Warnln(ctx, err)
+		sess.CloseWithError(1, "")
+		return
+	}
+	if !s.allowFunc(addr) {
+		sess.CloseWithError(1, "")
+		return
+	}
+	go fn(ctx, sess)
+}
+
+// dial creates a new connection to dst, offering the ALPN protocols alpns.
+// If early is true, the connection may be returned before the handshake completes, when a session is being resumed.
+func (s *Swarm[T]) dial(ctx context.Context, dst Addr[T], alpns []string, early bool) (quic.Connection, error) {
+	raddr := p2pconn.NewAddr(s.inner, dst.Addr)
+	signer, err := x509.ToStandardSigner(&s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := generateClientTLS(signer, alpns)
+	tlsConfig.VerifyConnection = s.verifyConnection(&dst.ID)
+	if !early || s.tickets == nil {
+		return s.transport.Dial(ctx, raddr, tlsConfig, s.quicConfig())
+	}
+	// crypto/tls only uses the session cache if ServerName is set, the name itself is ignored by ticketCache.
+	tlsConfig.ServerName = "p2p"
+	tlsConfig.ClientSessionCache = ticketCache{store: s.tickets, key: s.ticketKey(dst)}
+	return s.transport.DialEarly(ctx, raddr, tlsConfig, s.quicConfig())
+}
+
+// ticketKey returns the key used to store tickets for dst.
+// Views store their tickets separately, since 0-RTT data is only accepted for the ALPN protocol of the original session.
+func (s *Swarm[T]) ticketKey(dst Addr[T]) string {
+	if s.parent == nil {
+		return dst.Key()
+	}
+	return s.alpn + " " + dst.Key()
+}
+
+// closeView closes a view, leaving the transport open.
+func (s *Swarm[T]) closeView() error {
+	s.cf()
+	s.tells.CloseWithError(p2p.ErrClosed)
+	s.asks.CloseWithError(p2p.ErrClosed)
+	for _, sess := range s.sessions.closeAll() {
+		sess.CloseWithError(0, "")
+	}
+	return nil
+}
+
+var errInvalidProtocols = errors.New("quicswarm: ALPN protocols must be non-empty and unique")
+
+// checkProtocols returns an error if any ALPN protocol is empty, or registered more than once.
+func (s *Swarm[T]) checkProtocols() error {
+	seen := map[string]struct{}{}
+	for _, alpn := range s.nextProtos() {
+		if _, exists := seen[alpn]; exists || alpn == "" {
+			return errInvalidProtocols
+		}
+		seen[alpn] = struct{}{}
+	}
+	return nil
+}
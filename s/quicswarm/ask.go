@@ -0,0 +1,71 @@
+package quicswarm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/quic-go/quic-go"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// Error codes used to reset the streams carrying Asks.
+const (
+	// AskCodeCancelled means the requester gave up on the ask.
+	// The handler's context is cancelled when it is received.
+	AskCodeCancelled = quic.StreamErrorCode(0x100 + iota)
+	// AskCodeUnavailable means the request could not be delivered to a handler.
+	AskCodeUnavailable
+	// AskCodeHandlerError means the handler returned a value < 0.
+	AskCodeHandlerError
+)
+
+// askCodeHandlerBase is added to the negation of the value returned by a handler, to produce the reset code.
+const askCodeHandlerBase = quic.StreamErrorCode(0x10000)
+
+// ErrAskFailed is returned by Ask when the remote party did not produce a response.
+type ErrAskFailed struct {
+	Addr p2p.Addr
+	Code quic.StreamErrorCode
+	// HandlerValue is the value < 0 returned by the handler, if Code is AskCodeHandlerError.
+	HandlerValue int
+}
+
+func (e ErrAskFailed) Error() string {
+	switch e.Code {
+	case AskCodeHandlerError:
+		return fmt.Sprintf("quicswarm: ask to %v failed: handler returned %d", e.Addr, e.HandlerValue)
+	case AskCodeUnavailable:
+		return fmt.Sprintf("quicswarm: ask to %v failed: unavailable", e.Addr)
+	case AskCodeCancelled:
+		return fmt.Sprintf("quicswarm: ask to %v failed: cancelled", e.Addr)
+	default:
+		return fmt.Sprintf("quicswarm: ask to %v failed: code=%d", e.Addr, e.Code)
+	}
+}
+
+// handlerResetCode returns the code used to reset the stream, when a handler returns n < 0
+func handlerResetCode(n int) quic.StreamErrorCode {
+	if n < -math.MaxInt32 {
+		n = -math.MaxInt32
+	}
+	return askCodeHandlerBase + quic.StreamErrorCode(-n)
+}
+
+// askError converts a stream reset by the server into an ErrAskFailed.
+// Other errors are returned unchanged.
+func askError(dst p2p.Addr, err error) error {
+	var serr *quic.StreamError
+	if !errors.As(err, &serr) || !serr.Remote {
+		return err
+	}
+	if serr.ErrorCode >= askCodeHandlerBase {
+		return ErrAskFailed{
+			Addr:         dst,
+			Code:         AskCodeHandlerError,
+			HandlerValue: -int(serr.ErrorCode - askCodeHandlerBase),
+		}
+	}
+	return ErrAskFailed{Addr: dst, Code: serr.ErrorCode}
+}
@@ -1,6 +1,11 @@
 package quicswarm
 
-import "go.brendoncarroll.net/p2p"
+import (
+	"time"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
+)
 
 type Option[T p2p.Addr] func(s *Swarm[T])
 
@@ -22,3 +27,147 @@ func WithFingerprinter[T p2p.Addr](fp Fingerprinter) Option[T] {
 		s.fingerprinter = fp
 	}
 }
+
+// WithKeyTransitions allows a peer to be dialed by its old PeerID, using a new key,
+// during the grace period of a transition in set.
+// The set must derive PeerIDs in the same way as the swarm's Fingerprinter.
+func WithKeyTransitions[T p2p.Addr](set *keytransition.Set) Option[T] {
+	return func(s *Swarm[T]) {
+		s.transitions = set
+	}
+}
+
+// WithTransition sets a transition to the swarm's key, which is announced to every peer
+// the swarm establishes a session with.
+// New returns an error if t.New is not the swarm's public key.
+func WithTransition[T p2p.Addr](t *keytransition.Transition) Option[T] {
+	return func(s *Swarm[T]) {
+		s.transition = t
+	}
+}
+
+// WithDatagrams enables sending Tells as unreliable DATAGRAM frames (RFC 9221).
+// Tells with payloads larger than maxSize, or to peers which have not enabled datagrams, are sent on streams.
+// If maxSize <= 0, DefaultMaxDatagramSize is used.
+// The number of Tells sent each way is reported by Stats.
+func WithDatagrams[T p2p.Addr](maxSize int) Option[T] {
+	return func(s *Swarm[T]) {
+		if maxSize <= 0 {
+			maxSize = DefaultMaxDatagramSize
+		}
+		s.maxDatagram = maxSize
+	}
+}
+
+// WithIdleTimeout sets the time after which a session with no network activity is closed.
+// Zero uses the QUIC implementation's default.
+func WithIdleTimeout[T p2p.Addr](d time.Duration) Option[T] {
+	return func(s *Swarm[T]) {
+		s.idleTimeout = d
+	}
+}
+
+// WithKeepAlive sets the period at which keep-alive packets are sent, to prevent sessions from becoming idle.
+// Zero disables keep-alives, which is the default.
+func WithKeepAlive[T p2p.Addr](period time.Duration) Option[T] {
+	return func(s *Swarm[T]) {
+		s.keepAlivePeriod = period
+	}
+}
+
+// WithMaxSessions limits the number of sessions the swarm will hold.
+// When the limit is reached, the least recently used idle session is closed to make room.
+// Sessions with Asks in flight or open Streams are not idle.
+// If no session is idle, incoming sessions are refused, but outgoing sessions are still created.
+// n <= 0 means no limit, which is the default.
+func WithMaxSessions[T p2p.Addr](n int) Option[T] {
+	return func(s *Swarm[T]) {
+		s.maxSessions = n
+	}
+}
+
+// WithMaxIncomingStreams sets the number of concurrent streams that a peer can open in a single session.
+// bidi limits Asks and Streams, and uni limits Tells which are not sent as datagrams.
+// Zero uses the QUIC implementation's default.
+func WithMaxIncomingStreams[T p2p.Addr](bidi, uni int64) Option[T] {
+	return func(s *Swarm[T]) {
+		s.maxIncomingStreams = bidi
+		s.maxIncomingUniStreams = uni
+	}
+}
+
+// WithStreamReceiveWindow sets the initial and maximum flow-control window for each stream.
+// Zero uses the QUIC implementation's default.
+func WithStreamReceiveWindow[T p2p.Addr](initial, max uint64) Option[T] {
+	return func(s *Swarm[T]) {
+		s.streamWindow = [2]uint64{initial, max}
+	}
+}
+
+// WithConnectionReceiveWindow sets the initial and maximum flow-control window for each session.
+// Zero uses the QUIC implementation's default.
+func WithConnectionReceiveWindow[T p2p.Addr](initial, max uint64) Option[T] {
+	return func(s *Swarm[T]) {
+		s.connWindow = [2]uint64{initial, max}
+	}
+}
+
+// WithSessionResumption enables TLS session tickets, so sessions to peers which have been seen before
+// can be resumed without a full handshake.  Tickets are kept in store, if it is nil a MemTicketStore is used.
+//
+// Resumed sessions send Tells as QUIC 0-RTT data, before the handshake completes.
+// 0-RTT data can be replayed by an attacker, so the peer may receive the same Tell more than once.
+// If the peer rejects the 0-RTT data, the Tell is resent once the handshake completes.
+// Tells are already unreliable, but applications which are not idempotent should not enable resumption.
+// Asks and Streams always wait for the handshake to complete, and are never sent as 0-RTT data.
+// Both parties must enable resumption for 0-RTT to be used.
+func WithSessionResumption[T p2p.Addr](store TicketStore) Option[T] {
+	return func(s *Swarm[T]) {
+		if store == nil {
+			store = NewMemTicketStore()
+		}
+		s.tickets = store
+	}
+}
+
+// WithTrustStore only allows sessions with peers trusted by ts.
+// Peers are checked during the TLS handshake, for both incoming and outgoing sessions,
+// so untrusted peers are rejected before any streams or datagrams are accepted.
+func WithTrustStore[T p2p.Addr](ts TrustStore) Option[T] {
+	return func(s *Swarm[T]) {
+		s.trust = ts
+	}
+}
+
+// WithALPN sets the ALPN protocol negotiated by the swarm's sessions. The default is DefaultALPN.
+func WithALPN[T p2p.Addr](alpn string) Option[T] {
+	return func(s *Swarm[T]) {
+		s.alpn = alpn
+	}
+}
+
+// WithProtocol registers another ALPN protocol on the swarm's listener.
+// Sessions which negotiate alpn are served by a separate view of the swarm, which is returned by Swarm.Protocol.
+// The view has its own sessions, Tells, Asks and Streams, and shares the swarm's transport and key.
+//
+// The view is configured like the swarm, then opts are applied.
+// The QUIC transport parameters set by options only apply to sessions dialed by the view,
+// sessions accepted by the listener use the swarm's parameters.
+func WithProtocol[T p2p.Addr](alpn string, opts ...Option[T]) Option[T] {
+	return func(s *Swarm[T]) {
+		s.protocols = append(s.protocols, protocolSpec[T]{alpn: alpn, opts: opts})
+	}
+}
+
+// WithConnHandler registers another ALPN protocol on the swarm's listener.
+// Connections which negotiate alpn are passed to fn, instead of being used by the swarm.
+// Peers open these connections with Swarm.DialConn.
+// Clients must present a certificate, like any other peer.
+func WithConnHandler[T p2p.Addr](alpn string, fn ConnHandler) Option[T] {
+	return func(s *Swarm[T]) {
+		if s.connHandlers == nil {
+			s.connHandlers = make(map[string]ConnHandler)
+		}
+		s.connHandlers[alpn] = fn
+	}
+}
@@ -9,8 +9,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/quic-go/quic-go"
 	"go.brendoncarroll.net/stdctx/logctx"
@@ -18,6 +19,7 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
 	"go.brendoncarroll.net/p2p/f/x509"
 	"go.brendoncarroll.net/p2p/p2pconn"
 	"go.brendoncarroll.net/p2p/s/swarmutil"
@@ -26,6 +28,10 @@ import (
 
 const DefaultMTU = 1 << 20
 
+// DefaultMaxDatagramSize is the largest Tell sent as a DATAGRAM frame, when datagrams are enabled.
+// It is small enough that a frame always fits in a QUIC packet of the minimum size.
+const DefaultMaxDatagramSize = 1024
+
 type (
 	PrivateKey = x509.PrivateKey
 	PublicKey  = x509.PublicKey
@@ -37,21 +43,42 @@ type Swarm[T p2p.Addr] struct {
 	registry      x509.Registry
 	fingerprinter Fingerprinter
 	allowFunc     func(p2p.Addr) bool
-	privateKey    x509.PrivateKey
-	publicKey     x509.PublicKey
-	log           *zap.Logger
-
+	transitions   *keytransition.Set
+	transition    *keytransition.Transition
+	maxDatagram   int
+
+	idleTimeout           time.Duration
+	keepAlivePeriod       time.Duration
+	maxSessions           int
+	maxIncomingStreams    int64
+	maxIncomingUniStreams int64
+	streamWindow          [2]uint64
+	connWindow            [2]uint64
+	tickets               TicketStore
+	trust                 TrustStore
+	alpn                  string
+	protocols             []protocolSpec[T]
+	connHandlers          map[string]ConnHandler
+
+	privateKey x509.PrivateKey
+	publicKey  x509.PublicKey
+	log        *zap.Logger
+
+	// parent is the swarm which owns the transport, if this swarm is a view for another ALPN protocol.
+	parent    *Swarm[T]
+	views     map[string]*Swarm[T]
 	pconn     net.PacketConn
-	transport quic.Transport
-	l         *quic.Listener
+	transport *quic.Transport
+	l         listener
 	bgCtx     context.Context
 	cf        context.CancelFunc
 
-	mu        sync.RWMutex
-	sessCache map[sessionKey]quic.Connection
+	sessions *sessionCache
 
-	tells swarmutil.TellHub[Addr[T]]
-	asks  swarmutil.AskHub[Addr[T]]
+	tells   swarmutil.TellHub[Addr[T]]
+	asks    swarmutil.AskHub[Addr[T]]
+	streams chan *Stream[T]
+	stats   counters
 }
 
 func NewOnUDP(laddr string, privKey x509.PrivateKey, opts ...Option[udpswarm.Addr]) (*Swarm[udpswarm.Addr], error) {
@@ -71,38 +98,66 @@ func New[T p2p.Addr](x p2p.Swarm[T], privKey x509.PrivateKey, opts ...Option[T])
 		registry:      x509.DefaultRegistry(),
 		fingerprinter: DefaultFingerprinter,
 		allowFunc:     func(p2p.Addr) bool { return true },
+		alpn:          DefaultALPN,
 		log:           zap.New(nil),
 		pconn:         pconn,
 		privateKey:    privKey,
 
-		transport: quic.Transport{
+		transport: &quic.Transport{
 			Conn: pconn,
 		},
-		sessCache: map[sessionKey]quic.Connection{},
-		tells:     swarmutil.NewTellHub[Addr[T]](),
-		asks:      swarmutil.NewAskHub[Addr[T]](),
+		tells:   swarmutil.NewTellHub[Addr[T]](),
+		asks:    swarmutil.NewAskHub[Addr[T]](),
+		streams: make(chan *Stream[T]),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if err := s.checkProtocols(); err != nil {
+		return nil, err
+	}
+	s.sessions = newSessionCache(s.maxSessions)
 	pubKey, err := s.registry.PublicFromPrivate(&s.privateKey)
 	if err != nil {
 		return nil, err
 	}
 	s.publicKey = pubKey
+	if t := s.transition; t != nil && !x509.EqualPublicKeys(&t.New, &s.publicKey) {
+		return nil, errors.New("quicswarm: transition is not to the swarm's key")
+	}
 
 	ctx := context.Background()
 	ctx = logctx.NewContext(ctx, s.log)
 	ctx, cf := context.WithCancel(ctx)
 	s.bgCtx = ctx
 	s.cf = cf
+	s.views = make(map[string]*Swarm[T], len(s.protocols))
+	for _, spec := range s.protocols {
+		s.views[spec.alpn] = s.newView(spec.alpn, spec.opts)
+	}
 
-	tlsConfig := generateServerTLS(&s.privateKey, &s.publicKey, s.fingerprinter)
-	l, err := s.transport.Listen(tlsConfig, generateQUICConfig())
-	if err != nil {
-		return nil, err
+	tlsConfig := generateServerTLS(&s.privateKey, &s.publicKey, s.fingerprinter, s.nextProtos())
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		// each view checks the peers of its own sessions.
+		v := s.Protocol(cs.NegotiatedProtocol)
+		if v == nil {
+			v = s
+		}
+		return v.verifyConnection(nil)(cs)
+	}
+	if s.tickets != nil {
+		l, err := s.transport.ListenEarly(tlsConfig, s.quicConfig())
+		if err != nil {
+			return nil, err
+		}
+		s.l = earlyListener{l}
+	} else {
+		l, err := s.transport.Listen(tlsConfig, s.quicConfig())
+		if err != nil {
+			return nil, err
+		}
+		s.l = l
 	}
-	s.l = l
 	go s.serve(ctx)
 	return s, nil
 }
@@ -111,7 +166,29 @@ func (s *Swarm[T]) Tell(ctx context.Context, dst Addr[T], data p2p.IOVec) error
 	if p2p.VecSize(data) > s.mtu {
 		return p2p.ErrMTUExceeded
 	}
-	err := s.withSession(ctx, dst, func(sess quic.Connection) error {
+	for retried := false; ; retried = true {
+		err := s.tell(ctx, dst, data, true)
+		// If the session was replaced, or 0-RTT data was rejected, the handshake has completed by now,
+		// so the retry will not be sent as 0-RTT data.
+		if !retried && (isSessionReplaced(err) || errors.Is(err, quic.Err0RTTRejected)) {
+			continue
+		}
+		return err
+	}
+}
+
+// tell sends data to dst, if early is true it may be sent as 0-RTT data.
+func (s *Swarm[T]) tell(ctx context.Context, dst Addr[T], data p2p.IOVec, early bool) error {
+	return s.withEntry(ctx, dst, early, func(e *sessionEntry) error {
+		sess := e.conn
+		if !handshakeComplete(sess) {
+			// Sending 0-RTT data succeeds even if the peer rejects it later.
+			go s.resendIfRejected(sess, dst, p2p.VecBytes(nil, data))
+		}
+		if sent, err := s.tryDatagram(sess, data); err != nil || sent {
+			return err
+		}
+		s.stats.streamTells.Add(1)
 		stream, err := sess.OpenUniStream()
 		if err != nil {
 			return err
@@ -125,10 +202,22 @@ func (s *Swarm[T]) Tell(ctx context.Context, dst Addr[T], data p2p.IOVec) error
 		_, err = data.WriteTo(stream)
 		return err
 	})
-	if isSessionReplaced(err) {
-		return s.Tell(ctx, dst, data)
+}
+
+// resendIfRejected waits for the handshake of sess to complete, and resends data to dst if the peer rejected 0-RTT data.
+func (s *Swarm[T]) resendIfRejected(sess quic.Connection, dst Addr[T], data []byte) {
+	ctx, cf := context.WithTimeout(s.bgCtx, earlyResendTimeout)
+	defer cf()
+	if err := waitHandshake(ctx, sess); err != nil {
+		return
+	}
+	if sess.ConnectionState().Used0RTT {
+		return
+	}
+	s.stats.resent0RTT.Add(1)
+	if err := s.tell(ctx, dst, p2p.IOVec{data}, false); err != nil {
+		logctx.Debugln(ctx, "quicswarm: resending rejected 0-RTT tell", err)
 	}
-	return err
 }
 
 func (s *Swarm[T]) Receive(ctx context.Context, th func(p2p.Message[Addr[T]])) error {
@@ -148,6 +237,13 @@ func (s *Swarm[T]) Ask(ctx context.Context, resp []byte, dst Addr[T], data p2p.I
 			return err
 		}
 		defer stream.Close()
+		// if the context is cancelled, reset the stream so the server can cancel the handler.
+		cancel := func() {
+			stream.CancelRead(AskCodeCancelled)
+			stream.CancelWrite(AskCodeCancelled)
+		}
+		stop := context.AfterFunc(ctx, cancel)
+		defer stop()
 
 		log.Debug("opened bidi-stream", logctx.Any("stream-id", stream.StreamID()))
 		// deadlines
@@ -160,14 +256,30 @@ func (s *Swarm[T]) Ask(ctx context.Context, resp []byte, dst Addr[T], data p2p.I
 			}
 		}
 		// write
+		if !isLegacy(sess) {
+			if _, err := stream.Write([]byte{streamTypeAsk}); err != nil {
+				return err
+			}
+		}
 		if err := writeFrame(stream, data); err != nil {
 			return err
 		}
 		log.Debug("ask request sent")
 		n, err = readFrame(stream, resp, s.mtu)
+		if err != nil {
+			// the read deadline can expire before ctx is done, the handler should still be cancelled.
+			cancel()
+		}
 		return err
 	}); err != nil {
-		return 0, err
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the stream deadlines are set to ctx's deadline, they can expire before ctx is done.
+			return 0, context.DeadlineExceeded
+		}
+		return 0, askError(dst, err)
 	}
 	return n, nil
 }
@@ -176,7 +288,16 @@ func (s *Swarm[T]) ServeAsk(ctx context.Context, fn func(context.Context, []byte
 	return s.asks.ServeAsk(ctx, fn)
 }
 
+// Close closes the swarm.
+// If the swarm is a view for an ALPN protocol, only the view's sessions are closed,
+// otherwise the transport, and all of the views are closed.
 func (s *Swarm[T]) Close() (retErr error) {
+	if s.parent != nil {
+		return s.closeView()
+	}
+	for _, v := range s.views {
+		v.closeView()
+	}
 	s.cf()
 	s.tells.CloseWithError(p2p.ErrClosed)
 	s.asks.CloseWithError(p2p.ErrClosed)
@@ -237,36 +358,50 @@ func (s *Swarm[T]) ParseAddr(data []byte) (Addr[T], error) {
 }
 
 func (s *Swarm[T]) withSession(ctx context.Context, dst Addr[T], fn func(sess quic.Connection) error) error {
-	s.mu.Lock()
-	sess, exists := s.sessCache[sessionKey{addr: dst.Key(), outbound: false}]
-	if !exists {
-		sess, exists = s.sessCache[sessionKey{addr: dst.Key(), outbound: true}]
-	}
-	s.mu.Unlock()
-	if exists {
-		return fn(sess)
-	}
+	return s.withEntry(ctx, dst, false, func(e *sessionEntry) error {
+		return fn(e.conn)
+	})
+}
 
-	raddr := p2pconn.NewAddr(s.inner, dst.Addr)
-	signer, err := x509.ToStandardSigner(&s.privateKey)
-	if err != nil {
-		return err
-	}
-	sess, err = s.transport.Dial(ctx, raddr, generateClientTLS(signer), generateQUICConfig())
-	if err != nil {
-		return err
+// withEntry calls fn with a session to dst, dialing one if necessary.
+// The session will not be evicted while fn is running.
+// If early is true, fn may be called before the handshake completes, so anything it sends could be 0-RTT data.
+func (s *Swarm[T]) withEntry(ctx context.Context, dst Addr[T], early bool, fn func(e *sessionEntry) error) error {
+	if e := s.sessions.acquire(sessionKey{addr: dst.Key(), outbound: false}, sessionKey{addr: dst.Key(), outbound: true}); e != nil {
+		defer s.sessions.release(e)
+		if !early {
+			if err := waitHandshake(ctx, e.conn); err != nil {
+				return err
+			}
+		}
+		return fn(e)
 	}
-	peerAddr, err := s.remoteAddrFromSession(sess)
+
+	sess, err := s.dial(ctx, dst, s.sessionProtos(), true)
 	if err != nil {
 		return err
 	}
-	if !(peerAddr.ID == dst.ID) {
-		return fmt.Errorf("wrong peer HAVE: %v WANT: %v", peerAddr.ID, dst.ID)
+	// A session which is still in the handshake is resuming a session with dst,
+	// the peer is authenticated by the resumption secret.
+	peerAddr := dst
+	if handshakeComplete(sess) {
+		if peerAddr, err = s.remoteAddrFromSession(sess); err != nil {
+			return err
+		}
 	}
-	s.putSession(peerAddr, sess, true)
+	// The session is cached under the address that was dialed, which has a different PeerID
+	// than the session's key if the peer has transitioned to a new key.
+	e, evicted, _ := s.sessions.put(sessionKey{addr: dst.Key(), outbound: true}, sess, true)
+	s.closeEvicted(evicted)
+	defer s.sessions.release(e)
 	s.log.With(logctx.Any("remote_addr", peerAddr)).Debug("session established via dial")
-	go s.handleSession(s.bgCtx, sess, peerAddr, true)
-	return fn(sess)
+	go s.handleSession(s.bgCtx, e, peerAddr)
+	if !early {
+		if err := waitHandshake(ctx, sess); err != nil {
+			return err
+		}
+	}
+	return fn(e)
 }
 
 func (s *Swarm[T]) serve(ctx context.Context) {
@@ -278,33 +413,72 @@ func (s *Swarm[T]) serve(ctx context.Context) {
 			}
 			return
 		}
-		addr, err := s.remoteAddrFromSession(sess)
-		if err != nil {
-			logctx.Warnln(ctx, err)
-			continue
+		if handshakeComplete(sess) {
+			s.route(ctx, sess)
+		} else {
+			go s.route(ctx, sess)
 		}
-		if !s.allowFunc(addr) {
-			continue
+	}
+}
+
+func (s *Swarm[T]) acceptSession(ctx context.Context, sess quic.Connection) {
+	// The client's certificate is not available until the handshake completes,
+	// unless it is resuming a session.
+	if len(sess.ConnectionState().TLS.PeerCertificates) == 0 {
+		if err := waitHandshake(ctx, sess); err != nil {
+			return
 		}
-		s.putSession(addr, sess, false)
-		s.log.With(logctx.Any("remote_addr", addr)).Debug("session established via listen")
-		go s.handleSession(ctx, sess, addr, false)
 	}
+	addr, err := s.remoteAddrFromSession(sess)
+	if err != nil {
+		logctx.Warnln(ctx, err)
+		return
+	}
+	if !s.allowFunc(addr) {
+		return
+	}
+	e, evicted, ok := s.sessions.put(sessionKey{addr: addr.Key(), outbound: false}, sess, false)
+	s.closeEvicted(evicted)
+	if !ok {
+		s.stats.rejectedSessions.Add(1)
+		sess.CloseWithError(sessErrTooManySessions, "too many sessions")
+		return
+	}
+	s.sessions.release(e)
+	s.log.With(logctx.Any("remote_addr", addr)).Debug("session established via listen")
+	go s.handleSession(ctx, e, addr)
 }
 
-func (s *Swarm[T]) handleSession(ctx context.Context, sess quic.Connection, src Addr[T], isClient bool) {
-	defer func() {
-		s.mu.Lock()
-		delete(s.sessCache, sessionKey{addr: src.Key(), outbound: isClient})
-		s.mu.Unlock()
-	}()
+func (s *Swarm[T]) handleSession(ctx context.Context, e *sessionEntry, src Addr[T]) {
+	defer s.sessions.delete(e)
+	sess := e.conn
+	// The streams of an outbound session are replaced if 0-RTT data is rejected,
+	// so wait for the handshake before accepting streams.
+	if e.key.outbound {
+		if err := waitHandshake(ctx, sess); err != nil {
+			sess.CloseWithError(1, err.Error())
+			return
+		}
+		if cs := sess.ConnectionState(); cs.TLS.DidResume {
+			s.stats.resumedSessions.Add(1)
+			if cs.Used0RTT {
+				s.stats.used0RTT.Add(1)
+			}
+		}
+	}
+	go s.announceTransition(ctx, sess)
 	eg := errgroup.Group{}
 	eg.Go(func() error {
-		return s.handleAsks(ctx, sess, src)
+		return s.handleStreams(ctx, e, src)
 	})
 	eg.Go(func() error {
-		return s.handleTells(ctx, sess, src)
+		return s.handleTells(ctx, e, src)
 	})
+	if s.maxDatagram > 0 {
+		eg.Go(func() error {
+			return s.handleDatagrams(ctx, e, src)
+		})
+	}
 	err := quicErr(eg.Wait())
 	if err != nil && !errors.Is(err, context.Canceled) {
 		if err := sess.CloseWithError(1, err.Error()); err != nil {
@@ -317,17 +491,52 @@ func (s *Swarm[T]) handleSession(ctx context.Context, sess quic.Connection, src
 	}
 }
 
-func (s *Swarm[T]) handleAsks(ctx context.Context, sess quic.Connection, srcAddr Addr[T]) error {
+// handleStreams accepts bidirectional streams, which are either Asks or application streams.
+// On LegacyALPN sessions every stream is an Ask.
+func (s *Swarm[T]) handleStreams(ctx context.Context, e *sessionEntry, srcAddr Addr[T]) error {
 	log := s.log.With(logctx.Any("remote_addr", srcAddr))
+	sess := e.conn
 	for {
 		stream, err := sess.AcceptStream(ctx)
 		if err != nil {
 			return err
 		}
+		s.sessions.touch(e)
 		log.Debug("accepted bidi-stream ", logctx.Any("streamID", stream.StreamID()))
 		go func() {
-			if err := s.handleAsk(ctx, stream, srcAddr, s.makeLocalAddr(sess.LocalAddr())); err != nil {
-				log.Sugar().Error(ctx, "error handling ask: %v", err)
+			// bidirectional streams are not idempotent, so they are not processed until the handshake
+			// has completed, and they cannot have been replayed.
+			if err := waitHandshake(ctx, sess); err != nil {
+				return
+			}
+			dstAddr := s.makeLocalAddr(sess.LocalAddr())
+			if isLegacy(sess) {
+				if err := s.handleAsk(ctx, stream, srcAddr, dstAddr); err != nil {
+					log.Sugar().Errorf("error handling ask: %v", err)
+				}
+				return
+			}
+			var typ [1]byte
+			if _, err := io.ReadFull(stream, typ[:]); err != nil {
+				log.Sugar().Errorf("error reading stream type: %v", err)
+				return
+			}
+			switch typ[0] {
+			case streamTypeAsk:
+				if err := s.handleAsk(ctx, stream, srcAddr, dstAddr); err != nil {
+					log.Sugar().Error(ctx, "error handling ask: %v", err)
+				}
+			case streamTypeApp:
+				if err := s.handleAppStream(ctx, e, stream, srcAddr, dstAddr); err != nil {
+					log.Sugar().Errorf("error accepting stream: %v", err)
+				}
+			case streamTypeTransition:
+				if err := s.handleTransition(sess, stream); err != nil {
+					log.Sugar().Errorf("error handling transition: %v", err)
+				}
+			default:
+				stream.CancelRead(streamErrUnknownType)
+				stream.CancelWrite(streamErrUnknownType)
 			}
 		}()
 	}
@@ -346,13 +555,26 @@ func (s *Swarm[T]) handleAsk(ctx context.Context, stream quic.Stream, srcAddr, d
 		Src:     srcAddr,
 		Payload: reqData[:n],
 	}
+	// the handler is cancelled if the requester resets the stream.
+	ctx, cf := context.WithCancel(ctx)
+	defer cf()
+	stop := context.AfterFunc(stream.Context(), cf)
+	defer stop()
 	respBuf := make([]byte, s.mtu)
 	n, err = s.asks.Deliver(ctx, respBuf, m)
 	if err != nil {
+		code := AskCodeUnavailable
+		if stream.Context().Err() != nil {
+			code = AskCodeCancelled
+		}
+		stream.CancelRead(code)
+		stream.CancelWrite(code)
 		return err
 	}
 	if n < 0 {
-		return stream.Close()
+		stream.CancelRead(handlerResetCode(n))
+		stream.CancelWrite(handlerResetCode(n))
+		return nil
 	}
 	if err := writeFrame(stream, p2p.IOVec{respBuf[:n]}); err != nil {
 		return err
@@ -360,12 +582,14 @@ func (s *Swarm[T]) handleAsk(ctx context.Context, stream quic.Stream, srcAddr, d
 	return stream.Close()
 }
 
-func (s *Swarm[T]) handleTells(ctx context.Context, sess quic.Connection, srcAddr Addr[T]) error {
+func (s *Swarm[T]) handleTells(ctx context.Context, e *sessionEntry, srcAddr Addr[T]) error {
+	sess := e.conn
 	for {
 		stream, err := sess.AcceptUniStream(ctx)
 		if err != nil {
 			return err
 		}
+		s.sessions.touch(e)
 		go func() {
 			lr := io.LimitReader(stream, int64(s.mtu))
 			data, err := io.ReadAll(lr)
@@ -373,6 +597,7 @@ func (s *Swarm[T]) handleTells(ctx context.Context, sess quic.Connection, srcAdd
 				logctx.Errorln(ctx, err)
 				return
 			}
+			s.stats.streamTellsReceived.Add(1)
 			m := p2p.Message[Addr[T]]{
 				Dst:     s.makeLocalAddr(sess.LocalAddr()),
 				Src:     srcAddr,
@@ -385,10 +610,32 @@ func (s *Swarm[T]) handleTells(ctx context.Context, sess quic.Connection, srcAdd
 	}
 }
 
-func (s *Swarm[T]) putSession(addr Addr[T], newSess quic.Connection, isClient bool) {
-	s.mu.Lock()
-	s.sessCache[sessionKey{addr: addr.Key(), outbound: isClient}] = newSess
-	s.mu.Unlock()
+func (s *Swarm[T]) handleDatagrams(ctx context.Context, e *sessionEntry, srcAddr Addr[T]) error {
+	sess := e.conn
+	for {
+		data, err := sess.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		s.sessions.touch(e)
+		s.stats.datagramsReceived.Add(1)
+		m := p2p.Message[Addr[T]]{
+			Dst:     s.makeLocalAddr(sess.LocalAddr()),
+			Src:     srcAddr,
+			Payload: data,
+		}
+		if err := s.tells.Deliver(ctx, m); err != nil {
+			logctx.Errorf(ctx, "during tell delivery: %v", err)
+		}
+	}
+}
+
+// closeEvicted closes sessions which have been evicted from the cache.
+func (s *Swarm[T]) closeEvicted(evicted []quic.Connection) {
+	for _, sess := range evicted {
+		s.stats.evictedSessions.Add(1)
+		sess.CloseWithError(0, "")
+	}
 }
 
 // makeLocalAddr returns an Addr with the LocalID
@@ -419,18 +666,44 @@ func (s *Swarm[T]) remoteAddrFromSession(x quic.Connection) (Addr[T], error) {
 	}, nil
 }
 
-func generateClientTLS(privKey crypto.Signer) *tls.Config {
+// verifyConnection returns a function for tls.Config.VerifyConnection, which checks the peer's key.
+// If want is not nil, the peer must be *want, or have replaced it with a key transition.
+// If the swarm has a TrustStore, the peer must be trusted.
+// Unlike VerifyPeerCertificate, it is also called when a session is resumed.
+func (s *Swarm[T]) verifyConnection(want *p2p.PeerID) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) < 1 {
+			return errors.New("no certificates")
+		}
+		pubKey, err := x509.ParsePublicKey(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if err != nil {
+			return err
+		}
+		haveID := s.fingerprinter(pubKey)
+		if want != nil && haveID != *want {
+			if s.transitions == nil || !s.transitions.Accepts(*want, &pubKey, time.Now()) {
+				return fmt.Errorf("wrong peer HAVE: %v WANT: %v", haveID, *want)
+			}
+		}
+		if s.trust != nil && !s.trust.Trusts(haveID, &pubKey) {
+			return fmt.Errorf("quicswarm: peer %v is not trusted", haveID)
+		}
+		return nil
+	}
+}
+
+func generateClientTLS(privKey crypto.Signer, nextProtos []string) *tls.Config {
 	cert := swarmutil.GenerateSelfSigned(privKey)
 
 	return &tls.Config{
 		Certificates:       []tls.Certificate{cert},
 		InsecureSkipVerify: true,
 		ClientAuth:         tls.RequireAnyClientCert,
-		NextProtos:         []string{"p2p"},
+		NextProtos:         nextProtos,
 	}
 }
 
-func generateServerTLS(privKey *PrivateKey, publicKey *PublicKey, fp Fingerprinter) *tls.Config {
+func generateServerTLS(privKey *PrivateKey, publicKey *PublicKey, fp Fingerprinter, nextProtos []string) *tls.Config {
 	signer, err := x509.ToStandardSigner(privKey)
 	if err != nil {
 		panic(err)
@@ -439,16 +712,27 @@ func generateServerTLS(privKey *PrivateKey, publicKey *PublicKey, fp Fingerprint
 	localID := fp(*publicKey)
 	return &tls.Config{
 		Certificates:       []tls.Certificate{cert},
-		NextProtos:         []string{"p2p"},
+		NextProtos:         nextProtos,
 		ClientAuth:         tls.RequireAnyClientCert,
 		ServerName:         localID.String(),
 		InsecureSkipVerify: true,
 	}
 }
 
-func generateQUICConfig() *quic.Config {
+func (s *Swarm[T]) quicConfig() *quic.Config {
 	return &quic.Config{
-		EnableDatagrams: true,
+		EnableDatagrams: s.maxDatagram > 0,
+		Allow0RTT:       s.tickets != nil,
+
+		MaxIdleTimeout:        s.idleTimeout,
+		KeepAlivePeriod:       s.keepAlivePeriod,
+		MaxIncomingStreams:    s.maxIncomingStreams,
+		MaxIncomingUniStreams: s.maxIncomingUniStreams,
+
+		InitialStreamReceiveWindow:     s.streamWindow[0],
+		MaxStreamReceiveWindow:         s.streamWindow[1],
+		InitialConnectionReceiveWindow: s.connWindow[0],
+		MaxConnectionReceiveWindow:     s.connWindow[1],
 	}
 }
 
@@ -490,8 +774,3 @@ func isSessionReplaced(err error) bool {
 	}
 	return false
 }
-
-type sessionKey struct {
-	addr     string
-	outbound bool
-}
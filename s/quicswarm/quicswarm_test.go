@@ -1,16 +1,26 @@
 package quicswarm
 
 import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/require"
 	"go.brendoncarroll.net/exp/crypto/sign/sig_ed25519"
 	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
 	"go.brendoncarroll.net/p2p/f/x509"
 	"go.brendoncarroll.net/p2p/p2ptest"
 	"go.brendoncarroll.net/p2p/s/memswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
 	"go.brendoncarroll.net/p2p/s/udpswarm"
+	"golang.org/x/sync/errgroup"
 )
 
 func testSwarm[T p2p.Addr](t *testing.T, baseSwarms func(testing.TB, []p2p.Swarm[T])) {
@@ -83,3 +93,445 @@ func newTestKey(t testing.TB, i int) x509.PrivateKey {
 		Data:      data,
 	}
 }
+
+// newTestSwarm creates a swarm on r, with the i-th test key, which is closed when the test ends.
+func newTestSwarm(t testing.TB, r *memswarm.Realm, i int, opts ...Option[memswarm.Addr]) *Swarm[memswarm.Addr] {
+	s, err := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, i), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, s.Close()) })
+	return s
+}
+
+// serveEcho serves the asks sent to s in the background, by replying with the request, until the test ends or s is closed.
+func serveEcho(t testing.TB, ctx context.Context, s *Swarm[memswarm.Addr]) {
+	ctx, cf := context.WithCancel(ctx)
+	t.Cleanup(cf)
+	go func() {
+		for {
+			if err := s.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+				return copy(resp, req.Payload)
+			}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestKeyTransition(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	reg := x509.DefaultRegistry()
+	oldKey, newKey := newTestKey(t, 0), newTestKey(t, 2)
+	oldPub, err := reg.PublicFromPrivate(&oldKey)
+	require.NoError(t, err)
+	tr, err := keytransition.Sign(reg, &oldKey, &newKey, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	set := keytransition.NewSet(reg, func(pub *x509.PublicKey) p2p.PeerID {
+		return DefaultFingerprinter(*pub)
+	})
+	updated := make(chan p2p.PeerID, 1)
+	set.OnTransition(func(_, newID p2p.PeerID, _ *keytransition.Transition) {
+		updated <- newID
+	})
+
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a, err := New[memswarm.Addr](r.NewSwarm(), newKey, WithTransition[memswarm.Addr](tr))
+	require.NoError(t, err)
+	b, err := New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 1), WithKeyTransitions[memswarm.Addr](set))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+	})
+	dst := Addr[memswarm.Addr]{ID: DefaultFingerprinter(oldPub), Addr: a.LocalAddrs()[0].Addr}
+	require.Error(t, b.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+
+	// a announces the transition when it contacts b.
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, a.LocalID(), <-updated)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+		require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, a, &m))
+		require.Equal(t, b.LocalID(), m.Src.ID)
+	}
+	// the session is found by the old PeerID, instead of dialing again.
+	e := b.sessions.acquire(sessionKey{addr: dst.Key(), outbound: true})
+	require.NotNil(t, e)
+	b.sessions.release(e)
+}
+
+func TestDatagrams(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := newTestSwarm(t, r, 0, WithDatagrams[memswarm.Addr](0))
+	b := newTestSwarm(t, r, 1, WithDatagrams[memswarm.Addr](0))
+	c := newTestSwarm(t, r, 2)
+
+	var m p2p.Message[Addr[memswarm.Addr]]
+	small, large := []byte("hello"), make([]byte, DefaultMaxDatagramSize+1)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{small}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, small, m.Payload)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{large}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, large, m.Payload)
+	require.Equal(t, uint64(1), a.Stats().DatagramTells)
+	require.Equal(t, uint64(1), a.Stats().StreamTells)
+	require.Equal(t, uint64(1), b.Stats().DatagramsReceived)
+	require.Equal(t, uint64(1), b.Stats().StreamTellsReceived)
+
+	// c has not enabled datagrams
+	require.NoError(t, a.Tell(ctx, c.LocalAddrs()[0], p2p.IOVec{small}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, c, &m))
+	require.Equal(t, small, m.Payload)
+	require.Equal(t, uint64(2), a.Stats().StreamTells)
+	require.Equal(t, uint64(1), a.Stats().DatagramFallbacks)
+}
+
+func TestStreams(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := newTestSwarm(t, r, 0)
+	b := newTestSwarm(t, r, 1)
+
+	// larger than the MTU
+	data := make([]byte, 3*DefaultMTU)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		st, err := b.AcceptStream(ctx)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		if st.Protocol() != "test-proto" || st.RemoteID() != a.LocalID() {
+			return fmt.Errorf("wrong stream %q %v", st.Protocol(), st.RemoteID())
+		}
+		// echo
+		if _, err := io.Copy(st, st); err != nil {
+			return err
+		}
+		return st.CloseWrite()
+	})
+	st, err := a.OpenStream(ctx, b.LocalAddrs()[0], "test-proto")
+	require.NoError(t, err)
+	eg.Go(func() error {
+		if _, err := st.Write(data); err != nil {
+			return err
+		}
+		return st.CloseWrite()
+	})
+	actual, err := io.ReadAll(st)
+	require.NoError(t, err)
+	require.NoError(t, eg.Wait())
+	require.Equal(t, data, actual)
+
+	// asks still work alongside streams.
+	serveEcho(t, ctx, b)
+	resp := make([]byte, 10)
+	n, err := a.Ask(ctx, resp, b.LocalAddrs()[0], p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+}
+
+func TestMaxSessions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := newTestSwarm(t, r, 0, WithMaxSessions[memswarm.Addr](1), WithKeepAlive[memswarm.Addr](time.Second))
+	b := newTestSwarm(t, r, 1)
+	c := newTestSwarm(t, r, 2)
+
+	var m p2p.Message[Addr[memswarm.Addr]]
+	for _, dst := range []*Swarm[memswarm.Addr]{b, c, b} {
+		require.NoError(t, a.Tell(ctx, dst.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+		require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, dst, &m))
+		require.Equal(t, 1, a.Stats().Sessions)
+	}
+	require.Equal(t, uint64(2), a.Stats().EvictedSessions)
+
+	// a session with an open stream is not idle, so it is not evicted.
+	st, err := a.OpenStream(ctx, b.LocalAddrs()[0], "test")
+	require.NoError(t, err)
+	require.NoError(t, a.Tell(ctx, c.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, c, &m))
+	require.Equal(t, 2, a.Stats().Sessions)
+	require.Equal(t, uint64(2), a.Stats().EvictedSessions)
+	require.NoError(t, st.Close())
+}
+
+func TestAskErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	a := newTestSwarm(t, r, 0)
+	b := newTestSwarm(t, r, 1)
+	dst := b.LocalAddrs()[0]
+	resp := make([]byte, 10)
+
+	// handler error codes are returned to the caller.
+	go b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		return -5
+	})
+	_, err := a.Ask(ctx, resp, dst, p2p.IOVec{[]byte("ping")})
+	var askErr ErrAskFailed
+	require.ErrorAs(t, err, &askErr)
+	require.Equal(t, AskCodeHandlerError, askErr.Code)
+	require.Equal(t, -5, askErr.HandlerValue)
+
+	// cancelling the ask cancels the handler.
+	cancelled := make(chan struct{})
+	go b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		<-ctx.Done()
+		close(cancelled)
+		return 0
+	})
+	ctx2, cf := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cf()
+	_, err = a.Ask(ctx2, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case <-cancelled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	store := NewMemTicketStore()
+	a := newTestSwarm(t, r, 0, WithSessionResumption[memswarm.Addr](store))
+	b := newTestSwarm(t, r, 1, WithSessionResumption[memswarm.Addr](nil))
+	dst := b.LocalAddrs()[0]
+
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Eventually(t, func() bool {
+		_, ok := store.GetTicket(dst.Key())
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(0), a.Stats().ResumedSessions)
+
+	// a new swarm with the same key and ticket store, resumes the session.
+	a2 := newTestSwarm(t, r, 0, WithSessionResumption[memswarm.Addr](store))
+	require.NoError(t, a2.Tell(ctx, dst, p2p.IOVec{[]byte("hello again")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, "hello again", string(m.Payload))
+	require.Equal(t, a2.LocalAddrs()[0], m.Src)
+	require.Eventually(t, func() bool {
+		return a2.Stats().ZeroRTTSessions == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(1), a2.Stats().ResumedSessions)
+
+	// asks work on the resumed session.
+	serveEcho(t, ctx, b)
+	resp := make([]byte, 10)
+	n, err := a2.Ask(ctx, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+}
+
+func TestSessionResumptionRejected(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	store := NewMemTicketStore()
+	a := newTestSwarm(t, r, 0, WithSessionResumption[memswarm.Addr](store))
+	b := newTestSwarm(t, r, 1, WithSessionResumption[memswarm.Addr](nil))
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	var ticket []byte
+	require.Eventually(t, func() bool {
+		var ok bool
+		ticket, ok = store.GetTicket(b.LocalAddrs()[0].Key())
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// b2 has the same key as b, but cannot decrypt b's tickets, so it rejects the 0-RTT data.
+	b2 := newTestSwarm(t, r, 1, WithSessionResumption[memswarm.Addr](nil))
+	dst := b2.LocalAddrs()[0]
+	store.PutTicket(dst.Key(), ticket)
+	a2 := newTestSwarm(t, r, 0, WithSessionResumption[memswarm.Addr](store))
+	require.NoError(t, a2.Tell(ctx, dst, p2p.IOVec{[]byte("hello again")}))
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b2, &m))
+	require.Equal(t, "hello again", string(m.Payload))
+	require.Equal(t, uint64(0), a2.Stats().ZeroRTTSessions)
+	require.Equal(t, uint64(1), a2.Stats().Resent0RTTTells)
+}
+
+func TestTrustStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	newSwarm := func(i int, opts ...Option[memswarm.Addr]) *Swarm[memswarm.Addr] {
+		s := newTestSwarm(t, r, i, opts...)
+		serveEcho(t, ctx, s)
+		return s
+	}
+	ask := func(src, dst *Swarm[memswarm.Addr]) error {
+		ctx, cf := context.WithTimeout(ctx, 3*time.Second)
+		defer cf()
+		resp := make([]byte, 16)
+		_, err := src.Ask(ctx, resp, dst.LocalAddrs()[0], p2p.IOVec{[]byte("ping")})
+		return err
+	}
+
+	// PeerIDSet
+	ids := NewPeerIDSet()
+	a := newSwarm(0, WithTrustStore[memswarm.Addr](ids))
+	b := newSwarm(1)
+	require.Error(t, ask(a, b))
+	require.Error(t, ask(b, a))
+	ids.Add(b.LocalAddrs()[0].ID)
+	require.NoError(t, ask(a, b))
+	require.NoError(t, ask(b, a))
+
+	// KeyFileStore
+	p := filepath.Join(t.TempDir(), "trusted.pem")
+	writeKeys := func(xs ...*Swarm[memswarm.Addr]) {
+		var data []byte
+		for _, x := range xs {
+			pub := x.PublicKey()
+			data = append(data, pem.EncodeToMemory(&pem.Block{
+				Type:  PEMTypePublicKey,
+				Bytes: x509.MarshalPublicKey(nil, &pub),
+			})...)
+		}
+		require.NoError(t, os.WriteFile(p, data, 0o644))
+	}
+	writeKeys(b)
+	keys, err := NewKeyFileStore(p)
+	require.NoError(t, err)
+	c := newSwarm(2, WithTrustStore[memswarm.Addr](keys))
+	d := newSwarm(3)
+	require.NoError(t, ask(b, c))
+	require.Error(t, ask(d, c))
+	// the file is reloaded after it changes.
+	writeKeys(b, d)
+	require.Eventually(t, func() bool {
+		return ask(d, c) == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestProtocols(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := memswarm.NewRealm(memswarm.WithQueueLen(10))
+	echo := func(ctx context.Context, conn quic.Connection) {
+		defer conn.CloseWithError(0, "")
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.Close()
+		// wait for the client to close the connection, so the response is not lost.
+		<-conn.Context().Done()
+	}
+	opts := []Option[memswarm.Addr]{
+		WithProtocol[memswarm.Addr]("app2", WithMTU[memswarm.Addr](1024)),
+		WithConnHandler[memswarm.Addr]("echo", echo),
+	}
+	a, b := newTestSwarm(t, r, 0, opts...), newTestSwarm(t, r, 1, opts...)
+	a2, b2 := a.Protocol("app2"), b.Protocol("app2")
+	require.NotNil(t, a2)
+	require.Nil(t, a.Protocol("echo"))
+	require.Equal(t, a, a2.Protocol(DefaultALPN))
+	require.Equal(t, 1024, a2.MTU())
+	dst := b.LocalAddrs()[0]
+
+	// each view has its own sessions, and messages.
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello p2p")}))
+	var m p2p.Message[Addr[memswarm.Addr]]
+	require.NoError(t, p2p.Receive[Addr[memswarm.Addr]](ctx, b, &m))
+	require.Equal(t, "hello p2p", string(m.Payload))
+	go b2.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		return copy(resp, "app2: "+string(req.Payload))
+	})
+	resp := make([]byte, 64)
+	n, err := a2.Ask(ctx, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "app2: ping", string(resp[:n]))
+	require.Equal(t, 1, a.Stats().Sessions)
+	require.Equal(t, 1, a2.Stats().Sessions)
+
+	// raw connections are passed to the handler.
+	conn, err := a.DialConn(ctx, dst, "echo")
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("echo this"))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.Equal(t, "echo this", string(data))
+
+	// protocols which are not registered are refused.
+	_, err = a.DialConn(ctx, dst, "unknown")
+	require.Error(t, err)
+	_, err = New[memswarm.Addr](r.NewSwarm(), newTestKey(t, 2), WithProtocol[memswarm.Addr](DefaultALPN))
+	require.Error(t, err)
+}
+
+func TestLegacyALPN(t *testing.T) {
+	t.Parallel()
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	r := memswarm.NewRealm()
+	// legacy serves Asks the way peers did before streams had a type.
+	legacy := func(ctx context.Context, conn quic.Connection) {
+		defer conn.CloseWithError(0, "")
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 64)
+		n, err := readFrame(stream, buf, len(buf))
+		if err != nil {
+			return
+		}
+		writeFrame(stream, p2p.IOVec{[]byte("legacy: "), buf[:n]})
+		stream.Close()
+		<-conn.Context().Done()
+	}
+	a := newTestSwarm(t, r, 0)
+	b := newTestSwarm(t, r, 1)
+	c := newTestSwarm(t, r, 2, WithALPN[memswarm.Addr]("other"), WithConnHandler[memswarm.Addr](LegacyALPN, legacy))
+	require.Equal(t, a, a.Protocol(LegacyALPN))
+	require.Nil(t, c.Protocol(LegacyALPN))
+
+	// a legacy peer can Ask a swarm using DefaultALPN.
+	go b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr[memswarm.Addr]]) int {
+		return copy(resp, "b: "+string(req.Payload))
+	})
+	conn, err := a.DialConn(ctx, b.LocalAddrs()[0], LegacyALPN)
+	require.NoError(t, err)
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	require.NoError(t, err)
+	require.NoError(t, writeFrame(stream, p2p.IOVec{[]byte("ping")}))
+	resp := make([]byte, 64)
+	n, err := readFrame(stream, resp, len(resp))
+	require.NoError(t, err)
+	require.Equal(t, "b: ping", string(resp[:n]))
+
+	// a swarm using DefaultALPN can Ask a legacy peer.
+	n, err = a.Ask(ctx, resp, c.LocalAddrs()[0], p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "legacy: ping", string(resp[:n]))
+	_, err = a.OpenStream(ctx, c.LocalAddrs()[0], "app")
+	require.ErrorIs(t, err, errLegacyStreams)
+}
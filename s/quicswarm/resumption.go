@@ -0,0 +1,156 @@
+package quicswarm
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// earlyResendTimeout is how long to wait for the handshake of a session, before giving up on resending rejected 0-RTT data.
+const earlyResendTimeout = 10 * time.Second
+
+var errInvalidTicket = errors.New("quicswarm: invalid session ticket")
+
+// TicketStore holds TLS session tickets, which are used to resume sessions to peers.
+// An implementation which persists tickets allows sessions to be resumed after a restart.
+// Tickets are secret, they allow resuming a session without authenticating again.
+type TicketStore interface {
+	// GetTicket returns the ticket stored for key.
+	GetTicket(key string) ([]byte, bool)
+	// PutTicket stores a ticket for key, replacing any existing ticket.
+	// If ticket is nil, the ticket for key should be deleted.
+	PutTicket(key string, ticket []byte)
+}
+
+// MemTicketStore is a TicketStore in memory.
+type MemTicketStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func NewMemTicketStore() *MemTicketStore {
+	return &MemTicketStore{m: make(map[string][]byte)}
+}
+
+func (s *MemTicketStore) GetTicket(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.m[key]
+	return t, ok
+}
+
+func (s *MemTicketStore) PutTicket(key string, ticket []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ticket == nil {
+		delete(s.m, key)
+	} else {
+		s.m[key] = append([]byte{}, ticket...)
+	}
+}
+
+// ticketCache adapts a TicketStore to a tls.ClientSessionCache for a single peer.
+// The key chosen by the TLS implementation is ignored, tickets are stored under the peer's address,
+// which includes its PeerID.
+type ticketCache struct {
+	store TicketStore
+	key   string
+}
+
+func (tc ticketCache) Get(string) (*tls.ClientSessionState, bool) {
+	data, ok := tc.store.GetTicket(tc.key)
+	if !ok {
+		return nil, false
+	}
+	cs, err := parseTicket(data)
+	if err != nil {
+		tc.store.PutTicket(tc.key, nil)
+		return nil, false
+	}
+	return cs, true
+}
+
+func (tc ticketCache) Put(_ string, cs *tls.ClientSessionState) {
+	if cs == nil {
+		tc.store.PutTicket(tc.key, nil)
+		return
+	}
+	data, err := marshalTicket(cs)
+	if err != nil {
+		return
+	}
+	tc.store.PutTicket(tc.key, data)
+}
+
+// marshalTicket serializes cs as the length of the ticket, the ticket, and then the session state.
+func marshalTicket(cs *tls.ClientSessionState) ([]byte, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	stateData, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	out := binary.AppendUvarint(nil, uint64(len(ticket)))
+	out = append(out, ticket...)
+	return append(out, stateData...), nil
+}
+
+func parseTicket(data []byte) (*tls.ClientSessionState, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, errInvalidTicket
+	}
+	ticket := data[n : n+int(l)]
+	state, err := tls.ParseSessionState(data[n+int(l):])
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(ticket, state)
+}
+
+// handshakeComplete returns true if the handshake for sess has finished.
+// Sessions which are still in the handshake can only be used to send 0-RTT data.
+func handshakeComplete(sess quic.Connection) bool {
+	ec, ok := sess.(quic.EarlyConnection)
+	if !ok {
+		return true
+	}
+	select {
+	case <-ec.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+// waitHandshake blocks until the handshake for sess has finished.
+// If 0-RTT data was rejected, streams opened before the handshake completed will fail,
+// and new streams can be opened after waitHandshake returns.
+func waitHandshake(ctx context.Context, sess quic.Connection) error {
+	ec, ok := sess.(quic.EarlyConnection)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ec.HandshakeComplete():
+	}
+	ec.NextConnection()
+	return sess.Context().Err()
+}
+
+type earlyListener struct {
+	*quic.EarlyListener
+}
+
+func (l earlyListener) Accept(ctx context.Context) (quic.Connection, error) {
+	return l.EarlyListener.Accept(ctx)
+}
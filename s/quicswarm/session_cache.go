@@ -0,0 +1,157 @@
+package quicswarm
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// sessErrTooManySessions is the application error code used to refuse a session.
+const sessErrTooManySessions = quic.ApplicationErrorCode(2)
+
+type listener interface {
+	Accept(ctx context.Context) (quic.Connection, error)
+	Close() error
+}
+
+type sessionKey struct {
+	addr     string
+	outbound bool
+}
+
+// sessionEntry is a session held by the sessionCache.
+type sessionEntry struct {
+	key  sessionKey
+	conn quic.Connection
+
+	// the following are protected by the cache's mutex
+	lastUsed time.Time
+	// inUse is the number of operations and open streams using the session.
+	// Sessions which are in use are never evicted.
+	inUse int
+}
+
+// sessionCache holds the established sessions, and evicts the least recently used idle sessions
+// when there are more than max.
+type sessionCache struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[sessionKey]*sessionEntry
+}
+
+func newSessionCache(max int) *sessionCache {
+	return &sessionCache{
+		max:     max,
+		entries: make(map[sessionKey]*sessionEntry),
+	}
+}
+
+// acquire returns the first entry that exists for keys, and marks it as in use.
+// release must be called when the caller is done with the entry.
+func (sc *sessionCache) acquire(keys ...sessionKey) *sessionEntry {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, k := range keys {
+		if e, exists := sc.entries[k]; exists {
+			e.inUse++
+			e.lastUsed = time.Now()
+			return e
+		}
+	}
+	return nil
+}
+
+// retain marks e as in use. It does not matter if e is still in the cache.
+func (sc *sessionCache) retain(e *sessionEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.inUse++
+	e.lastUsed = time.Now()
+}
+
+func (sc *sessionCache) release(e *sessionEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.inUse--
+	e.lastUsed = time.Now()
+}
+
+// touch marks e as recently used.
+func (sc *sessionCache) touch(e *sessionEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.lastUsed = time.Now()
+}
+
+// put adds conn to the cache, replacing any session with the same key.
+// The returned entry is in use.
+// If the cache is full, idle sessions are evicted, and returned so the caller can close them.
+// If force is false and there is nothing to evict, the session is not added and ok is false.
+func (sc *sessionCache) put(key sessionKey, conn quic.Connection, force bool) (e *sessionEntry, evicted []quic.Connection, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, exists := sc.entries[key]; !exists && sc.max > 0 {
+		for len(sc.entries) >= sc.max {
+			victim := sc.lruIdle()
+			if victim == nil {
+				break
+			}
+			delete(sc.entries, victim.key)
+			evicted = append(evicted, victim.conn)
+		}
+		if len(sc.entries) >= sc.max && !force {
+			return nil, evicted, false
+		}
+	}
+	e = &sessionEntry{
+		key:      key,
+		conn:     conn,
+		lastUsed: time.Now(),
+		inUse:    1,
+	}
+	sc.entries[key] = e
+	return e, evicted, true
+}
+
+// delete removes e from the cache, if it has not already been replaced.
+func (sc *sessionCache) delete(e *sessionEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.entries[e.key] == e {
+		delete(sc.entries, e.key)
+	}
+}
+
+func (sc *sessionCache) len() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.entries)
+}
+
+// lruIdle returns the least recently used session which is not in use, or nil.
+func (sc *sessionCache) lruIdle() *sessionEntry {
+	var ret *sessionEntry
+	for _, e := range sc.entries {
+		if e.inUse > 0 {
+			continue
+		}
+		if ret == nil || e.lastUsed.Before(ret.lastUsed) {
+			ret = e
+		}
+	}
+	return ret
+}
+
+// closeAll removes every entry from the cache, and returns their sessions so the caller can close them.
+func (sc *sessionCache) closeAll() (ret []quic.Connection) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for k, e := range sc.entries {
+		ret = append(ret, e.conn)
+		delete(sc.entries, k)
+	}
+	return ret
+}
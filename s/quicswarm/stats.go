@@ -0,0 +1,91 @@
+package quicswarm
+
+import (
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+
+	"go.brendoncarroll.net/p2p"
+)
+
+// Stats contains counters for the swarm.
+type Stats struct {
+	// DatagramTells is the number of Tells sent as DATAGRAM frames.
+	DatagramTells uint64
+	// StreamTells is the number of Tells sent on unidirectional streams.
+	StreamTells uint64
+	// DatagramFallbacks is the number of Tells which were small enough to be sent as a datagram,
+	// but were sent on a stream, because the peer did not support datagrams, or the frame did not fit.
+	// They are included in StreamTells.
+	DatagramFallbacks uint64
+
+	DatagramsReceived   uint64
+	StreamTellsReceived uint64
+
+	// Sessions is the number of sessions currently held.
+	Sessions int
+	// EvictedSessions is the number of idle sessions closed to stay within the session limit.
+	EvictedSessions uint64
+	// RejectedSessions is the number of incoming sessions refused because the session limit
+	// was reached, and no session was idle.
+	RejectedSessions uint64
+	// ResumedSessions is the number of outbound sessions which resumed a previous session using a ticket.
+	ResumedSessions uint64
+	// ZeroRTTSessions is the number of resumed sessions where the peer accepted 0-RTT data.
+	ZeroRTTSessions uint64
+	// Resent0RTTTells is the number of Tells sent as 0-RTT data which were rejected by the peer, and resent.
+	Resent0RTTTells uint64
+}
+
+// Stats returns a snapshot of the swarm's counters.
+func (s *Swarm[T]) Stats() Stats {
+	return Stats{
+		DatagramTells:     s.stats.datagramTells.Load(),
+		StreamTells:       s.stats.streamTells.Load(),
+		DatagramFallbacks: s.stats.datagramFallbacks.Load(),
+
+		DatagramsReceived:   s.stats.datagramsReceived.Load(),
+		StreamTellsReceived: s.stats.streamTellsReceived.Load(),
+
+		Sessions:         s.sessions.len(),
+		EvictedSessions:  s.stats.evictedSessions.Load(),
+		RejectedSessions: s.stats.rejectedSessions.Load(),
+		ResumedSessions:  s.stats.resumedSessions.Load(),
+		ZeroRTTSessions:  s.stats.used0RTT.Load(),
+		Resent0RTTTells:  s.stats.resent0RTT.Load(),
+	}
+}
+
+type counters struct {
+	datagramTells     atomic.Uint64
+	streamTells       atomic.Uint64
+	datagramFallbacks atomic.Uint64
+
+	datagramsReceived   atomic.Uint64
+	streamTellsReceived atomic.Uint64
+
+	evictedSessions  atomic.Uint64
+	rejectedSessions atomic.Uint64
+	resumedSessions  atomic.Uint64
+	used0RTT         atomic.Uint64
+	resent0RTT       atomic.Uint64
+}
+
+// tryDatagram sends data as a DATAGRAM frame if datagrams are enabled, and it will fit.
+// It returns true if the message was sent.
+func (s *Swarm[T]) tryDatagram(sess quic.Connection, data p2p.IOVec) (bool, error) {
+	if s.maxDatagram <= 0 || p2p.VecSize(data) > s.maxDatagram {
+		return false, nil
+	}
+	if !sess.ConnectionState().SupportsDatagrams {
+		s.stats.datagramFallbacks.Add(1)
+		return false, nil
+	}
+	if err := sess.SendMessage(p2p.VecBytes(nil, data)); err != nil {
+		// the only other error is the connection closing, which the stream will also report.
+		s.stats.datagramFallbacks.Add(1)
+		return false, nil
+	}
+	s.stats.datagramTells.Add(1)
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package quicswarm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/p2pconn"
+)
+
+// The first byte of every bidirectional stream is its type, except on LegacyALPN sessions.
+const (
+	streamTypeAsk = uint8(iota)
+	streamTypeApp
+	streamTypeTransition
+)
+
+// Stream error codes, sent when a stream is reset.
+const (
+	streamErrUnknownType = quic.StreamErrorCode(iota + 1)
+	streamErrNotAccepted
+	streamErrClosed
+)
+
+// errLegacyStreams is returned when opening a stream to a peer which only speaks LegacyALPN.
+var errLegacyStreams = errors.New("quicswarm: peer does not support streams, it negotiated " + LegacyALPN)
+
+var _ net.Conn = &Stream[p2p.Addr]{}
+
+// Stream is a reliable, ordered, bidirectional stream to a peer.
+// It is carried by the same authenticated session as Tells and Asks.
+type Stream[T p2p.Addr] struct {
+	quic.Stream
+	protocol string
+	local    net.Addr
+	remote   net.Addr
+	remoteID p2p.PeerID
+
+	releaseOnce sync.Once
+	release     func()
+}
+
+// Protocol returns the protocol tag that the stream was opened with.
+func (st *Stream[T]) Protocol() string {
+	return st.protocol
+}
+
+// RemoteID returns the PeerID of the other party.
+func (st *Stream[T]) RemoteID() p2p.PeerID {
+	return st.remoteID
+}
+
+// LocalAddr implements net.Conn.LocalAddr. The address is a p2pconn.Addr[Addr[T]]
+func (st *Stream[T]) LocalAddr() net.Addr {
+	return st.local
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr. The address is a p2pconn.Addr[Addr[T]]
+func (st *Stream[T]) RemoteAddr() net.Addr {
+	return st.remote
+}
+
+// CloseWrite closes the sending direction of the stream.
+// The other party will read io.EOF after it has read everything written.
+func (st *Stream[T]) CloseWrite() error {
+	return st.Stream.Close()
+}
+
+// Close closes both directions of the stream.
+// Unlike quic.Stream.Close, the other party will not be able to continue writing.
+// The session carrying the stream is not considered idle until all of its streams are closed.
+func (st *Stream[T]) Close() error {
+	st.releaseOnce.Do(st.release)
+	st.Stream.CancelRead(0)
+	return st.Stream.Close()
+}
+
+// OpenStream opens a stream to dst, tagged with protocol.
+// The other party receives the stream from AcceptStream.
+func (s *Swarm[T]) OpenStream(ctx context.Context, dst Addr[T], protocol string) (*Stream[T], error) {
+	if len(protocol) == 0 || len(protocol) > math.MaxUint8 {
+		return nil, fmt.Errorf("quicswarm: invalid protocol tag length %d", len(protocol))
+	}
+	var ret *Stream[T]
+	err := s.withEntry(ctx, dst, false, func(e *sessionEntry) error {
+		sess := e.conn
+		if isLegacy(sess) {
+			return errLegacyStreams
+		}
+		stream, err := sess.OpenStreamSync(ctx)
+		if err != nil {
+			return err
+		}
+		hdr := append([]byte{streamTypeApp, uint8(len(protocol))}, protocol...)
+		if _, err := stream.Write(hdr); err != nil {
+			stream.CancelRead(streamErrClosed)
+			stream.CancelWrite(streamErrClosed)
+			return err
+		}
+		remote, err := s.remoteAddrFromSession(sess)
+		if err != nil {
+			return err
+		}
+		ret = s.newStream(e, stream, protocol, s.makeLocalAddr(sess.LocalAddr()), remote)
+		return nil
+	})
+	if isSessionReplaced(err) {
+		return s.OpenStream(ctx, dst, protocol)
+	}
+	return ret, err
+}
+
+// AcceptStream blocks until a peer opens a stream, or ctx is cancelled.
+// Streams for every protocol are returned, the caller should check Stream.Protocol.
+func (s *Swarm[T]) AcceptStream(ctx context.Context) (*Stream[T], error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.bgCtx.Done():
+		return nil, p2p.ErrClosed
+	case st := <-s.streams:
+		return st, nil
+	}
+}
+
+// handleAppStream reads the protocol tag, and waits for the application to accept the stream.
+func (s *Swarm[T]) handleAppStream(ctx context.Context, e *sessionEntry, stream quic.Stream, srcAddr, dstAddr Addr[T]) error {
+	var l [1]byte
+	if _, err := io.ReadFull(stream, l[:]); err != nil {
+		return err
+	}
+	protocol := make([]byte, l[0])
+	if _, err := io.ReadFull(stream, protocol); err != nil {
+		return err
+	}
+	st := s.newStream(e, stream, string(protocol), dstAddr, srcAddr)
+	select {
+	case <-ctx.Done():
+		st.releaseOnce.Do(st.release)
+		stream.CancelRead(streamErrNotAccepted)
+		stream.CancelWrite(streamErrNotAccepted)
+		return ctx.Err()
+	case s.streams <- st:
+		return nil
+	}
+}
+
+// newStream creates a Stream, which holds e in use until it is closed.
+func (s *Swarm[T]) newStream(e *sessionEntry, stream quic.Stream, protocol string, local, remote Addr[T]) *Stream[T] {
+	s.sessions.retain(e)
+	return &Stream[T]{
+		Stream:   stream,
+		protocol: protocol,
+		local:    p2pconn.NewAddr[Addr[T]](s, local),
+		remote:   p2pconn.NewAddr[Addr[T]](s, remote),
+		remoteID: remote.ID,
+		release:  func() { s.sessions.release(e) },
+	}
+}
@@ -0,0 +1,86 @@
+package quicswarm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.brendoncarroll.net/stdctx/logctx"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/keytransition"
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+const (
+	// maxTransitionSize is the largest transition which will be read from a peer.
+	maxTransitionSize = 4096
+	// transitionTimeout is how long announcing a transition to a peer may take.
+	transitionTimeout = 10 * time.Second
+)
+
+// announceTransition sends the local transition over sess, if there is one.
+// Nothing is sent on LegacyALPN sessions, where the peer would read the stream as an Ask.
+func (s *Swarm[T]) announceTransition(ctx context.Context, sess quic.Connection) {
+	if s.transition == nil {
+		return
+	}
+	ctx, cf := context.WithTimeout(ctx, transitionTimeout)
+	defer cf()
+	if err := func() error {
+		if err := waitHandshake(ctx, sess); err != nil {
+			return err
+		}
+		if isLegacy(sess) {
+			return nil
+		}
+		stream, err := sess.OpenStreamSync(ctx)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		if deadline, yes := ctx.Deadline(); yes {
+			if err := stream.SetWriteDeadline(deadline); err != nil {
+				return err
+			}
+		}
+		if _, err := stream.Write([]byte{streamTypeTransition}); err != nil {
+			return err
+		}
+		return writeFrame(stream, p2p.IOVec{keytransition.Marshal(nil, s.transition)})
+	}(); err != nil {
+		logctx.Debugln(ctx, "quicswarm: announcing transition", err)
+	}
+}
+
+// handleTransition reads a transition from stream, and adds it to the transition set.
+// Only transitions to the key of the peer on the other side of sess are accepted.
+func (s *Swarm[T]) handleTransition(sess quic.Connection, stream quic.Stream) error {
+	defer stream.Close()
+	if s.transitions == nil {
+		stream.CancelRead(streamErrNotAccepted)
+		return nil
+	}
+	buf := make([]byte, maxTransitionSize)
+	n, err := readFrame(stream, buf, len(buf))
+	if err != nil {
+		return err
+	}
+	t, err := keytransition.Parse(buf[:n])
+	if err != nil {
+		return err
+	}
+	certs := sess.ConnectionState().TLS.PeerCertificates
+	if len(certs) < 1 {
+		return errors.New("no certificates")
+	}
+	remoteKey, err := x509.ParsePublicKey(certs[0].RawSubjectPublicKeyInfo)
+	if err != nil {
+		return err
+	}
+	if !x509.EqualPublicKeys(&t.New, &remoteKey) {
+		return errors.New("quicswarm: transition is not to the sender's key")
+	}
+	return s.transitions.Add(t)
+}
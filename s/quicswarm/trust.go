@@ -0,0 +1,188 @@
+package quicswarm
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/f/x509"
+)
+
+// TrustStore decides which peers are allowed to complete a handshake with the swarm.
+// It is consulted during every handshake, including resumed sessions,
+// so changes to the store apply to new sessions without restarting the swarm.
+// Sessions which have already been established are not affected.
+type TrustStore interface {
+	// Trusts returns true if the peer with PeerID id, and public key pub should be allowed.
+	// It is called during the TLS handshake, so it should not block.
+	Trusts(id p2p.PeerID, pub *x509.PublicKey) bool
+}
+
+// PeerIDSet is a TrustStore which trusts a set of PeerIDs.
+// It is safe to modify the set while the swarm is using it.
+type PeerIDSet struct {
+	mu  sync.RWMutex
+	ids map[p2p.PeerID]struct{}
+}
+
+func NewPeerIDSet(ids ...p2p.PeerID) *PeerIDSet {
+	s := &PeerIDSet{ids: make(map[p2p.PeerID]struct{})}
+	s.Add(ids...)
+	return s
+}
+
+// Add adds ids to the set.
+func (s *PeerIDSet) Add(ids ...p2p.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		s.ids[id] = struct{}{}
+	}
+}
+
+// Remove removes ids from the set.
+func (s *PeerIDSet) Remove(ids ...p2p.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.ids, id)
+	}
+}
+
+func (s *PeerIDSet) Trusts(id p2p.PeerID, _ *x509.PublicKey) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// PEMTypePublicKey is the type of PEM blocks read by KeyFileStore.
+const PEMTypePublicKey = "PUBLIC KEY"
+
+// KeyFileStore is a TrustStore which trusts the public keys stored in a set of files.
+// Each file contains one or more PEM blocks of type "PUBLIC KEY", holding keys marshaled with x509.MarshalPublicKey.
+//
+// The files are checked for modifications at most once per second, and reloaded if they have changed.
+// The check is started by a handshake, and runs in the background, so the handshake uses the keys which were
+// already loaded, and changes apply to later handshakes.  Call Reload to apply changes immediately.
+// If a file cannot be read or parsed, none of its keys are trusted until it is fixed.
+type KeyFileStore struct {
+	paths []string
+	// checking is true while the files are being checked in the background.
+	checking atomic.Bool
+
+	mu        sync.RWMutex
+	lastCheck time.Time
+	modTimes  map[string]time.Time
+	keys      map[string]map[string]struct{}
+}
+
+// NewKeyFileStore creates a KeyFileStore from the files at paths, and loads them.
+// If any of the files cannot be loaded, the store is still returned along with the error.
+func NewKeyFileStore(paths ...string) (*KeyFileStore, error) {
+	s := &KeyFileStore{
+		paths:    append([]string{}, paths...),
+		modTimes: make(map[string]time.Time),
+		keys:     make(map[string]map[string]struct{}),
+	}
+	return s, s.Reload()
+}
+
+// Reload reads all of the files, regardless of whether they have changed.
+func (s *KeyFileStore) Reload() error {
+	return s.load(true)
+}
+
+func (s *KeyFileStore) Trusts(_ p2p.PeerID, pub *x509.PublicKey) bool {
+	k := string(x509.MarshalPublicKey(nil, pub))
+	s.mu.RLock()
+	stale := time.Since(s.lastCheck) >= time.Second
+	var trusted bool
+	for _, keys := range s.keys {
+		if _, trusted = keys[k]; trusted {
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if stale && s.checking.CompareAndSwap(false, true) {
+		go func() {
+			defer s.checking.Store(false)
+			s.load(false)
+		}()
+	}
+	return trusted
+}
+
+// load reads the files which have changed since they were last loaded, or all of them if all is true.
+// The files are read without holding s.mu.
+func (s *KeyFileStore) load(all bool) error {
+	s.mu.RLock()
+	modTimes := maps.Clone(s.modTimes)
+	s.mu.RUnlock()
+	var errs []error
+	for _, p := range s.paths {
+		if !all {
+			if finfo, err := os.Stat(p); err == nil && finfo.ModTime().Equal(modTimes[p]) {
+				continue
+			}
+		}
+		keys, modTime, err := readKeyFile(p)
+		s.mu.Lock()
+		if err != nil {
+			delete(s.keys, p)
+			delete(s.modTimes, p)
+			errs = append(errs, err)
+		} else {
+			s.keys[p] = keys
+			s.modTimes[p] = modTime
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.lastCheck = time.Now()
+	s.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// readKeyFile returns the keys in the file at p, and its modification time.
+func readKeyFile(p string) (map[string]struct{}, time.Time, error) {
+	finfo, err := os.Stat(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	keys, err := parseKeyFile(data)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("quicswarm: loading %s: %w", p, err)
+	}
+	return keys, finfo.ModTime(), nil
+}
+
+func parseKeyFile(data []byte) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != PEMTypePublicKey {
+			return nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+		}
+		pub, err := x509.ParsePublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(x509.MarshalPublicKey(nil, &pub))] = struct{}{}
+	}
+	return keys, nil
+}
@@ -2,6 +2,7 @@ package sshswarm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -20,21 +21,23 @@ type Addr struct {
 	Port        uint16
 }
 
-func NewAddr(publicKey PublicKey, host string, port int) *Addr {
+// NewAddr returns the address of the swarm with publicKey, listening on host and port.
+// host can be an IP address, or a host name which is resolved using the default resolver.
+// Use NewHostAddr to resolve the host name when the address is used instead.
+func NewAddr(publicKey PublicKey, host string, port int) (*Addr, error) {
 	id := ssh.FingerprintSHA256(publicKey)
-	ipAddr, err := net.ResolveIPAddr("tcp", host)
+	ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrapf(err, "sshswarm: resolving %s", host)
 	}
-	ip, ok := netip.AddrFromSlice(ipAddr.IP)
-	if !ok {
-		panic(ip)
+	if len(ips) == 0 {
+		return nil, errors.Errorf("sshswarm: no ips for %s", host)
 	}
 	return &Addr{
 		Fingerprint: id,
-		IP:          ip,
+		IP:          ips[0].Unmap(),
 		Port:        uint16(port),
-	}
+	}, nil
 }
 
 func (a Addr) MarshalText() ([]byte, error) {
@@ -106,3 +109,141 @@ func (a Addr) MapTCP(fn func(net.TCPAddr) net.TCPAddr) p2p.Addr {
 		Port:        uint16(newTCP.Port),
 	}
 }
+
+// HostAddr is the address of a swarm created with New, with a host name instead of an IP address.
+// The host name is resolved to an Addr when it is used, see dnsswarm.
+type HostAddr struct {
+	Fingerprint string
+	Host        string
+	Port        uint16
+}
+
+// NewHostAddr returns the address of the swarm with publicKey, listening on host and port.
+func NewHostAddr(publicKey PublicKey, host string, port int) HostAddr {
+	return HostAddr{
+		Fingerprint: ssh.FingerprintSHA256(publicKey),
+		Host:        host,
+		Port:        uint16(port),
+	}
+}
+
+// HostAddrOf returns a HostAddr with a's IP as the host.
+func HostAddrOf(a Addr) HostAddr {
+	return HostAddr{Fingerprint: a.Fingerprint, Host: a.IP.String(), Port: a.Port}
+}
+
+func (a HostAddr) MarshalText() ([]byte, error) {
+	hostPort := net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+	return []byte(a.Fingerprint + "@" + hostPort), nil
+}
+
+func ParseHostAddr(data []byte) (HostAddr, error) {
+	fp, hostPort, ok := bytes.Cut(data, []byte("@"))
+	if !ok || len(fp) == 0 {
+		return HostAddr{}, errors.Errorf("sshswarm: address must contain fingerprint@")
+	}
+	host, port, err := net.SplitHostPort(string(hostPort))
+	if err != nil {
+		return HostAddr{}, errors.Wrapf(err, "sshswarm: parsing addr")
+	}
+	if host == "" {
+		return HostAddr{}, errors.Errorf("sshswarm: address is missing host")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return HostAddr{}, errors.Wrapf(err, "sshswarm: parsing addr")
+	}
+	return HostAddr{Fingerprint: string(fp), Host: host, Port: uint16(p)}, nil
+}
+
+func (a HostAddr) String() string {
+	return a.Key()
+}
+
+func (a HostAddr) Key() string {
+	data, _ := a.MarshalText()
+	return string(data)
+}
+
+func (a HostAddr) GetHost() string {
+	return a.Host
+}
+
+// WithIP returns the Addr for the host at ip.
+func (a HostAddr) WithIP(ip netip.Addr) Addr {
+	return Addr{Fingerprint: a.Fingerprint, IP: ip, Port: a.Port}
+}
+
+// NetAddr is the address of a swarm created with NewOnListener.
+type NetAddr struct {
+	Fingerprint string
+	// Addr is the address of the listener, which is passed to the DialFunc.
+	Addr string
+}
+
+func (a NetAddr) MarshalText() ([]byte, error) {
+	return []byte(a.Fingerprint + "@" + a.Addr), nil
+}
+
+func ParseNetAddr(data []byte) (NetAddr, error) {
+	fp, addr, ok := bytes.Cut(data, []byte("@"))
+	if !ok || len(fp) == 0 {
+		return NetAddr{}, errors.Errorf("sshswarm: address must contain fingerprint@")
+	}
+	return NetAddr{Fingerprint: string(fp), Addr: string(addr)}, nil
+}
+
+func (a NetAddr) String() string {
+	return a.Key()
+}
+
+func (a NetAddr) Key() string {
+	data, _ := a.MarshalText()
+	return string(data)
+}
+
+// SwarmAddr is the address of a swarm created with NewOnSwarm.
+type SwarmAddr[T p2p.Addr] struct {
+	Fingerprint string
+	Addr        T
+}
+
+func (a SwarmAddr[T]) MarshalText() ([]byte, error) {
+	data, err := a.Addr.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s@%s", a.Fingerprint, data)), nil
+}
+
+func ParseSwarmAddr[T p2p.Addr](inner p2p.AddrParser[T], data []byte) (SwarmAddr[T], error) {
+	fp, rest, ok := bytes.Cut(data, []byte("@"))
+	if !ok || len(fp) == 0 {
+		return SwarmAddr[T]{}, errors.Errorf("sshswarm: address must contain fingerprint@")
+	}
+	innerAddr, err := inner(rest)
+	if err != nil {
+		return SwarmAddr[T]{}, err
+	}
+	return SwarmAddr[T]{Fingerprint: string(fp), Addr: innerAddr}, nil
+}
+
+func (a SwarmAddr[T]) String() string {
+	return a.Key()
+}
+
+func (a SwarmAddr[T]) Key() string {
+	data, _ := a.MarshalText()
+	return string(data)
+}
+
+func (a SwarmAddr[T]) Unwrap() T {
+	return a.Addr
+}
+
+func (a SwarmAddr[T]) Map(fn func(T) T) SwarmAddr[T] {
+	return SwarmAddr[T]{
+		Fingerprint: a.Fingerprint,
+		Addr:        fn(a.Addr),
+	}
+}
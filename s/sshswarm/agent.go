@@ -0,0 +1,95 @@
+package sshswarm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeySelector chooses a key held by an SSH agent.
+type KeySelector func(k *agent.Key) bool
+
+// KeyByFingerprint selects the key with the SHA256 fingerprint fp, as printed by ssh-add -l.
+func KeyByFingerprint(fp string) KeySelector {
+	return func(k *agent.Key) bool {
+		return ssh.FingerprintSHA256(k) == fp
+	}
+}
+
+// KeyByComment selects the key with the comment c.
+func KeyByComment(c string) KeySelector {
+	return func(k *agent.Key) bool {
+		return k.Comment == c
+	}
+}
+
+// AgentSigner returns a signer for a key held by ag.
+// The first key accepted by sel is used, if sel is nil the first key is used.
+// The private key never leaves the agent, so it can be held in hardware, by an agent which supports it.
+func AgentSigner(ag agent.Agent, sel KeySelector) (ssh.Signer, error) {
+	keys, err := ag.List()
+	if err != nil {
+		return nil, err
+	}
+	var key *agent.Key
+	for _, k := range keys {
+		if sel == nil || sel(k) {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New("sshswarm: no matching key in agent")
+	}
+	signers, err := ag.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("sshswarm: agent has no signer for key %s", ssh.FingerprintSHA256(key))
+}
+
+// DialAgent connects to the SSH agent listening on the unix socket in the SSH_AUTH_SOCK environment variable.
+// The returned connection must be closed when the agent is no longer needed.
+func DialAgent() (agent.ExtendedAgent, net.Conn, error) {
+	sockPath := os.Getenv("SSH_AUTH_SOCK")
+	if sockPath == "" {
+		return nil, nil, errors.New("sshswarm: SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// NewWithAgent creates a swarm, which authenticates using a key held by the SSH agent at SSH_AUTH_SOCK.
+// sel chooses the key, as in AgentSigner.
+// The connection to the agent is closed when the swarm is closed.
+func NewWithAgent(laddr string, sel KeySelector, opts ...Option) (*Swarm, error) {
+	ag, conn, err := DialAgent()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := AgentSigner(ag, sel)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s, err := New(laddr, signer, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.closers = append(s.closers, conn)
+	return s, nil
+}
@@ -0,0 +1,123 @@
+package sshswarm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is an entry in an authorized_keys file.
+type authorizedKey struct {
+	key ssh.PublicKey
+	// from is the pattern list from the from= option, or nil if the key can be used from any address.
+	from []string
+}
+
+// loadAuthorizedKeys reads an OpenSSH authorized_keys file.
+// Lines which cannot be parsed are skipped, as they are by sshd.
+func loadAuthorizedKeys(p string) ([]authorizedKey, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var ret []authorizedKey
+	for len(data) > 0 {
+		pk, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// the only error is that there are no more keys.
+			break
+		}
+		ak := authorizedKey{key: pk}
+		for _, opt := range options {
+			k, v, _ := strings.Cut(opt, "=")
+			if strings.EqualFold(k, "from") {
+				ak.from = strings.Split(strings.Trim(v, `"`), ",")
+			}
+		}
+		ret = append(ret, ak)
+		data = rest
+	}
+	return ret, nil
+}
+
+// checkAuthorized returns an error if the client with key pk, connecting from raddr, is not authorized.
+func (c *config) checkAuthorized(raddr net.Addr, pk ssh.PublicKey) error {
+	if c.authorizedKeys == nil {
+		return nil
+	}
+	aks, err := c.authorizedKeys.get()
+	if err != nil {
+		return fmt.Errorf("sshswarm: loading authorized keys: %w", err)
+	}
+	var ip netip.Addr
+	if tcpAddr, ok := raddr.(*net.TCPAddr); ok {
+		ip, _ = netip.AddrFromSlice(tcpAddr.IP)
+		ip = ip.Unmap()
+	}
+	pkData := pk.Marshal()
+	for _, ak := range aks {
+		if !bytes.Equal(ak.key.Marshal(), pkData) {
+			continue
+		}
+		if ak.from == nil || matchFrom(ak.from, ip) {
+			return nil
+		}
+	}
+	return errors.New("sshswarm: key is not authorized")
+}
+
+// matchFrom returns true if ip is allowed by the patterns from a from= option.
+// A pattern is an address with the wildcards '*' and '?', or a CIDR block, and is negated by a leading '!'.
+// ip is allowed if it matches a pattern, and does not match any negated pattern.
+// Host names are never resolved, so patterns containing names do not match.
+func matchFrom(patterns []string, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	var allowed bool
+	for _, pat := range patterns {
+		pat, negated := strings.CutPrefix(strings.TrimSpace(pat), "!")
+		var match bool
+		if prefix, err := netip.ParsePrefix(pat); err == nil {
+			match = prefix.Contains(ip)
+		} else {
+			match = wildcardMatch(pat, ip.String())
+		}
+		if match && negated {
+			return false
+		}
+		allowed = allowed || match
+	}
+	return allowed
+}
+
+// wildcardMatch matches s against pat, where '*' matches any sequence of characters, and '?' matches any single character.
+func wildcardMatch(pat, s string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pat[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pat[0] != s[0] {
+				return false
+			}
+		}
+		pat, s = pat[1:], s[1:]
+	}
+	return len(s) == 0
+}
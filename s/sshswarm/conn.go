@@ -2,9 +2,9 @@ package sshswarm
 
 import (
 	"context"
-	"log"
 	"net"
-	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.brendoncarroll.net/p2p"
@@ -12,22 +12,35 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-type Conn struct {
-	swarm      *Swarm
-	remoteAddr Addr
-	localAddr  Addr
-	shutdown   chan struct{}
+type Conn[A p2p.Addr] struct {
+	swarm      *StreamSwarm[A]
+	remoteAddr A
+	localAddr  A
+	ctx        context.Context
+	cf         context.CancelFunc
+	closeOnce  sync.Once
+	// replies holds the Asks from the peer in the order they were received, so they can be answered in order.
+	replies chan pendingReply
+	// tells holds Tells from the peer, until they are delivered.
+	tells chan p2p.Message[A]
+	// inflight limits the number of requests waiting for a reply from the peer.
+	inflight chan struct{}
 
 	newChanReqs <-chan ssh.NewChannel
 	reqs        <-chan *ssh.Request
 	sconn       ssh.Conn
 	pubKey      ssh.PublicKey
+	// isClient is true if the connection was dialed by the local swarm.
+	isClient bool
 }
 
-func newServer(s *Swarm, netConn net.Conn) (*Conn, error) {
+func newServer[A p2p.Addr](s *StreamSwarm[A], netConn net.Conn) (*Conn[A], error) {
 	var pubKey ssh.PublicKey
 	config := &ssh.ServerConfig{
 		PublicKeyCallback: func(md ssh.ConnMetadata, pk ssh.PublicKey) (*ssh.Permissions, error) {
+			if err := s.checkAuthorized(md.RemoteAddr(), pk); err != nil {
+				return nil, err
+			}
 			pubKey = pk
 			return &ssh.Permissions{}, nil
 		},
@@ -42,23 +55,10 @@ func newServer(s *Swarm, netConn net.Conn) (*Conn, error) {
 		return nil, errors.New("pubkey not set after connection")
 	}
 
-	raddr := sconn.RemoteAddr().(*net.TCPAddr)
-	rip, _ := netip.AddrFromSlice(raddr.IP)
-	port := raddr.Port
-
-	c := &Conn{
-		swarm: s,
-		remoteAddr: Addr{
-			Fingerprint: ssh.FingerprintSHA256(pubKey),
-			IP:          rip,
-			Port:        uint16(port),
-		},
-		localAddr: Addr{
-			Fingerprint: ssh.FingerprintSHA256(s.signer.PublicKey()),
-			IP:          s.LocalAddrs()[0].IP,
-			Port:        uint16(netConn.LocalAddr().(*net.TCPAddr).Port),
-		},
-		shutdown: make(chan struct{}),
+	c := &Conn[A]{
+		swarm:      s,
+		remoteAddr: s.transport.addrOf(ssh.FingerprintSHA256(pubKey), netConn.RemoteAddr()),
+		localAddr:  s.transport.addrOf(ssh.FingerprintSHA256(s.pubKey), netConn.LocalAddr()),
 
 		newChanReqs: newChans,
 		reqs:        reqs,
@@ -69,7 +69,7 @@ func newServer(s *Swarm, netConn net.Conn) (*Conn, error) {
 	return c, nil
 }
 
-func newClient(s *Swarm, remoteAddr Addr, netConn net.Conn) (*Conn, error) {
+func newClient[A p2p.Addr](s *StreamSwarm[A], remoteAddr A, netConn net.Conn) (*Conn[A], error) {
 	var pubKey ssh.PublicKey
 	config := &ssh.ClientConfig{
 		Auth: []ssh.AuthMethod{
@@ -77,9 +77,14 @@ func newClient(s *Swarm, remoteAddr Addr, netConn net.Conn) (*Conn, error) {
 		},
 		HostKeyCallback: func(host string, raddr net.Addr, pk ssh.PublicKey) error {
 			fp := ssh.FingerprintSHA256(pk)
-			if fp != remoteAddr.Fingerprint {
+			if fp != s.transport.fingerprint(remoteAddr) {
 				return errors.New("Fingerprint does not match")
 			}
+			if s.knownHosts != nil {
+				if err := s.knownHosts.check(host, raddr, pk); err != nil {
+					return err
+				}
+			}
 			pubKey = pk
 			return nil
 		},
@@ -93,66 +98,281 @@ func newClient(s *Swarm, remoteAddr Addr, netConn net.Conn) (*Conn, error) {
 		return nil, errors.New("pubkey not set after connection")
 	}
 
-	c := &Conn{
+	c := &Conn[A]{
 		swarm:      s,
 		remoteAddr: remoteAddr,
-		shutdown:   make(chan struct{}),
+		localAddr:  s.transport.addrOf(ssh.FingerprintSHA256(s.pubKey), netConn.LocalAddr()),
 
 		newChanReqs: newChans,
 		reqs:        reqs,
 		sconn:       sconn,
 		pubKey:      pubKey,
+		isClient:    true,
 	}
 
 	return c, nil
 }
 
-func (c *Conn) loop(ctx context.Context) {
-	resp := make([]byte, MTU)
+// replaces returns true if c should be used instead of existing, which connects to the same address.
+// If both parties dial each other at the same time, they each have two connections to the other.
+// They both keep the connection dialed by the party with the lower fingerprint, so they do not close each other's connections.
+// Otherwise the existing connection is kept.
+func (c *Conn[A]) replaces(existing *Conn[A]) bool {
+	if c.isClient == existing.isClient {
+		return false
+	}
+	return c.dialerFingerprint() < existing.dialerFingerprint()
+}
+
+// dialerFingerprint returns the fingerprint of the party which dialed the connection.
+func (c *Conn[A]) dialerFingerprint() string {
+	if c.isClient {
+		return c.swarm.transport.fingerprint(c.localAddr)
+	}
+	return c.swarm.transport.fingerprint(c.remoteAddr)
+}
+
+// tellQueueLen is the number of Tells from a peer which can wait for delivery.
+// Tells which arrive when the queue is full are dropped, so the connection does not stop responding to keepalives and Asks.
+const tellQueueLen = 64
+
+// keepAliveRequest is the type of the requests sent to check that the peer is alive.
+// It is the same as OpenSSH's, so peers reply with a failure, which still counts as a response.
+const keepAliveRequest = "keepalive@openssh.com"
+
+// keepAliveChannel is the type of the channel which keepalives are sent on.
+// Replies to global requests must be sent in the order the requests were received, so a keepalive sent as a global request
+// would not be answered until the Asks before it were.  Requests on the channel are answered as soon as they arrive.
+const keepAliveChannel = "keepalive@brendoncarroll.net"
+
+// maxInflightRequests is the most requests to the peer which can wait for a reply at once,
+// including requests whose callers have stopped waiting.
+const maxInflightRequests = 16
+
+type pendingReply struct {
+	req  *ssh.Request
+	done chan askResult
+}
+
+type askResult struct {
+	ok   bool
+	data []byte
+}
+
+// start begins handling requests from the peer, and sending keepalives.
+// The connection is closed when ctx is cancelled.
+func (c *Conn[A]) start(ctx context.Context) {
+	c.ctx, c.cf = context.WithCancel(ctx)
+	c.replies = make(chan pendingReply, 16)
+	c.tells = make(chan p2p.Message[A], tellQueueLen)
+	c.inflight = make(chan struct{}, maxInflightRequests)
+	go c.loop()
+	go c.replyLoop()
+	go c.deliverLoop()
+	if c.swarm.keepAliveInterval > 0 {
+		go c.keepAlive(c.swarm.keepAliveInterval, c.swarm.keepAliveMaxMissed)
+	}
+}
+
+// loop receives requests from the peer until the connection is closed.
+// It never waits for messages to be delivered, or for a handler to respond to an Ask,
+// so the connection keeps responding to keepalives.
+func (c *Conn[A]) loop() {
+	defer c.Close()
+	ctx := c.ctx
 	for {
 		select {
 		case req, ok := <-c.reqs:
 			if !ok {
 				return
 			}
-			ctx := context.TODO()
-			msg := p2p.Message[Addr]{
+			if req.Type != "" {
+				// keepalives, and any other requests which are not messages, are refused.
+				if req.WantReply && !c.enqueueReply(req, nil) {
+					return
+				}
+				continue
+			}
+			msg := p2p.Message[A]{
 				Src:     c.RemoteAddr(),
 				Dst:     c.localAddr,
 				Payload: req.Payload,
 			}
 			if req.WantReply {
-				n, err := c.swarm.askHub.Deliver(ctx, resp, msg)
-				if err != nil {
-					log.Println(err)
-				}
-				ok := n >= 0
-				if n < 0 {
-					n = 0
-				}
-				if err := req.Reply(ok, resp[:n]); err != nil {
-					logctx.Errorln(ctx, err)
+				if !c.enqueueReply(req, func() askResult { return c.handleAsk(msg) }) {
+					return
 				}
 			} else {
-				if err := c.swarm.tellHub.Deliver(ctx, msg); err != nil {
-					logctx.Errorln(ctx, err)
+				select {
+				case c.tells <- msg:
+				default:
+					logctx.Warnf(ctx, "sshswarm: dropped tell from %v, queue is full", msg.Src)
 				}
 			}
 		case ncr, ok := <-c.newChanReqs:
 			if !ok {
 				return
 			}
+			if ncr.ChannelType() == keepAliveChannel {
+				// the channel is closed with the connection.
+				if _, reqs, err := ncr.Accept(); err != nil {
+					logctx.Errorln(ctx, err)
+				} else {
+					go ssh.DiscardRequests(reqs)
+				}
+				continue
+			}
 			if err := ncr.Reject(ssh.Prohibited, "don't do that"); err != nil {
 				logctx.Errorln(ctx, err)
 			}
-		case <-c.shutdown:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (c *Conn) Send(wantReply bool, payload []byte) ([]byte, error) {
-	ok, resData, err := c.sconn.SendRequest("", wantReply, payload)
+// enqueueReply queues a reply to req, which will be produced by fn in the background.
+// If fn is nil, the reply is a failure.
+// It returns false if the connection was closed.
+func (c *Conn[A]) enqueueReply(req *ssh.Request, fn func() askResult) bool {
+	done := make(chan askResult, 1)
+	select {
+	case c.replies <- pendingReply{req: req, done: done}:
+	case <-c.ctx.Done():
+		return false
+	}
+	if fn == nil {
+		done <- askResult{}
+	} else {
+		go func() { done <- fn() }()
+	}
+	return true
+}
+
+// handleAsk delivers an Ask to the swarm's handler, and produces the reply.
+func (c *Conn[A]) handleAsk(msg p2p.Message[A]) askResult {
+	ctx := c.ctx
+	if c.swarm.askTimeout > 0 {
+		var cf context.CancelFunc
+		ctx, cf = context.WithTimeout(ctx, c.swarm.askTimeout)
+		defer cf()
+	}
+	resp := make([]byte, MTU)
+	n, err := c.swarm.askHub.Deliver(ctx, resp, msg)
+	if err != nil {
+		logctx.Errorln(ctx, err)
+		return askResult{}
+	}
+	if n < 0 {
+		return askResult{}
+	}
+	return askResult{ok: true, data: resp[:n]}
+}
+
+// deliverLoop delivers Tells from the peer to the swarm, in the order they were received.
+func (c *Conn[A]) deliverLoop() {
+	for {
+		select {
+		case msg := <-c.tells:
+			if err := c.swarm.tellHub.Deliver(c.ctx, msg); err != nil {
+				logctx.Errorln(c.ctx, err)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// replyLoop sends replies to the peer's requests, in the order the requests were received.
+// The SSH protocol matches replies to requests by their order.
+func (c *Conn[A]) replyLoop() {
+	for {
+		var pr pendingReply
+		select {
+		case pr = <-c.replies:
+		case <-c.ctx.Done():
+			return
+		}
+		var res askResult
+		select {
+		case res = <-pr.done:
+		case <-c.ctx.Done():
+			return
+		}
+		if err := pr.req.Reply(res.ok, res.data); err != nil {
+			logctx.Errorln(c.ctx, err)
+		}
+	}
+}
+
+// keepAlive sends a keepalive request every interval,
+// and closes the connection if maxMissed requests in a row are not answered within interval.
+// Keepalives are sent on a keepAliveChannel.
+// Peers which refuse the channel treat every global request as an Ask, so they are not sent keepalives,
+// and dead peers are only detected by the transport, e.g. by TCP keepalives, which are on by default.
+func (c *Conn[A]) keepAlive(interval time.Duration, maxMissed int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	opened := make(chan ssh.Channel, 1)
+	go func() {
+		ch, reqs, err := c.sconn.OpenChannel(keepAliveChannel, nil)
+		if err != nil {
+			opened <- nil
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		opened <- ch
+	}()
+	var ch ssh.Channel
+	var isOpen bool
+	var missed int
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !isOpen {
+			select {
+			case ch = <-opened:
+				isOpen = true
+			default:
+			}
+			if isOpen && ch == nil {
+				logctx.Debugf(c.ctx, "sshswarm: %v does not support keepalives", c.RemoteAddr())
+				return
+			}
+		}
+		ctx, cf := context.WithTimeout(c.ctx, interval)
+		var err error
+		switch {
+		case !isOpen:
+			err = errors.New("keepalive channel has not been opened")
+		default:
+			_, _, err = c.call(ctx, func() (bool, []byte, error) {
+				ok, err := ch.SendRequest(keepAliveRequest, true, nil)
+				return ok, nil, err
+			})
+		}
+		cf()
+		if err == nil {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed >= maxMissed {
+			logctx.Warnf(c.ctx, "sshswarm: closing connection to %v after %d keepalives were not answered", c.RemoteAddr(), missed)
+			c.Close()
+			return
+		}
+	}
+}
+
+// Send sends payload to the peer.
+// If wantReply is true, Send waits for the reply and returns it.
+// If ctx is done first, Send returns without the reply, and the connection can still be used.
+func (c *Conn[A]) Send(ctx context.Context, wantReply bool, payload []byte) ([]byte, error) {
+	ok, resData, err := c.sendRequest(ctx, wantReply, payload)
 	if err != nil {
 		return nil, err
 	}
@@ -165,12 +385,59 @@ func (c *Conn) Send(wantReply bool, payload []byte) ([]byte, error) {
 	return resData, nil
 }
 
-func (c *Conn) RemoteAddr() Addr {
+// sendRequest sends a global request, which the peer delivers as a Tell or an Ask.
+// If wantReply is true, it returns early if ctx is done.  Otherwise it returns once the request has been written.
+func (c *Conn[A]) sendRequest(ctx context.Context, wantReply bool, payload []byte) (bool, []byte, error) {
+	if !wantReply {
+		return c.sconn.SendRequest("", false, payload)
+	}
+	return c.call(ctx, func() (bool, []byte, error) {
+		return c.sconn.SendRequest("", true, payload)
+	})
+}
+
+// call runs fn, which sends a request to the peer, and returns early if ctx is done.
+// Requests cannot be cancelled, so fn keeps running until the peer replies or the connection is closed.
+// At most maxInflightRequests calls run at once, so callers which stop waiting cannot leave goroutines behind without limit.
+func (c *Conn[A]) call(ctx context.Context, fn func() (bool, []byte, error)) (bool, []byte, error) {
+	select {
+	case c.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case <-c.ctx.Done():
+		return false, nil, net.ErrClosed
+	}
+	type result struct {
+		ok   bool
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer func() { <-c.inflight }()
+		ok, data, err := fn()
+		ch <- result{ok, data, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return false, nil, ctx.Err()
+	case res := <-ch:
+		return res.ok, res.data, res.err
+	}
+}
+
+func (c *Conn[A]) RemoteAddr() A {
 	return c.remoteAddr
 }
 
-func (c *Conn) Close() error {
-	err := c.sconn.Close()
-	c.swarm.deleteConn(c)
+// Close closes the connection, and removes it from the swarm.
+func (c *Conn[A]) Close() (err error) {
+	c.closeOnce.Do(func() {
+		if c.cf != nil {
+			c.cf()
+		}
+		err = c.sconn.Close()
+		c.swarm.deleteConn(c)
+	})
 	return err
 }
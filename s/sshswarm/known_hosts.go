@@ -0,0 +1,83 @@
+package sshswarm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsMode determines how hosts which are not in a known_hosts file are handled.
+type KnownHostsMode int
+
+const (
+	// KnownHostsStrict refuses to connect to hosts which are not in the file.
+	KnownHostsStrict = KnownHostsMode(iota)
+	// KnownHostsTOFU trusts hosts which are not in the file on first use, and adds them to the file.
+	KnownHostsTOFU
+)
+
+// knownHosts checks the keys of hosts dialed by the swarm against a known_hosts file.
+type knownHosts struct {
+	path  string
+	mode  KnownHostsMode
+	cache *fileCache[ssh.HostKeyCallback]
+
+	// mu serializes adding hosts to the file.
+	mu sync.Mutex
+}
+
+func newKnownHosts(path string, mode KnownHostsMode) *knownHosts {
+	return &knownHosts{
+		path: path,
+		mode: mode,
+		cache: newFileCache(path, func(p string) (ssh.HostKeyCallback, error) {
+			cb, err := knownhosts.New(p)
+			if errors.Is(err, fs.ErrNotExist) && mode == KnownHostsTOFU {
+				// the file will be created when the first host is added.
+				return func(string, net.Addr, ssh.PublicKey) error {
+					return &knownhosts.KeyError{}
+				}, nil
+			}
+			return cb, err
+		}),
+	}
+}
+
+// check is an ssh.HostKeyCallback.
+// Keys which do not match the file are always rejected.
+func (kh *knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if kh.mode == KnownHostsTOFU {
+		kh.mu.Lock()
+		defer kh.mu.Unlock()
+	}
+	cb, err := kh.cache.get()
+	if err != nil {
+		return fmt.Errorf("sshswarm: loading known hosts: %w", err)
+	}
+	err = cb(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if err == nil || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 || kh.mode != KnownHostsTOFU {
+		return err
+	}
+	return kh.add(hostname, key)
+}
+
+// add appends a line for hostname to the file.
+func (kh *knownHosts) add(hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
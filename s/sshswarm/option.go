@@ -1,4 +1,93 @@
 package sshswarm
 
+import (
+	"time"
+
+	"go.brendoncarroll.net/p2p/s/swarmutil/retry"
+)
+
 // Option configures a swarm
-type Option func(s *Swarm)
+type Option func(c *config)
+
+// config holds the settings from Options, which are the same for every transport.
+type config struct {
+	authorizedKeys *fileCache[[]authorizedKey]
+	knownHosts     *knownHosts
+
+	keepAliveInterval  time.Duration
+	keepAliveMaxMissed int
+	askTimeout         time.Duration
+	dialAttempts       int
+	dialBackoff        retry.BackoffFunc
+}
+
+// WithAuthorizedKeys only accepts connections from clients with a key in the OpenSSH authorized_keys file at path.
+// The from= option is supported, and restricts the addresses a key can connect from; other options are ignored.
+// The file is loaded again when it changes.
+func WithAuthorizedKeys(path string) Option {
+	return func(c *config) {
+		c.authorizedKeys = newFileCache(path, loadAuthorizedKeys)
+	}
+}
+
+// WithKnownHosts checks the keys of the hosts the swarm connects to, against the OpenSSH known_hosts file at path.
+// mode determines what happens when a host is not in the file.
+// A host with a different key than the one in the file is always rejected.
+// known_hosts files contain IP addresses, so connections which are not over TCP are always rejected.
+// The file is loaded again when it changes.
+func WithKnownHosts(path string, mode KnownHostsMode) Option {
+	return func(c *config) {
+		c.knownHosts = newKnownHosts(path, mode)
+	}
+}
+
+const (
+	// DefaultKeepAliveInterval is the time between keepalive requests, unless WithKeepAlive is given.
+	DefaultKeepAliveInterval = 15 * time.Second
+	// DefaultKeepAliveMaxMissed is the number of keepalive requests in a row which can go unanswered,
+	// before the connection is closed.
+	DefaultKeepAliveMaxMissed = 3
+	// DefaultAskTimeout is the time a handler has to respond to an Ask from a peer, unless WithAskTimeout is given.
+	DefaultAskTimeout = 30 * time.Second
+	// DefaultDialAttempts is the number of times a connection is dialed, before giving up.
+	DefaultDialAttempts = 3
+)
+
+var defaultDialBackoff = retry.MaxBackoff(retry.NewExponentialBackoff(100*time.Millisecond, 1), 5*time.Second)
+
+// WithKeepAlive sends a keepalive@openssh.com request on every connection each interval.
+// If maxMissed requests in a row are not answered within interval, the peer is considered dead, and the connection is closed.
+// If interval <= 0, no keepalives are sent.
+func WithKeepAlive(interval time.Duration, maxMissed int) Option {
+	return func(c *config) {
+		if maxMissed < 1 {
+			maxMissed = 1
+		}
+		c.keepAliveInterval = interval
+		c.keepAliveMaxMissed = maxMissed
+	}
+}
+
+// WithAskTimeout limits the time a handler has to respond to an Ask from a peer.
+// The handler's context is cancelled after d, and the peer receives an error.
+// Replies are sent in the order Asks are received, so a slow handler delays replies to later Asks on the connection.
+// If d <= 0, there is no limit.
+func WithAskTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.askTimeout = d
+	}
+}
+
+// WithDialBackoff sets how connections are dialed.
+// A connection is dialed up to attempts times, with backoff determining the time between attempts.
+// Only network errors are retried, not errors from the SSH handshake.
+// Dialing also stops when the context passed to Tell or Ask is done.
+func WithDialBackoff(attempts int, backoff retry.BackoffFunc) Option {
+	return func(c *config) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.dialAttempts = attempts
+		c.dialBackoff = backoff
+	}
+}
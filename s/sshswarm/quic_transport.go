@@ -0,0 +1,203 @@
+package sshswarm
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/ssh"
+
+	"go.brendoncarroll.net/p2p"
+	"go.brendoncarroll.net/p2p/p2pconn"
+	"go.brendoncarroll.net/p2p/s/swarmutil"
+)
+
+// quicALPN is the protocol negotiated by the QUIC connections which carry SSH.
+const quicALPN = "ssh"
+
+// streamAcceptTimeout is how long an incoming QUIC connection has to open its stream.
+const streamAcceptTimeout = 10 * time.Second
+
+// NewOnSwarm creates a swarm which runs SSH over x.
+// x only needs to deliver Tells, which are unreliable and unordered, so QUIC is used to provide reliable streams.
+// Each SSH connection is carried by a single stream, in its own QUIC connection.
+// x is closed when the swarm is closed.
+//
+// QUIC's TLS handshake does not authenticate either party: each swarm uses a throwaway certificate,
+// and certificates are not verified, so any party can complete it.
+// The only authentication is done by SSH, which checks the remote host key against the fingerprint in the SwarmAddr,
+// and the keys configured with WithKnownHosts and WithAuthorizedKeys.
+// SSH encrypts and authenticates the connection on its own, so nothing should be trusted before its handshake completes.
+func NewOnSwarm[T p2p.Addr](x p2p.Swarm[T], privateKey ssh.Signer, opts ...Option) (*StreamSwarm[SwarmAddr[T]], error) {
+	t, err := newQUICTransport(x)
+	if err != nil {
+		return nil, err
+	}
+	return newSwarm[SwarmAddr[T]](t, privateKey, opts), nil
+}
+
+var _ transport[SwarmAddr[p2p.Addr]] = &quicTransport[p2p.Addr]{}
+
+// quicTransport is the transport for swarms created with NewOnSwarm.
+type quicTransport[T p2p.Addr] struct {
+	inner     p2p.Swarm[T]
+	tr        *quic.Transport
+	l         *quic.Listener
+	tlsConfig *tls.Config
+	ctx       context.Context
+	cf        context.CancelFunc
+	accepted  chan net.Conn
+}
+
+func newQUICTransport[T p2p.Addr](x p2p.Swarm[T]) (*quicTransport[T], error) {
+	// The key only satisfies TLS, and the certificates of peers are not verified.
+	// TLS does no authentication, peers are authenticated by their SSH host keys.
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{swarmutil.GenerateSelfSigned(privKey)},
+		InsecureSkipVerify: true,
+		NextProtos:         []string{quicALPN},
+	}
+	tr := &quic.Transport{
+		Conn: connWrapper{p2pconn.NewPacketConn(x)},
+	}
+	l, err := tr.Listen(tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cf := context.WithCancel(context.Background())
+	t := &quicTransport[T]{
+		inner:     x,
+		tr:        tr,
+		l:         l,
+		tlsConfig: tlsConfig,
+		ctx:       ctx,
+		cf:        cf,
+		accepted:  make(chan net.Conn),
+	}
+	go t.acceptLoop()
+	return t, nil
+}
+
+// acceptLoop accepts QUIC connections, and then the stream which carries SSH from each of them.
+func (t *quicTransport[T]) acceptLoop() {
+	for {
+		qconn, err := t.l.Accept(t.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			ctx, cf := context.WithTimeout(t.ctx, streamAcceptTimeout)
+			defer cf()
+			stream, err := qconn.AcceptStream(ctx)
+			if err != nil {
+				qconn.CloseWithError(0, "")
+				return
+			}
+			select {
+			case t.accepted <- streamConn{Stream: stream, conn: qconn}:
+			case <-t.ctx.Done():
+				qconn.CloseWithError(0, "")
+			}
+		}()
+	}
+}
+
+func (t *quicTransport[T]) accept() (net.Conn, error) {
+	select {
+	case c := <-t.accepted:
+		return c, nil
+	case <-t.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *quicTransport[T]) dial(ctx context.Context, addr SwarmAddr[T]) (net.Conn, error) {
+	qconn, err := t.tr.Dial(ctx, p2pconn.NewAddr(t.inner, addr.Addr), t.tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		qconn.CloseWithError(0, "")
+		return nil, err
+	}
+	return streamConn{Stream: stream, conn: qconn}, nil
+}
+
+func (t *quicTransport[T]) close() error {
+	t.cf()
+	err := t.l.Close()
+	// the inner swarm must be closed for the transport to stop reading from it.
+	if err2 := t.inner.Close(); err == nil {
+		err = err2
+	}
+	if err2 := t.tr.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (t *quicTransport[T]) localAddrs(fingerprint string) []SwarmAddr[T] {
+	var ret []SwarmAddr[T]
+	for _, addr := range t.inner.LocalAddrs() {
+		ret = append(ret, SwarmAddr[T]{Fingerprint: fingerprint, Addr: addr})
+	}
+	return ret
+}
+
+func (t *quicTransport[T]) addrOf(fingerprint string, na net.Addr) SwarmAddr[T] {
+	return SwarmAddr[T]{
+		Fingerprint: fingerprint,
+		Addr:        na.(p2pconn.Addr[T]).Addr,
+	}
+}
+
+func (t *quicTransport[T]) fingerprint(addr SwarmAddr[T]) string {
+	return addr.Fingerprint
+}
+
+func (t *quicTransport[T]) parseAddr(data []byte) (SwarmAddr[T], error) {
+	return ParseSwarmAddr(t.inner.ParseAddr, data)
+}
+
+// streamConn is a net.Conn for a QUIC stream, which is the only stream in its connection.
+type streamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the stream, and the connection carrying it.
+func (c streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+// connWrapper lets QUIC's path MTU discovery continue, when the inner swarm's MTU is exceeded.
+type connWrapper struct {
+	net.PacketConn
+}
+
+func (cw connWrapper) WriteTo(data []byte, addr net.Addr) (int, error) {
+	n, err := cw.PacketConn.WriteTo(data, addr)
+	if p2p.IsErrMTUExceeded(err) {
+		return len(data), nil
+	}
+	return n, err
+}
@@ -2,15 +2,16 @@ package sshswarm
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log"
 	"net"
-	"net/netip"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	"go.brendoncarroll.net/p2p"
 	"go.brendoncarroll.net/p2p/s/swarmutil"
+	"go.brendoncarroll.net/p2p/s/swarmutil/retry"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,94 +22,129 @@ type (
 	PublicKey  = ssh.PublicKey
 )
 
-var _ p2p.SecureSwarm[Addr, PublicKey] = &Swarm{}
+var (
+	_ p2p.SecureSwarm[Addr, PublicKey]                = &Swarm{}
+	_ p2p.SecureSwarm[NetAddr, PublicKey]             = &StreamSwarm[NetAddr]{}
+	_ p2p.SecureSwarm[SwarmAddr[p2p.Addr], PublicKey] = &StreamSwarm[SwarmAddr[p2p.Addr]]{}
+)
 
+// Swarm is a swarm which runs SSH over TCP.
+// It has the methods of StreamSwarm, with Addr as the address type.
 type Swarm struct {
-	ctx    context.Context
-	pubKey ssh.PublicKey
-	signer ssh.Signer
-	l      net.Listener
+	*StreamSwarm[Addr]
+}
+
+// StreamSwarm runs SSH over reliable streams, which are provided by a transport.
+// The transport determines the type of the swarm's addresses.
+type StreamSwarm[A p2p.Addr] struct {
+	config
+	ctx       context.Context
+	cf        context.CancelFunc
+	pubKey    ssh.PublicKey
+	signer    ssh.Signer
+	transport transport[A]
 
-	tellHub swarmutil.TellHub[Addr]
-	askHub  swarmutil.AskHub[Addr]
+	// closers are closed after the transport, when the swarm is closed.
+	closers []io.Closer
+
+	tellHub swarmutil.TellHub[A]
+	askHub  swarmutil.AskHub[A]
 
 	mu    sync.RWMutex
-	conns map[string]*Conn
+	conns map[string]*Conn[A]
 }
 
+// New creates a swarm which listens for TCP connections on laddr.
 func New(laddr string, privateKey ssh.Signer, opts ...Option) (*Swarm, error) {
 	l, err := net.Listen("tcp", laddr)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	s := &Swarm{
-		ctx:    ctx,
-		pubKey: privateKey.PublicKey(),
-		signer: privateKey,
-		l:      l,
+	return &Swarm{newSwarm[Addr](tcpTransport{l: l}, privateKey, opts)}, nil
+}
 
-		tellHub: swarmutil.NewTellHub[Addr](),
-		askHub:  swarmutil.NewAskHub[Addr](),
+func newSwarm[A p2p.Addr](t transport[A], privateKey ssh.Signer, opts []Option) *StreamSwarm[A] {
+	ctx, cf := context.WithCancel(context.Background())
+	s := &StreamSwarm[A]{
+		config: config{
+			keepAliveInterval:  DefaultKeepAliveInterval,
+			keepAliveMaxMissed: DefaultKeepAliveMaxMissed,
+			askTimeout:         DefaultAskTimeout,
+			dialAttempts:       DefaultDialAttempts,
+			dialBackoff:        defaultDialBackoff,
+		},
+		ctx:       ctx,
+		cf:        cf,
+		pubKey:    privateKey.PublicKey(),
+		signer:    privateKey,
+		transport: t,
 
-		conns: map[string]*Conn{},
+		tellHub: swarmutil.NewTellHub[A](),
+		askHub:  swarmutil.NewAskHub[A](),
+
+		conns: map[string]*Conn[A]{},
+	}
+	for _, opt := range opts {
+		opt(&s.config)
 	}
 
 	go s.serveLoop(ctx)
 
-	return s, nil
+	return s
 }
 
-func (s *Swarm) MTU() int {
+func (s *StreamSwarm[A]) MTU() int {
 	return MTU
 }
 
-func (s *Swarm) LocalAddrs() []Addr {
-	pubKey := s.signer.PublicKey()
-	laddr := s.l.Addr().(*net.TCPAddr)
-	ip, ok := netip.AddrFromSlice(laddr.IP)
-	if !ok {
-		panic(laddr)
-	}
-	x := Addr{
-		Fingerprint: ssh.FingerprintSHA256(pubKey),
-		IP:          ip,
-		Port:        uint16(laddr.Port),
-	}
-	ys := p2p.ExpandUnspecifiedIPs([]Addr{x})
-	return ys
+func (s *StreamSwarm[A]) LocalAddrs() []A {
+	return s.transport.localAddrs(ssh.FingerprintSHA256(s.pubKey))
 }
 
-func (s *Swarm) Close() error {
+func (s *StreamSwarm[A]) Close() error {
+	s.cf()
 	s.tellHub.CloseWithError(p2p.ErrClosed)
 	s.askHub.CloseWithError(p2p.ErrClosed)
-	return s.l.Close()
+	err := s.transport.close()
+	s.mu.RLock()
+	conns := make([]*Conn[A], 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	for _, c := range s.closers {
+		c.Close()
+	}
+	return err
 }
 
-func (s *Swarm) PublicKey() PublicKey {
+func (s *StreamSwarm[A]) PublicKey() PublicKey {
 	return s.pubKey
 }
 
-func (s *Swarm) LookupPublicKey(ctx context.Context, x Addr) (PublicKey, error) {
+func (s *StreamSwarm[A]) LookupPublicKey(ctx context.Context, x A) (PublicKey, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	c := s.conns[x.Key()]
+	c := s.conns[addrKey(x)]
 	if c == nil {
 		return nil, p2p.ErrPublicKeyNotFound
 	}
 	return c.pubKey.(PublicKey), nil
 }
 
-func (s *Swarm) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[Addr]) int) error {
+func (s *StreamSwarm[A]) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[A]) int) error {
 	return s.askHub.ServeAsk(ctx, fn)
 }
 
-func (s *Swarm) Receive(ctx context.Context, th func(p2p.Message[Addr])) error {
+func (s *StreamSwarm[A]) Receive(ctx context.Context, th func(p2p.Message[A])) error {
 	return s.tellHub.Receive(ctx, th)
 }
 
-func (s *Swarm) Ask(ctx context.Context, resp []byte, dst Addr, data p2p.IOVec) (int, error) {
+func (s *StreamSwarm[A]) Ask(ctx context.Context, resp []byte, dst A, data p2p.IOVec) (int, error) {
 	if p2p.VecSize(data) > MTU {
 		return 0, p2p.ErrMTUExceeded
 	}
@@ -116,70 +152,96 @@ func (s *Swarm) Ask(ctx context.Context, resp []byte, dst Addr, data p2p.IOVec)
 	if err != nil {
 		return 0, err
 	}
-	reply, err := c.Send(true, p2p.VecBytes(nil, data))
+	// Asks are not sent again if the connection fails, since the peer may have already handled it.
+	reply, err := c.Send(ctx, true, p2p.VecBytes(nil, data))
 	if err != nil {
 		return 0, err
 	}
 	return copy(resp, reply), nil
 }
 
-func (s *Swarm) Tell(ctx context.Context, dst Addr, data p2p.IOVec) error {
+func (s *StreamSwarm[A]) Tell(ctx context.Context, dst A, data p2p.IOVec) error {
 	if p2p.VecSize(data) > MTU {
 		return p2p.ErrMTUExceeded
 	}
+	payload := p2p.VecBytes(nil, data)
 	c, err := s.getConn(ctx, dst)
 	if err != nil {
 		return err
 	}
-	_, err = c.Send(false, p2p.VecBytes(nil, data))
-	if err != nil {
-		return err
+	if _, err = c.Send(ctx, false, payload); isTransient(err) {
+		// the connection has failed, try again with a new one.
+		c.Close()
+		if c, err = s.getConn(ctx, dst); err != nil {
+			return err
+		}
+		_, err = c.Send(ctx, false, payload)
 	}
-	return nil
+	return err
 }
 
-func (s *Swarm) ParseAddr(data []byte) (Addr, error) {
-	return ParseAddr(data)
+func (s *StreamSwarm[A]) ParseAddr(data []byte) (A, error) {
+	return s.transport.parseAddr(data)
 }
 
-func (s *Swarm) getConn(ctx context.Context, addr Addr) (*Conn, error) {
+func (s *StreamSwarm[A]) getConn(ctx context.Context, addr A) (*Conn[A], error) {
 	s.mu.RLock()
-	c, exists := s.conns[addr.Key()]
+	c, exists := s.conns[addrKey(addr)]
 	s.mu.RUnlock()
 	if exists {
 		return c, nil
 	}
 
 	// try to dial
-	raddr := addr.IP.String() + ":" + strconv.Itoa(int(addr.Port))
-	netConn, err := net.Dial("tcp", raddr)
-	if err != nil {
-		return nil, err
-	}
-	c, err = newClient(s, addr, netConn)
+	c, err := s.dial(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	remoteAddr := c.RemoteAddr()
-	c2, exists := s.conns[remoteAddr.Key()]
-	if exists {
-		return c2, nil
-	}
-	s.conns[remoteAddr.Key()] = c
-	go c.loop(s.ctx)
+	return s.putConn(c), nil
+}
+
+// dial establishes a connection to addr.
+// Network errors are retried, up to the swarm's dial attempts, with backoff between attempts.
+// Errors during the SSH handshake, such as an unexpected host key, are not retried.
+func (s *StreamSwarm[A]) dial(ctx context.Context, addr A) (*Conn[A], error) {
+	var attempts int
+	var ret *Conn[A]
+	err := retry.Retry(ctx, func() error {
+		attempts++
+		netConn, err := s.transport.dial(ctx, addr)
+		if err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			netConn.SetDeadline(deadline)
+		}
+		c, err := newClient(s, addr, netConn)
+		if err != nil {
+			netConn.Close()
+			return err
+		}
+		netConn.SetDeadline(time.Time{})
+		ret = c
+		return nil
+	}, retry.WithBackoff(s.dialBackoff), retry.WithPredicate(func(err error) bool {
+		return attempts < s.dialAttempts && isTransient(err)
+	}))
+	return ret, err
+}
 
-	return c, nil
+// isTransient returns true for errors which could be fixed by connecting again.
+func isTransient(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.As(err, &netErr)
 }
 
-func (s *Swarm) serveLoop(ctx context.Context) {
+func (s *StreamSwarm[A]) serveLoop(ctx context.Context) {
 	for {
-		conn, err := s.l.Accept()
+		conn, err := s.transport.accept()
 		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				err = nil
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("ERROR:", err)
 			}
 			return
 		}
@@ -189,20 +251,44 @@ func (s *Swarm) serveLoop(ctx context.Context) {
 				log.Println("ERROR:", err)
 				return
 			}
-			s.addConn(c)
-			go c.loop(ctx)
+			s.putConn(c)
 		}()
 	}
 }
 
-func (s *Swarm) addConn(c *Conn) {
+// duplicateCloseDelay is how long a duplicate connection stays open after it is replaced,
+// so messages which the peer has already sent on it are still received.
+const duplicateCloseDelay = 5 * time.Second
+
+// putConn adds c to the swarm, and returns the connection which should be used to reach its remote address.
+// If there is already a connection to the address, only one of them is kept, and the other is closed after duplicateCloseDelay.
+func (s *StreamSwarm[A]) putConn(c *Conn[A]) *Conn[A] {
+	key := addrKey(c.RemoteAddr())
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.conns[c.RemoteAddr().Key()] = c
+	keep, drop := c, s.conns[key]
+	if drop != nil && !c.replaces(drop) {
+		keep, drop = drop, c
+	}
+	s.conns[key] = keep
+	c.start(s.ctx)
+	s.mu.Unlock()
+	if drop != nil {
+		time.AfterFunc(duplicateCloseDelay, func() { drop.Close() })
+	}
+	return keep
 }
 
-func (s *Swarm) deleteConn(c *Conn) {
+// deleteConn removes c from the swarm, if it has not already been replaced.
+func (s *StreamSwarm[A]) deleteConn(c *Conn[A]) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.conns, c.RemoteAddr().Key())
+	if s.conns[addrKey(c.RemoteAddr())] == c {
+		delete(s.conns, addrKey(c.RemoteAddr()))
+	}
+}
+
+// addrKey returns a string which identifies addr, for use as a map key.
+func addrKey[A p2p.Addr](addr A) string {
+	data, _ := addr.MarshalText()
+	return string(data)
 }
@@ -1,14 +1,27 @@
 package sshswarm
 
 import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/stretchr/testify/require"
 	"go.brendoncarroll.net/p2p"
 	"go.brendoncarroll.net/p2p/p2ptest"
+	"go.brendoncarroll.net/p2p/s/memswarm"
 	"go.brendoncarroll.net/p2p/s/swarmtest"
+	"go.brendoncarroll.net/p2p/s/swarmutil/retry"
 )
 
 func TestSwarm(t *testing.T) {
@@ -48,9 +61,482 @@ func TestSwarm(t *testing.T) {
 	})
 }
 
+func TestOnSwarm(t *testing.T) {
+	t.Parallel()
+	type A = SwarmAddr[memswarm.Addr]
+	swarmtest.TestSwarm(t, func(t testing.TB, xs []p2p.Swarm[A]) {
+		r := memswarm.NewRealm()
+		for i := range xs {
+			s, err := NewOnSwarm[memswarm.Addr](r.NewSwarm(), newTestSigner(t, i))
+			require.NoError(t, err)
+			xs[i] = s
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSwarms(t, xs)
+		})
+	})
+	swarmtest.TestAskSwarm(t, func(t testing.TB, xs []p2p.AskSwarm[A]) {
+		r := memswarm.NewRealm()
+		for i := range xs {
+			s, err := NewOnSwarm[memswarm.Addr](r.NewSwarm(), newTestSigner(t, i))
+			require.NoError(t, err)
+			xs[i] = s
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseAskSwarms(t, xs)
+		})
+	})
+}
+
+func TestOnListener(t *testing.T) {
+	t.Parallel()
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	swarmtest.TestSecureSwarm(t, func(t testing.TB, xs []p2p.SecureSwarm[NetAddr, PublicKey]) {
+		for i := range xs {
+			l, err := net.Listen("tcp", "127.0.0.1:")
+			require.NoError(t, err)
+			xs[i] = NewOnListener(l, dial, newTestSigner(t, i))
+		}
+		t.Cleanup(func() {
+			swarmtest.CloseSecureSwarms(t, xs)
+		})
+	})
+}
+
 func newTestSigner(t testing.TB, i int) ssh.Signer {
 	privKey := p2ptest.NewTestKey(t, i)
 	pk, err := ssh.NewSignerFromSigner(privKey)
 	require.NoError(t, err)
 	return pk
 }
+
+func TestAuthorizedKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "authorized_keys")
+	a, b, c := newTestSwarm(t, 0), newTestSwarm(t, 1), newTestSwarm(t, 2)
+	writeAuthorizedKeys := func(lines ...string) {
+		require.NoError(t, os.WriteFile(p, []byte(strings.Join(lines, "")), 0o600))
+	}
+	authLine := func(opts string, s *Swarm) string {
+		line := string(ssh.MarshalAuthorizedKey(s.PublicKey()))
+		if opts != "" {
+			line = opts + " " + line
+		}
+		return line
+	}
+	writeAuthorizedKeys(
+		"# comment\n",
+		authLine(`from="127.0.0.*"`, a),
+		authLine(`from="!127.0.0.1,127.0.0.0/8"`, b),
+	)
+	srv, err := New("127.0.0.1:", newTestSigner(t, 3), WithAuthorizedKeys(p))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	dst := srv.LocalAddrs()[0]
+
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.Error(t, b.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	require.Error(t, c.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+
+	// the file is reloaded when it changes.
+	writeAuthorizedKeys(authLine("", c))
+	require.NoError(t, c.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+}
+
+func TestMatchFrom(t *testing.T) {
+	tcs := []struct {
+		Patterns string
+		IP       string
+		Out      bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.1", "127.0.0.2", false},
+		{"127.0.0.?", "127.0.0.2", true},
+		{"127.0.0.?", "127.0.0.20", false},
+		{"10.*", "10.1.2.3", true},
+		{"*", "::1", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+		{"!10.0.0.1,10.0.0.0/8", "10.0.0.1", false},
+		{"!10.0.0.1,10.0.0.0/8", "10.0.0.2", true},
+		{"fd00::/8", "fd00::1", true},
+		{"example.com", "10.0.0.1", false},
+	}
+	for _, tc := range tcs {
+		ip := netip.MustParseAddr(tc.IP)
+		require.Equal(t, tc.Out, matchFrom(strings.Split(tc.Patterns, ","), ip), "%s %s", tc.Patterns, tc.IP)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	b, c := newTestSwarm(t, 1), newTestSwarm(t, 2)
+
+	// hosts are added to the file on first use.
+	a, err := New("127.0.0.1:", newTestSigner(t, 0), WithKnownHosts(p, KnownHostsTOFU))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	data, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.Contains(t, string(data), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(b.PublicKey()))))
+
+	// only hosts in the file are allowed in strict mode.
+	s, err := New("127.0.0.1:", newTestSigner(t, 3), WithKnownHosts(p, KnownHostsStrict))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	require.Error(t, s.Tell(ctx, c.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+
+	// a host with a different key is rejected, even with TOFU.
+	cAddr := c.LocalAddrs()[0]
+	hostport := net.JoinHostPort(cAddr.IP.String(), strconv.Itoa(int(cAddr.Port)))
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostport)}, b.PublicKey()) + "\n"
+	require.NoError(t, os.WriteFile(p, append(data, line...), 0o600))
+	require.Error(t, a.Tell(ctx, cAddr, p2p.IOVec{[]byte("hello")}))
+}
+
+func newTestSwarm(t testing.TB, i int) *Swarm {
+	s, err := New("127.0.0.1:", newTestSigner(t, i))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAgent(t *testing.T) {
+	ctx := context.Background()
+	keyring := agent.NewKeyring()
+	for i, comment := range []string{"node-0", "node-1"} {
+		require.NoError(t, keyring.Add(agent.AddedKey{
+			PrivateKey: p2ptest.NewTestKey(t, i),
+			Comment:    comment,
+		}))
+	}
+	sockPath := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sockPath)
+
+	// key selection
+	key1 := newTestSigner(t, 1).PublicKey()
+	for _, sel := range []KeySelector{
+		KeyByComment("node-1"),
+		KeyByFingerprint(ssh.FingerprintSHA256(key1)),
+	} {
+		signer, err := AgentSigner(keyring, sel)
+		require.NoError(t, err)
+		require.Equal(t, key1.Marshal(), signer.PublicKey().Marshal())
+	}
+	_, err = AgentSigner(keyring, KeyByComment("node-2"))
+	require.Error(t, err)
+
+	// a swarm with a key in the agent
+	a, err := NewWithAgent("127.0.0.1:", KeyByComment("node-1"))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	require.Equal(t, key1.Marshal(), a.PublicKey().Marshal())
+	b := newTestSwarm(t, 2)
+	require.NoError(t, a.Tell(ctx, b.LocalAddrs()[0], p2p.IOVec{[]byte("hello")}))
+	var m p2p.Message[Addr]
+	require.NoError(t, p2p.Receive[Addr](ctx, b, &m))
+	require.Equal(t, "hello", string(m.Payload))
+	require.Equal(t, a.LocalAddrs()[0].Fingerprint, m.Src.Fingerprint)
+	require.NoError(t, b.Tell(ctx, m.Src, p2p.IOVec{[]byte("hi")}))
+	require.NoError(t, p2p.Receive[Addr](ctx, a, &m))
+	require.Equal(t, "hi", string(m.Payload))
+}
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a, err := New("127.0.0.1:", newTestSigner(t, 0), WithKeepAlive(50*time.Millisecond, 2))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	b := newTestSwarm(t, 1)
+
+	// a proxy which stops forwarding anything, without closing the connection.
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var frozen atomic.Bool
+	// replies counts the reads forwarded from b to a.
+	var replies atomic.Int64
+	go func() {
+		for {
+			c1, err := l.Accept()
+			if err != nil {
+				return
+			}
+			bAddr := b.LocalAddrs()[0].GetTCP()
+			c2, err := net.Dial("tcp", bAddr.String())
+			if err != nil {
+				return
+			}
+			forward := func(dst, src net.Conn, count *atomic.Int64) {
+				buf := make([]byte, 4096)
+				for {
+					n, err := src.Read(buf)
+					if err != nil {
+						return
+					}
+					if !frozen.Load() {
+						dst.Write(buf[:n])
+						count.Add(1)
+					}
+				}
+			}
+			go forward(c1, c2, &replies)
+			go forward(c2, c1, new(atomic.Int64))
+		}
+	}()
+	dst := b.LocalAddrs()[0]
+	dst.Port = uint16(l.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	numConns := func() int {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return len(a.conns)
+	}
+	require.Equal(t, 1, numConns())
+	// the connection stays open while keepalives are answered
+	start := replies.Load()
+	require.Eventually(t, func() bool {
+		return replies.Load() >= start+5
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, numConns())
+
+	frozen.Store(true)
+	require.Eventually(t, func() bool {
+		return numConns() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestKeepAliveUnsupported(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	// the server is a peer which refuses the keepalive channel, and counts the global requests which are not Tells.
+	hostKey := newTestSigner(t, 1)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	var others atomic.Int64
+	received := make(chan struct{}, 1)
+	go func() {
+		netConn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		_, chans, reqs, err := ssh.NewServerConn(netConn, config)
+		if err != nil {
+			return
+		}
+		go func() {
+			for ncr := range chans {
+				ncr.Reject(ssh.UnknownChannelType, "")
+			}
+		}()
+		for req := range reqs {
+			if req.Type != "" {
+				others.Add(1)
+			} else {
+				received <- struct{}{}
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	a, err := New("127.0.0.1:", newTestSigner(t, 0), WithKeepAlive(20*time.Millisecond, 2))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	dst, err := NewAddr(hostKey.PublicKey(), "127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+	require.NoError(t, a.Tell(ctx, *dst, p2p.IOVec{[]byte("hello")}))
+	<-received
+	// no keepalives are sent, and the connection is not closed for missing them.
+	require.Never(t, func() bool {
+		return others.Load() > 0
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	require.Len(t, a.conns, 1)
+}
+
+func TestKeepAliveDuringAsk(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a, err := New("127.0.0.1:", newTestSigner(t, 0), WithKeepAlive(50*time.Millisecond, 2))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	b := newTestSwarm(t, 1)
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr]) int {
+			close(started)
+			<-release
+			return copy(resp, req.Payload)
+		})
+	}()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := a.Ask(ctx, make([]byte, 16), b.LocalAddrs()[0], p2p.IOVec{[]byte("slow")})
+		errCh <- err
+	}()
+	<-started
+	// keepalives are answered while the handler is running, so the connection is not closed.
+	require.Never(t, func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return len(a.conns) == 0
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, <-errCh)
+}
+
+func TestAskTimeout(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a := newTestSwarm(t, 0)
+	b, err := New("127.0.0.1:", newTestSigner(t, 1), WithAskTimeout(300*time.Millisecond))
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	go func() {
+		for {
+			if err := b.ServeAsk(ctx, func(ctx context.Context, resp []byte, req p2p.Message[Addr]) int {
+				if string(req.Payload) == "slow" {
+					<-ctx.Done()
+					return -1
+				}
+				return copy(resp, req.Payload)
+			}); err != nil {
+				return
+			}
+		}
+	}()
+	dst := b.LocalAddrs()[0]
+	resp := make([]byte, 16)
+
+	// the caller's context is respected.
+	ctx1, cf := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cf()
+	_, err = a.Ask(ctx1, resp, dst, p2p.IOVec{[]byte("slow")})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Tells are delivered while the handler is still running.
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("hello")}))
+	var m p2p.Message[Addr]
+	ctx2, cf2 := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cf2()
+	require.NoError(t, p2p.Receive[Addr](ctx2, b, &m))
+	require.Equal(t, "hello", string(m.Payload))
+
+	// the slow Ask times out on the server, and the connection can be used again.
+	n, err := a.Ask(ctx, resp, dst, p2p.IOVec{[]byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(resp[:n]))
+}
+
+func TestRedial(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	// retried receives a value each time a dial fails, and is retried.
+	retried := make(chan struct{}, 1)
+	constant := retry.NewConstantBackoff(50 * time.Millisecond)
+	backoff := func(n int, elapsed time.Duration) time.Duration {
+		select {
+		case retried <- struct{}{}:
+		default:
+		}
+		return constant(n, elapsed)
+	}
+	a, err := New("127.0.0.1:", newTestSigner(t, 0), WithDialBackoff(20, backoff))
+	require.NoError(t, err)
+	t.Cleanup(func() { a.Close() })
+	b := newTestSwarm(t, 1)
+	dst := b.LocalAddrs()[0]
+	var m p2p.Message[Addr]
+
+	// the connection is dialed again after the peer closes it.
+	require.NoError(t, a.Tell(ctx, dst, p2p.IOVec{[]byte("1")}))
+	require.NoError(t, p2p.Receive[Addr](ctx, b, &m))
+	b.mu.RLock()
+	for _, c := range b.conns {
+		defer c.Close()
+	}
+	b.mu.RUnlock()
+	require.Eventually(t, func() bool {
+		return a.Tell(ctx, dst, p2p.IOVec{[]byte("2")}) == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, p2p.Receive[Addr](ctx, b, &m))
+	require.Equal(t, "2", string(m.Payload))
+
+	// dialing is retried until the peer is listening.
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	laddr := l.Addr().String()
+	require.NoError(t, l.Close())
+	select {
+	case <-retried:
+	default:
+	}
+	go func() {
+		<-retried
+		c, err := New(laddr, newTestSigner(t, 2))
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { c.Close() })
+	}()
+	dst2 := Addr{
+		Fingerprint: ssh.FingerprintSHA256(newTestSigner(t, 2).PublicKey()),
+		IP:          netip.MustParseAddr("127.0.0.1"),
+		Port:        uint16(l.Addr().(*net.TCPAddr).Port),
+	}
+	require.NoError(t, a.Tell(ctx, dst2, p2p.IOVec{[]byte("hello")}))
+}
+
+func TestHostAddr(t *testing.T) {
+	pub := newTestSigner(t, 0).PublicKey()
+	x := NewHostAddr(pub, "example.com", 22)
+	data, err := x.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, ssh.FingerprintSHA256(pub)+"@example.com:22", string(data))
+	y, err := ParseHostAddr(data)
+	require.NoError(t, err)
+	require.Equal(t, x, y)
+
+	ip := netip.MustParseAddr("::1")
+	require.Equal(t, Addr{Fingerprint: x.Fingerprint, IP: ip, Port: 22}, x.WithIP(ip))
+	y, err = ParseHostAddr([]byte(HostAddrOf(x.WithIP(ip)).String()))
+	require.NoError(t, err)
+	require.Equal(t, HostAddr{Fingerprint: x.Fingerprint, Host: "::1", Port: 22}, y)
+
+	addr, err := NewAddr(pub, "127.0.0.1", 22)
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("127.0.0.1"), addr.IP)
+	_, err = NewAddr(pub, "invalid..", 22)
+	require.Error(t, err)
+}
@@ -0,0 +1,123 @@
+package sshswarm
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"go.brendoncarroll.net/p2p"
+	"golang.org/x/crypto/ssh"
+)
+
+// transport provides the connections which SSH runs over, and the addresses used to reach them.
+type transport[A p2p.Addr] interface {
+	// accept waits for the next connection from another swarm.
+	// It returns net.ErrClosed after the transport is closed.
+	accept() (net.Conn, error)
+	// dial connects to the swarm at addr.
+	dial(ctx context.Context, addr A) (net.Conn, error)
+	// close stops accepting connections.
+	close() error
+
+	// localAddrs returns the addresses of the local swarm, which has a key with fingerprint.
+	localAddrs(fingerprint string) []A
+	// addrOf returns the address of the swarm, with a key with fingerprint, at one end of a connection.
+	// na is the connection's LocalAddr or RemoteAddr.
+	addrOf(fingerprint string, na net.Addr) A
+	// fingerprint returns the fingerprint of the key, which the swarm at addr must have.
+	fingerprint(addr A) string
+	parseAddr(data []byte) (A, error)
+}
+
+var _ transport[Addr] = tcpTransport{}
+
+// tcpTransport is the transport for swarms created with New.
+type tcpTransport struct {
+	l net.Listener
+}
+
+func (t tcpTransport) accept() (net.Conn, error) {
+	return t.l.Accept()
+}
+
+func (t tcpTransport) dial(ctx context.Context, addr Addr) (net.Conn, error) {
+	raddr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", raddr)
+}
+
+func (t tcpTransport) close() error {
+	return t.l.Close()
+}
+
+func (t tcpTransport) localAddrs(fingerprint string) []Addr {
+	return p2p.ExpandUnspecifiedIPs([]Addr{t.addrOf(fingerprint, t.l.Addr())})
+}
+
+func (t tcpTransport) addrOf(fingerprint string, na net.Addr) Addr {
+	tcpAddr := na.(*net.TCPAddr)
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		panic(tcpAddr)
+	}
+	return Addr{
+		Fingerprint: fingerprint,
+		IP:          ip.Unmap(),
+		Port:        uint16(tcpAddr.Port),
+	}
+}
+
+func (t tcpTransport) fingerprint(addr Addr) string {
+	return addr.Fingerprint
+}
+
+func (t tcpTransport) parseAddr(data []byte) (Addr, error) {
+	return ParseAddr(data)
+}
+
+// DialFunc connects to the listener with the address addr, as returned by the listener's Addr().String().
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// NewOnListener creates a swarm which accepts connections from l, and connects to other swarms using dial.
+// The swarm's addresses contain the address of l.
+// l is closed when the swarm is closed.
+func NewOnListener(l net.Listener, dial DialFunc, privateKey ssh.Signer, opts ...Option) *StreamSwarm[NetAddr] {
+	return newSwarm[NetAddr](listenerTransport{l: l, dialFn: dial}, privateKey, opts)
+}
+
+var _ transport[NetAddr] = listenerTransport{}
+
+// listenerTransport is the transport for swarms created with NewOnListener.
+type listenerTransport struct {
+	l      net.Listener
+	dialFn DialFunc
+}
+
+func (t listenerTransport) accept() (net.Conn, error) {
+	return t.l.Accept()
+}
+
+func (t listenerTransport) dial(ctx context.Context, addr NetAddr) (net.Conn, error) {
+	return t.dialFn(ctx, addr.Addr)
+}
+
+func (t listenerTransport) close() error {
+	return t.l.Close()
+}
+
+func (t listenerTransport) localAddrs(fingerprint string) []NetAddr {
+	return []NetAddr{t.addrOf(fingerprint, t.l.Addr())}
+}
+
+func (t listenerTransport) addrOf(fingerprint string, na net.Addr) NetAddr {
+	return NetAddr{Fingerprint: fingerprint, Addr: na.String()}
+}
+
+func (t listenerTransport) fingerprint(addr NetAddr) string {
+	return addr.Fingerprint
+}
+
+func (t listenerTransport) parseAddr(data []byte) (NetAddr, error) {
+	return ParseNetAddr(data)
+}
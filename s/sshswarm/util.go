@@ -2,6 +2,9 @@ package sshswarm
 
 import (
 	"crypto"
+	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -9,3 +12,38 @@ import (
 func NewSignerFromSigner(x crypto.Signer) (ssh.Signer, error) {
 	return ssh.NewSignerFromSigner(x)
 }
+
+// fileCache holds a value loaded from a file, and loads it again when the file changes.
+type fileCache[T any] struct {
+	path string
+	load func(path string) (T, error)
+
+	mu      sync.Mutex
+	loaded  bool
+	modTime time.Time
+	size    int64
+	value   T
+	err     error
+}
+
+func newFileCache[T any](path string, load func(string) (T, error)) *fileCache[T] {
+	return &fileCache[T]{path: path, load: load}
+}
+
+// get returns the value loaded from the file, loading it again if the file has been modified since it was last loaded.
+func (fc *fileCache[T]) get() (T, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	var modTime time.Time
+	var size int64
+	finfo, err := os.Stat(fc.path)
+	if err == nil {
+		modTime, size = finfo.ModTime(), finfo.Size()
+	}
+	if !fc.loaded || !modTime.Equal(fc.modTime) || size != fc.size {
+		fc.value, fc.err = fc.load(fc.path)
+		fc.loaded = true
+		fc.modTime, fc.size = modTime, size
+	}
+	return fc.value, fc.err
+}
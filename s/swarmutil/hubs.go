@@ -94,6 +94,7 @@ func (q *TellHub[A]) CloseWithError(err error) {
 }
 
 type serveReq[A p2p.Addr] struct {
+	ctx  context.Context
 	msg  p2p.Message[A]
 	resp []byte
 	n    int
@@ -115,6 +116,8 @@ func NewAskHub[A p2p.Addr]() AskHub[A] {
 	}
 }
 
+// ServeAsk calls fn with the next request passed to Deliver.
+// The context passed to fn is cancelled when either ctx, or the context passed to Deliver is done.
 func (q *AskHub[A]) ServeAsk(ctx context.Context, fn func(context.Context, []byte, p2p.Message[A]) int) error {
 	if err := q.checkClosed(); err != nil {
 		return err
@@ -125,14 +128,21 @@ func (q *AskHub[A]) ServeAsk(ctx context.Context, fn func(context.Context, []byt
 	case <-q.closed:
 		return q.err
 	case req := <-q.reqs:
+		ctx, cf := context.WithCancel(ctx)
+		stop := context.AfterFunc(req.ctx, cf)
 		req.n = fn(ctx, req.resp, req.msg)
+		stop()
+		cf()
 		close(req.done)
 		return nil
 	}
 }
 
+// Deliver passes a request to a call to ServeAsk, and waits for the response.
+// If ctx is cancelled while the request is being served, the handler's context is also cancelled.
 func (q *AskHub[A]) Deliver(ctx context.Context, respData []byte, msg p2p.Message[A]) (int, error) {
 	req := &serveReq[A]{
+		ctx:  ctx,
 		msg:  msg,
 		resp: respData,
 		done: make(chan struct{}),
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
 )
 
 type Addr struct {
@@ -77,3 +78,51 @@ func ParseAddr(x []byte) (Addr, error) {
 	err := addr.UnmarshalText(x)
 	return addr, err
 }
+
+// HostAddr is a UDP address with a host name, which is resolved to an Addr when it is used.
+// A HostAddr's Host can also be an IP address.
+type HostAddr struct {
+	Host string
+	Port uint16
+}
+
+// HostAddrOf returns a HostAddr with a's IP as the host.
+func HostAddrOf(a Addr) HostAddr {
+	return HostAddr{Host: a.IP.String(), Port: a.Port}
+}
+
+func (a HostAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(int(a.Port)))
+}
+
+func (a HostAddr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a HostAddr) Key() string {
+	return a.String()
+}
+
+func (a HostAddr) GetHost() string {
+	return a.Host
+}
+
+// WithIP returns the Addr for the host at ip.
+func (a HostAddr) WithIP(ip netip.Addr) Addr {
+	return Addr{IP: ip, Port: a.Port}
+}
+
+func ParseHostAddr(x []byte) (HostAddr, error) {
+	host, port, err := net.SplitHostPort(string(x))
+	if err != nil {
+		return HostAddr{}, err
+	}
+	if host == "" {
+		return HostAddr{}, fmt.Errorf("address is missing host: %s", x)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return HostAddr{}, fmt.Errorf("could not parse port from: %s, %v", port, err)
+	}
+	return HostAddr{Host: host, Port: uint16(p)}, nil
+}
@@ -21,3 +21,19 @@ func TestSwarm(t *testing.T) {
 		})
 	})
 }
+
+func TestParseHostAddr(t *testing.T) {
+	for _, x := range []HostAddr{
+		{Host: "example.com", Port: 1234},
+		{Host: "127.0.0.1", Port: 1},
+		{Host: "::1", Port: 65535},
+	} {
+		y, err := ParseHostAddr([]byte(x.String()))
+		require.NoError(t, err)
+		require.Equal(t, x, y)
+	}
+	for _, x := range []string{"example.com", ":1234", "example.com:65536"} {
+		_, err := ParseHostAddr([]byte(x))
+		require.Error(t, err, x)
+	}
+}